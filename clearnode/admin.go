@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// AdminSet holds the addresses allowed to call admin RPCs
+type AdminSet map[string]bool
+
+// ParseAdminSet parses a comma-separated list of admin addresses
+func ParseAdminSet(value string) AdminSet {
+	admins := AdminSet{}
+	for _, addr := range strings.Split(value, ",") {
+		addr = strings.TrimSpace(addr)
+		if common.IsHexAddress(addr) {
+			admins[common.HexToAddress(addr).Hex()] = true
+		}
+	}
+	return admins
+}
+
+// Contains reports whether an address is an admin
+func (a AdminSet) Contains(address string) bool {
+	return common.IsHexAddress(address) && a[common.HexToAddress(address).Hex()]
+}
+
+// verifyAdmin checks that an admin RPC is called and signed by an admin
+func verifyAdmin(rpc *RPCMessage, address string, admins AdminSet) error {
+	if !admins.Contains(address) {
+		return errors.New("admin RPCs are restricted to admin addresses")
+	}
+	if len(rpc.Sig) == 0 {
+		return errors.New("missing signature")
+	}
+
+	reqBytes, err := json.Marshal(rpc.Req)
+	if err != nil {
+		return errors.New("error serializing message")
+	}
+	isValid, err := ValidateSignature(reqBytes, rpc.Sig[0], address)
+	if err != nil || !isValid {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// AdminFundsParams represents parameters to move broker funds in or out of a custody contract
+type AdminFundsParams struct {
+	ChainID uint32          `json:"chain_id" validate:"required"`
+	Asset   string          `json:"asset"    validate:"required"`
+	Amount  decimal.Decimal `json:"amount"`
+}
+
+// AdminFundsResponse represents the transaction moving broker funds
+type AdminFundsResponse struct {
+	ChainID uint32          `json:"chain_id"`
+	Asset   string          `json:"asset"`
+	Token   string          `json:"token"`
+	Amount  decimal.Decimal `json:"amount"`
+	TxHash  string          `json:"tx_hash"`
+}
+
+// HandleAdminDeposit deposits broker funds into the custody contract of a chain
+func HandleAdminDeposit(rpc *RPCMessage, address string, db *gorm.DB, admins AdminSet, liquidity *Liquidity) (*RPCMessage, error) {
+	return handleAdminFunds(rpc, address, db, admins, liquidity, liquidity.Deposit)
+}
+
+// HandleAdminWithdraw withdraws broker funds from the custody contract of a chain
+func HandleAdminWithdraw(rpc *RPCMessage, address string, db *gorm.DB, admins AdminSet, liquidity *Liquidity) (*RPCMessage, error) {
+	return handleAdminFunds(rpc, address, db, admins, liquidity, liquidity.Withdraw)
+}
+
+func handleAdminFunds(rpc *RPCMessage, address string, db *gorm.DB, admins AdminSet, liquidity *Liquidity, move func(context.Context, *Asset, decimal.Decimal) (common.Hash, error)) (*RPCMessage, error) {
+	if err := verifyAdmin(rpc, address, admins); err != nil {
+		return nil, err
+	}
+	if len(rpc.Req.Params) < 1 {
+		return nil, errors.New("missing parameters")
+	}
+
+	var params AdminFundsParams
+	paramsJSON, err := json.Marshal(rpc.Req.Params[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse parameters: %w", err)
+	}
+
+	if err := json.Unmarshal(paramsJSON, &params); err != nil {
+		return nil, fmt.Errorf("invalid parameters format: %w", err)
+	}
+
+	if err := validate.Struct(&params); err != nil {
+		return nil, err
+	}
+	if !params.Amount.IsPositive() {
+		return nil, errors.New("amount must be positive")
+	}
+	if liquidity == nil {
+		return nil, errors.New("broker liquidity is not available")
+	}
+
+	asset, err := GetAssetBySymbol(db, params.Asset, params.ChainID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find asset: %w", err)
+	}
+	if asset == nil {
+		return nil, fmt.Errorf("asset %s is not supported on chain %d", params.Asset, params.ChainID)
+	}
+	if !params.Amount.Shift(int32(asset.Decimals)).IsInteger() {
+		return nil, fmt.Errorf("amount exceeds the %d decimals of %s", asset.Decimals, asset.Symbol)
+	}
+
+	txHash, err := move(context.Background(), asset, params.Amount)
+	if err != nil {
+		return nil, err
+	}
+
+	response := AdminFundsResponse{
+		ChainID: asset.ChainID,
+		Asset:   asset.Symbol,
+		Token:   asset.Token,
+		Amount:  params.Amount,
+		TxHash:  txHash.Hex(),
+	}
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
+	return rpcResponse, nil
+}
+
+// AdminCloseChannelParams represents parameters to close a channel on behalf of the broker
+type AdminCloseChannelParams struct {
+	ChannelID        string    `json:"channel_id"                  validate:"required"`
+	Mode             CloseMode `json:"mode"                        validate:"required,oneof=cooperative challenge"`
+	FundsDestination string    `json:"funds_destination,omitempty"` // Defaults to the participant
+}
+
+// CloseRequestResponse represents a broker-initiated channel close
+type CloseRequestResponse struct {
+	RequestID          uint               `json:"request_id"`
+	ChannelID          string             `json:"channel_id"`
+	ChainID            uint32             `json:"chain_id"`
+	Participant        string             `json:"participant"`
+	Mode               CloseMode          `json:"mode"`
+	Status             CloseRequestStatus `json:"status"`
+	State              SignedState        `json:"state"`
+	TxHash             string             `json:"tx_hash,omitempty"`
+	ChallengeExpiresAt *time.Time         `json:"challenge_expires_at,omitempty"`
+	CreatedAt          time.Time          `json:"created_at"`
+}
+
+// HandleAdminCloseChannel closes a channel on behalf of the broker, either by asking the participant
+// to countersign the final state or by challenging the channel with the latest mutually signed state
+func HandleAdminCloseChannel(rpc *RPCMessage, address string, db *gorm.DB, admins AdminSet, settlement *Settlement) (*RPCMessage, error) {
+	if err := verifyAdmin(rpc, address, admins); err != nil {
+		return nil, err
+	}
+	if len(rpc.Req.Params) < 1 {
+		return nil, errors.New("missing parameters")
+	}
+
+	var params AdminCloseChannelParams
+	paramsJSON, err := json.Marshal(rpc.Req.Params[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse parameters: %w", err)
+	}
+
+	if err := json.Unmarshal(paramsJSON, &params); err != nil {
+		return nil, fmt.Errorf("invalid parameters format: %w", err)
+	}
+
+	if err := validate.Struct(&params); err != nil {
+		return nil, err
+	}
+	if settlement == nil {
+		return nil, errors.New("channel settlement is not available")
+	}
+
+	channel, err := GetChannelByID(db, params.ChannelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find channel: %w", err)
+	}
+	if channel == nil {
+		return nil, fmt.Errorf("channel %s not found", params.ChannelID)
+	}
+
+	fundsDestination := channel.Participant
+	if params.FundsDestination != "" {
+		if !common.IsHexAddress(params.FundsDestination) {
+			return nil, fmt.Errorf("invalid funds destination: %s", params.FundsDestination)
+		}
+		fundsDestination = params.FundsDestination
+	}
+
+	request, err := settlement.RequestClose(context.Background(), channel, params.Mode, common.HexToAddress(fundsDestination), address)
+	if err != nil {
+		return nil, err
+	}
+
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{newCloseRequestResponse(request)}, time.Now())
+	return rpcResponse, nil
+}
+
+func newCloseRequestResponse(request *ChannelCloseRequest) CloseRequestResponse {
+	return CloseRequestResponse{
+		RequestID:          request.ID,
+		ChannelID:          request.ChannelID,
+		ChainID:            request.ChainID,
+		Participant:        request.Participant,
+		Mode:               request.Mode,
+		Status:             request.Status,
+		State:              request.State,
+		TxHash:             request.TxHash,
+		ChallengeExpiresAt: request.ChallengeExpiresAt,
+		CreatedAt:          request.CreatedAt,
+	}
+}
+
+// AdminRevokeSessionParams represents parameters to revoke the auth session of a participant
+type AdminRevokeSessionParams struct {
+	Address string `json:"address" validate:"required"`
+}
+
+// AdminRevokeSessionResponse represents the participant whose session is revoked
+type AdminRevokeSessionResponse struct {
+	Address string `json:"address"`
+}
+
+// HandleAdminRevokeSession validates the revocation of the auth session of a participant. The caller revokes
+// the session on every node.
+func HandleAdminRevokeSession(rpc *RPCMessage, address string, admins AdminSet) (*RPCMessage, error) {
+	if err := verifyAdmin(rpc, address, admins); err != nil {
+		return nil, err
+	}
+	if len(rpc.Req.Params) < 1 {
+		return nil, errors.New("missing parameters")
+	}
+
+	var params AdminRevokeSessionParams
+	paramsJSON, err := json.Marshal(rpc.Req.Params[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse parameters: %w", err)
+	}
+
+	if err := json.Unmarshal(paramsJSON, &params); err != nil {
+		return nil, fmt.Errorf("invalid parameters format: %w", err)
+	}
+
+	if err := validate.Struct(&params); err != nil {
+		return nil, err
+	}
+	if !common.IsHexAddress(params.Address) {
+		return nil, fmt.Errorf("invalid address: %s", params.Address)
+	}
+
+	response := AdminRevokeSessionResponse{Address: common.HexToAddress(params.Address).Hex()}
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
+	return rpcResponse, nil
+}
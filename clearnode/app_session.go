@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/lib/pq"
 	"gorm.io/gorm"
@@ -19,14 +20,16 @@ type AppSession struct {
 	Quorum       uint64         `gorm:"column:quorum;default:100"`
 	Version      uint64         `gorm:"column:version;default:1"`
 	Status       ChannelStatus  `gorm:"column:status;not null"`
+	CreatedAt    time.Time
+	UpdatedAt    time.Time
 }
 
 func (AppSession) TableName() string {
 	return "app_sessions"
 }
 
-// getAppSessionsForParticipant finds all channels for a participant
-func getAppSessionsForParticipant(tx *gorm.DB, participant string, status string) ([]AppSession, error) {
+// getAppSessionsForParticipant returns a page of app sessions for a participant
+func getAppSessionsForParticipant(tx *gorm.DB, participant string, status string, opts ListOptions) ([]AppSession, PageInfo, error) {
 	var sessions []AppSession
 	switch tx.Dialector.Name() {
 	case "postgres":
@@ -34,15 +37,24 @@ func getAppSessionsForParticipant(tx *gorm.DB, participant string, status string
 	case "sqlite":
 		tx = tx.Where("instr(participants, ?) > 0", participant)
 	default:
-		return nil, fmt.Errorf("unsupported database driver: %s", tx.Dialector.Name())
+		return nil, PageInfo{}, fmt.Errorf("unsupported database driver: %s", tx.Dialector.Name())
 	}
 	if status != "" {
 		tx = tx.Where("status = ?", status)
 	}
+	tx = opts.applyTimeRange(tx, "created_at")
+
+	tx, err := paginateByID(tx, opts)
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
 
 	if err := tx.Find(&sessions).Error; err != nil {
-		return nil, err
+		return nil, PageInfo{}, err
 	}
 
-	return sessions, nil
+	sessions, page := newPage(sessions, opts, func(s AppSession) pageCursor {
+		return pageCursor{ID: s.ID}
+	})
+	return sessions, page, nil
 }
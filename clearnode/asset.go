@@ -1,9 +1,28 @@
 package main
 
 import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
+// NativeTokenAddress is the token of channel allocations in the native gas token of a chain
+var NativeTokenAddress = common.Address{}
+
+// nativeDecimals is the number of decimals of the native gas token of EVM chains
+const nativeDecimals = 18
+
+// nativeSymbols maps the chain IDs of known networks to the asset symbol of their native gas token
+var nativeSymbols = map[uint32]string{
+	137:      "pol",
+	11155111: "eth",
+	42220:    "celo",
+	8453:     "eth",
+	480:      "eth",
+}
+
 type Asset struct {
 	Token    string `gorm:"column:token;primaryKey"`    // part of primaryKey
 	ChainID  uint32 `gorm:"column:chain_id;primaryKey"` // part of primaryKey
@@ -45,3 +64,18 @@ func GetAllAssets(db *gorm.DB, chainID *uint32) ([]Asset, error) {
 	err := query.Order("chain_id, symbol").Find(&assets).Error
 	return assets, err
 }
+
+// RegisterNativeAsset adds the native gas token of a chain to the assets, under the zero address.
+// An asset already registered for the zero address is kept as is.
+func RegisterNativeAsset(db *gorm.DB, chainID uint32) error {
+	symbol, ok := nativeSymbols[chainID]
+	if !ok {
+		return nil
+	}
+
+	asset := Asset{Token: NativeTokenAddress.Hex(), ChainID: chainID, Symbol: symbol, Decimals: nativeDecimals}
+	if err := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&asset).Error; err != nil {
+		return fmt.Errorf("failed to register native asset of chain %d: %w", chainID, err)
+	}
+	return nil
+}
@@ -147,6 +147,18 @@ func (am *AuthManager) ValidateSession(address string) bool {
 	return true
 }
 
+// RevokeSession ends the session of an address, which has to authenticate again. Addresses are
+// compared case-insensitively, as sessions keep the case the client authenticated with.
+func (am *AuthManager) RevokeSession(address string) {
+	am.authSessionsMu.Lock()
+	defer am.authSessionsMu.Unlock()
+	for addr := range am.authSessions {
+		if strings.EqualFold(addr, address) {
+			delete(am.authSessions, addr)
+		}
+	}
+}
+
 // UpdateSession updates the last active time for a session
 func (am *AuthManager) UpdateSession(address string) bool {
 	am.authSessionsMu.Lock()
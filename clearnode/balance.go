@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// AccountBalance is the maintained balance of a ledger account, equal to the sum of its credits minus its debits.
+// It is updated in the same database transaction as the entries, so reads don't need to aggregate the ledger.
+type AccountBalance struct {
+	AccountID   string          `gorm:"column:account_id;primaryKey"`
+	Participant string          `gorm:"column:participant;primaryKey"`
+	AssetSymbol string          `gorm:"column:asset_symbol;primaryKey"`
+	AccountType AccountType     `gorm:"column:account_type;not null"`
+	Amount      decimal.Decimal `gorm:"column:amount;type:decimal(38,18);not null"`
+	UpdatedAt   time.Time
+}
+
+func (AccountBalance) TableName() string {
+	return "balances"
+}
+
+// balanceKey identifies a row of the balances table
+type balanceKey struct {
+	AccountID   string
+	Participant string
+	AssetSymbol string
+}
+
+func (b AccountBalance) key() balanceKey {
+	return balanceKey{AccountID: b.AccountID, Participant: b.Participant, AssetSymbol: b.AssetSymbol}
+}
+
+// sortedBalances orders balance rows by key, so that rows are always written in the same order
+func sortedBalances(balances map[balanceKey]*AccountBalance) []AccountBalance {
+	rows := make([]AccountBalance, 0, len(balances))
+	for _, b := range balances {
+		rows = append(rows, *b)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		a, b := rows[i].key(), rows[j].key()
+		if a.AccountID != b.AccountID {
+			return a.AccountID < b.AccountID
+		}
+		if a.Participant != b.Participant {
+			return a.Participant < b.Participant
+		}
+		return a.AssetSymbol < b.AssetSymbol
+	})
+	return rows
+}
+
+// BalanceRef identifies the balance of an account in an asset
+type BalanceRef struct {
+	Account     Account
+	AssetSymbol string
+}
+
+// LockBalances locks the balance rows of the given accounts until the end of the database transaction,
+// so that concurrent operations can't spend the same funds between a balance check and the matching entries.
+// Missing rows are created, and rows are always locked in the same order to avoid deadlocks.
+//
+// On PostgreSQL the rows are locked with SELECT ... FOR UPDATE. SQLite has no row locks, but writing
+// the rows acquires the database write lock, which serializes all balance-mutating transactions.
+func LockBalances(tx *gorm.DB, refs ...BalanceRef) error {
+	rowsByKey := map[balanceKey]*AccountBalance{}
+	for _, ref := range refs {
+		b := &AccountBalance{
+			AccountID:   ref.Account.ID,
+			Participant: ref.Account.Participant,
+			AssetSymbol: ref.AssetSymbol,
+			AccountType: ref.Account.Type,
+			Amount:      decimal.Zero,
+			UpdatedAt:   time.Now(),
+		}
+		rowsByKey[b.key()] = b
+	}
+	return lockBalanceRows(tx, sortedBalances(rowsByKey))
+}
+
+func lockBalanceRows(tx *gorm.DB, rows []AccountBalance) error {
+	if len(rows) == 0 {
+		return nil
+	}
+
+	if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&rows).Error; err != nil {
+		return fmt.Errorf("failed to create balances: %w", err)
+	}
+
+	if tx.Dialector.Name() != "postgres" {
+		return nil
+	}
+
+	keys := make([][]any, len(rows))
+	for i, r := range rows {
+		keys[i] = []any{r.AccountID, r.Participant, r.AssetSymbol}
+	}
+
+	var locked []AccountBalance
+	if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("(account_id, participant, asset_symbol) IN ?", keys).
+		Order("account_id, participant, asset_symbol").
+		Find(&locked).Error; err != nil {
+		return fmt.Errorf("failed to lock balances: %w", err)
+	}
+	return nil
+}
+
+// applyBalanceDeltas adds the net amount of the entries to the balances of their accounts
+func applyBalanceDeltas(tx *gorm.DB, entries []Entry) error {
+	now := time.Now()
+	deltas := map[balanceKey]*AccountBalance{}
+	for _, entry := range entries {
+		k := balanceKey{AccountID: entry.AccountID, Participant: entry.Participant, AssetSymbol: entry.AssetSymbol}
+		if _, ok := deltas[k]; !ok {
+			deltas[k] = &AccountBalance{
+				AccountID:   entry.AccountID,
+				Participant: entry.Participant,
+				AssetSymbol: entry.AssetSymbol,
+				AccountType: entry.AccountType,
+				Amount:      decimal.Zero,
+				UpdatedAt:   now,
+			}
+		}
+		deltas[k].Amount = deltas[k].Amount.Add(entry.Credit).Sub(entry.Debit)
+	}
+
+	rows := sortedBalances(deltas)
+	if len(rows) == 0 {
+		return nil
+	}
+
+	locks := make([]AccountBalance, len(rows))
+	for i, r := range rows {
+		locks[i] = r
+		locks[i].Amount = decimal.Zero
+	}
+	if err := lockBalanceRows(tx, locks); err != nil {
+		return err
+	}
+
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "account_id"}, {Name: "participant"}, {Name: "asset_symbol"}},
+		DoUpdates: clause.Assignments(map[string]any{
+			"amount":     gorm.Expr("balances.amount + excluded.amount"),
+			"updated_at": gorm.Expr("excluded.updated_at"),
+		}),
+	}).Create(&rows).Error
+}
+
+// LedgerCheckpoint is a snapshot of all account balances up to and including an entry.
+// Full history verification starts from the latest checkpoint instead of the first entry.
+type LedgerCheckpoint struct {
+	ID          uint `gorm:"primaryKey"`
+	LastEntryID uint `gorm:"column:last_entry_id;not null"`
+	CreatedAt   time.Time
+}
+
+func (LedgerCheckpoint) TableName() string {
+	return "ledger_checkpoints"
+}
+
+// LedgerCheckpointBalance is the balance of an account at a checkpoint
+type LedgerCheckpointBalance struct {
+	CheckpointID uint            `gorm:"column:checkpoint_id;primaryKey"`
+	AccountID    string          `gorm:"column:account_id;primaryKey"`
+	Participant  string          `gorm:"column:participant;primaryKey"`
+	AssetSymbol  string          `gorm:"column:asset_symbol;primaryKey"`
+	AccountType  AccountType     `gorm:"column:account_type;not null"`
+	Amount       decimal.Decimal `gorm:"column:amount;type:decimal(38,18);not null"`
+}
+
+func (LedgerCheckpointBalance) TableName() string {
+	return "ledger_checkpoint_balances"
+}
+
+// BalanceMismatch describes an account whose maintained balance differs from the balance computed from entries
+type BalanceMismatch struct {
+	AccountID   string
+	Participant string
+	AssetSymbol string
+	Maintained  decimal.Decimal
+	Computed    decimal.Decimal
+}
+
+// checkpointLag keeps the most recent entries out of checkpoints,
+// so that entries of transactions which are still being committed aren't skipped.
+const checkpointLag = time.Minute
+
+// latestCheckpoint returns the most recent checkpoint, or nil if there is none
+func latestCheckpoint(tx *gorm.DB) (*LedgerCheckpoint, error) {
+	var checkpoints []LedgerCheckpoint
+	if err := tx.Order("id DESC").Limit(1).Find(&checkpoints).Error; err != nil {
+		return nil, err
+	}
+	if len(checkpoints) == 0 {
+		return nil, nil
+	}
+	return &checkpoints[0], nil
+}
+
+// computeBalances recomputes account balances from the checkpoint and the entries after it, up to lastEntryID
+func computeBalances(tx *gorm.DB, checkpoint *LedgerCheckpoint, lastEntryID uint) (map[balanceKey]*AccountBalance, error) {
+	balances := map[balanceKey]*AccountBalance{}
+
+	firstEntryID := uint(0)
+	if checkpoint != nil {
+		firstEntryID = checkpoint.LastEntryID
+
+		var rows []LedgerCheckpointBalance
+		if err := tx.Where("checkpoint_id = ?", checkpoint.ID).Find(&rows).Error; err != nil {
+			return nil, err
+		}
+		for _, r := range rows {
+			b := &AccountBalance{AccountID: r.AccountID, Participant: r.Participant, AssetSymbol: r.AssetSymbol, AccountType: r.AccountType, Amount: r.Amount}
+			balances[b.key()] = b
+		}
+	}
+
+	type row struct {
+		AccountID   string          `gorm:"column:account_id"`
+		Participant string          `gorm:"column:participant"`
+		AssetSymbol string          `gorm:"column:asset_symbol"`
+		AccountType AccountType     `gorm:"column:account_type"`
+		Balance     decimal.Decimal `gorm:"column:balance"`
+	}
+	var rows []row
+	if err := tx.Model(&Entry{}).
+		Where("id > ? AND id <= ?", firstEntryID, lastEntryID).
+		Select("account_id", "participant", "asset_symbol", "MAX(account_type) AS account_type", "COALESCE(SUM(credit),0) - COALESCE(SUM(debit),0) AS balance").
+		Group("account_id, participant, asset_symbol").
+		Scan(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	for _, r := range rows {
+		k := balanceKey{AccountID: r.AccountID, Participant: r.Participant, AssetSymbol: r.AssetSymbol}
+		if b, ok := balances[k]; ok {
+			b.Amount = b.Amount.Add(r.Balance)
+			continue
+		}
+		balances[k] = &AccountBalance{AccountID: r.AccountID, Participant: r.Participant, AssetSymbol: r.AssetSymbol, AccountType: r.AccountType, Amount: r.Balance}
+	}
+
+	return balances, nil
+}
+
+// lastEntryID returns the highest entry ID, optionally only considering entries created before the given time
+func lastEntryID(tx *gorm.DB, before *time.Time) (uint, error) {
+	var id sql.NullInt64
+	q := tx.Model(&Entry{})
+	if before != nil {
+		q = q.Where("created_at < ?", *before)
+	}
+	if err := q.Select("MAX(id)").Scan(&id).Error; err != nil {
+		return 0, err
+	}
+	return uint(id.Int64), nil
+}
+
+// snapshotTransaction runs fn in a transaction which sees a consistent snapshot of the ledger
+func snapshotTransaction(db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	if db.Dialector.Name() == "postgres" {
+		return db.Transaction(fn, &sql.TxOptions{Isolation: sql.LevelRepeatableRead})
+	}
+	// SQLite transactions are serializable
+	return db.Transaction(fn)
+}
+
+// VerifyBalances recomputes all balances from the latest checkpoint and the entries after it,
+// and compares them with the maintained balances.
+func VerifyBalances(db *gorm.DB) ([]BalanceMismatch, error) {
+	var mismatches []BalanceMismatch
+	err := snapshotTransaction(db, func(tx *gorm.DB) error {
+		checkpoint, err := latestCheckpoint(tx)
+		if err != nil {
+			return fmt.Errorf("failed to load checkpoint: %w", err)
+		}
+		lastID, err := lastEntryID(tx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to load last entry: %w", err)
+		}
+		computed, err := computeBalances(tx, checkpoint, lastID)
+		if err != nil {
+			return fmt.Errorf("failed to compute balances: %w", err)
+		}
+
+		var maintained []AccountBalance
+		if err := tx.Find(&maintained).Error; err != nil {
+			return fmt.Errorf("failed to load balances: %w", err)
+		}
+
+		for _, b := range maintained {
+			expected := decimal.Zero
+			if c, ok := computed[b.key()]; ok {
+				expected = c.Amount
+				delete(computed, b.key())
+			}
+			if !b.Amount.Equal(expected) {
+				mismatches = append(mismatches, BalanceMismatch{AccountID: b.AccountID, Participant: b.Participant, AssetSymbol: b.AssetSymbol, Maintained: b.Amount, Computed: expected})
+			}
+		}
+		// Accounts with entries but without a maintained balance
+		for _, c := range sortedBalances(computed) {
+			if !c.Amount.IsZero() {
+				mismatches = append(mismatches, BalanceMismatch{AccountID: c.AccountID, Participant: c.Participant, AssetSymbol: c.AssetSymbol, Maintained: decimal.Zero, Computed: c.Amount})
+			}
+		}
+		return nil
+	})
+	return mismatches, err
+}
+
+// CreateCheckpoint snapshots the balances of all entries older than checkpointLag.
+// It returns nil if there are no new entries since the latest checkpoint.
+func CreateCheckpoint(db *gorm.DB) (*LedgerCheckpoint, error) {
+	var created *LedgerCheckpoint
+	err := snapshotTransaction(db, func(tx *gorm.DB) error {
+		previous, err := latestCheckpoint(tx)
+		if err != nil {
+			return fmt.Errorf("failed to load checkpoint: %w", err)
+		}
+
+		before := time.Now().Add(-checkpointLag)
+		lastID, err := lastEntryID(tx, &before)
+		if err != nil {
+			return fmt.Errorf("failed to load last entry: %w", err)
+		}
+		if lastID == 0 || (previous != nil && lastID <= previous.LastEntryID) {
+			return nil
+		}
+
+		balances, err := computeBalances(tx, previous, lastID)
+		if err != nil {
+			return fmt.Errorf("failed to compute balances: %w", err)
+		}
+
+		checkpoint := LedgerCheckpoint{LastEntryID: lastID}
+		if err := tx.Create(&checkpoint).Error; err != nil {
+			return fmt.Errorf("failed to create checkpoint: %w", err)
+		}
+
+		rows := make([]LedgerCheckpointBalance, 0, len(balances))
+		for _, b := range sortedBalances(balances) {
+			rows = append(rows, LedgerCheckpointBalance{
+				CheckpointID: checkpoint.ID,
+				AccountID:    b.AccountID,
+				Participant:  b.Participant,
+				AssetSymbol:  b.AssetSymbol,
+				AccountType:  b.AccountType,
+				Amount:       b.Amount,
+			})
+		}
+		if len(rows) > 0 {
+			if err := tx.CreateInBatches(rows, 500).Error; err != nil {
+				return fmt.Errorf("failed to store checkpoint balances: %w", err)
+			}
+		}
+
+		created = &checkpoint
+		return nil
+	})
+	return created, err
+}
+
+// backfillBalances initializes the balances table from the ledger if it is empty
+func backfillBalances(db *gorm.DB) error {
+	var count int64
+	if err := db.Model(&AccountBalance{}).Count(&count).Error; err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		lastID, err := lastEntryID(tx, nil)
+		if err != nil || lastID == 0 {
+			return err
+		}
+		balances, err := computeBalances(tx, nil, lastID)
+		if err != nil {
+			return err
+		}
+		rows := sortedBalances(balances)
+		for i := range rows {
+			rows[i].UpdatedAt = time.Now()
+		}
+		return tx.CreateInBatches(rows, 500).Error
+	})
+}
+
+// RunLedgerChecks periodically verifies the maintained balances against the ledger entries,
+// and creates a new checkpoint after each successful verification.
+func RunLedgerChecks(ctx context.Context, db *gorm.DB, metrics *Metrics, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			CheckLedger(db, metrics)
+		}
+	}
+}
+
+// CheckLedger verifies the maintained balances once, reporting mismatches in the logs and metrics
+func CheckLedger(db *gorm.DB, metrics *Metrics) {
+	mismatches, err := VerifyBalances(db)
+	if err != nil {
+		log.Printf("Ledger consistency check failed: %v", err)
+		return
+	}
+
+	metrics.LedgerBalanceMismatches.Set(float64(len(mismatches)))
+	if len(mismatches) > 0 {
+		for _, m := range mismatches {
+			log.Printf("ALERT: balance mismatch for account %s of %s in %s: maintained %s, computed %s",
+				m.AccountID, m.Participant, m.AssetSymbol, m.Maintained, m.Computed)
+		}
+		// Don't snapshot balances which may be wrong
+		return
+	}
+
+	checkpoint, err := CreateCheckpoint(db)
+	if err != nil {
+		log.Printf("Failed to create ledger checkpoint: %v", err)
+		return
+	}
+	if checkpoint != nil {
+		log.Printf("Created ledger checkpoint %d at entry %d", checkpoint.ID, checkpoint.LastEntryID)
+	}
+}
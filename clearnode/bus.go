@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// BusTopic is the kind of a message delivered across the nodes of a cluster
+type BusTopic string
+
+const (
+	BusTopicForward      BusTopic = "forward" // App session message to one of its participants
+	BusTopicNotification BusTopic = "notify"  // Broker notification such as bu or cu
+	BusTopicRevoke       BusTopic = "revoke"  // Revocation of the auth session of a participant
+)
+
+// BusMessage is delivered by every node to its connection of the recipient
+type BusMessage struct {
+	Topic     BusTopic        `json:"topic"`
+	Recipient string          `json:"recipient"`
+	Payload   json.RawMessage `json:"payload,omitempty"` // WebSocket message as written to the recipient
+}
+
+// MessageBus delivers messages to every node of a cluster, the publishing node included
+type MessageBus interface {
+	Publish(ctx context.Context, msg BusMessage) error
+	Subscribe(handler func(BusMessage))
+	Close() error
+}
+
+// LocalBus delivers messages within the process, for a single node
+type LocalBus struct {
+	handlers   []func(BusMessage)
+	handlersMu sync.RWMutex
+}
+
+// NewLocalBus creates an in-process message bus
+func NewLocalBus() *LocalBus {
+	return &LocalBus{}
+}
+
+// Publish delivers a message to the subscribers before returning
+func (b *LocalBus) Publish(ctx context.Context, msg BusMessage) error {
+	b.handlersMu.RLock()
+	defer b.handlersMu.RUnlock()
+	for _, handler := range b.handlers {
+		handler(msg)
+	}
+	return nil
+}
+
+// Subscribe registers a handler of every published message
+func (b *LocalBus) Subscribe(handler func(BusMessage)) {
+	b.handlersMu.Lock()
+	defer b.handlersMu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+// Close does nothing, messages are delivered synchronously
+func (b *LocalBus) Close() error {
+	return nil
+}
+
+// NewMessageBus creates the bus of a kind, "local" or "postgres". Nodes sharing a database must use the
+// postgres bus to reach the participants connected to each other.
+func NewMessageBus(kind string, db *gorm.DB, cnf DatabaseConfig) (MessageBus, error) {
+	switch kind {
+	case "local":
+		return NewLocalBus(), nil
+	case "postgres":
+		if cnf.Driver != "postgres" {
+			return nil, fmt.Errorf("the postgres message bus requires a postgres database, not %s", cnf.Driver)
+		}
+		dsn, err := postgresqlDbUrl(cnf)
+		if err != nil {
+			return nil, err
+		}
+		return NewPostgresBus(db, dsn)
+	default:
+		return nil, fmt.Errorf("unsupported message bus: %s", kind)
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	"gorm.io/gorm"
+)
+
+const (
+	busChannel = "clearnode_bus"
+	// Postgres refuses notification payloads from 8000 bytes, larger messages are stored in bus_payloads
+	maxNotificationPayload = 7900
+	busPayloadRetention    = time.Minute
+	busPayloadRefPrefix    = "ref:"
+)
+
+// BusPayload is a message too large for a notification, the notification carries its ID
+type BusPayload struct {
+	ID        uint64 `gorm:"primaryKey"`
+	Payload   string `gorm:"column:payload;type:text;not null"`
+	CreatedAt time.Time
+}
+
+// TableName specifies the table name for the BusPayload model
+func (BusPayload) TableName() string {
+	return "bus_payloads"
+}
+
+// PostgresBus delivers messages across the nodes sharing a Postgres database with LISTEN/NOTIFY.
+// Notifications are not persisted: a node whose listener reconnects misses the messages published meanwhile.
+type PostgresBus struct {
+	db         *gorm.DB
+	listener   *pq.Listener
+	handlers   []func(BusMessage)
+	handlersMu sync.RWMutex
+	done       chan struct{}
+	closeOnce  sync.Once
+}
+
+// NewPostgresBus listens on the bus channel with a dedicated connection to the database
+func NewPostgresBus(db *gorm.DB, dsn string) (*PostgresBus, error) {
+	listener := pq.NewListener(dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Message bus listener error: %v", err)
+		}
+	})
+	if err := listener.Listen(busChannel); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to listen on the message bus: %w", err)
+	}
+
+	b := &PostgresBus{
+		db:       db,
+		listener: listener,
+		done:     make(chan struct{}),
+	}
+	go b.run()
+	return b, nil
+}
+
+// Publish notifies every node listening on the bus channel
+func (b *PostgresBus) Publish(ctx context.Context, msg BusMessage) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to encode bus message: %w", err)
+	}
+
+	payload := string(data)
+	if len(payload) > maxNotificationPayload {
+		stored := BusPayload{Payload: payload}
+		if err := b.db.WithContext(ctx).Create(&stored).Error; err != nil {
+			return fmt.Errorf("failed to store bus message: %w", err)
+		}
+		payload = busPayloadRefPrefix + strconv.FormatUint(stored.ID, 10)
+
+		// Every node read the stored messages long before they expire
+		if err := b.db.WithContext(ctx).Where("created_at < ?", time.Now().Add(-busPayloadRetention)).Delete(&BusPayload{}).Error; err != nil {
+			log.Printf("Failed to delete expired bus messages: %v", err)
+		}
+	}
+
+	if err := b.db.WithContext(ctx).Exec("SELECT pg_notify(?, ?)", busChannel, payload).Error; err != nil {
+		return fmt.Errorf("failed to publish bus message: %w", err)
+	}
+	return nil
+}
+
+// Subscribe registers a handler of every message published by any node
+func (b *PostgresBus) Subscribe(handler func(BusMessage)) {
+	b.handlersMu.Lock()
+	defer b.handlersMu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+// Close stops listening on the bus channel
+func (b *PostgresBus) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		close(b.done)
+		err = b.listener.Close()
+	})
+	return err
+}
+
+func (b *PostgresBus) run() {
+	for {
+		select {
+		case <-b.done:
+			return
+		case notification := <-b.listener.Notify:
+			if notification == nil {
+				log.Println("Message bus listener reconnected, messages published meanwhile are lost")
+				continue
+			}
+			msg, err := b.decode(notification.Extra)
+			if err != nil {
+				log.Printf("Failed to read bus message: %v", err)
+				continue
+			}
+			b.deliver(msg)
+		case <-time.After(90 * time.Second):
+			// Detect a dead connection while the bus is quiet
+			go b.listener.Ping()
+		}
+	}
+}
+
+func (b *PostgresBus) decode(payload string) (BusMessage, error) {
+	if ref, ok := strings.CutPrefix(payload, busPayloadRefPrefix); ok {
+		id, err := strconv.ParseUint(ref, 10, 64)
+		if err != nil {
+			return BusMessage{}, fmt.Errorf("invalid bus message reference %q: %w", ref, err)
+		}
+		var stored BusPayload
+		if err := b.db.Where("id = ?", id).First(&stored).Error; err != nil {
+			return BusMessage{}, fmt.Errorf("failed to get bus message %d: %w", id, err)
+		}
+		payload = stored.Payload
+	}
+
+	var msg BusMessage
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		return BusMessage{}, fmt.Errorf("failed to decode bus message: %w", err)
+	}
+	return msg, nil
+}
+
+func (b *PostgresBus) deliver(msg BusMessage) {
+	b.handlersMu.RLock()
+	defer b.handlersMu.RUnlock()
+	for _, handler := range b.handlers {
+		handler(msg)
+	}
+}
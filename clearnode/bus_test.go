@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// connectParticipant registers the connection of an authenticated participant on a node, and returns
+// the client side of the connection
+func connectParticipant(t *testing.T, node *UnifiedWSHandler, address string) *websocket.Conn {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := node.upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		node.authManager.registerAuthSession(address)
+		node.connectionsMu.Lock()
+		node.connections[address] = conn
+		node.connectionsMu.Unlock()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	require.Eventually(t, func() bool { return node.ConnectionCount() == 1 }, 5*time.Second, time.Millisecond)
+	return client
+}
+
+func readMessage(t *testing.T, conn *websocket.Conn) []byte {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	return message
+}
+
+func TestMessageBus(t *testing.T) {
+	// Two nodes sharing a bus, Alice is connected to the first one and Bob to the second
+	bus := NewLocalBus()
+	nodeA, nodeB := newTestWSHandler(t), newTestWSHandler(t)
+	nodeA.bus, nodeB.bus = bus, bus
+	bus.Subscribe(nodeA.deliverBusMessage)
+	bus.Subscribe(nodeB.deliverBusMessage)
+
+	aliceKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	alice := crypto.PubkeyToAddress(aliceKey.PublicKey).Hex()
+	bob := common.HexToAddress("0xb0b").Hex()
+	connectParticipant(t, nodeA, alice)
+	bobConn := connectParticipant(t, nodeB, bob)
+
+	t.Run("Notification", func(t *testing.T) {
+		nodeA.sendBalanceUpdate(bob)
+
+		var response RPCMessage
+		require.NoError(t, json.Unmarshal(readMessage(t, bobConn), &response))
+		assert.Equal(t, "bu", response.Res.Method)
+	})
+
+	t.Run("Forward", func(t *testing.T) {
+		require.NoError(t, nodeA.db.Create(&AppSession{
+			SessionID:    "0xBusSession",
+			Participants: []string{alice, bob},
+			Status:       ChannelStatusOpen,
+			Weights:      []int64{50, 50},
+			Quorum:       100,
+		}).Error)
+		nodeB.db = nodeA.db
+
+		msg := RPCMessage{Req: &RPCData{RequestID: 7, Method: "message", Params: []any{"hello"}, Timestamp: uint64(time.Now().UnixMilli())}, AppSessionID: "0xBusSession"}
+		reqBytes, err := json.Marshal(msg.Req)
+		require.NoError(t, err)
+		signer := LocalSigner{privateKey: aliceKey}
+		signature, err := signer.Sign(reqBytes)
+		require.NoError(t, err)
+		msg.Sig = []string{hexutil.Encode(signature)}
+		msgBytes, err := json.Marshal(msg)
+		require.NoError(t, err)
+
+		require.NoError(t, forwardMessage(&msg, msgBytes, alice, nodeA))
+		assert.JSONEq(t, string(msgBytes), string(readMessage(t, bobConn)))
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		assert.True(t, nodeB.authManager.ValidateSession(bob))
+		nodeA.RevokeSession(strings.ToLower(bob))
+
+		assert.False(t, nodeB.authManager.ValidateSession(bob))
+		bobConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := bobConn.ReadMessage()
+		var closeErr *websocket.CloseError
+		require.ErrorAs(t, err, &closeErr)
+		assert.Equal(t, websocket.ClosePolicyViolation, closeErr.Code)
+		assert.True(t, nodeA.authManager.ValidateSession(alice), "other sessions are kept")
+	})
+
+	t.Run("AdminRevokeSession", func(t *testing.T) {
+		admins := ParseAdminSet(alice)
+		req := &RPCMessage{Req: &RPCData{RequestID: 1, Method: "admin_revoke_session", Params: []any{map[string]string{"address": strings.ToLower(bob)}}, Timestamp: 1}}
+		reqBytes, err := json.Marshal(req.Req)
+		require.NoError(t, err)
+		signer := LocalSigner{privateKey: aliceKey}
+		signature, err := signer.Sign(reqBytes)
+		require.NoError(t, err)
+		req.Sig = []string{hexutil.Encode(signature)}
+
+		response, err := HandleAdminRevokeSession(req, alice, admins)
+		require.NoError(t, err)
+		assert.Equal(t, AdminRevokeSessionResponse{Address: bob}, response.Res.Params[0])
+
+		_, err = HandleAdminRevokeSession(req, bob, admins)
+		assert.EqualError(t, err, "admin RPCs are restricted to admin addresses")
+	})
+}
+
+func TestPostgresBus(t *testing.T) {
+	if os.Getenv("TEST_DB_DRIVER") != "postgres" {
+		t.Skip("set TEST_DB_DRIVER=postgres to test the Postgres message bus")
+	}
+
+	ctx := context.Background()
+	db, container, url := setupTestPostgres(ctx, t)
+	defer container.Terminate(ctx)
+	require.NoError(t, db.AutoMigrate(&BusPayload{}))
+
+	// Two nodes, a message published by one is delivered on both
+	received := make(chan BusMessage, 4)
+	var nodes []*PostgresBus
+	for range 2 {
+		bus, err := NewPostgresBus(db, url)
+		require.NoError(t, err)
+		defer bus.Close()
+		bus.Subscribe(func(msg BusMessage) { received <- msg })
+		nodes = append(nodes, bus)
+	}
+
+	large := json.RawMessage(`"` + strings.Repeat("a", 2*maxNotificationPayload) + `"`)
+	for _, payload := range []json.RawMessage{json.RawMessage(`{"res":[1,"bu",[],1]}`), large} {
+		sent := BusMessage{Topic: BusTopicNotification, Recipient: "0xBob", Payload: payload}
+		require.NoError(t, nodes[0].Publish(ctx, sent))
+		for range 2 {
+			select {
+			case msg := <-received:
+				assert.Equal(t, sent, msg)
+			case <-time.After(5 * time.Second):
+				t.Fatal("bus message is not delivered")
+			}
+		}
+	}
+
+	var stored int64
+	require.NoError(t, db.Model(&BusPayload{}).Count(&stored).Error)
+	assert.Equal(t, int64(1), stored, "only messages too large for a notification are stored")
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+)
+
+// ChainBackend is the access to a chain the custody contract is used through: contract calls,
+// log filtering and subscriptions, and transaction submission.
+// Live networks use an ethclient.Client, tests a simulated backend with the custody contract deployed.
+type ChainBackend interface {
+	bind.ContractBackend
+	bind.DeployBackend
+
+	ChainID(ctx context.Context) (*big.Int, error)
+	TransactionByHash(ctx context.Context, hash common.Hash) (tx *types.Transaction, isPending bool, err error)
+}
+
+// DialChainBackend connects to the RPC endpoint of a network
+func DialChainBackend(url string) (ChainBackend, error) {
+	client, err := ethclient.Dial(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Ethereum node: %w", err)
+	}
+	return client, nil
+}
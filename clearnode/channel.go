@@ -4,8 +4,11 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/big"
 	"time"
 
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/common"
 	"gorm.io/gorm"
 )
 
@@ -16,6 +19,8 @@ var (
 	ChannelStatusJoining ChannelStatus = "joining"
 	ChannelStatusOpen    ChannelStatus = "open"
 	ChannelStatusClosed  ChannelStatus = "closed"
+	// The broker didn't join the channel, the participant closes it with the signed refund state
+	ChannelStatusRejected ChannelStatus = "rejected"
 )
 
 // Channel represents a state channel between participants
@@ -24,8 +29,10 @@ type Channel struct {
 	ChainID     uint32        `gorm:"column:chain_id;not null"`
 	Token       string        `gorm:"column:token;not null"`
 	Participant string        `gorm:"column:participant;not null"`
+	Broker      string        `gorm:"column:broker;not null;default:''"`
 	Amount      uint64        `gorm:"column:amount;not null"`
 	Status      ChannelStatus `gorm:"column:status;not null;"`
+	Reason      string        `gorm:"column:reason;not null;default:''"` // Why the broker rejected the channel
 	Challenge   uint64        `gorm:"column:challenge;default:0"`
 	Nonce       uint64        `gorm:"column:nonce;default:0"`
 	Version     uint64        `gorm:"column:version;default:0"`
@@ -40,14 +47,16 @@ func (Channel) TableName() string {
 }
 
 // CreateChannel creates a new channel in the database
-// For real channels, participantB is always the broker application
-func CreateChannel(tx *gorm.DB, channelID, participantA string, nonce uint64, adjudicator string, chainID uint32, tokenAddress string, amount uint64) (Channel, error) {
+// For real channels, participantB is always the broker application, identified by the broker key address
+func CreateChannel(tx *gorm.DB, channelID, participantA, broker string, nonce, challenge uint64, adjudicator string, chainID uint32, tokenAddress string, amount uint64) (Channel, error) {
 	channel := Channel{
 		ChannelID:   channelID,
 		Participant: participantA,
+		Broker:      broker,
 		ChainID:     chainID, // Set the network ID for channels
 		Status:      ChannelStatusJoining,
 		Nonce:       nonce,
+		Challenge:   challenge,
 		Adjudicator: adjudicator,
 		Token:       tokenAddress,
 		Amount:      amount,
@@ -91,6 +100,44 @@ func getChannelsByParticipant(tx *gorm.DB, participant string, status string) ([
 	return channels, nil
 }
 
+// ChannelFilter narrows down channel listings
+type ChannelFilter struct {
+	Participant string
+	Status      string
+	Token       string
+	ChainID     uint32
+}
+
+// listChannels returns a page of channels matching the filter, ordered by creation time
+func listChannels(tx *gorm.DB, filter ChannelFilter, opts ListOptions) ([]Channel, PageInfo, error) {
+	q := tx.Model(&Channel{}).Where("participant = ?", filter.Participant)
+	if filter.Status != "" {
+		q = q.Where("status = ?", filter.Status)
+	}
+	if filter.Token != "" {
+		q = q.Where("token = ?", filter.Token)
+	}
+	if filter.ChainID != 0 {
+		q = q.Where("chain_id = ?", filter.ChainID)
+	}
+	q = opts.applyTimeRange(q, "created_at")
+
+	q, err := paginateByCreatedAt(q, "channel_id", opts)
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
+
+	var channels []Channel
+	if err := q.Find(&channels).Error; err != nil {
+		return nil, PageInfo{}, fmt.Errorf("error finding channels for participant %s: %w", filter.Participant, err)
+	}
+
+	channels, page := newPage(channels, opts, func(c Channel) pageCursor {
+		return pageCursor{CreatedAt: &c.CreatedAt, Key: c.ChannelID}
+	})
+	return channels, page, nil
+}
+
 // CheckExistingChannels checks if there is an existing open channel on the same network between participant and broker
 func CheckExistingChannels(tx *gorm.DB, participantA, token string, chainID uint32) (*Channel, error) {
 	var channel Channel
@@ -105,3 +152,55 @@ func CheckExistingChannels(tx *gorm.DB, participantA, token string, chainID uint
 
 	return &channel, nil
 }
+
+// CheckDuplicateChannel returns another open or joining channel of the participant for the token on the same network
+func CheckDuplicateChannel(tx *gorm.DB, channelID, participantA, token string, chainID uint32) (*Channel, error) {
+	var channel Channel
+	err := tx.Where("channel_id <> ? AND participant = ? AND token = ? AND chain_id = ? AND status IN ?",
+		channelID, participantA, token, chainID, []ChannelStatus{ChannelStatusOpen, ChannelStatusJoining}).
+		First(&channel).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error checking for duplicate channel: %w", err)
+	}
+
+	return &channel, nil
+}
+
+// RejectChannel marks a channel the broker won't join as rejected, and signs a final state which refunds
+// the participant deposit, so that the participant can close the channel right away
+func RejectChannel(tx *gorm.DB, signer Signer, channel *Channel, deposit nitrolite.Allocation, reason string) (*ChannelState, error) {
+	channel.Status = ChannelStatusRejected
+	channel.Reason = reason
+	channel.UpdatedAt = time.Now()
+	if err := tx.Save(channel).Error; err != nil {
+		return nil, fmt.Errorf("failed to reject channel: %w", err)
+	}
+
+	// The broker never deposited, its allocation is empty
+	allocations := []nitrolite.Allocation{
+		deposit,
+		{
+			Destination: signer.GetAddress(),
+			Token:       deposit.Token,
+			Amount:      big.NewInt(0),
+		},
+	}
+	version := channel.Version + 1
+	if err := ReserveStateVersion(tx, channel.ChannelID, version); err != nil {
+		return nil, err
+	}
+
+	stateData := []byte{}
+	encodedState, err := nitrolite.EncodeState(common.HexToHash(channel.ChannelID), nitrolite.IntentFINALIZE, new(big.Int).SetUint64(version), stateData, allocations)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode state hash: %w", err)
+	}
+	sig, err := signer.NitroSign(encodedState)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign state: %w", err)
+	}
+	return StoreChannelState(tx, channel.ChannelID, nitrolite.IntentFINALIZE, version, stateData, allocations, sig)
+}
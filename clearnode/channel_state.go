@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"gorm.io/gorm"
+)
+
+// ChannelStateStatus represents whether a signed state can still be submitted on-chain
+type ChannelStateStatus string
+
+var (
+	ChannelStateStatusPending    ChannelStateStatus = "pending" // Signed, and can still be submitted on-chain
+	ChannelStateStatusOnChain    ChannelStateStatus = "on_chain"
+	ChannelStateStatusSuperseded ChannelStateStatus = "superseded" // Another state landed instead, or the channel closed
+)
+
+// ChannelState is a channel state signed by the broker, with the participant signature once seen on-chain.
+// Only one state per version of a channel is valid, superseded states don't count.
+type ChannelState struct {
+	ID              uint               `gorm:"primaryKey"`
+	ChannelID       string             `gorm:"column:channel_id;not null;uniqueIndex:idx_channel_states_channel_version,where:status <> 'superseded'"`
+	Version         uint64             `gorm:"column:version;not null;uniqueIndex:idx_channel_states_channel_version,where:status <> 'superseded'"`
+	Intent          uint8              `gorm:"column:intent;not null"`
+	StateData       string             `gorm:"column:state_data;not null"`
+	Allocations     []Allocation       `gorm:"column:allocations;type:text;serializer:json;not null"`
+	StateHash       string             `gorm:"column:state_hash;not null;index"`
+	BrokerSignature Signature          `gorm:"column:broker_signature;type:text;serializer:json;not null"`
+	UserSignature   *Signature         `gorm:"column:user_signature;type:text;serializer:json"`
+	Status          ChannelStateStatus `gorm:"column:status;not null;default:'pending'"`
+	TxHash          string             `gorm:"column:tx_hash;not null;default:''"` // Transaction which put the state on-chain
+	CreatedAt       time.Time
+	UpdatedAt       time.Time
+}
+
+// TableName specifies the table name for the ChannelState model
+func (ChannelState) TableName() string {
+	return "channel_states"
+}
+
+// findPendingState returns the pending state of a channel identical to a state, nil if there is none.
+// A participant requesting the same state again, e.g. after losing the response, gets the pending one back.
+func findPendingState(tx *gorm.DB, channelID string, state nitrolite.State) (*ChannelState, error) {
+	observed, err := newChannelState(channelID, state)
+	if err != nil {
+		return nil, err
+	}
+
+	var pending ChannelState
+	err = tx.Where("channel_id = ? AND state_hash = ? AND status = ?", channelID, observed.StateHash, ChannelStateStatusPending).
+		Order("id").First(&pending).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to find channel state: %w", err)
+	}
+	return &pending, nil
+}
+
+// ReserveStateVersion refuses to sign a state for a version of a channel which already has a valid one,
+// as the participant could submit either of them. It runs in the transaction storing the new state,
+// and the unique index on the valid states of a version catches concurrent transactions.
+func ReserveStateVersion(tx *gorm.DB, channelID string, version uint64) error {
+	state, err := validState(tx, channelID, version)
+	if err != nil {
+		return err
+	}
+	if state != nil {
+		return fmt.Errorf("a state for version %d of channel %s is already signed, submit it on-chain first", version, channelID)
+	}
+	return nil
+}
+
+// validState returns the state of a version of a channel which isn't superseded, nil if there is none
+func validState(tx *gorm.DB, channelID string, version uint64) (*ChannelState, error) {
+	var state ChannelState
+	err := tx.Where("channel_id = ? AND version = ? AND status <> ?", channelID, version, ChannelStateStatusSuperseded).
+		First(&state).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to check channel states: %w", err)
+	}
+	return &state, nil
+}
+
+// signChannelState signs a state of a channel with a broker key and stores it as pending
+func signChannelState(tx *gorm.DB, signer Signer, channelID string, state nitrolite.State) (*ChannelState, error) {
+	encodedState, err := nitrolite.EncodeState(common.HexToHash(channelID), nitrolite.Intent(state.Intent), state.Version, state.Data, state.Allocations)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode state hash: %w", err)
+	}
+	sig, err := signer.NitroSign(encodedState)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign state: %w", err)
+	}
+	return StoreChannelState(tx, channelID, nitrolite.Intent(state.Intent), state.Version.Uint64(), state.Data, state.Allocations, sig)
+}
+
+// StoreChannelState records a state the broker signed for a channel
+func StoreChannelState(tx *gorm.DB, channelID string, intent nitrolite.Intent, version uint64, stateData []byte, allocations []nitrolite.Allocation, brokerSig nitrolite.Signature) (*ChannelState, error) {
+	state, err := newChannelState(channelID, nitrolite.State{
+		Intent:      uint8(intent),
+		Version:     new(big.Int).SetUint64(version),
+		Data:        stateData,
+		Allocations: allocations,
+	})
+	if err != nil {
+		return nil, err
+	}
+	state.BrokerSignature = newSignature(brokerSig)
+	state.Status = ChannelStateStatusPending
+
+	if err := tx.Create(&state).Error; err != nil {
+		return nil, fmt.Errorf("failed to store channel state: %w", err)
+	}
+	return &state, nil
+}
+
+// recordOnChainState records the participant signature of a state submitted to the custody contract.
+// Signatures are ordered like the channel participants, the participant first and the broker second.
+func recordOnChainState(tx *gorm.DB, channelID string, onChain nitrolite.State, txHash string) error {
+	if len(onChain.Sigs) < 2 {
+		return nil
+	}
+
+	observed, err := newChannelState(channelID, onChain)
+	if err != nil {
+		return err
+	}
+	userSig := newSignature(onChain.Sigs[0])
+
+	var state ChannelState
+	err = tx.Where("channel_id = ? AND state_hash = ?", channelID, observed.StateHash).Order("id").First(&state).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Signed before states were stored, or when joining the channel
+		observed.BrokerSignature = newSignature(onChain.Sigs[1])
+		observed.UserSignature = &userSig
+		observed.Status = ChannelStateStatusOnChain
+		observed.TxHash = txHash
+		if err := tx.Create(&observed).Error; err != nil {
+			return fmt.Errorf("failed to store channel state: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find channel state: %w", err)
+	}
+
+	state.UserSignature = &userSig
+	state.Status = ChannelStateStatusOnChain
+	state.TxHash = txHash
+	if err := tx.Save(&state).Error; err != nil {
+		return fmt.Errorf("failed to update channel state: %w", err)
+	}
+	return nil
+}
+
+// settleResizedStates records that a resize of a channel to a version landed on-chain with the given state data.
+// The matching pending resize state is on-chain and its holds are converted and returned. The other pending states
+// up to the version, resize or final, can't be submitted anymore: they are superseded and their holds released.
+func settleResizedStates(tx *gorm.DB, channelID string, version uint64, stateData string) ([]LedgerHold, error) {
+	var states []ChannelState
+	err := tx.Where("channel_id = ? AND version <= ? AND status = ?", channelID, version, ChannelStateStatusPending).
+		Order("id").Find(&states).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to find channel states: %w", err)
+	}
+
+	var landed, superseded []uint
+	for _, state := range states {
+		if state.Version == version && state.Intent == uint8(nitrolite.IntentRESIZE) && state.StateData == stateData {
+			landed = append(landed, state.ID)
+		} else {
+			superseded = append(superseded, state.ID)
+		}
+	}
+	if err := setChannelStateStatus(tx, superseded, ChannelStateStatusSuperseded); err != nil {
+		return nil, err
+	}
+	if err := setChannelStateStatus(tx, landed, ChannelStateStatusOnChain); err != nil {
+		return nil, err
+	}
+	if err := ReleaseHolds(tx, superseded...); err != nil {
+		return nil, err
+	}
+	return ConvertHolds(tx, channelID, landed...)
+}
+
+// settleClosedStates records that a channel closed on-chain. None of its pending states can be submitted anymore:
+// the holds of the final states, one of which paid out the balance, are converted and returned, the holds of the
+// resize states released. The final state which landed is recorded from the closing transaction.
+func settleClosedStates(tx *gorm.DB, channelID string) ([]LedgerHold, error) {
+	var states []ChannelState
+	if err := tx.Where("channel_id = ? AND status = ?", channelID, ChannelStateStatusPending).Order("id").Find(&states).Error; err != nil {
+		return nil, fmt.Errorf("failed to find channel states: %w", err)
+	}
+
+	var final, resized, all []uint
+	for _, state := range states {
+		all = append(all, state.ID)
+		if state.Intent == uint8(nitrolite.IntentFINALIZE) {
+			final = append(final, state.ID)
+		} else {
+			resized = append(resized, state.ID)
+		}
+	}
+	if err := setChannelStateStatus(tx, all, ChannelStateStatusSuperseded); err != nil {
+		return nil, err
+	}
+	if err := ReleaseHolds(tx, resized...); err != nil {
+		return nil, err
+	}
+	return ConvertHolds(tx, channelID, final...)
+}
+
+func setChannelStateStatus(tx *gorm.DB, ids []uint, status ChannelStateStatus) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	err := tx.Model(&ChannelState{}).Where("id IN ?", ids).
+		Updates(map[string]any{"status": status, "updated_at": time.Now()}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update channel states: %w", err)
+	}
+	return nil
+}
+
+// GetLatestSignedState returns the state of a channel with the highest version signed by both parties, nil if none is known
+func GetLatestSignedState(tx *gorm.DB, channelID string) (*ChannelState, error) {
+	var state ChannelState
+	err := tx.Where("channel_id = ? AND user_signature IS NOT NULL", channelID).
+		Order("version DESC").Order("id DESC").First(&state).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to find latest signed state: %w", err)
+	}
+	return &state, nil
+}
+
+// listChannelStates returns a page of the states signed for a channel, ordered by signing time
+func listChannelStates(tx *gorm.DB, channelID string, opts ListOptions) ([]ChannelState, PageInfo, error) {
+	q := tx.Model(&ChannelState{}).Where("channel_id = ?", channelID)
+	q = opts.applyTimeRange(q, "created_at")
+
+	q, err := paginateByID(q, opts)
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
+
+	var states []ChannelState
+	if err := q.Find(&states).Error; err != nil {
+		return nil, PageInfo{}, fmt.Errorf("failed to list channel states: %w", err)
+	}
+
+	states, page := newPage(states, opts, func(s ChannelState) pageCursor { return pageCursor{ID: s.ID} })
+	return states, page, nil
+}
+
+// signedState returns the state with the participant signature first and the broker signature second
+func (s ChannelState) signedState() SignedState {
+	signed := SignedState{
+		Intent:      s.Intent,
+		Version:     s.Version,
+		StateData:   s.StateData,
+		Allocations: s.Allocations,
+	}
+	if s.UserSignature != nil {
+		signed.Sigs = append(signed.Sigs, *s.UserSignature)
+	}
+	signed.Sigs = append(signed.Sigs, s.BrokerSignature)
+	return signed
+}
+
+// newChannelState converts a custody contract state without its signatures, and hashes it
+func newChannelState(channelID string, state nitrolite.State) (ChannelState, error) {
+	encodedState, err := nitrolite.EncodeState(common.HexToHash(channelID), nitrolite.Intent(state.Intent), state.Version, state.Data, state.Allocations)
+	if err != nil {
+		return ChannelState{}, fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	signed := newSignedState(nitrolite.State{
+		Intent:      state.Intent,
+		Version:     state.Version,
+		Data:        state.Data,
+		Allocations: state.Allocations,
+	})
+	return ChannelState{
+		ChannelID:   channelID,
+		Version:     signed.Version,
+		Intent:      signed.Intent,
+		StateData:   signed.StateData,
+		Allocations: signed.Allocations,
+		StateHash:   crypto.Keccak256Hash(encodedState).Hex(),
+	}, nil
+}
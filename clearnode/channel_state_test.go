@@ -0,0 +1,215 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelStates(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	rawBroker, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	broker := &LocalSigner{privateKey: rawBroker}
+	rawParticipant, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	participant := &LocalSigner{privateKey: rawParticipant}
+
+	token := common.HexToAddress("0x1234567890123456789012345678901234567890")
+	channel := &Channel{
+		ChannelID:   common.HexToHash("0x5747e").Hex(),
+		Participant: participant.GetAddress().Hex(),
+		Broker:      broker.GetAddress().Hex(),
+		Status:      ChannelStatusOpen,
+		Token:       token.Hex(),
+		ChainID:     137,
+		Amount:      1000,
+		Version:     1,
+	}
+	require.NoError(t, db.Create(channel).Error)
+
+	// The initial state is recorded with both signatures when the broker joins
+	initial := nitrolite.State{
+		Intent:  uint8(nitrolite.IntentINITIALIZE),
+		Version: big.NewInt(0),
+		Data:    []byte{},
+		Allocations: []nitrolite.Allocation{
+			{Destination: participant.GetAddress(), Token: token, Amount: big.NewInt(1000)},
+			{Destination: broker.GetAddress(), Token: token, Amount: big.NewInt(0)},
+		},
+	}
+	encodedInitial, err := nitrolite.EncodeState(common.HexToHash(channel.ChannelID), nitrolite.IntentINITIALIZE, initial.Version, initial.Data, initial.Allocations)
+	require.NoError(t, err)
+	for _, signer := range []Signer{participant, broker} {
+		sig, err := signer.NitroSign(encodedInitial)
+		require.NoError(t, err)
+		initial.Sigs = append(initial.Sigs, sig)
+	}
+	require.NoError(t, recordOnChainState(db, channel.ChannelID, initial, "0xc0"))
+
+	allocations := []nitrolite.Allocation{
+		{Destination: participant.GetAddress(), Token: token, Amount: big.NewInt(600)},
+		{Destination: broker.GetAddress(), Token: token, Amount: big.NewInt(0)},
+	}
+	signResize := func(resizeAmounts []*big.Int, allocations []nitrolite.Allocation) *ChannelState {
+		state, err := newResizeState(channel, resizeAmounts, allocations)
+		require.NoError(t, err)
+		signed, err := signChannelState(db, broker, channel.ChannelID, state)
+		require.NoError(t, err)
+		return signed
+	}
+	resized := signResize([]*big.Int{big.NewInt(-400), big.NewInt(0)}, allocations)
+
+	t.Run("StoresSignedStates", func(t *testing.T) {
+		var stored ChannelState
+		require.NoError(t, db.Where("channel_id = ? AND version = ?", channel.ChannelID, 2).First(&stored).Error)
+		assert.Equal(t, resized.StateHash, stored.StateHash)
+		assert.Equal(t, resized.StateData, stored.StateData)
+		assert.Equal(t, resized.BrokerSignature, stored.BrokerSignature)
+		assert.Nil(t, stored.UserSignature)
+		require.Len(t, stored.Allocations, 2)
+		assert.Equal(t, int64(600), stored.Allocations[0].Amount.Int64())
+
+		latest, err := GetLatestSignedState(db, channel.ChannelID)
+		require.NoError(t, err)
+		require.NotNil(t, latest)
+		assert.Equal(t, uint64(0), latest.Version)
+		assert.Equal(t, "0xc0", latest.TxHash)
+	})
+
+	t.Run("RecordsUserSignatureOnChain", func(t *testing.T) {
+		state, err := SignedState{
+			Intent:      resized.Intent,
+			Version:     resized.Version,
+			StateData:   resized.StateData,
+			Allocations: resized.Allocations,
+			Sigs:        []Signature{resized.BrokerSignature},
+		}.toNitrolite()
+		require.NoError(t, err)
+		encoded, err := nitrolite.EncodeState(common.HexToHash(channel.ChannelID), nitrolite.IntentRESIZE, state.Version, state.Data, state.Allocations)
+		require.NoError(t, err)
+		userSig, err := participant.NitroSign(encoded)
+		require.NoError(t, err)
+		state.Sigs = append([]nitrolite.Signature{userSig}, state.Sigs...)
+
+		require.NoError(t, recordOnChainState(db, channel.ChannelID, state, "0xc1"))
+
+		var count int64
+		require.NoError(t, db.Model(&ChannelState{}).Where("channel_id = ?", channel.ChannelID).Count(&count).Error)
+		assert.Equal(t, int64(2), count)
+
+		latest, err := GetLatestSignedState(db, channel.ChannelID)
+		require.NoError(t, err)
+		require.NotNil(t, latest)
+		assert.Equal(t, uint64(2), latest.Version)
+		assert.Equal(t, "0xc1", latest.TxHash)
+		require.NotNil(t, latest.UserSignature)
+		assert.Equal(t, newSignature(userSig), *latest.UserSignature)
+
+		signed, err := latest.signedState().toNitrolite()
+		require.NoError(t, err)
+		assert.Equal(t, state.Sigs, signed.Sigs)
+	})
+
+	t.Run("SettlesPendingStates", func(t *testing.T) {
+		channel.Version = 2
+		amounts := []*big.Int{big.NewInt(-100), big.NewInt(0)}
+		pending := signResize(amounts, allocations)
+
+		// The same state is found again instead of signing another one
+		state, err := newResizeState(channel, amounts, allocations)
+		require.NoError(t, err)
+		found, err := findPendingState(db, channel.ChannelID, state)
+		require.NoError(t, err)
+		require.NotNil(t, found)
+		assert.Equal(t, pending.ID, found.ID)
+
+		// Another state for the same version is refused, the participant could submit either of them
+		state, err = newResizeState(channel, []*big.Int{big.NewInt(-50), big.NewInt(0)}, []nitrolite.Allocation{
+			{Destination: participant.GetAddress(), Token: token, Amount: big.NewInt(550)},
+			{Destination: broker.GetAddress(), Token: token, Amount: big.NewInt(0)},
+		})
+		require.NoError(t, err)
+		require.ErrorContains(t, ReserveStateVersion(db, channel.ChannelID, 3), "a state for version 3 of channel "+channel.ChannelID+" is already signed")
+		// The unique index refuses it when concurrent requests both passed the check
+		_, err = signChannelState(db, broker, channel.ChannelID, state)
+		require.ErrorContains(t, err, "failed to store channel state")
+
+		stateStatus := func(id uint) ChannelStateStatus {
+			var stored ChannelState
+			require.NoError(t, db.First(&stored, id).Error)
+			return stored.Status
+		}
+		signFinal := func(version int64) *ChannelState {
+			final, err := signChannelState(db, broker, channel.ChannelID, nitrolite.State{
+				Intent:      uint8(nitrolite.IntentFINALIZE),
+				Version:     big.NewInt(version),
+				Data:        []byte{},
+				Allocations: allocations,
+			})
+			require.NoError(t, err)
+			return final
+		}
+		settleResize := func(version uint64, amounts []*big.Int) {
+			data, err := encodeResizeAmounts(amounts)
+			require.NoError(t, err)
+			_, err = settleResizedStates(db, channel.ChannelID, version, hexutil.Encode(data))
+			require.NoError(t, err)
+		}
+
+		// The Resized event carries the resize amounts of the state which landed
+		settleResize(3, amounts)
+		assert.Equal(t, ChannelStateStatusOnChain, stateStatus(pending.ID))
+
+		// A final state of a version the channel moved past can't be submitted anymore
+		final := signFinal(4)
+		channel.Version = 4
+		laterAmounts := []*big.Int{big.NewInt(-10), big.NewInt(0)}
+		later := signResize(laterAmounts, allocations)
+		settleResize(5, laterAmounts)
+		assert.Equal(t, ChannelStateStatusOnChain, stateStatus(later.ID))
+		assert.Equal(t, ChannelStateStatusSuperseded, stateStatus(final.ID))
+
+		// Nothing can be submitted once the channel closed
+		closing := signFinal(6)
+		_, err = settleClosedStates(db, channel.ChannelID)
+		require.NoError(t, err)
+		assert.Equal(t, ChannelStateStatusSuperseded, stateStatus(closing.ID))
+
+		require.NoError(t, db.Where("channel_id = ? AND version > ?", channel.ChannelID, 2).Delete(&ChannelState{}).Error)
+		channel.Version = 1
+	})
+
+	t.Run("GetChannelStates", func(t *testing.T) {
+		rpc := &RPCMessage{Req: &RPCData{RequestID: 1, Method: "get_channel_states", Params: []any{map[string]any{"channel_id": channel.ChannelID, "limit": 1}}}}
+		resp, err := HandleGetChannelStates(rpc, db)
+		require.NoError(t, err)
+
+		states, ok := resp.Res.Params[0].([]ChannelStateResponse)
+		require.True(t, ok)
+		require.Len(t, states, 1)
+		assert.Equal(t, uint64(2), states[0].Version)
+		assert.NotNil(t, states[0].UserSignature)
+		assert.Equal(t, ChannelStateStatusOnChain, states[0].Status)
+		page := resp.Res.Params[1].(PageInfo)
+		assert.NotEmpty(t, page.NextCursor)
+
+		rpc.Req.Params = []any{map[string]any{"channel_id": channel.ChannelID, "limit": 1, "cursor": page.NextCursor}}
+		resp, err = HandleGetChannelStates(rpc, db)
+		require.NoError(t, err)
+		states = resp.Res.Params[0].([]ChannelStateResponse)
+		require.Len(t, states, 1)
+		assert.Equal(t, uint8(nitrolite.IntentINITIALIZE), states[0].Intent)
+
+		_, err = HandleGetChannelStates(&RPCMessage{Req: &RPCData{Params: []any{}}}, db)
+		require.ErrorContains(t, err, "missing channel_id")
+	})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRejectDuplicateChannel(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	rawBroker, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	broker := &LocalSigner{privateKey: rawBroker}
+	participant := "0xParticipantDuplicate"
+	token := common.HexToAddress("0x1234567890123456789012345678901234567890")
+
+	open := Channel{
+		ChannelID:   common.HexToHash("0xa1").Hex(),
+		Participant: participant,
+		Broker:      broker.GetAddress().Hex(),
+		Status:      ChannelStatusOpen,
+		Token:       token.Hex(),
+		ChainID:     137,
+		Amount:      1000,
+	}
+	require.NoError(t, db.Create(&open).Error)
+
+	duplicateID := common.HexToHash("0xa2").Hex()
+	existing, err := CheckDuplicateChannel(db, duplicateID, participant, token.Hex(), 137)
+	require.NoError(t, err)
+	require.NotNil(t, existing)
+	assert.Equal(t, open.ChannelID, existing.ChannelID)
+
+	existing, err = CheckDuplicateChannel(db, open.ChannelID, participant, token.Hex(), 137)
+	require.NoError(t, err)
+	assert.Nil(t, existing)
+
+	duplicate, err := CreateChannel(db, duplicateID, participant, broker.GetAddress().Hex(), 2, 3600, "0xAdjudicator", 137, token.Hex(), 500)
+	require.NoError(t, err)
+	deposit := nitrolite.Allocation{Destination: common.HexToAddress("0xdead"), Token: token, Amount: big.NewInt(500)}
+	refund, err := RejectChannel(db, broker, &duplicate, deposit, "duplicate channel")
+	require.NoError(t, err)
+
+	stored, err := GetChannelByID(db, duplicateID)
+	require.NoError(t, err)
+	assert.Equal(t, ChannelStatusRejected, stored.Status)
+	assert.Equal(t, "duplicate channel", stored.Reason)
+	assert.Equal(t, uint64(3600), stored.Challenge)
+
+	// The refund state pays the deposit back and can be closed with the participant signature
+	assert.Equal(t, uint8(nitrolite.IntentFINALIZE), refund.Intent)
+	assert.Equal(t, uint64(1), refund.Version)
+	require.Len(t, refund.Allocations, 2)
+	assert.Equal(t, deposit.Destination.Hex(), refund.Allocations[0].Participant)
+	assert.Equal(t, int64(500), refund.Allocations[0].Amount.Int64())
+	assert.Equal(t, int64(0), refund.Allocations[1].Amount.Int64())
+
+	state, err := refund.signedState().toNitrolite()
+	require.NoError(t, err)
+	encoded, err := nitrolite.EncodeState(common.HexToHash(duplicateID), nitrolite.IntentFINALIZE, state.Version, state.Data, state.Allocations)
+	require.NoError(t, err)
+	assert.Equal(t, crypto.Keccak256Hash(encoded).Hex(), refund.StateHash)
+	valid, err := nitrolite.Verify(encoded, state.Sigs[0], broker.GetAddress())
+	require.NoError(t, err)
+	assert.True(t, valid)
+	assert.Equal(t, "0x", hexutil.Encode(state.Data))
+
+	// Nothing was credited for the rejected deposit
+	balances, err := GetParticipantLedger(db, participant).GetBalances(participant)
+	require.NoError(t, err)
+	assert.Empty(t, balances)
+}
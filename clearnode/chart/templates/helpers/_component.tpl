@@ -65,7 +65,7 @@ Returns component's probes
   {{- if eq $probe.type "http" }}
   httpGet:
     port: {{ $port }}
-    path: {{ default "/health" $probe.endpoint }}
+    path: {{ default "/healthz" $probe.endpoint }}
   {{- else }}
   tcpSocket:
     port: {{ $port }}
@@ -1,19 +1,31 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ilyakaznacheev/cleanenv"
 	"github.com/joho/godotenv"
+	"github.com/shopspring/decimal"
 )
 
 // knownNetworks maps network name prefixes to their respective chain IDs.
 // Each prefix is used to find corresponding environment variables:
 // - {PREFIX}_INFURA_URL: The Infura endpoint URL for the network
+// - {PREFIX}_RPC_URLS: Optional comma-separated RPC endpoints the network fails over to
+// - {PREFIX}_EVENT_INGESTION: Optional custody event ingestion mode, subscribe or poll
+// - {PREFIX}_POLL_INTERVAL, {PREFIX}_LOG_BLOCK_RANGE: Optional polling interval in seconds and largest eth_getLogs block range
 // - {PREFIX}_CUSTODY_CONTRACT_ADDRESS: The custody contract address
+// - {PREFIX}_LIQUIDITY_RESERVE_{SYMBOL}, {PREFIX}_LIQUIDITY_TARGET_{SYMBOL}: Optional broker liquidity thresholds of an asset
+// - {PREFIX}_ALLOWED_ADJUDICATORS: Optional comma-separated adjudicators of the channels the broker joins
+// - {PREFIX}_MIN_CHALLENGE_PERIOD, {PREFIX}_MAX_CHALLENGE_PERIOD: Optional bounds of the channel challenge period in seconds
+// - {PREFIX}_MIN_DEPOSIT_{SYMBOL}, {PREFIX}_MAX_DEPOSIT_{SYMBOL}: Optional bounds of the initial channel deposit of an asset
 var knownNetworks = map[string]uint32{
 	"POLYGON":     137,
 	"ETH_SEPOLIA": 11155111,
@@ -26,50 +38,48 @@ var knownNetworks = map[string]uint32{
 type NetworkConfig struct {
 	Name           string
 	ChainID        uint32
-	InfuraURL      string
+	RPCURLs        []string // In order of preference until their latency is known
 	CustodyAddress string
+	Liquidity      map[string]LiquidityThreshold // By lowercase asset symbol
+	Policy         *ChannelPolicy
+	Ingestion      IngestionConfig
 }
 
 // Config represents the overall application configuration
 type Config struct {
 	networks      map[string]*NetworkConfig
-	privateKeyHex string
+	keysConf      KeyRingConfig
 	dbConf        DatabaseConfig
 	msgExpiryTime int // Time in seconds for message timestamp validation
+	httpPort      int // Port of the HTTP/WebSocket server and its health endpoints
+	metricsPort   int // Port of the Prometheus metrics server
+
+	shutdownTimeout time.Duration // Time given to connections and listeners to drain on shutdown
+
+	messageBus             string        // Bus delivering messages across nodes, "local" or "postgres"
+	leaderElectionInterval time.Duration // Interval of leadership checks, and of takeover attempts of followers
+
+	ledgerCheckInterval time.Duration // Interval of ledger consistency checks and checkpoints
+	holdTimeout         time.Duration // Time after which holds of states never submitted on-chain are released
+	reconcileInterval   time.Duration // Interval of on-chain reconciliation runs
+	liquidityInterval   time.Duration // Interval of broker liquidity checks against the targets
+	settlementInterval  time.Duration // Interval of checks for expired challenges of broker-initiated closes
+	rpcHealthInterval   time.Duration // Interval of RPC endpoint health checks
+
+	fees   *FeeSchedule // Broker fees, nil when no fee schedule is configured
+	admins AdminSet     // Addresses allowed to call admin RPCs
 }
 
 // LoadConfig builds configuration from environment variables
 func LoadConfig() (*Config, error) {
-	var err error
-	// Load environment variables
-	if err = godotenv.Load(); err != nil {
-		log.Println("Warning: .env file not found")
+	dbConf, err := LoadDatabaseConfig()
+	if err != nil {
+		return nil, err
 	}
 
-	// Get database URL from environment variables
-	var dbConf DatabaseConfig
-	dbURL := os.Getenv("CLEARNODE_DATABASE_URL")
-
-	// If DATABASE_URL is not empty, parse the connection string
-	// Otherwise, read the envs in usual way
-	if dbURL != "" {
-		dbConf, err = ParseConnectionString(dbURL)
-		if err != nil {
-			logger.Errorw("failed to parse connection string", "err", err)
-			return nil, err
-		}
-	} else {
-		// Read db config
-		if err := cleanenv.ReadEnv(&dbConf); err != nil {
-			logger.Errorw("failed to read env", "err", err)
-			return nil, err
-		}
-	}
-
-	// Retrieve the private key.
-	privateKeyHex := os.Getenv("BROKER_PRIVATE_KEY")
-	if privateKeyHex == "" {
-		log.Println("BROKER_PRIVATE_KEY environment variable is required")
+	keysConf, err := loadKeyRingConfig()
+	if err != nil {
+		return nil, err
 	}
 
 	messageTimestampExpiry := 60
@@ -84,15 +94,47 @@ func LoadConfig() (*Config, error) {
 
 	config := Config{
 		networks:      make(map[string]*NetworkConfig),
-		privateKeyHex: privateKeyHex,
+		keysConf:      keysConf,
 		dbConf:        dbConf,
 		msgExpiryTime: messageTimestampExpiry,
+		httpPort:      getEnvInt("HTTP_PORT", 8000),
+		metricsPort:   getEnvInt("METRICS_PORT", 4242),
+
+		shutdownTimeout: time.Duration(getEnvInt("SHUTDOWN_TIMEOUT", 30)) * time.Second,
+
+		messageBus:             os.Getenv("MESSAGE_BUS"),
+		leaderElectionInterval: time.Duration(getEnvInt("LEADER_ELECTION_INTERVAL", 10)) * time.Second,
+
+		ledgerCheckInterval: time.Duration(getEnvInt("LEDGER_CHECK_INTERVAL", 600)) * time.Second,
+		holdTimeout:         time.Duration(getEnvInt("LEDGER_HOLD_TIMEOUT", 3600)) * time.Second,
+		reconcileInterval:   time.Duration(getEnvInt("RECONCILIATION_INTERVAL", 600)) * time.Second,
+		liquidityInterval:   time.Duration(getEnvInt("LIQUIDITY_CHECK_INTERVAL", 60)) * time.Second,
+		settlementInterval:  time.Duration(getEnvInt("SETTLEMENT_CHECK_INTERVAL", 60)) * time.Second,
+		rpcHealthInterval:   time.Duration(getEnvInt("RPC_HEALTH_CHECK_INTERVAL", 15)) * time.Second,
+
+		admins: ParseAdminSet(os.Getenv("ADMIN_ADDRESSES")),
+	}
+
+	// Nodes sharing a Postgres database reach each other's clients through it
+	if config.messageBus == "" {
+		config.messageBus = "local"
+		if dbConf.Driver == "postgres" {
+			config.messageBus = "postgres"
+		}
+	}
+
+	if path := os.Getenv("FEE_SCHEDULE_PATH"); path != "" {
+		fees, err := LoadFeeSchedule(path)
+		if err != nil {
+			return nil, err
+		}
+		config.fees = fees
+		log.Printf("Loaded %d fee rules from %s", len(fees.Rules), path)
 	}
 
 	// Process each network
 	envs := os.Environ()
 	for network, chainID := range knownNetworks {
-		infuraURL := ""
 		custodyAddress := ""
 
 		// Look for matching environment variables
@@ -105,24 +147,377 @@ func LoadConfig() (*Config, error) {
 			key := parts[0]
 			value := parts[1]
 
-			if strings.HasPrefix(key, network+"_INFURA_URL") {
-				infuraURL = value
-			} else if strings.HasPrefix(key, network+"_CUSTODY_CONTRACT_ADDRESS") {
+			if strings.HasPrefix(key, network+"_CUSTODY_CONTRACT_ADDRESS") {
 				custodyAddress = value
 			}
 		}
 
-		// Only add network if both required variables are present
-		if infuraURL != "" && custodyAddress != "" {
+		// Only add network if both an endpoint and the custody address are present
+		rpcURLs := loadRPCURLs(network, envs)
+		if len(rpcURLs) > 0 && custodyAddress != "" {
+			liquidity, err := loadLiquidityThresholds(network, envs)
+			if err != nil {
+				return nil, err
+			}
+
+			policy, err := loadChannelPolicy(network, envs)
+			if err != nil {
+				return nil, err
+			}
+
+			ingestion, err := loadIngestionConfig(network, envs, rpcURLs)
+			if err != nil {
+				return nil, err
+			}
+
 			networkLower := strings.ToLower(network)
 			config.networks[networkLower] = &NetworkConfig{
 				Name:           networkLower,
 				ChainID:        chainID,
-				InfuraURL:      infuraURL,
+				RPCURLs:        rpcURLs,
 				CustodyAddress: custodyAddress,
+				Liquidity:      liquidity,
+				Policy:         policy,
+				Ingestion:      ingestion,
 			}
 		}
 	}
 
 	return &config, nil
 }
+
+// loadRPCURLs reads the RPC endpoints of a network: {PREFIX}_INFURA_URL first, then the comma-separated
+// {PREFIX}_RPC_URLS
+func loadRPCURLs(network string, envs []string) []string {
+	var primary, fallbacks []string
+	for _, env := range envs {
+		key, value, ok := strings.Cut(env, "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case network + "_INFURA_URL":
+			if value != "" {
+				primary = append(primary, value)
+			}
+		case network + "_RPC_URLS":
+			for _, u := range strings.Split(value, ",") {
+				if u = strings.TrimSpace(u); u != "" {
+					fallbacks = append(fallbacks, u)
+				}
+			}
+		}
+	}
+
+	urls := primary
+	for _, u := range fallbacks {
+		if !slices.Contains(urls, u) {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// loadIngestionConfig reads how the custody events of a network are read. Events are polled by default
+// unless an endpoint is a WebSocket one, as subscriptions don't work over HTTP.
+func loadIngestionConfig(network string, envs []string, rpcURLs []string) (IngestionConfig, error) {
+	ingestion := IngestionConfig{
+		Mode:          EventIngestionPoll,
+		PollInterval:  5 * time.Second,
+		MaxBlockRange: 1000,
+	}
+	for _, u := range rpcURLs {
+		if strings.HasPrefix(u, "ws://") || strings.HasPrefix(u, "wss://") {
+			ingestion.Mode = EventIngestionSubscribe
+		}
+	}
+
+	for _, env := range envs {
+		key, value, ok := strings.Cut(env, "=")
+		if !ok {
+			continue
+		}
+
+		switch key {
+		case network + "_EVENT_INGESTION":
+			mode := EventIngestion(strings.ToLower(value))
+			if mode != EventIngestionSubscribe && mode != EventIngestionPoll {
+				return IngestionConfig{}, fmt.Errorf("invalid %s: must be %s or %s", key, EventIngestionSubscribe, EventIngestionPoll)
+			}
+			ingestion.Mode = mode
+		case network + "_POLL_INTERVAL":
+			seconds, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || seconds == 0 {
+				return IngestionConfig{}, fmt.Errorf("invalid %s: must be a positive number of seconds", key)
+			}
+			ingestion.PollInterval = time.Duration(seconds) * time.Second
+		case network + "_LOG_BLOCK_RANGE":
+			blocks, err := strconv.ParseUint(value, 10, 64)
+			if err != nil || blocks == 0 {
+				return IngestionConfig{}, fmt.Errorf("invalid %s: must be a positive number of blocks", key)
+			}
+			ingestion.MaxBlockRange = blocks
+		}
+	}
+	return ingestion, nil
+}
+
+// loadLiquidityThresholds reads the liquidity reserves and targets of a network's assets.
+// The target defaults to the reserve, so that an alert is raised before allocations start failing.
+func loadLiquidityThresholds(network string, envs []string) (map[string]LiquidityThreshold, error) {
+	thresholds := map[string]LiquidityThreshold{}
+	reservePrefix := network + "_LIQUIDITY_RESERVE_"
+	targetPrefix := network + "_LIQUIDITY_TARGET_"
+	targets := map[string]bool{}
+
+	for _, env := range envs {
+		key, value, ok := strings.Cut(env, "=")
+		if !ok {
+			continue
+		}
+
+		var symbol string
+		isTarget := false
+		switch {
+		case strings.HasPrefix(key, reservePrefix):
+			symbol = strings.ToLower(strings.TrimPrefix(key, reservePrefix))
+		case strings.HasPrefix(key, targetPrefix):
+			symbol = strings.ToLower(strings.TrimPrefix(key, targetPrefix))
+			isTarget = true
+		default:
+			continue
+		}
+
+		amount, err := decimal.NewFromString(value)
+		if err != nil || amount.IsNegative() {
+			return nil, fmt.Errorf("invalid %s: must be a non-negative amount", key)
+		}
+
+		threshold := thresholds[symbol]
+		if isTarget {
+			threshold.Target = amount
+			targets[symbol] = true
+		} else {
+			threshold.Reserve = amount
+		}
+		thresholds[symbol] = threshold
+	}
+
+	for symbol, threshold := range thresholds {
+		if !targets[symbol] {
+			threshold.Target = threshold.Reserve
+			thresholds[symbol] = threshold
+		}
+	}
+	return thresholds, nil
+}
+
+// loadChannelPolicy reads the policy of the channels the broker joins on a network
+func loadChannelPolicy(network string, envs []string) (*ChannelPolicy, error) {
+	policy := NewChannelPolicy()
+	minDepositPrefix := network + "_MIN_DEPOSIT_"
+	maxDepositPrefix := network + "_MAX_DEPOSIT_"
+
+	for _, env := range envs {
+		key, value, ok := strings.Cut(env, "=")
+		if !ok {
+			continue
+		}
+
+		switch {
+		case key == network+"_ALLOWED_ADJUDICATORS":
+			for _, addr := range strings.Split(value, ",") {
+				addr = strings.TrimSpace(addr)
+				if addr == "" {
+					continue
+				}
+				if !common.IsHexAddress(addr) {
+					return nil, fmt.Errorf("invalid %s: %s is not an address", key, addr)
+				}
+				policy.Adjudicators[strings.ToLower(addr)] = true
+			}
+		case key == network+"_MIN_CHALLENGE_PERIOD", key == network+"_MAX_CHALLENGE_PERIOD":
+			seconds, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s: must be a number of seconds", key)
+			}
+			if key == network+"_MIN_CHALLENGE_PERIOD" {
+				policy.MinChallenge = seconds
+			} else {
+				policy.MaxChallenge = seconds
+			}
+		case strings.HasPrefix(key, minDepositPrefix), strings.HasPrefix(key, maxDepositPrefix):
+			amount, err := decimal.NewFromString(value)
+			if err != nil || amount.IsNegative() {
+				return nil, fmt.Errorf("invalid %s: must be a non-negative amount", key)
+			}
+			symbol, isMin := strings.CutPrefix(key, minDepositPrefix)
+			if !isMin {
+				symbol = strings.TrimPrefix(key, maxDepositPrefix)
+			}
+			symbol = strings.ToLower(symbol)
+			limits := policy.Deposits[symbol]
+			if isMin {
+				limits.Min = amount
+			} else {
+				limits.Max = amount
+			}
+			policy.Deposits[symbol] = limits
+		}
+	}
+
+	if policy.MaxChallenge > 0 && policy.MaxChallenge < policy.MinChallenge {
+		return nil, fmt.Errorf("invalid %s_MAX_CHALLENGE_PERIOD: below the minimum of %ds", network, policy.MinChallenge)
+	}
+	for symbol, limits := range policy.Deposits {
+		if limits.Max.IsPositive() && limits.Max.LessThan(limits.Min) {
+			return nil, fmt.Errorf("invalid %s_MAX_DEPOSIT_%s: below the minimum of %s", network, strings.ToUpper(symbol), limits.Min)
+		}
+	}
+	if len(policy.Adjudicators) == 0 {
+		log.Printf("WARNING: %s_ALLOWED_ADJUDICATORS is not set, channels with any adjudicator are joined", network)
+	}
+	return policy, nil
+}
+
+// KeyRingConfig represents the active broker key and the legacy keys kept for key rotation
+type KeyRingConfig struct {
+	Active      SignerConfig
+	ActivatedAt *time.Time
+	Legacy      []LegacyKeyConfig
+}
+
+// LegacyKeyConfig represents a rotated broker key which is still honored for existing channels
+type LegacyKeyConfig struct {
+	SignerConfig
+	RetiresAt *time.Time
+}
+
+// LoadDatabaseConfig reads the database configuration from environment variables
+func LoadDatabaseConfig() (DatabaseConfig, error) {
+	var err error
+	// Load environment variables
+	if err = godotenv.Load(); err != nil {
+		log.Println("Warning: .env file not found")
+	}
+
+	// Get database URL from environment variables
+	var dbConf DatabaseConfig
+	dbURL := os.Getenv("CLEARNODE_DATABASE_URL")
+
+	// If DATABASE_URL is not empty, parse the connection string
+	// Otherwise, read the envs in usual way
+	if dbURL != "" {
+		dbConf, err = ParseConnectionString(dbURL)
+		if err != nil {
+			logger.Errorw("failed to parse connection string", "err", err)
+			return DatabaseConfig{}, err
+		}
+	} else {
+		// Read db config
+		if err := cleanenv.ReadEnv(&dbConf); err != nil {
+			logger.Errorw("failed to read env", "err", err)
+			return DatabaseConfig{}, err
+		}
+	}
+	return dbConf, nil
+}
+
+// loadKeyRingConfig reads the broker keys from environment variables.
+// The active key is configured with the BROKER prefix and optionally BROKER_ACTIVATED_AT (RFC3339).
+// Legacy keys use the BROKER_LEGACY_{N} prefix, numbered from 1, and optionally BROKER_LEGACY_{N}_RETIRES_AT (RFC3339).
+func loadKeyRingConfig() (KeyRingConfig, error) {
+	cnf := KeyRingConfig{
+		Active: loadSignerConfig("BROKER"),
+	}
+
+	activatedAt, err := parseOptionalTime("BROKER_ACTIVATED_AT")
+	if err != nil {
+		return KeyRingConfig{}, err
+	}
+	cnf.ActivatedAt = activatedAt
+
+	for i := 1; ; i++ {
+		prefix := fmt.Sprintf("BROKER_LEGACY_%d", i)
+		if os.Getenv(prefix+"_SIGNER_TYPE") == "" && os.Getenv(prefix+"_PRIVATE_KEY") == "" {
+			break
+		}
+
+		retiresAt, err := parseOptionalTime(prefix + "_RETIRES_AT")
+		if err != nil {
+			return KeyRingConfig{}, err
+		}
+		cnf.Legacy = append(cnf.Legacy, LegacyKeyConfig{
+			SignerConfig: loadSignerConfig(prefix),
+			RetiresAt:    retiresAt,
+		})
+	}
+
+	return cnf, nil
+}
+
+// getEnvInt reads a positive integer from an environment variable, falling back to the default value
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed <= 0 {
+		log.Printf("Invalid %s, using default value %d", key, defaultValue)
+		return defaultValue
+	}
+	return parsed
+}
+
+// parseOptionalTime reads an optional RFC3339 timestamp from an environment variable
+func parseOptionalTime(key string) (*time.Time, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", key, err)
+	}
+	return &t, nil
+}
+
+// loadSignerConfig reads the signer backend settings from environment variables with the given prefix:
+// - {PREFIX}_SIGNER_TYPE: local (default), keystore or remote
+// - {PREFIX}_PRIVATE_KEY: hex-encoded private key for the local signer
+// - {PREFIX}_KEYSTORE_PATH, {PREFIX}_KEYSTORE_PASSPHRASE: geth keystore JSON file and its passphrase
+// - {PREFIX}_REMOTE_SIGNER_URL, {PREFIX}_REMOTE_SIGNER_ADDRESS, {PREFIX}_REMOTE_SIGNER_TOKEN: remote signing service
+func loadSignerConfig(prefix string) SignerConfig {
+	cnf := SignerConfig{
+		Type:               strings.ToLower(os.Getenv(prefix + "_SIGNER_TYPE")),
+		PrivateKeyHex:      os.Getenv(prefix + "_PRIVATE_KEY"),
+		KeystorePath:       os.Getenv(prefix + "_KEYSTORE_PATH"),
+		KeystorePassphrase: os.Getenv(prefix + "_KEYSTORE_PASSPHRASE"),
+		RemoteURL:          os.Getenv(prefix + "_REMOTE_SIGNER_URL"),
+		RemoteAddress:      os.Getenv(prefix + "_REMOTE_SIGNER_ADDRESS"),
+		RemoteToken:        os.Getenv(prefix + "_REMOTE_SIGNER_TOKEN"),
+	}
+	if cnf.Type == "" {
+		cnf.Type = SignerTypeLocal
+	}
+
+	switch cnf.Type {
+	case SignerTypeLocal:
+		if cnf.PrivateKeyHex == "" {
+			log.Printf("%s_PRIVATE_KEY environment variable is required", prefix)
+		}
+	case SignerTypeKeystore:
+		if cnf.KeystorePath == "" {
+			log.Printf("%s_KEYSTORE_PATH environment variable is required", prefix)
+		}
+	case SignerTypeRemote:
+		if cnf.RemoteURL == "" || cnf.RemoteAddress == "" {
+			log.Printf("%s_REMOTE_SIGNER_URL and %s_REMOTE_SIGNER_ADDRESS environment variables are required", prefix, prefix)
+		}
+	}
+
+	return cnf
+}
@@ -0,0 +1,19 @@
+-- +goose Up
+ALTER TABLE channels ADD COLUMN broker VARCHAR NOT NULL DEFAULT '';
+
+-- Channels created before key rotation was supported were opened with the original broker key,
+-- which the server passes to migrations as clearnode.channel_broker
+-- +goose StatementBegin
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM channels WHERE broker = '') THEN
+        IF COALESCE(current_setting('clearnode.channel_broker', true), '') = '' THEN
+            RAISE EXCEPTION 'channels without a broker key: run the migration from the server with the broker keys configured';
+        END IF;
+        UPDATE channels SET broker = current_setting('clearnode.channel_broker', true) WHERE broker = '';
+    END IF;
+END $$;
+-- +goose StatementEnd
+
+-- +goose Down
+ALTER TABLE channels DROP COLUMN broker;
@@ -0,0 +1,10 @@
+-- +goose Up
+ALTER TABLE ledger ADD COLUMN tx_id VARCHAR NOT NULL DEFAULT '';
+CREATE INDEX idx_ledger_tx_id ON ledger (tx_id);
+
+-- Entries written before the chart of accounts was applied are all participant or app session balances
+UPDATE ledger SET account_type = 2000 WHERE account_type = 0;
+
+-- +goose Down
+DROP INDEX idx_ledger_tx_id;
+ALTER TABLE ledger DROP COLUMN tx_id;
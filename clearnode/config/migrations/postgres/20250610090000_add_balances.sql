@@ -0,0 +1,36 @@
+-- +goose Up
+CREATE TABLE balances (
+    account_id VARCHAR NOT NULL,
+    participant VARCHAR NOT NULL,
+    asset_symbol VARCHAR NOT NULL,
+    account_type BIGINT NOT NULL,
+    amount DECIMAL(64,18) NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (account_id, participant, asset_symbol)
+);
+
+INSERT INTO balances (account_id, participant, asset_symbol, account_type, amount)
+SELECT account_id, participant, asset_symbol, MAX(account_type), COALESCE(SUM(credit),0) - COALESCE(SUM(debit),0)
+FROM ledger
+GROUP BY account_id, participant, asset_symbol;
+
+CREATE TABLE ledger_checkpoints (
+    id SERIAL PRIMARY KEY,
+    last_entry_id BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE ledger_checkpoint_balances (
+    checkpoint_id BIGINT NOT NULL REFERENCES ledger_checkpoints (id) ON DELETE CASCADE,
+    account_id VARCHAR NOT NULL,
+    participant VARCHAR NOT NULL,
+    asset_symbol VARCHAR NOT NULL,
+    account_type BIGINT NOT NULL,
+    amount DECIMAL(64,18) NOT NULL,
+    PRIMARY KEY (checkpoint_id, account_id, participant, asset_symbol)
+);
+
+-- +goose Down
+DROP TABLE ledger_checkpoint_balances;
+DROP TABLE ledger_checkpoints;
+DROP TABLE balances;
@@ -0,0 +1,19 @@
+-- +goose Up
+CREATE TABLE ledger_holds (
+    id SERIAL PRIMARY KEY,
+    channel_id VARCHAR NOT NULL,
+    account_id VARCHAR NOT NULL,
+    participant VARCHAR NOT NULL,
+    asset_symbol VARCHAR NOT NULL,
+    amount DECIMAL(64,18) NOT NULL,
+    status VARCHAR NOT NULL,
+    version BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_ledger_holds_channel_id ON ledger_holds(channel_id);
+CREATE INDEX idx_ledger_holds_account ON ledger_holds(account_id, participant, asset_symbol);
+
+-- +goose Down
+DROP TABLE ledger_holds;
@@ -0,0 +1,11 @@
+-- +goose Up
+ALTER TABLE ledger ADD COLUMN reference_type VARCHAR NOT NULL DEFAULT '';
+ALTER TABLE ledger ADD COLUMN reference VARCHAR NOT NULL DEFAULT '';
+ALTER TABLE ledger ADD COLUMN memo VARCHAR NOT NULL DEFAULT '';
+CREATE INDEX idx_ledger_reference ON ledger (reference);
+
+-- +goose Down
+DROP INDEX idx_ledger_reference;
+ALTER TABLE ledger DROP COLUMN memo;
+ALTER TABLE ledger DROP COLUMN reference;
+ALTER TABLE ledger DROP COLUMN reference_type;
@@ -0,0 +1,44 @@
+-- +goose Up
+CREATE TABLE reconciliation_runs (
+    id SERIAL PRIMARY KEY,
+    status VARCHAR NOT NULL,
+    discrepancies BIGINT NOT NULL DEFAULT 0,
+    error VARCHAR NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_reconciliation_runs_created_at ON reconciliation_runs(created_at);
+
+CREATE TABLE reconciliation_balances (
+    id SERIAL PRIMARY KEY,
+    run_id BIGINT NOT NULL REFERENCES reconciliation_runs (id) ON DELETE CASCADE,
+    chain_id BIGINT NOT NULL,
+    token VARCHAR NOT NULL,
+    asset_symbol VARCHAR NOT NULL,
+    broker_available DECIMAL(64,18) NOT NULL,
+    channel_count BIGINT NOT NULL,
+    open_channels BIGINT NOT NULL,
+    channel_amount DECIMAL(64,18) NOT NULL,
+    custody_amount DECIMAL(64,18) NOT NULL
+);
+
+CREATE INDEX idx_reconciliation_balances_run_id ON reconciliation_balances(run_id);
+
+CREATE TABLE reconciliation_discrepancies (
+    id SERIAL PRIMARY KEY,
+    run_id BIGINT NOT NULL REFERENCES reconciliation_runs (id) ON DELETE CASCADE,
+    kind VARCHAR NOT NULL,
+    chain_id BIGINT NOT NULL DEFAULT 0,
+    token VARCHAR NOT NULL DEFAULT '',
+    asset_symbol VARCHAR NOT NULL DEFAULT '',
+    channel_id VARCHAR NOT NULL DEFAULT '',
+    expected VARCHAR NOT NULL DEFAULT '',
+    actual VARCHAR NOT NULL DEFAULT ''
+);
+
+CREATE INDEX idx_reconciliation_discrepancies_run_id ON reconciliation_discrepancies(run_id);
+
+-- +goose Down
+DROP TABLE reconciliation_discrepancies;
+DROP TABLE reconciliation_balances;
+DROP TABLE reconciliation_runs;
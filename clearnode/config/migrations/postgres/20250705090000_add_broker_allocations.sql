@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE ledger_holds ADD COLUMN broker_allocation DECIMAL(64,18) NOT NULL DEFAULT 0;
+
+-- +goose Down
+ALTER TABLE ledger_holds DROP COLUMN broker_allocation;
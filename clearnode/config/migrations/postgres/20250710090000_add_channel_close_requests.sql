@@ -0,0 +1,21 @@
+-- +goose Up
+CREATE TABLE channel_close_requests (
+    id SERIAL PRIMARY KEY,
+    channel_id VARCHAR NOT NULL,
+    chain_id BIGINT NOT NULL,
+    participant VARCHAR NOT NULL,
+    mode VARCHAR NOT NULL,
+    status VARCHAR NOT NULL,
+    requested_by VARCHAR NOT NULL,
+    state TEXT NOT NULL,
+    tx_hash VARCHAR NOT NULL DEFAULT '',
+    challenge_expires_at TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_channel_close_requests_channel_id ON channel_close_requests(channel_id);
+CREATE INDEX idx_channel_close_requests_status ON channel_close_requests(status);
+
+-- +goose Down
+DROP TABLE channel_close_requests;
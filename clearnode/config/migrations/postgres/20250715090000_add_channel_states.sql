@@ -0,0 +1,21 @@
+-- +goose Up
+CREATE TABLE channel_states (
+    id SERIAL PRIMARY KEY,
+    channel_id VARCHAR NOT NULL,
+    version BIGINT NOT NULL,
+    intent SMALLINT NOT NULL,
+    state_data VARCHAR NOT NULL,
+    allocations TEXT NOT NULL,
+    state_hash VARCHAR NOT NULL,
+    broker_signature TEXT NOT NULL,
+    user_signature TEXT,
+    tx_hash VARCHAR NOT NULL DEFAULT '',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_channel_states_channel_version ON channel_states(channel_id, version);
+CREATE INDEX idx_channel_states_state_hash ON channel_states(state_hash);
+
+-- +goose Down
+DROP TABLE channel_states;
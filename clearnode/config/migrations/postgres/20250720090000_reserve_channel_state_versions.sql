@@ -0,0 +1,28 @@
+-- +goose Up
+ALTER TABLE channel_states ADD COLUMN status VARCHAR NOT NULL DEFAULT 'pending';
+
+UPDATE channel_states SET status = 'on_chain' WHERE user_signature IS NOT NULL;
+
+-- Of the states signed for the same version, only the one which landed or else the latest stays valid
+UPDATE channel_states SET status = 'superseded'
+WHERE status = 'pending' AND EXISTS (
+    SELECT 1 FROM channel_states other
+    WHERE other.channel_id = channel_states.channel_id
+      AND other.version = channel_states.version
+      AND (other.status = 'on_chain' OR other.id > channel_states.id)
+);
+
+-- States the channel moved past can't be submitted anymore
+UPDATE channel_states SET status = 'superseded'
+WHERE status = 'pending' AND version <= (
+    SELECT channels.version FROM channels WHERE channels.channel_id = channel_states.channel_id
+);
+
+DROP INDEX idx_channel_states_channel_version;
+CREATE UNIQUE INDEX idx_channel_states_channel_version ON channel_states(channel_id, version) WHERE status <> 'superseded';
+
+-- +goose Down
+DROP INDEX idx_channel_states_channel_version;
+CREATE INDEX idx_channel_states_channel_version ON channel_states(channel_id, version);
+
+ALTER TABLE channel_states DROP COLUMN status;
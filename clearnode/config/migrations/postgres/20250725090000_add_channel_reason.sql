@@ -0,0 +1,5 @@
+-- +goose Up
+ALTER TABLE channels ADD COLUMN reason VARCHAR NOT NULL DEFAULT '';
+
+-- +goose Down
+ALTER TABLE channels DROP COLUMN reason;
@@ -0,0 +1,23 @@
+-- +goose Up
+CREATE TABLE event_cursors (
+    chain_id BIGINT NOT NULL,
+    contract_address VARCHAR NOT NULL,
+    block_number BIGINT NOT NULL,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (chain_id, contract_address)
+);
+
+CREATE TABLE processed_events (
+    id SERIAL PRIMARY KEY,
+    chain_id BIGINT NOT NULL,
+    tx_hash VARCHAR NOT NULL,
+    log_index INTEGER NOT NULL,
+    block_number BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE UNIQUE INDEX idx_processed_events_log ON processed_events(chain_id, tx_hash, log_index);
+
+-- +goose Down
+DROP TABLE processed_events;
+DROP TABLE event_cursors;
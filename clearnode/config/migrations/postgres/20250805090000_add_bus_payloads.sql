@@ -0,0 +1,11 @@
+-- +goose Up
+CREATE TABLE bus_payloads (
+    id BIGSERIAL PRIMARY KEY,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX idx_bus_payloads_created_at ON bus_payloads(created_at);
+
+-- +goose Down
+DROP TABLE bus_payloads;
@@ -0,0 +1,16 @@
+-- +goose Up
+ALTER TABLE ledger_holds ADD COLUMN channel_state_id BIGINT NOT NULL DEFAULT 0;
+
+-- Holds were placed for the valid state of their version, if it was stored
+UPDATE ledger_holds SET channel_state_id = COALESCE((
+    SELECT channel_states.id FROM channel_states
+    WHERE channel_states.channel_id = ledger_holds.channel_id
+      AND channel_states.version = ledger_holds.version
+      AND channel_states.status <> 'superseded'
+), 0);
+
+CREATE INDEX idx_ledger_holds_channel_state_id ON ledger_holds(channel_state_id);
+
+-- +goose Down
+DROP INDEX idx_ledger_holds_channel_state_id;
+ALTER TABLE ledger_holds DROP COLUMN channel_state_id;
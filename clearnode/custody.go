@@ -6,14 +6,17 @@ import (
 	"fmt"
 	"log"
 	"math/big"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/core/types"
-	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/shopspring/decimal"
 	"gorm.io/gorm"
@@ -25,93 +28,434 @@ var (
 
 // Custody implements the BlockchainClient interface using the Custody contract
 type Custody struct {
-	client            *ethclient.Client
+	client            ChainBackend
 	custody           *nitrolite.Custody
 	db                *gorm.DB
 	custodyAddr       common.Address
-	transactOpts      *bind.TransactOpts
+	transactOpts      map[common.Address]*bind.TransactOpts
+	transactOptsMu    sync.Mutex
 	chainID           uint32
-	signer            *Signer
+	keys              *KeyRing
+	policy            *ChannelPolicy
+	ingestion         IngestionConfig
+	status            ListenerStatus
+	statusMu          sync.RWMutex
 	sendBalanceUpdate func(string)
 	sendChannelUpdate func(Channel)
 }
 
-// NewCustody initializes the Ethereum client and custody contract wrapper.
-func NewCustody(signer *Signer, db *gorm.DB, sendBalanceUpdate func(string), sendChannelUpdate func(Channel), infuraURL, custodyAddressStr string, chain uint32) (*Custody, error) {
+// NewCustody initializes the custody contract wrapper on a chain backend.
+func NewCustody(client ChainBackend, keys *KeyRing, db *gorm.DB, policy *ChannelPolicy, ingestion IngestionConfig, sendBalanceUpdate func(string), sendChannelUpdate func(Channel), custodyAddressStr string, chain uint32) (*Custody, error) {
 	custodyAddress := common.HexToAddress(custodyAddressStr)
-	client, err := ethclient.Dial(infuraURL)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to Ethereum node: %w", err)
-	}
-
 	chainID, err := client.ChainID(context.Background())
 	if err != nil {
 		return nil, fmt.Errorf("failed to get chain ID: %w", err)
 	}
 
-	// Create auth options for transactions.
-	auth, err := bind.NewKeyedTransactorWithChainID(signer.GetPrivateKey(), chainID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create transaction signer: %w", err)
-	}
-	auth.GasPrice = big.NewInt(30000000000) // 20 gwei.
-	auth.GasLimit = uint64(3000000)
-
 	custody, err := nitrolite.NewCustody(custodyAddress, client)
 	if err != nil {
 		return nil, fmt.Errorf("failed to bind custody contract: %w", err)
 	}
 
-	return &Custody{
+	c := &Custody{
 		client:            client,
 		custody:           custody,
 		db:                db,
 		custodyAddr:       custodyAddress,
-		transactOpts:      auth,
+		transactOpts:      make(map[common.Address]*bind.TransactOpts),
 		chainID:           uint32(chainID.Int64()),
-		signer:            signer,
+		keys:              keys,
+		policy:            policy,
+		ingestion:         ingestion,
+		status:            ListenerStatus{State: ListenerStateStandby},
 		sendBalanceUpdate: sendBalanceUpdate,
 		sendChannelUpdate: sendChannelUpdate,
-	}, nil
+	}
+
+	// Create auth options for transactions with every honored broker key.
+	for _, signer := range keys.Signers() {
+		if _, err := c.transactor(signer); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// transactor returns transaction options for the given broker key, creating them on first use
+func (c *Custody) transactor(signer Signer) (*bind.TransactOpts, error) {
+	c.transactOptsMu.Lock()
+	defer c.transactOptsMu.Unlock()
+
+	if auth, ok := c.transactOpts[signer.GetAddress()]; ok {
+		return auth, nil
+	}
+
+	auth, err := signer.NewTransactor(big.NewInt(int64(c.chainID)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create transaction signer: %w", err)
+	}
+	auth.GasPrice = big.NewInt(30000000000) // 20 gwei.
+	auth.GasLimit = uint64(3000000)
+
+	c.transactOpts[signer.GetAddress()] = auth
+	return auth, nil
 }
 
-// ListenEvents initializes event listening for the custody contract
+// ListenEvents reads the events of the custody contract from the last block with processed events,
+// until the context is cancelled
 func (c *Custody) ListenEvents(ctx context.Context) {
-	// TODO: store processed events in a database
-	listenEvents(ctx, c.client, c.custodyAddr, c.chainID, 0, c.handleBlockChainEvent)
+	lastBlock, err := GetEventCursor(c.db, c.chainID, c.custodyAddr.Hex())
+	if err != nil {
+		log.Printf("Failed to get the event cursor of chain %d, reading new events only: %v", c.chainID, err)
+	}
+	c.setLastBlock(lastBlock)
+	ingestEvents(ctx, c.client, c.custodyAddr, c.chainID, lastBlock, c.ingestion, c.processEvent, c)
+}
+
+// processEvent handles a custody contract event once, events read again after a restart or
+// by the backfill of a new subscription are skipped. An event whose handling fails is left unmarked,
+// so that it is read again.
+func (c *Custody) processEvent(l types.Log) error {
+	processed, err := IsEventProcessed(c.db, c.chainID, l)
+	if err != nil {
+		return fmt.Errorf("failed to check event %s:%d of chain %d: %w", l.TxHash.Hex(), l.Index, c.chainID, err)
+	}
+	if processed {
+		return nil
+	}
+
+	if err := c.handleBlockChainEvent(l); err != nil && !errors.Is(err, ErrEventProcessed) {
+		return fmt.Errorf("failed to handle event %s:%d of chain %d: %w", l.TxHash.Hex(), l.Index, c.chainID, err)
+	}
+	c.setLastBlock(l.BlockNumber)
+	return nil
+}
+
+// markProcessed records an event in the transaction of its handling
+func (c *Custody) markProcessed(tx *gorm.DB, l types.Log) error {
+	return MarkEventProcessed(tx, c.chainID, c.custodyAddr.Hex(), l)
+}
+
+// skipEvent records an event which is not handled, e.g. one of another broker, so that it isn't read again
+func (c *Custody) skipEvent(l types.Log) error {
+	return c.markProcessed(c.db, l)
+}
+
+// SaveCursor records that the events of the custody contract were all handled up to a block
+func (c *Custody) SaveCursor(blockNumber uint64) {
+	if err := SaveEventCursor(c.db, c.chainID, c.custodyAddr.Hex(), blockNumber); err != nil {
+		log.Printf("Failed to save the event cursor of chain %d: %v", c.chainID, err)
+		return
+	}
+	c.setLastBlock(blockNumber)
+}
+
+// SetState records the state of the events listener
+func (c *Custody) SetState(state ListenerState) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	c.status.State = state
 }
 
-// Join calls the join method on the custody contract
-func (c *Custody) Join(channelID string, lastStateData []byte) error {
+// SetHeadBlock records the head block last seen by the events listener
+func (c *Custody) SetHeadBlock(blockNumber uint64) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	c.status.HeadBlock = max(c.status.HeadBlock, blockNumber)
+}
+
+func (c *Custody) setLastBlock(blockNumber uint64) {
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	c.status.LastBlock = max(c.status.LastBlock, blockNumber)
+}
+
+// Status returns the progress of the events listener
+func (c *Custody) Status() ListenerStatus {
+	c.statusMu.RLock()
+	defer c.statusMu.RUnlock()
+	return c.status
+}
+
+// Join calls the join method on the custody contract with the broker key the channel was opened with,
+// and returns the broker signature of the initial state
+func (c *Custody) Join(channelID string, broker string, lastStateData []byte) (nitrolite.Signature, error) {
 	// Convert string channelID to bytes32
 	channelIDBytes := common.HexToHash(channelID)
 
 	// The broker will always join as participant with index 1 (second participant)
 	index := big.NewInt(1)
 
-	sig, err := c.signer.NitroSign(lastStateData)
+	signer, err := c.keys.Get(broker)
 	if err != nil {
-		return fmt.Errorf("failed to sign data: %w", err)
+		return nitrolite.Signature{}, err
+	}
+
+	sig, err := signer.NitroSign(lastStateData)
+	if err != nil {
+		return nitrolite.Signature{}, fmt.Errorf("failed to sign data: %w", err)
+	}
+
+	auth, err := c.transactor(signer)
+	if err != nil {
+		return nitrolite.Signature{}, err
 	}
 
 	gasPrice, err := c.client.SuggestGasPrice(context.Background())
 	if err != nil {
-		return fmt.Errorf("failed to suggest gas price: %w", err)
+		return nitrolite.Signature{}, fmt.Errorf("failed to suggest gas price: %w", err)
 	}
 
-	c.transactOpts.GasPrice = gasPrice.Add(gasPrice, gasPrice)
+	c.transactOptsMu.Lock()
+	defer c.transactOptsMu.Unlock()
+
+	auth.GasPrice = gasPrice.Add(gasPrice, gasPrice)
 	// Call the join method on the custody contract
-	tx, err := c.custody.Join(c.transactOpts, channelIDBytes, index, sig)
+	tx, err := c.custody.Join(auth, channelIDBytes, index, sig)
 	if err != nil {
-		return fmt.Errorf("failed to join channel: %w", err)
+		return nitrolite.Signature{}, fmt.Errorf("failed to join channel: %w", err)
 	}
 	log.Println("TxHash:", tx.Hash().Hex())
 
+	return sig, nil
+}
+
+// erc20ApproveAbi is the part of the ERC20 interface needed to let the custody contract pull broker deposits
+const erc20ApproveAbi = `[{"type":"function","name":"approve","stateMutability":"nonpayable","inputs":[{"name":"spender","type":"address"},{"name":"amount","type":"uint256"}],"outputs":[{"name":"","type":"bool"}]}]`
+
+// DepositFunds deposits funds of the active broker key into the custody contract, after approving the transfer of an ERC20 token
+func (c *Custody) DepositFunds(ctx context.Context, token common.Address, amount *big.Int) (common.Hash, error) {
+	signer := c.keys.Active()
+	auth, err := c.transactor(signer)
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	gasPrice, err := c.client.SuggestGasPrice(ctx)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("failed to suggest gas price: %w", err)
+	}
+
+	erc20, err := abi.JSON(strings.NewReader(erc20ApproveAbi))
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("failed to parse ERC20 ABI: %w", err)
+	}
+
+	c.transactOptsMu.Lock()
+	defer c.transactOptsMu.Unlock()
+
+	auth.GasPrice = gasPrice.Add(gasPrice, gasPrice)
+	if token == NativeTokenAddress {
+		// The native token is sent along with the deposit call, the transact options are shared
+		auth.Value = amount
+		defer func() { auth.Value = nil }()
+	} else {
+		approveTx, err := bind.NewBoundContract(token, erc20, c.client, c.client, c.client).Transact(auth, "approve", c.custodyAddr, amount)
+		if err != nil {
+			return common.Hash{}, fmt.Errorf("failed to approve token transfer: %w", err)
+		}
+		if _, err := bind.WaitMined(ctx, c.client, approveTx); err != nil {
+			return common.Hash{}, fmt.Errorf("failed to wait for approval: %w", err)
+		}
+	}
+
+	tx, err := c.custody.Deposit(auth, token, amount)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("failed to deposit: %w", err)
+	}
+	log.Printf("Deposited %s of token %s on chain %d, TxHash: %s", amount, token.Hex(), c.chainID, tx.Hash().Hex())
+	return tx.Hash(), nil
+}
+
+// WithdrawFunds withdraws available funds of the active broker key from the custody contract
+func (c *Custody) WithdrawFunds(ctx context.Context, token common.Address, amount *big.Int) (common.Hash, error) {
+	signer := c.keys.Active()
+	auth, err := c.transactor(signer)
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	gasPrice, err := c.client.SuggestGasPrice(ctx)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("failed to suggest gas price: %w", err)
+	}
+
+	c.transactOptsMu.Lock()
+	defer c.transactOptsMu.Unlock()
+
+	auth.GasPrice = gasPrice.Add(gasPrice, gasPrice)
+	tx, err := c.custody.Withdraw(auth, token, amount)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("failed to withdraw: %w", err)
+	}
+	log.Printf("Withdrew %s of token %s on chain %d, TxHash: %s", amount, token.Hex(), c.chainID, tx.Hash().Hex())
+	return tx.Hash(), nil
+}
+
+// CloseChannel submits a state to close a channel with the broker key the channel was opened with
+func (c *Custody) CloseChannel(ctx context.Context, channelID common.Hash, broker string, state nitrolite.State) (common.Hash, error) {
+	return c.settle(ctx, broker, "close", func(auth *bind.TransactOpts) (*types.Transaction, error) {
+		return c.custody.Close(auth, channelID, state, []nitrolite.State{})
+	})
+}
+
+// ChallengeChannel starts the challenge period of a channel with a mutually signed state
+func (c *Custody) ChallengeChannel(ctx context.Context, channelID common.Hash, broker string, state nitrolite.State) (common.Hash, error) {
+	return c.settle(ctx, broker, "challenge", func(auth *bind.TransactOpts) (*types.Transaction, error) {
+		return c.custody.Challenge(auth, channelID, state, []nitrolite.State{})
+	})
+}
+
+func (c *Custody) settle(ctx context.Context, broker, action string, send func(*bind.TransactOpts) (*types.Transaction, error)) (common.Hash, error) {
+	signer, err := c.keys.Get(broker)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	auth, err := c.transactor(signer)
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	gasPrice, err := c.client.SuggestGasPrice(ctx)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("failed to suggest gas price: %w", err)
+	}
+
+	c.transactOptsMu.Lock()
+	defer c.transactOptsMu.Unlock()
+
+	auth.GasPrice = gasPrice.Add(gasPrice, gasPrice)
+	tx, err := send(auth)
+	if err != nil {
+		return common.Hash{}, fmt.Errorf("failed to %s channel: %w", action, err)
+	}
+	log.Printf("Sent %s of channel on chain %d, TxHash: %s", action, c.chainID, tx.Hash().Hex())
+	return tx.Hash(), nil
+}
+
+// LatestSignedState returns the latest state of a channel signed by both parties, decoded from
+// the transaction which last put a state of the channel on-chain.
+// The initial state only carries the participant signature, the broker signature is added to it.
+func (c *Custody) LatestSignedState(ctx context.Context, channelID common.Hash, broker string) (nitrolite.State, error) {
+	logs, err := c.client.FilterLogs(ctx, ethereum.FilterQuery{
+		Addresses: []common.Address{c.custodyAddr},
+		Topics: [][]common.Hash{
+			{
+				custodyAbi.Events["Created"].ID,
+				custodyAbi.Events["Resized"].ID,
+				custodyAbi.Events["Checkpointed"].ID,
+				custodyAbi.Events["Challenged"].ID,
+			},
+			{channelID},
+		},
+	})
+	if err != nil {
+		return nitrolite.State{}, fmt.Errorf("failed to filter channel events: %w", err)
+	}
+	if len(logs) == 0 {
+		return nitrolite.State{}, fmt.Errorf("no states of channel %s found on chain %d", channelID.Hex(), c.chainID)
+	}
+
+	state, err := c.stateFromTransaction(ctx, logs[len(logs)-1].TxHash)
+	if err != nil {
+		return nitrolite.State{}, err
+	}
+
+	if len(state.Sigs) < 2 {
+		signer, err := c.keys.Get(broker)
+		if err != nil {
+			return nitrolite.State{}, err
+		}
+		encodedState, err := nitrolite.EncodeState(channelID, nitrolite.Intent(state.Intent), state.Version, state.Data, state.Allocations)
+		if err != nil {
+			return nitrolite.State{}, fmt.Errorf("failed to encode state: %w", err)
+		}
+		sig, err := signer.NitroSign(encodedState)
+		if err != nil {
+			return nitrolite.State{}, fmt.Errorf("failed to sign state: %w", err)
+		}
+		state.Sigs = append(state.Sigs, sig)
+	}
+	return state, nil
+}
+
+// stateFromTransaction decodes the channel state submitted by a custody contract call
+func (c *Custody) stateFromTransaction(ctx context.Context, txHash common.Hash) (nitrolite.State, error) {
+	tx, _, err := c.client.TransactionByHash(ctx, txHash)
+	if err != nil {
+		return nitrolite.State{}, fmt.Errorf("failed to fetch transaction %s: %w", txHash.Hex(), err)
+	}
+	if tx.To() == nil || *tx.To() != c.custodyAddr || len(tx.Data()) < 4 {
+		return nitrolite.State{}, fmt.Errorf("transaction %s does not call the custody contract directly", txHash.Hex())
+	}
+
+	method, err := custodyAbi.MethodById(tx.Data()[:4])
+	if err != nil {
+		return nitrolite.State{}, fmt.Errorf("failed to decode transaction %s: %w", txHash.Hex(), err)
+	}
+	args, err := method.Inputs.Unpack(tx.Data()[4:])
+	if err != nil {
+		return nitrolite.State{}, fmt.Errorf("failed to unpack %s arguments: %w", method.Name, err)
+	}
+	// create(ch, initial) and close, resize, checkpoint and challenge(channelId, candidate, proofs) all pass the state second
+	if len(args) < 2 {
+		return nitrolite.State{}, fmt.Errorf("unexpected arguments of %s", method.Name)
+	}
+	return *abi.ConvertType(args[1], new(nitrolite.State)).(*nitrolite.State), nil
+}
+
+// recordTransactionState records the participant signature of the state a custody contract call submitted
+func (c *Custody) recordTransactionState(channelID string, txHash common.Hash) {
+	state, err := c.stateFromTransaction(context.Background(), txHash)
+	if err != nil {
+		log.Printf("Failed to decode the state of channel %s: %v", channelID, err)
+		return
+	}
+	if err := recordOnChainState(c.db, channelID, state, txHash.Hex()); err != nil {
+		log.Printf("Failed to record the state of channel %s: %v", channelID, err)
+	}
+}
+
+// rejectChannel records a channel the broker doesn't join and notifies the participant of the reason,
+// the participant closes it with the refund state
+func (c *Custody) rejectChannel(l types.Log, channelID, participant, broker string, ev *nitrolite.CustodyCreated, reason string) error {
+	signer, err := c.keys.Get(broker)
+	if err != nil {
+		return err
+	}
+
+	var ch Channel
+	err = c.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		// A deposit too large for the channel amount is still refunded in full by the refund state
+		var amount uint64
+		if deposit := ev.Initial.Allocations[0].Amount; deposit.IsUint64() {
+			amount = deposit.Uint64()
+		}
+		ch, err = CreateChannel(tx, channelID, participant, broker, ev.Channel.Nonce, ev.Channel.Challenge, ev.Channel.Adjudicator.Hex(), c.chainID,
+			ev.Initial.Allocations[0].Token.Hex(), amount)
+		if err != nil {
+			return err
+		}
+		if _, err := RejectChannel(tx, signer, &ch, ev.Initial.Allocations[0], reason); err != nil {
+			return err
+		}
+		return c.markProcessed(tx, l)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reject channel %s: %w", channelID, err)
+	}
+
+	c.sendChannelUpdate(ch)
+	log.Printf("[Created] Rejected channel %s on chain %d, signed its refund state", channelID, c.chainID)
 	return nil
 }
 
-// handleBlockChainEvent processes different event types received from the blockchain
-func (c *Custody) handleBlockChainEvent(l types.Log) {
+// handleBlockChainEvent processes different event types received from the blockchain. The database
+// changes of an event are committed together with its processed event record, events which are not
+// handled are recorded as well. A Created event is only recorded once the join transaction is sent.
+func (c *Custody) handleBlockChainEvent(l types.Log) error {
 	log.Printf("Received event: %+v\n", l)
 
 	eventID := l.Topics[0]
@@ -121,63 +465,107 @@ func (c *Custody) handleBlockChainEvent(l types.Log) {
 		log.Printf("[Created] Event data: %+v\n", ev)
 		if err != nil {
 			log.Println("error parsing Created event:", err)
-			return
+			return c.skipEvent(l)
 		}
 
 		if len(ev.Channel.Participants) < 2 {
 			log.Println("[Created] Error: not enough participants in the channel")
-			return
+			return c.skipEvent(l)
+		}
+
+		// Nothing was deposited without allocations, there is nothing to refund either
+		if len(ev.Initial.Allocations) == 0 {
+			log.Println("[Created] Error: no initial allocations in the channel")
+			return c.skipEvent(l)
 		}
 
 		participantA := ev.Channel.Participants[0].Hex()
 		nonce := ev.Channel.Nonce
 		participantB := ev.Channel.Participants[1]
 		tokenAddress := ev.Initial.Allocations[0].Token.Hex()
-		tokenAmount := ev.Initial.Allocations[0].Amount.Int64()
 
-		// Check if channel was created with the broker.
-		if participantB != c.signer.GetAddress() {
-			log.Printf("participantB %s is not Broker %s\n", participantB, c.signer.GetAddress().Hex())
-			return
+		// Check if channel was created with the active broker key.
+		// Legacy keys are only honored for channels opened before the key rotation.
+		if !c.keys.IsActive(participantB.Hex()) {
+			log.Printf("participantB %s is not Broker %s\n", participantB, c.keys.Active().GetAddress().Hex())
+			return c.skipEvent(l)
+		}
+
+		channelID := common.BytesToHash(ev.ChannelId[:]).Hex()
+
+		// Channels outside of the network policy could drain the broker, they are not joined
+		reason, err := c.policy.Check(c.db, c.chainID, ev.Channel.Adjudicator.Hex(), ev.Channel.Challenge, ev.Initial.Allocations)
+		if err != nil {
+			return fmt.Errorf("failed to check channel policy: %w", err)
+		}
+
+		if reason != "" {
+			log.Printf("[Created] Channel %s violates the policy of chain %d: %s", channelID, c.chainID, reason)
+			return c.rejectChannel(l, channelID, participantA, participantB.Hex(), ev, reason)
 		}
 
 		// Check if there is already existing open channel with the broker
-		existingOpenChannel, err := CheckExistingChannels(c.db, participantA, tokenAddress, c.chainID)
+		existingOpenChannel, err := CheckDuplicateChannel(c.db, channelID, participantA, tokenAddress, c.chainID)
 		if err != nil {
-			log.Printf("[Created] Error checking channels in database: %v", err)
-			return
+			return fmt.Errorf("failed to check channels in database: %w", err)
 		}
 
 		if existingOpenChannel != nil {
-			log.Printf("[Created] An open channel with broker already exists: %s", existingOpenChannel.ChannelID)
-			return
+			log.Printf("[Created] An open channel with broker already exists: %s, rejecting channel %s", existingOpenChannel.ChannelID, channelID)
+			reason := fmt.Sprintf("channel %s is already open for this token on chain %d", existingOpenChannel.ChannelID, c.chainID)
+			return c.rejectChannel(l, channelID, participantA, participantB.Hex(), ev, reason)
 		}
 
-		channelID := common.BytesToHash(ev.ChannelId[:]).Hex()
-		ch, err := CreateChannel(
-			c.db,
-			channelID,
-			participantA,
-			nonce,
-			ev.Channel.Adjudicator.Hex(),
-			c.chainID,
-			tokenAddress,
-			uint64(tokenAmount),
-		)
+		encodedState, err := nitrolite.EncodeState(ev.ChannelId, nitrolite.IntentINITIALIZE, big.NewInt(0), ev.Initial.Data, ev.Initial.Allocations)
 		if err != nil {
-			log.Printf("[ChannelCreated] Error creating/updating channel in database: %v", err)
-			return
+			return fmt.Errorf("failed to encode the initial state of channel %s: %w", channelID, err)
 		}
 
-		encodedState, err := nitrolite.EncodeState(ev.ChannelId, nitrolite.IntentINITIALIZE, big.NewInt(0), ev.Initial.Data, ev.Initial.Allocations)
+		// A channel whose join failed was recorded by the previous attempt to handle the event
+		var ch Channel
+		err = c.db.Transaction(func(tx *gorm.DB) error {
+			existing, err := GetChannelByID(tx, channelID)
+			if err != nil {
+				return err
+			}
+			if existing != nil {
+				ch = *existing
+				return nil
+			}
+			ch, err = CreateChannel(
+				tx,
+				channelID,
+				participantA,
+				participantB.Hex(),
+				nonce,
+				ev.Channel.Challenge,
+				ev.Channel.Adjudicator.Hex(),
+				c.chainID,
+				tokenAddress,
+				ev.Initial.Allocations[0].Amount.Uint64(),
+			)
+			return err
+		})
 		if err != nil {
-			log.Printf("[ChannelCreated] Error encoding state hash: %v", err)
-			return
+			return fmt.Errorf("failed to create channel %s: %w", channelID, err)
 		}
 
-		if err := c.Join(channelID, encodedState); err != nil {
-			log.Printf("[ChannelCreated] Error joining channel: %v", err)
-			return
+		// The event is only processed once the join is sent, it's handled again when joining fails
+		brokerSig, err := c.Join(channelID, ch.Broker, encodedState)
+		if err != nil {
+			return fmt.Errorf("failed to join channel %s: %w", channelID, err)
+		}
+		if err := c.markProcessed(c.db, l); err != nil {
+			return err
+		}
+
+		// The participant signed the initial state on create, the broker on join
+		if len(ev.Initial.Sigs) == 1 {
+			initial := ev.Initial
+			initial.Sigs = append(initial.Sigs, brokerSig)
+			if err := recordOnChainState(c.db, channelID, initial, l.TxHash.Hex()); err != nil {
+				log.Printf("[ChannelCreated] Error recording initial state: %v", err)
+			}
 		}
 
 		c.sendChannelUpdate(ch)
@@ -188,17 +576,19 @@ func (c *Custody) handleBlockChainEvent(l types.Log) {
 		ev, err := c.custody.ParseJoined(l)
 		if err != nil {
 			log.Println("error parsing ChannelJoined event:", err)
-			return
+			return c.skipEvent(l)
 		}
 		log.Printf("Joined event data: %+v\n", ev)
 
 		var channel Channel
+		found := true
 		channelID := common.BytesToHash(ev.ChannelId[:]).Hex()
 		err = c.db.Transaction(func(tx *gorm.DB) error {
 			result := tx.Where("channel_id = ?", channelID).First(&channel)
 			if result.Error != nil {
 				if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-					return fmt.Errorf("channel with ID %s not found", channelID)
+					found = false
+					return c.markProcessed(tx, l)
 				}
 				return fmt.Errorf("error finding channel: %w", result.Error)
 			}
@@ -222,17 +612,24 @@ func (c *Custody) handleBlockChainEvent(l types.Log) {
 
 			tokenAmount := decimal.NewFromBigInt(big.NewInt(int64(channel.Amount)), -int32(asset.Decimals))
 
-			ledger := GetParticipantLedger(tx, channel.Participant)
-			if err := ledger.Record(channel.Participant, asset.Symbol, tokenAmount); err != nil {
+			// The deposit is held by the custody contract and owed to the participant
+			ledgerTx := NewLedgerTransaction(tx)
+			ledgerTx.SetReference(ReferenceTypeTxHash, l.TxHash.Hex(), fmt.Sprintf("Deposit into channel %s on chain %d", channelID, c.chainID))
+			ledgerTx.Debit(CustodyAccount(c.chainID), asset.Symbol, tokenAmount)
+			ledgerTx.Credit(ParticipantAccount(channel.Participant), asset.Symbol, tokenAmount)
+			if err := ledgerTx.Post(); err != nil {
 				log.Printf("[Joined] Error recording balance update for participant A: %v", err)
 				return err
 			}
 
-			return nil
+			return c.markProcessed(tx, l)
 		})
 		if err != nil {
-			log.Printf("[Joined] Error closing channel in database: %v", err)
-			return
+			return fmt.Errorf("failed to open channel %s: %w", channelID, err)
+		}
+		if !found {
+			log.Printf("[Joined] Channel %s is not a channel of the broker", channelID)
+			return nil
 		}
 		c.sendBalanceUpdate(channel.Participant)
 		c.sendChannelUpdate(channel)
@@ -241,36 +638,51 @@ func (c *Custody) handleBlockChainEvent(l types.Log) {
 		ev, err := c.custody.ParseClosed(l)
 		if err != nil {
 			log.Println("error parsing ChannelClosed event:", err)
-			return
+			return c.skipEvent(l)
 		}
 		log.Printf("Closed event data: %+v\n", ev)
 
 		var channel Channel
+		found := true
 		channelID := common.BytesToHash(ev.ChannelId[:]).Hex()
 		err = c.db.Transaction(func(tx *gorm.DB) error {
 			result := tx.Where("channel_id = ?", channelID).First(&channel)
 			if result.Error != nil {
 				if errors.Is(result.Error, gorm.ErrRecordNotFound) {
-					return fmt.Errorf("channel with ID %s not found", channelID)
+					found = false
+					return c.markProcessed(tx, l)
 				}
 				return fmt.Errorf("error finding channel: %w", result.Error)
 			}
 
-			asset, err := GetAssetByToken(tx, channel.Token, c.chainID)
+			// None of the pending states can be submitted anymore, the holds of the final ones are replaced by the ledger entries
+			holds, err := settleClosedStates(tx, channelID)
 			if err != nil {
-				return fmt.Errorf("DB error fetching asset: %w", err)
+				return err
 			}
 
-			if asset == nil {
-				return fmt.Errorf("Asset not found in database for token: %s", channel.Token)
-			}
+			// The deposit of a rejected channel was never credited to the participant, it's refunded as is
+			if channel.Status != ChannelStatusRejected {
+				asset, err := GetAssetByToken(tx, channel.Token, c.chainID)
+				if err != nil {
+					return fmt.Errorf("DB error fetching asset: %w", err)
+				}
 
-			tokenAmount := decimal.NewFromBigInt(big.NewInt(int64(channel.Amount)), -int32(asset.Decimals))
+				if asset == nil {
+					return fmt.Errorf("Asset not found in database for token: %s", channel.Token)
+				}
 
-			ledger := GetParticipantLedger(tx, channel.Participant)
-			if err := ledger.Record(channel.Participant, asset.Symbol, tokenAmount.Neg()); err != nil {
-				log.Printf("[Closed] Error recording balance update for participant: %v", err)
-				return err
+				tokenAmount := decimal.NewFromBigInt(big.NewInt(int64(channel.Amount)), -int32(asset.Decimals))
+
+				ledgerTx := NewLedgerTransaction(tx)
+				ledgerTx.SetReference(ReferenceTypeTxHash, l.TxHash.Hex(), fmt.Sprintf("Withdrawal on close of channel %s on chain %d", channelID, c.chainID))
+				ledgerTx.Debit(ParticipantAccount(channel.Participant), asset.Symbol, tokenAmount)
+				ledgerTx.Credit(CustodyAccount(c.chainID), asset.Symbol, tokenAmount)
+				chargeHoldFees(ledgerTx, holds)
+				if err := ledgerTx.Post(); err != nil {
+					log.Printf("[Closed] Error recording balance update for participant: %v", err)
+					return err
+				}
 			}
 
 			// Update the channel status to "closed"
@@ -282,30 +694,64 @@ func (c *Custody) handleBlockChainEvent(l types.Log) {
 				return fmt.Errorf("failed to close channel: %w", err)
 			}
 
+			if err := completeCloseRequests(tx, channelID, l.TxHash.Hex()); err != nil {
+				return err
+			}
+
 			log.Printf("Closed channel with ID: %s", channelID)
 
-			return nil
+			return c.markProcessed(tx, l)
 		})
 		if err != nil {
-			log.Printf("[Closed] Error closing channel: %v", err)
-			return
+			return fmt.Errorf("failed to close channel %s: %w", channelID, err)
 		}
+		if !found {
+			log.Printf("[Closed] Channel %s is not a channel of the broker", channelID)
+			return nil
+		}
+		c.recordTransactionState(channelID, l.TxHash)
 		c.sendBalanceUpdate(channel.Participant)
 		c.sendChannelUpdate(channel)
 
+	case custodyAbi.Events["Challenged"].ID:
+		ev, err := c.custody.ParseChallenged(l)
+		if err != nil {
+			log.Println("error parsing Challenged event:", err)
+			return c.skipEvent(l)
+		}
+		log.Printf("Challenged event data: %+v\n", ev)
+
+		channelID := common.BytesToHash(ev.ChannelId[:]).Hex()
+		err = c.db.Transaction(func(tx *gorm.DB) error {
+			if err := markCloseRequestsChallenged(tx, channelID, time.Unix(ev.Expiration.Int64(), 0)); err != nil {
+				return err
+			}
+			return c.markProcessed(tx, l)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update close requests of channel %s: %w", channelID, err)
+		}
+		c.recordTransactionState(channelID, l.TxHash)
+		log.Printf("Channel %s challenged until %s", channelID, time.Unix(ev.Expiration.Int64(), 0).Format(time.RFC3339))
+
 	case custodyAbi.Events["Resized"].ID:
 		ev, err := c.custody.ParseResized(l)
 		if err != nil {
 			log.Println("error parsing Resized event:", err)
-			return
+			return c.skipEvent(l)
 		}
 		log.Printf("Resized event data: %+v\n", ev)
 
 		var channel Channel
+		found := true
+		channelID := common.BytesToHash(ev.ChannelId[:]).Hex()
 		err = c.db.Transaction(func(tx *gorm.DB) error {
-			channelID := common.BytesToHash(ev.ChannelId[:]).Hex()
-			result := c.db.Where("channel_id = ?", channelID).First(&channel)
+			result := tx.Where("channel_id = ?", channelID).First(&channel)
 			if result.Error != nil {
+				if errors.Is(result.Error, gorm.ErrRecordNotFound) {
+					found = false
+					return c.markProcessed(tx, l)
+				}
 				return fmt.Errorf("error finding channel: %w", result.Error)
 			}
 
@@ -317,12 +763,28 @@ func (c *Custody) handleBlockChainEvent(l types.Log) {
 			channel.Amount = uint64(newAmount)
 			channel.UpdatedAt = time.Now()
 			channel.Version++
-			if err := c.db.Save(&channel).Error; err != nil {
+			if err := tx.Save(&channel).Error; err != nil {
 				return fmt.Errorf("[Resized] Error saving channel in database: %w", err)
 			}
 
+			// The signed resize state landed, its hold is replaced by the ledger entries
+			stateData, err := encodeResizeAmounts(ev.DeltaAllocations)
+			if err != nil {
+				return err
+			}
+			holds, err := settleResizedStates(tx, channelID, channel.Version, hexutil.Encode(stateData))
+			if err != nil {
+				return err
+			}
+
+			ledgerTx := NewLedgerTransaction(tx)
+			ledgerTx.SetReference(ReferenceTypeTxHash, l.TxHash.Hex(), fmt.Sprintf("Resize of channel %s on chain %d", channelID, c.chainID))
 			resizeAmount := ev.DeltaAllocations[0] // Participant deposits or withdraws.
-			if resizeAmount.Cmp(big.NewInt(0)) != 0 {
+			brokerAmount := big.NewInt(0)          // Broker allocates from or reclaims its own liquidity.
+			if len(ev.DeltaAllocations) > 1 {
+				brokerAmount = ev.DeltaAllocations[1]
+			}
+			if resizeAmount.Sign() != 0 || brokerAmount.Sign() != 0 {
 				asset, err := GetAssetByToken(tx, channel.Token, c.chainID)
 				if err != nil {
 					return fmt.Errorf("DB error fetching asset: %w", err)
@@ -333,26 +795,52 @@ func (c *Custody) handleBlockChainEvent(l types.Log) {
 				}
 
 				amount := decimal.NewFromBigInt(resizeAmount, -int32(asset.Decimals))
-				ledger := GetParticipantLedger(tx, channel.Participant)
-				if err := ledger.Record(channel.Participant, asset.Symbol, amount); err != nil {
-					log.Printf("[Resized] Error recording balance update for participant: %v", err)
-					return err
+				if amount.IsPositive() {
+					ledgerTx.Debit(CustodyAccount(c.chainID), asset.Symbol, amount)
+					ledgerTx.Credit(ParticipantAccount(channel.Participant), asset.Symbol, amount)
+				} else if amount.IsNegative() {
+					ledgerTx.Debit(ParticipantAccount(channel.Participant), asset.Symbol, amount.Abs())
+					ledgerTx.Credit(CustodyAccount(c.chainID), asset.Symbol, amount.Abs())
 				}
+
+				// Funds the broker moves between its custody balance and the channel change what the custody holds
+				// for the broker's users, e.g. when it pays out a withdrawal of funds deposited on another chain
+				allocation := decimal.NewFromBigInt(brokerAmount, -int32(asset.Decimals))
+				ledgerTx.withMemo(fmt.Sprintf("Broker allocation to channel %s on chain %d", channelID, c.chainID), func() {
+					if allocation.IsPositive() {
+						ledgerTx.Debit(CustodyAccount(c.chainID), asset.Symbol, allocation)
+						ledgerTx.Credit(BrokerEquityAccount(), asset.Symbol, allocation)
+					} else if allocation.IsNegative() {
+						ledgerTx.Debit(BrokerEquityAccount(), asset.Symbol, allocation.Abs())
+						ledgerTx.Credit(CustodyAccount(c.chainID), asset.Symbol, allocation.Abs())
+					}
+				})
+			}
+			chargeHoldFees(ledgerTx, holds)
+			if err := ledgerTx.Post(); err != nil {
+				log.Printf("[Resized] Error recording balance update for participant: %v", err)
+				return err
 			}
 
-			return nil
+			return c.markProcessed(tx, l)
 		})
 
 		if err != nil {
-			log.Printf("[Resized] Error resizing channel: %v", err)
-			return
+			return fmt.Errorf("failed to resize channel %s: %w", channelID, err)
+		}
+		if !found {
+			log.Printf("[Resized] Channel %s is not a channel of the broker", channelID)
+			return nil
 		}
+		c.recordTransactionState(channel.ChannelID, l.TxHash)
 
 		c.sendBalanceUpdate(channel.Participant)
 		c.sendChannelUpdate(channel)
 	default:
 		log.Println("Unknown event ID:", eventID.Hex())
+		return c.skipEvent(l)
 	}
+	return nil
 }
 
 // UpdateBalanceMetrics fetches the broker's account information from the smart contract and updates metrics
@@ -362,31 +850,35 @@ func (c *Custody) UpdateBalanceMetrics(ctx context.Context, tokens []common.Addr
 		return
 	}
 
-	brokerAddr := c.signer.GetAddress()
-	for _, token := range tokens {
-		// Create a call opts with the provided context
-		callOpts := &bind.CallOpts{
-			Context: ctx,
-		}
+	for _, signer := range c.keys.Signers() {
+		brokerAddr := signer.GetAddress()
+		for _, token := range tokens {
+			// Create a call opts with the provided context
+			callOpts := &bind.CallOpts{
+				Context: ctx,
+			}
 
-		logger.Infow("Fetching account info", "network", c.chainID, "token", token.Hex(), "broker", brokerAddr.Hex())
-		// Call getAccountInfo on the custody contract
-		info, err := c.custody.GetAccountInfo(callOpts, brokerAddr, token)
-		if err != nil {
-			logger.Errorw("Failed to get account info", "network", c.chainID, "token", token.Hex(), "error", err)
-			continue
-		}
+			logger.Infow("Fetching account info", "network", c.chainID, "token", token.Hex(), "broker", brokerAddr.Hex())
+			// Call getAccountInfo on the custody contract
+			info, err := c.custody.GetAccountInfo(callOpts, brokerAddr, token)
+			if err != nil {
+				logger.Errorw("Failed to get account info", "network", c.chainID, "token", token.Hex(), "error", err)
+				continue
+			}
 
-		metrics.BrokerBalanceAvailable.With(prometheus.Labels{
-			"network": fmt.Sprintf("%d", c.chainID),
-			"token":   token.Hex(),
-		}).Set(float64(info.Available.Int64()))
+			metrics.BrokerBalanceAvailable.With(prometheus.Labels{
+				"network": fmt.Sprintf("%d", c.chainID),
+				"token":   token.Hex(),
+				"broker":  brokerAddr.Hex(),
+			}).Set(float64(info.Available.Int64()))
 
-		metrics.BrokerChannelCount.With(prometheus.Labels{
-			"network": fmt.Sprintf("%d", c.chainID),
-			"token":   token.Hex(),
-		}).Set(float64(info.ChannelCount.Int64()))
+			metrics.BrokerChannelCount.With(prometheus.Labels{
+				"network": fmt.Sprintf("%d", c.chainID),
+				"token":   token.Hex(),
+				"broker":  brokerAddr.Hex(),
+			}).Set(float64(info.ChannelCount.Int64()))
 
-		logger.Infow("Updated contract balance metrics", "network", c.chainID, "token", token.Hex(), "available", info.Available.String(), "channels", info.ChannelCount.String())
+			logger.Infow("Updated contract balance metrics", "network", c.chainID, "token", token.Hex(), "broker", brokerAddr.Hex(), "available", info.Available.String(), "channels", info.ChannelCount.String())
+		}
 	}
 }
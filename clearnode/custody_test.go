@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient/simulated"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// simulatedChainID is the chain ID of the simulated backend
+const simulatedChainID = 1337
+
+// resizeDeltas encodes the allocation changes of a resize state
+var resizeDeltas = abi.Arguments{{Type: abi.Type{T: abi.SliceTy, Elem: &abi.Type{T: abi.IntTy, Size: 256}}}}
+
+// permissiveAdjudicator is the runtime code of an adjudicator which accepts every state
+var permissiveAdjudicator = common.FromHex("600160005260206000f3")
+
+// simulatedChain is a chain backend for tests which mines a block for every sent transaction,
+// with the custody contract and a permissive adjudicator deployed
+type simulatedChain struct {
+	simulated.Client
+	backend     *simulated.Backend
+	custody     common.Address
+	adjudicator common.Address
+	subscribed  chan struct{}
+	failSends   int // Transactions to refuse before sending again, as a node out of funds would
+}
+
+func newSimulatedChain(t *testing.T, funded ...common.Address) *simulatedChain {
+	t.Helper()
+
+	deployer, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	adjudicator := common.HexToAddress("0xAdA0000000000000000000000000000000000001")
+
+	ether := new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+	alloc := types.GenesisAlloc{
+		crypto.PubkeyToAddress(deployer.PublicKey): {Balance: new(big.Int).Mul(big.NewInt(100), ether)},
+		adjudicator: {Code: permissiveAdjudicator, Balance: big.NewInt(0)},
+	}
+	for _, addr := range funded {
+		alloc[addr] = types.Account{Balance: new(big.Int).Mul(big.NewInt(100), ether)}
+	}
+
+	backend := simulated.NewBackend(alloc)
+	t.Cleanup(func() { backend.Close() })
+
+	chain := &simulatedChain{
+		Client:      backend.Client(),
+		backend:     backend,
+		adjudicator: adjudicator,
+		subscribed:  make(chan struct{}, 1),
+	}
+
+	auth, err := bind.NewKeyedTransactorWithChainID(deployer, big.NewInt(simulatedChainID))
+	require.NoError(t, err)
+	chain.custody, _, _, err = nitrolite.DeployCustody(auth, chain)
+	require.NoError(t, err)
+	return chain
+}
+
+// SendTransaction mines the transaction right away
+func (c *simulatedChain) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	if c.failSends > 0 {
+		c.failSends--
+		return errors.New("insufficient funds for gas * price + value")
+	}
+	if err := c.Client.SendTransaction(ctx, tx); err != nil {
+		return err
+	}
+	c.backend.Commit()
+	return nil
+}
+
+// SubscribeFilterLogs reports the subscription, events of blocks mined before it are not delivered
+func (c *simulatedChain) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	sub, err := c.Client.SubscribeFilterLogs(ctx, q, ch)
+	if err == nil {
+		select {
+		case c.subscribed <- struct{}{}:
+		default:
+		}
+	}
+	return sub, err
+}
+
+func TestCustodyChannelLifecycle(t *testing.T) {
+	t.Run("Subscribe", func(t *testing.T) {
+		testChannelLifecycle(t, IngestionConfig{Mode: EventIngestionSubscribe, MaxBlockRange: 1000})
+	})
+	t.Run("Poll", func(t *testing.T) {
+		testChannelLifecycle(t, IngestionConfig{Mode: EventIngestionPoll, PollInterval: 10 * time.Millisecond, MaxBlockRange: 2})
+	})
+}
+
+// testChannelLifecycle drives a channel through the Created, Joined, Resized and Closed events
+func testChannelLifecycle(t *testing.T, ingestion IngestionConfig) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	rawBroker, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	rawParticipant, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	broker := &LocalSigner{privateKey: rawBroker}
+	participant := &LocalSigner{privateKey: rawParticipant}
+
+	chain := newSimulatedChain(t, broker.GetAddress(), participant.GetAddress())
+	// The simulated chain isn't a known network, register its native token by hand
+	require.NoError(t, db.Create(&Asset{Token: NativeTokenAddress.Hex(), ChainID: simulatedChainID, Symbol: "eth", Decimals: 18}).Error)
+
+	custody, err := NewCustody(chain, NewKeyRing(broker), db, NewChannelPolicy(), ingestion, func(string) {}, func(Channel) {}, chain.custody.Hex(), simulatedChainID)
+	require.NoError(t, err)
+
+	// Events are read from the deployment block on
+	head, err := chain.HeaderByNumber(context.Background(), nil)
+	require.NoError(t, err)
+	require.NoError(t, SaveEventCursor(db, simulatedChainID, chain.custody.Hex(), head.Number.Uint64()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		custody.ListenEvents(ctx)
+		close(stopped)
+	}()
+	if ingestion.Mode == EventIngestionSubscribe {
+		select {
+		case <-chain.subscribed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("custody events are not watched")
+		}
+	}
+
+	// The participant deposits one ether and opens a channel with all of it
+	deposit := new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+	contract, err := nitrolite.NewCustody(chain.custody, chain)
+	require.NoError(t, err)
+	auth, err := participant.NewTransactor(big.NewInt(simulatedChainID))
+	require.NoError(t, err)
+	auth.Value = deposit
+	_, err = contract.Deposit(auth, NativeTokenAddress, deposit)
+	require.NoError(t, err)
+	auth.Value = nil
+
+	ch := nitrolite.Channel{
+		Participants: []common.Address{participant.GetAddress(), broker.GetAddress()},
+		Adjudicator:  chain.adjudicator,
+		Challenge:    3600,
+		Nonce:        uint64(time.Now().UnixNano()),
+	}
+	channelID := contractChannelID(t, ch)
+	initial := nitrolite.State{
+		Intent:  uint8(nitrolite.IntentINITIALIZE),
+		Version: big.NewInt(0),
+		Data:    []byte{},
+		Allocations: []nitrolite.Allocation{
+			{Destination: participant.GetAddress(), Token: NativeTokenAddress, Amount: deposit},
+			{Destination: broker.GetAddress(), Token: NativeTokenAddress, Amount: big.NewInt(0)},
+		},
+	}
+	initial.Sigs = signState(t, channelID, initial, participant)
+	_, err = contract.Create(auth, ch, initial)
+	require.NoError(t, err)
+
+	// The broker joins on Created, the deposit is credited on Joined
+	waitForChannel(t, db, channelID.Hex(), func(ch *Channel) bool { return ch.Status == ChannelStatusOpen })
+	ledger := GetParticipantLedger(db, participant.GetAddress().Hex())
+	balance, err := ledger.Balance(participant.GetAddress().Hex(), "eth")
+	require.NoError(t, err)
+	assert.True(t, decimal.NewFromInt(1).Equal(balance), "balance %s", balance)
+
+	// Both sides sign a resize which moves half of the deposit back to the participant's custody balance,
+	// the custody contract adds the deltas of the state data to the allocations
+	half := new(big.Int).Div(deposit, big.NewInt(2))
+	deltas, err := resizeDeltas.Pack([]*big.Int{new(big.Int).Neg(half), big.NewInt(0)})
+	require.NoError(t, err)
+	resized := nitrolite.State{
+		Intent:  uint8(nitrolite.IntentRESIZE),
+		Version: big.NewInt(1),
+		Data:    deltas,
+		Allocations: []nitrolite.Allocation{
+			{Destination: participant.GetAddress(), Token: NativeTokenAddress, Amount: half},
+			{Destination: broker.GetAddress(), Token: NativeTokenAddress, Amount: big.NewInt(0)},
+		},
+	}
+	resized.Sigs = signState(t, channelID, resized, participant, broker)
+	proof := initial
+	proof.Sigs = signState(t, channelID, initial, participant, broker)
+	_, err = contract.Resize(auth, channelID, resized, []nitrolite.State{proof})
+	require.NoError(t, err)
+
+	waitForChannel(t, db, channelID.Hex(), func(ch *Channel) bool { return ch.Version == 1 })
+	channel, err := GetChannelByID(db, channelID.Hex())
+	require.NoError(t, err)
+	assert.Equal(t, half.Uint64(), channel.Amount)
+	balance, err = ledger.Balance(participant.GetAddress().Hex(), "eth")
+	require.NoError(t, err)
+	assert.True(t, decimal.NewFromFloat(0.5).Equal(balance), "balance %s", balance)
+
+	// The participant countersigns the final state of close_channel and submits it
+	rpc := &RPCMessage{
+		Req: &RPCData{
+			RequestID: 1,
+			Method:    "close_channel",
+			Params:    []any{CloseChannelParams{ChannelID: channelID.Hex(), FundsDestination: participant.GetAddress().Hex()}},
+			Timestamp: uint64(time.Now().Unix()),
+		},
+	}
+	reqBytes, err := json.Marshal(rpc.Req)
+	require.NoError(t, err)
+	reqSig, err := participant.Sign(reqBytes)
+	require.NoError(t, err)
+	rpc.Sig = []string{hexutil.Encode(reqSig)}
+
+	resp, err := HandleCloseChannel(rpc, db, custody.keys)
+	require.NoError(t, err)
+	closeResp, ok := resp.Res.Params[0].(CloseChannelResponse)
+	require.True(t, ok)
+
+	final := nitrolite.State{
+		Intent:  closeResp.Intent,
+		Version: new(big.Int).SetUint64(closeResp.Version),
+		Data:    hexutil.MustDecode(closeResp.StateData),
+	}
+	for _, a := range closeResp.FinalAllocations {
+		final.Allocations = append(final.Allocations, nitrolite.Allocation{
+			Destination: common.HexToAddress(a.Participant),
+			Token:       common.HexToAddress(a.TokenAddress),
+			Amount:      a.Amount,
+		})
+	}
+	final.Sigs = append(signState(t, channelID, final, participant), nitrolite.Signature{
+		V: closeResp.Signature.V,
+		R: [32]byte(hexutil.MustDecode(closeResp.Signature.R)),
+		S: [32]byte(hexutil.MustDecode(closeResp.Signature.S)),
+	})
+	_, err = contract.Close(auth, channelID, final, nil)
+	require.NoError(t, err)
+
+	// The payout leaves the ledger on Closed, and the final state is recorded as on-chain
+	waitForChannel(t, db, channelID.Hex(), func(ch *Channel) bool { return ch.Status == ChannelStatusClosed })
+	balance, err = ledger.Balance(participant.GetAddress().Hex(), "eth")
+	require.NoError(t, err)
+	assert.True(t, balance.IsZero(), "balance %s", balance)
+
+	require.Eventually(t, func() bool {
+		var landed ChannelState
+		err := db.Where("channel_id = ? AND intent = ?", channelID.Hex(), uint8(nitrolite.IntentFINALIZE)).First(&landed).Error
+		return err == nil && landed.Status == ChannelStateStatusOnChain
+	}, 5*time.Second, 20*time.Millisecond, "the final state wasn't recorded as on-chain")
+
+	status := custody.Status()
+	assert.Contains(t, []ListenerState{ListenerStateSubscribed, ListenerStatePolling}, status.State)
+	assert.Greater(t, status.LastBlock, head.Number.Uint64(), "the close event was processed")
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("custody events are still watched after cancellation")
+	}
+	assert.Equal(t, ListenerStateStopped, custody.Status().State)
+
+	// Events read again, e.g. after a restart, are skipped
+	logs, err := chain.FilterLogs(context.Background(), ethereum.FilterQuery{Addresses: []common.Address{chain.custody}})
+	require.NoError(t, err)
+	for _, l := range logs {
+		require.NoError(t, custody.processEvent(l))
+	}
+	balance, err = ledger.Balance(participant.GetAddress().Hex(), "eth")
+	require.NoError(t, err)
+	assert.True(t, balance.IsZero(), "balance %s", balance)
+	var processed int64
+	require.NoError(t, db.Model(&ProcessedEvent{}).Count(&processed).Error)
+	assert.Equal(t, int64(len(logs)), processed)
+
+	cursor, err := GetEventCursor(db, simulatedChainID, chain.custody.Hex())
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, cursor, logs[len(logs)-1].BlockNumber)
+}
+
+func TestCustodyRetriesFailedJoin(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	rawBroker, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	rawParticipant, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	broker := &LocalSigner{privateKey: rawBroker}
+	participant := &LocalSigner{privateKey: rawParticipant}
+
+	chain := newSimulatedChain(t, broker.GetAddress(), participant.GetAddress())
+	require.NoError(t, db.Create(&Asset{Token: NativeTokenAddress.Hex(), ChainID: simulatedChainID, Symbol: "eth", Decimals: 18}).Error)
+	custody, err := NewCustody(chain, NewKeyRing(broker), db, NewChannelPolicy(), IngestionConfig{Mode: EventIngestionPoll}, func(string) {}, func(Channel) {}, chain.custody.Hex(), simulatedChainID)
+	require.NoError(t, err)
+
+	deposit := new(big.Int).Exp(big.NewInt(10), big.NewInt(18), nil)
+	contract, err := nitrolite.NewCustody(chain.custody, chain)
+	require.NoError(t, err)
+	auth, err := participant.NewTransactor(big.NewInt(simulatedChainID))
+	require.NoError(t, err)
+	auth.Value = deposit
+	_, err = contract.Deposit(auth, NativeTokenAddress, deposit)
+	require.NoError(t, err)
+	auth.Value = nil
+
+	ch := nitrolite.Channel{
+		Participants: []common.Address{participant.GetAddress(), broker.GetAddress()},
+		Adjudicator:  chain.adjudicator,
+		Challenge:    3600,
+		Nonce:        uint64(time.Now().UnixNano()),
+	}
+	channelID := contractChannelID(t, ch)
+	initial := nitrolite.State{
+		Intent:  uint8(nitrolite.IntentINITIALIZE),
+		Version: big.NewInt(0),
+		Data:    []byte{},
+		Allocations: []nitrolite.Allocation{
+			{Destination: participant.GetAddress(), Token: NativeTokenAddress, Amount: deposit},
+			{Destination: broker.GetAddress(), Token: NativeTokenAddress, Amount: big.NewInt(0)},
+		},
+	}
+	initial.Sigs = signState(t, channelID, initial, participant)
+	_, err = contract.Create(auth, ch, initial)
+	require.NoError(t, err)
+
+	logs, err := chain.FilterLogs(context.Background(), ethereum.FilterQuery{
+		Addresses: []common.Address{chain.custody},
+		Topics:    [][]common.Hash{{custodyAbi.Events["Created"].ID}},
+	})
+	require.NoError(t, err)
+	require.Len(t, logs, 1)
+	created := logs[0]
+
+	// The join can't be sent, the event is left to be handled again
+	chain.failSends = 1
+	require.ErrorContains(t, custody.processEvent(created), "failed to join channel")
+	processed, err := IsEventProcessed(db, simulatedChainID, created)
+	require.NoError(t, err)
+	assert.False(t, processed)
+	channel, err := GetChannelByID(db, channelID.Hex())
+	require.NoError(t, err)
+	require.NotNil(t, channel)
+	assert.Equal(t, ChannelStatusJoining, channel.Status)
+
+	// The retry joins the channel recorded by the first attempt
+	require.NoError(t, custody.processEvent(created))
+	processed, err = IsEventProcessed(db, simulatedChainID, created)
+	require.NoError(t, err)
+	assert.True(t, processed)
+
+	joined, err := chain.FilterLogs(context.Background(), ethereum.FilterQuery{
+		Addresses: []common.Address{chain.custody},
+		Topics:    [][]common.Hash{{custodyAbi.Events["Joined"].ID}},
+	})
+	require.NoError(t, err)
+	assert.Len(t, joined, 1)
+}
+
+// waitForChannel waits for the events of the simulated chain to update a channel
+func waitForChannel(t *testing.T, db *gorm.DB, channelID string, done func(*Channel) bool) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		channel, err := GetChannelByID(db, channelID)
+		return err == nil && channel != nil && done(channel)
+	}, 5*time.Second, 20*time.Millisecond, "channel %s wasn't updated", channelID)
+}
+
+// signState signs a channel state with each of the signers in turn
+func signState(t *testing.T, channelID common.Hash, state nitrolite.State, signers ...Signer) []nitrolite.Signature {
+	t.Helper()
+	encoded, err := nitrolite.EncodeState(channelID, nitrolite.Intent(state.Intent), state.Version, state.Data, state.Allocations)
+	require.NoError(t, err)
+
+	var sigs []nitrolite.Signature
+	for _, signer := range signers {
+		sig, err := signer.NitroSign(encoded)
+		require.NoError(t, err)
+		sigs = append(sigs, sig)
+	}
+	return sigs
+}
+
+// contractChannelID returns the ID the custody contract gives a channel, which encodes the participants as
+// a dynamic array unlike nitrolite.GetChannelID. The broker takes channel IDs from the events.
+func contractChannelID(t *testing.T, ch nitrolite.Channel) common.Hash {
+	t.Helper()
+	addresses, err := abi.NewType("address[]", "", nil)
+	require.NoError(t, err)
+	address, err := abi.NewType("address", "", nil)
+	require.NoError(t, err)
+	uint64Type, err := abi.NewType("uint64", "", nil)
+	require.NoError(t, err)
+
+	encoded, err := abi.Arguments{{Type: addresses}, {Type: address}, {Type: uint64Type}, {Type: uint64Type}}.
+		Pack(ch.Participants, ch.Adjudicator, ch.Challenge, ch.Nonce)
+	require.NoError(t, err)
+	return crypto.Keccak256Hash(encoded)
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"io/fs"
 	"log"
 	"net/url"
 	"strconv"
@@ -29,6 +30,9 @@ type DatabaseConfig struct {
 	Host     string `env:"CLEARNODE_DATABASE_HOST" env-default:"localhost"`
 	Port     string `env:"CLEARNODE_DATABASE_PORT" env-default:"5432"`
 	Retries  int    `env:"CLEARNODE_DATABASE_RETRIES" env-default:"5"`
+
+	// ChannelBroker is the broker key address which migrations assign to channels created before key rotation was supported
+	ChannelBroker string
 }
 
 // ParseConnectionString parses a PostgreSQL URI and returns a DatabaseConfig
@@ -221,6 +225,10 @@ func migratePostgres(cnf DatabaseConfig) error {
 		return err
 	}
 
+	if cnf.ChannelBroker != "" && cnf.Driver == "postgres" {
+		dsn = fmt.Sprintf("%s options='-c clearnode.channel_broker=%s'", dsn, cnf.ChannelBroker)
+	}
+
 	db, err := goose.OpenDBWithDriver(cnf.Driver, dsn)
 	if err != nil {
 		return err
@@ -245,9 +253,53 @@ func migratePostgres(cnf DatabaseConfig) error {
 	return nil
 }
 
-func migrateSqlite(db *gorm.DB) error {
-	if err := db.AutoMigrate(&Entry{}, &Channel{}, &Asset{}, &AppSession{}, &RPCRecord{}); err != nil {
+// CheckMigrations tells whether the latest embedded migration was applied. SQLite databases are migrated
+// automatically on connection.
+func CheckMigrations(db *gorm.DB, driver string) error {
+	if driver != "postgres" {
+		return nil
+	}
+
+	latest, err := latestMigrationVersion("config/migrations/" + driver)
+	if err != nil {
 		return err
 	}
+
+	var applied int64
+	if err := db.Raw("SELECT COALESCE(MAX(version_id), 0) FROM goose_db_version WHERE is_applied").Scan(&applied).Error; err != nil {
+		return fmt.Errorf("failed to get applied migration version: %w", err)
+	}
+	if applied < latest {
+		return fmt.Errorf("migration %d is not applied, database is at version %d", latest, applied)
+	}
 	return nil
 }
+
+// latestMigrationVersion returns the version prefix of the latest embedded migration
+func latestMigrationVersion(dir string) (int64, error) {
+	files, err := fs.ReadDir(embedMigrations, dir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read migrations: %w", err)
+	}
+
+	var latest int64
+	for _, file := range files {
+		prefix, _, ok := strings.Cut(file.Name(), "_")
+		if !ok || !strings.HasSuffix(file.Name(), ".sql") {
+			continue
+		}
+		version, err := strconv.ParseInt(prefix, 10, 64)
+		if err != nil {
+			continue
+		}
+		latest = max(latest, version)
+	}
+	return latest, nil
+}
+
+func migrateSqlite(db *gorm.DB) error {
+	if err := db.AutoMigrate(&Entry{}, &Channel{}, &Asset{}, &AppSession{}, &RPCRecord{}, &AccountBalance{}, &LedgerCheckpoint{}, &LedgerCheckpointBalance{}, &LedgerHold{}, &ReconciliationRun{}, &ReconciliationBalance{}, &ReconciliationDiscrepancy{}, &ChannelCloseRequest{}, &ChannelState{}, &EventCursor{}, &ProcessedEvent{}); err != nil {
+		return err
+	}
+	return backfillBalances(db)
+}
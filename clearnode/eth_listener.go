@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"math/big"
 	"sync/atomic"
 	"time"
 
@@ -31,25 +33,97 @@ func init() {
 	}
 }
 
-type LogHandler func(l types.Log)
+// LogHandler handles an event, an event whose handling fails is read again
+type LogHandler func(l types.Log) error
 
-// listenEvents listens for blockchain events and processes them with the provided handler
+// ListenerState is the state of a custody events listener
+type ListenerState string
+
+const (
+	ListenerStateStandby    ListenerState = "standby" // Another node is the leader running the listeners
+	ListenerStateStarting   ListenerState = "starting"
+	ListenerStateSubscribed ListenerState = "subscribed"
+	ListenerStatePolling    ListenerState = "polling"
+	ListenerStateRetrying   ListenerState = "retrying" // The subscription or the last poll failed
+	ListenerStateStopped    ListenerState = "stopped"
+)
+
+// ListenerStatus is the progress of an events listener
+type ListenerStatus struct {
+	State     ListenerState `json:"state"`
+	HeadBlock uint64        `json:"head_block"`
+	LastBlock uint64        `json:"last_processed_block"`
+}
+
+// ListenerProgress receives the progress of an events listener
+type ListenerProgress interface {
+	SetState(state ListenerState)
+	SetHeadBlock(blockNumber uint64)
+	SaveCursor(blockNumber uint64) // The events of the contract were all handled up to the block
+}
+
+// EventIngestion selects how the custody events of a network are read
+type EventIngestion string
+
+const (
+	EventIngestionSubscribe EventIngestion = "subscribe" // eth_subscribe, which needs a WebSocket endpoint
+	EventIngestionPoll      EventIngestion = "poll"      // eth_getLogs over block ranges, which works over HTTP
+)
+
+// IngestionConfig configures how the custody events of a network are read
+type IngestionConfig struct {
+	Mode          EventIngestion
+	PollInterval  time.Duration // Time between polls once the head block is reached
+	MaxBlockRange uint64        // Largest block range of an eth_getLogs call, shrunk while the provider refuses it
+}
+
+// ingestEvents reads the events of a contract from the last block with processed events, with the ingestion
+// mode of the network, until the context is cancelled
+func ingestEvents(
+	ctx context.Context,
+	client bind.ContractBackend,
+	contractAddress common.Address,
+	chainID uint32,
+	lastBlock uint64,
+	ingestion IngestionConfig,
+	handler LogHandler,
+	progress ListenerProgress,
+) {
+	if ingestion.Mode == EventIngestionPoll {
+		pollEvents(ctx, client, contractAddress, chainID, lastBlock, ingestion, handler, progress)
+		return
+	}
+	listenEvents(ctx, client, contractAddress, chainID, lastBlock, ingestion, handler, progress)
+}
+
+// listenEvents listens for blockchain events and processes them with the provided handler.
+// Every time the subscription is made, the events since the last block are read first, so that
+// none is missed while the node was down or disconnected.
 func listenEvents(
 	ctx context.Context,
 	client bind.ContractBackend,
 	contractAddress common.Address,
 	chainID uint32,
 	lastBlock uint64,
+	ingestion IngestionConfig,
 	handler LogHandler,
+	progress ListenerProgress,
 ) {
+	reader := newLogRangeReader(client, contractAddress, ingestion.MaxBlockRange)
 	var backOffCount atomic.Uint64
 	var currentCh chan types.Log
 	var eventSubscription event.Subscription
 
 	logger.Infow("starting listening events", "chainID", chainID, "contractAddress", contractAddress.String())
+	progress.SetState(ListenerStateStarting)
+	defer progress.SetState(ListenerStateStopped)
 	for {
 		if eventSubscription == nil {
-			waitForBackOffTimeout(int(backOffCount.Load()))
+			if ctx.Err() != nil {
+				logger.Infow("stopped listening events", "chainID", chainID, "contractAddress", contractAddress.String())
+				return
+			}
+			waitForBackOffTimeout(ctx, int(backOffCount.Load()))
 
 			currentCh = make(chan types.Log, 100)
 
@@ -59,6 +133,7 @@ func listenEvents(
 			eventSub, err := client.SubscribeFilterLogs(ctx, watchFQ, currentCh)
 			if err != nil {
 				logger.Errorw("failed to subscribe on events", "error", err, "chainID", chainID, "contractAddress", contractAddress.String())
+				progress.SetState(ListenerStateRetrying)
 				backOffCount.Add(1)
 				continue
 			}
@@ -66,16 +141,47 @@ func listenEvents(
 			eventSubscription = eventSub
 			logger.Infow("watching events", "chainID", chainID, "contractAddress", contractAddress.String())
 			backOffCount.Store(0)
+
+			if lastBlock > 0 {
+				backfilled, err := backfillEvents(ctx, client, reader, lastBlock, handler, progress)
+				if err != nil {
+					logger.Errorw("failed to read missed events", "error", err, "chainID", chainID, "contractAddress", contractAddress.String())
+					progress.SetState(ListenerStateRetrying)
+					eventSubscription.Unsubscribe()
+					eventSubscription = nil
+					backOffCount.Add(1)
+					continue
+				}
+				lastBlock = backfilled
+			}
+			progress.SetState(ListenerStateSubscribed)
 		}
 
 		select {
+		case <-ctx.Done():
+			eventSubscription.Unsubscribe()
+			logger.Infow("stopped listening events", "chainID", chainID, "contractAddress", contractAddress.String())
+			return
 		case eventLog := <-currentCh:
+			if eventLog.Removed {
+				logger.Warnw("event removed by a reorg", "chainID", chainID, "blockNumber", eventLog.BlockNumber, "txHash", eventLog.TxHash.String())
+				continue
+			}
 			lastBlock = eventLog.BlockNumber
+			progress.SetHeadBlock(lastBlock)
 			logger.Debugw("received new event", "chainID", chainID, "contractAddress", contractAddress.String(), "blockNumber", lastBlock, "logIndex", eventLog.Index)
-			handler(eventLog)
+			if err := handler(eventLog); err != nil {
+				// The block of the event is read again by the backfill of the next subscription
+				logger.Errorw("failed to handle event", "error", err, "chainID", chainID, "contractAddress", contractAddress.String(), "blockNumber", lastBlock)
+				progress.SetState(ListenerStateRetrying)
+				eventSubscription.Unsubscribe()
+				eventSubscription = nil
+				backOffCount.Add(1)
+			}
 		case err := <-eventSubscription.Err():
 			if err != nil {
 				logger.Errorw("event subscription error", "error", err, "chainID", chainID, "contractAddress", contractAddress.String())
+				progress.SetState(ListenerStateRetrying)
 				eventSubscription.Unsubscribe()
 			} else {
 				logger.Debugw("subscription closed, resubscribing", "chainID", chainID, "contractAddress", contractAddress.String())
@@ -86,15 +192,163 @@ func listenEvents(
 	}
 }
 
-// waitForBackOffTimeout implements exponential backoff between retries
-func waitForBackOffTimeout(backOffCount int) {
-	if backOffCount > maxBackOffCount {
-		logger.Fatalw("back off limit reached, exiting", "backOffCollisionCount", backOffCount)
+// backfillEvents handles the events from a block up to the head block, and returns the head block
+func backfillEvents(ctx context.Context, client bind.ContractBackend, reader *logRangeReader, from uint64, handler LogHandler, progress ListenerProgress) (uint64, error) {
+	head, err := client.HeaderByNumber(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get head block: %w", err)
+	}
+	progress.SetHeadBlock(head.Number.Uint64())
+
+	for next := from; next <= head.Number.Uint64(); {
+		logs, end, err := reader.read(ctx, next, head.Number.Uint64())
+		if err != nil {
+			return 0, err
+		}
+		if err := handleLogs(logs, handler); err != nil {
+			return 0, err
+		}
+		progress.SaveCursor(end)
+		next = end + 1
+	}
+	return max(from, head.Number.Uint64()), nil
+}
+
+// pollEvents polls the events of a contract with eth_getLogs, from the last block with processed events or
+// from the head block without one, and processes them with the provided handler
+func pollEvents(
+	ctx context.Context,
+	client bind.ContractBackend,
+	contractAddress common.Address,
+	chainID uint32,
+	lastBlock uint64,
+	ingestion IngestionConfig,
+	handler LogHandler,
+	progress ListenerProgress,
+) {
+	reader := newLogRangeReader(client, contractAddress, ingestion.MaxBlockRange)
+	backOffCount := 0
+	next := lastBlock // The last block with processed events is read again, its processed events are skipped
+
+	logger.Infow("starting polling events", "chainID", chainID, "contractAddress", contractAddress.String())
+	progress.SetState(ListenerStateStarting)
+	defer progress.SetState(ListenerStateStopped)
+	for {
+		if ctx.Err() != nil {
+			logger.Infow("stopped polling events", "chainID", chainID, "contractAddress", contractAddress.String())
+			return
+		}
+		waitForBackOffTimeout(ctx, backOffCount)
+
+		head, err := client.HeaderByNumber(ctx, nil)
+		if err != nil {
+			logger.Errorw("failed to get head block", "error", err, "chainID", chainID, "contractAddress", contractAddress.String())
+			progress.SetState(ListenerStateRetrying)
+			backOffCount++
+			continue
+		}
+		progress.SetHeadBlock(head.Number.Uint64())
+		if next == 0 {
+			next = head.Number.Uint64()
+		}
+
+		if next > head.Number.Uint64() {
+			backOffCount = 0
+			select {
+			case <-ctx.Done():
+			case <-time.After(ingestion.PollInterval):
+			}
+			continue
+		}
+
+		logs, end, err := reader.read(ctx, next, head.Number.Uint64())
+		if err != nil {
+			logger.Errorw("failed to poll events", "error", err, "chainID", chainID, "contractAddress", contractAddress.String(), "fromBlock", next)
+			progress.SetState(ListenerStateRetrying)
+			backOffCount++
+			continue
+		}
+		progress.SetState(ListenerStatePolling)
+		backOffCount = 0
+		logger.Debugw("polled events", "chainID", chainID, "contractAddress", contractAddress.String(), "fromBlock", next, "toBlock", end, "count", len(logs))
+
+		if err := handleLogs(logs, handler); err != nil {
+			// The range is read again, its events which were processed are skipped
+			logger.Errorw("failed to handle polled events", "error", err, "chainID", chainID, "contractAddress", contractAddress.String(), "fromBlock", next)
+			progress.SetState(ListenerStateRetrying)
+			backOffCount++
+			continue
+		}
+		progress.SaveCursor(end)
+		next = end + 1
+	}
+}
+
+// handleLogs passes logs read from a block range to the handler, skipping the ones removed by a reorg.
+// It stops at the first log whose handling fails.
+func handleLogs(logs []types.Log, handler LogHandler) error {
+	for _, l := range logs {
+		if l.Removed {
+			continue
+		}
+		if err := handler(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logRangeReader reads the logs of a contract over block ranges. The range is halved while the provider
+// refuses it, e.g. for exceeding its block range limit, and grows back up to the maximum after each read.
+type logRangeReader struct {
+	client   bind.ContractFilterer
+	contract common.Address
+	maxRange uint64
+	size     uint64
+}
+
+func newLogRangeReader(client bind.ContractFilterer, contract common.Address, maxRange uint64) *logRangeReader {
+	maxRange = max(maxRange, 1)
+	return &logRangeReader{client: client, contract: contract, maxRange: maxRange, size: maxRange}
+}
+
+// read returns the logs of the blocks from a block up to at most another one, and the last block read
+func (r *logRangeReader) read(ctx context.Context, from, to uint64) ([]types.Log, uint64, error) {
+	for {
+		end := min(to, from+r.size-1)
+		logs, err := r.client.FilterLogs(ctx, ethereum.FilterQuery{
+			FromBlock: new(big.Int).SetUint64(from),
+			ToBlock:   new(big.Int).SetUint64(end),
+			Addresses: []common.Address{r.contract},
+		})
+		if err == nil {
+			r.size = min(r.maxRange, r.size*2)
+			return logs, end, nil
+		}
+		if ctx.Err() != nil || r.size == 1 {
+			return nil, 0, fmt.Errorf("failed to filter logs of blocks %d to %d: %w", from, end, err)
+		}
+
+		r.size = max(1, r.size/2)
+		logger.Debugw("shrinking block range of log queries", "error", err, "contractAddress", r.contract.String(), "blockRange", r.size)
+	}
+}
+
+// waitForBackOffTimeout implements exponential backoff between retries. The timeout stops growing after
+// maxBackOffCount retries, a network whose endpoints are all down keeps retrying without affecting the others.
+func waitForBackOffTimeout(ctx context.Context, backOffCount int) {
+	if backOffCount == 0 {
 		return
 	}
+	if backOffCount >= maxBackOffCount {
+		logger.Errorw("events subscription keeps failing, network is degraded", "backOffCollisionCount", backOffCount)
+		backOffCount = maxBackOffCount
+	}
 
-	if backOffCount > 0 {
-		logger.Infow("backing off before subscribing on contract events", "backOffCollisionCount", backOffCount)
-		<-time.After(time.Duration(2^backOffCount-1) * time.Second)
+	timeout := time.Duration(1<<backOffCount-1) * time.Second
+	logger.Infow("backing off before subscribing on contract events", "backOffCollisionCount", backOffCount, "timeout", timeout)
+	select {
+	case <-ctx.Done():
+	case <-time.After(timeout):
 	}
 }
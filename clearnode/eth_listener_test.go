@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// rangeLimitedBackend serves one log per block, and refuses log queries over more than limit blocks
+type rangeLimitedBackend struct {
+	ChainBackend
+	head   uint64
+	limit  uint64
+	ranges [][2]uint64
+}
+
+func (b *rangeLimitedBackend) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	return &types.Header{Number: new(big.Int).SetUint64(b.head)}, nil
+}
+
+func (b *rangeLimitedBackend) FilterLogs(ctx context.Context, q ethereum.FilterQuery) ([]types.Log, error) {
+	from, to := q.FromBlock.Uint64(), q.ToBlock.Uint64()
+	b.ranges = append(b.ranges, [2]uint64{from, to})
+	if to-from+1 > b.limit {
+		return nil, errors.New("block range is too wide")
+	}
+
+	var logs []types.Log
+	for block := from; block <= to; block++ {
+		logs = append(logs, types.Log{BlockNumber: block, TxHash: common.BigToHash(new(big.Int).SetUint64(block))})
+	}
+	return logs, nil
+}
+
+// testProgress records the state of a listener and passes saved cursors to saveCursor
+type testProgress struct {
+	mu         sync.Mutex
+	states     []ListenerState
+	head       uint64
+	saveCursor func(blockNumber uint64)
+}
+
+func (p *testProgress) SetState(state ListenerState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.states) == 0 || p.states[len(p.states)-1] != state {
+		p.states = append(p.states, state)
+	}
+}
+
+func (p *testProgress) SetHeadBlock(blockNumber uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.head = blockNumber
+}
+
+func (p *testProgress) SaveCursor(blockNumber uint64) {
+	p.saveCursor(blockNumber)
+}
+
+func TestPollEvents(t *testing.T) {
+	backend := &rangeLimitedBackend{head: 120, limit: 25}
+
+	var mu sync.Mutex
+	var handled []uint64
+	var cursor uint64
+	handler := func(l types.Log) error {
+		mu.Lock()
+		defer mu.Unlock()
+		handled = append(handled, l.BlockNumber)
+		return nil
+	}
+	progress := &testProgress{saveCursor: func(blockNumber uint64) {
+		mu.Lock()
+		defer mu.Unlock()
+		cursor = blockNumber
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		pollEvents(ctx, backend, common.HexToAddress("0xc0"), 137, 10, IngestionConfig{PollInterval: time.Millisecond, MaxBlockRange: 100}, handler, progress)
+		close(stopped)
+	}()
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return cursor == 120
+	}, 5*time.Second, time.Millisecond)
+	cancel()
+	<-stopped
+
+	// The last block with processed events is read again, and every later block once
+	require.Len(t, handled, 111)
+	for i, block := range handled {
+		assert.Equal(t, uint64(10+i), block)
+	}
+
+	// The range shrinks below the provider limit, and grows back to it
+	assert.Equal(t, [2]uint64{10, 109}, backend.ranges[0])
+	assert.Equal(t, [2]uint64{10, 34}, backend.ranges[2])
+	for _, r := range backend.ranges[3:] {
+		assert.LessOrEqual(t, r[1]-r[0]+1, uint64(50))
+	}
+
+	// Shrinking the range is not a failure of the listener
+	assert.Equal(t, []ListenerState{ListenerStateStarting, ListenerStatePolling, ListenerStateStopped}, progress.states)
+	assert.Equal(t, uint64(120), progress.head)
+}
+
+func TestPollEventsRetriesFailedEvents(t *testing.T) {
+	backend := &rangeLimitedBackend{head: 60, limit: 100}
+
+	var mu sync.Mutex
+	var failed bool
+	var handled, cursors []uint64
+	handler := func(l types.Log) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if l.BlockNumber == 50 && !failed {
+			failed = true
+			return errors.New("database is unreachable")
+		}
+		handled = append(handled, l.BlockNumber)
+		return nil
+	}
+	progress := &testProgress{saveCursor: func(blockNumber uint64) {
+		mu.Lock()
+		defer mu.Unlock()
+		cursors = append(cursors, blockNumber)
+	}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		pollEvents(ctx, backend, common.HexToAddress("0xc0"), 137, 10, IngestionConfig{PollInterval: time.Millisecond, MaxBlockRange: 100}, handler, progress)
+		close(stopped)
+	}()
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(cursors) > 0
+	}, 5*time.Second, time.Millisecond)
+	cancel()
+	<-stopped
+
+	// The cursor doesn't move past the failed event, which is handled again with its range
+	assert.Equal(t, []uint64{60}, cursors)
+	assert.Contains(t, handled, uint64(50))
+	assert.Equal(t, uint64(60), handled[len(handled)-1])
+	assert.Contains(t, progress.states, ListenerStateRetrying)
+}
+
+func TestEventCursor(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	contract := "0x00000000000000000000000000000000000000C0"
+	block, err := GetEventCursor(db, 137, contract)
+	require.NoError(t, err)
+	assert.Zero(t, block)
+
+	require.NoError(t, SaveEventCursor(db, 137, contract, 100))
+	require.NoError(t, SaveEventCursor(db, 137, contract, 90))
+	require.NoError(t, SaveEventCursor(db, 8453, contract, 5))
+	block, err = GetEventCursor(db, 137, contract)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(100), block, "the cursor never moves back")
+
+	l := types.Log{TxHash: common.HexToHash("0xabc"), Index: 3, BlockNumber: 120}
+	processed, err := IsEventProcessed(db, 137, l)
+	require.NoError(t, err)
+	assert.False(t, processed)
+
+	// The handling of an event is rolled back with its record, and an event is recorded once
+	err = db.Transaction(func(tx *gorm.DB) error {
+		require.NoError(t, MarkEventProcessed(tx, 137, contract, l))
+		return errors.New("ledger post failed")
+	})
+	require.Error(t, err)
+	processed, err = IsEventProcessed(db, 137, l)
+	require.NoError(t, err)
+	assert.False(t, processed, "a failed handling leaves the event unmarked")
+
+	require.NoError(t, MarkEventProcessed(db, 137, contract, l))
+	assert.ErrorIs(t, MarkEventProcessed(db, 137, contract, l), ErrEventProcessed)
+	processed, err = IsEventProcessed(db, 137, l)
+	require.NoError(t, err)
+	assert.True(t, processed)
+	processed, err = IsEventProcessed(db, 8453, l)
+	require.NoError(t, err)
+	assert.False(t, processed)
+
+	block, err = GetEventCursor(db, 137, contract)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(120), block)
+}
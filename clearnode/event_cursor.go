@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// EventCursor is the last block of a custody contract with processed events. Ingestion resumes by reading
+// the block again, its events which were processed are skipped.
+type EventCursor struct {
+	ChainID         uint32 `gorm:"column:chain_id;primaryKey"`
+	ContractAddress string `gorm:"column:contract_address;primaryKey"`
+	BlockNumber     uint64 `gorm:"column:block_number;not null"`
+	UpdatedAt       time.Time
+}
+
+// TableName specifies the table name for the EventCursor model
+func (EventCursor) TableName() string {
+	return "event_cursors"
+}
+
+// ProcessedEvent is a custody contract event which was handled, so that events read again are skipped
+type ProcessedEvent struct {
+	ID          uint   `gorm:"primaryKey"`
+	ChainID     uint32 `gorm:"column:chain_id;not null;uniqueIndex:idx_processed_events_log"`
+	TxHash      string `gorm:"column:tx_hash;not null;uniqueIndex:idx_processed_events_log"`
+	LogIndex    uint   `gorm:"column:log_index;not null;uniqueIndex:idx_processed_events_log"`
+	BlockNumber uint64 `gorm:"column:block_number;not null"`
+	CreatedAt   time.Time
+}
+
+// TableName specifies the table name for the ProcessedEvent model
+func (ProcessedEvent) TableName() string {
+	return "processed_events"
+}
+
+// GetEventCursor returns the last processed block of a custody contract, or 0 when none was processed yet
+func GetEventCursor(tx *gorm.DB, chainID uint32, contractAddress string) (uint64, error) {
+	var cursor EventCursor
+	err := tx.Where("chain_id = ? AND contract_address = ?", chainID, contractAddress).First(&cursor).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get event cursor: %w", err)
+	}
+	return cursor.BlockNumber, nil
+}
+
+// SaveEventCursor moves the cursor of a custody contract forward to a block, it never moves back
+func SaveEventCursor(tx *gorm.DB, chainID uint32, contractAddress string, blockNumber uint64) error {
+	cursor := EventCursor{ChainID: chainID, ContractAddress: contractAddress, BlockNumber: blockNumber, UpdatedAt: time.Now()}
+	err := tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{{Name: "chain_id"}, {Name: "contract_address"}},
+		DoUpdates: clause.Set{
+			{Column: clause.Column{Name: "block_number"}, Value: gorm.Expr("CASE WHEN event_cursors.block_number > ? THEN event_cursors.block_number ELSE ? END", blockNumber, blockNumber)},
+			{Column: clause.Column{Name: "updated_at"}, Value: cursor.UpdatedAt},
+		},
+	}).Create(&cursor).Error
+	if err != nil {
+		return fmt.Errorf("failed to save event cursor: %w", err)
+	}
+	return nil
+}
+
+// IsEventProcessed tells whether a custody contract event was already handled
+func IsEventProcessed(tx *gorm.DB, chainID uint32, l types.Log) (bool, error) {
+	var count int64
+	err := tx.Model(&ProcessedEvent{}).
+		Where("chain_id = ? AND tx_hash = ? AND log_index = ?", chainID, l.TxHash.Hex(), l.Index).
+		Count(&count).Error
+	if err != nil {
+		return false, fmt.Errorf("failed to check processed events: %w", err)
+	}
+	return count > 0, nil
+}
+
+// ErrEventProcessed is returned when recording an event which was already processed, the transaction
+// handling it again must be rolled back
+var ErrEventProcessed = errors.New("event was already processed")
+
+// MarkEventProcessed records a handled custody contract event and moves the cursor to its block. It runs
+// in the transaction of the handling, the unique key of the event rejects a second handling.
+func MarkEventProcessed(tx *gorm.DB, chainID uint32, contractAddress string, l types.Log) error {
+	return tx.Transaction(func(tx *gorm.DB) error {
+		event := ProcessedEvent{ChainID: chainID, TxHash: l.TxHash.Hex(), LogIndex: l.Index, BlockNumber: l.BlockNumber}
+		result := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&event)
+		if result.Error != nil {
+			return fmt.Errorf("failed to record processed event: %w", result.Error)
+		}
+		if result.RowsAffected == 0 {
+			return ErrEventProcessed
+		}
+		return SaveEventCursor(tx, chainID, contractAddress, l.BlockNumber)
+	})
+}
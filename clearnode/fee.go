@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/shopspring/decimal"
+)
+
+// FeeOperation is an operation the broker can charge a fee for
+type FeeOperation string
+
+var (
+	FeeOperationCloseAppSession FeeOperation = "close_app_session" // Charged on the allocation each participant receives
+	FeeOperationResizeChannel   FeeOperation = "resize_channel"    // Charged on the amount withdrawn from the unified balance
+)
+
+// basisPointsDenominator is the number of basis points in 100%
+const basisPointsDenominator = 10000
+
+// RevenueAccount collects the fees charged by the broker
+func RevenueAccount() Account {
+	return Account{ID: "revenue:fees", Type: RevenueDefault, Participant: BrokerParticipant}
+}
+
+// FeeRule is a flat and/or proportional fee for an operation.
+// Rules can be narrowed down to an app protocol and an asset, the most specific matching rule applies.
+type FeeRule struct {
+	Operation   FeeOperation    `json:"operation"`
+	Protocol    string          `json:"protocol,omitempty"`
+	Asset       string          `json:"asset,omitempty"`
+	Flat        decimal.Decimal `json:"flat"`
+	BasisPoints uint32          `json:"basis_points"`
+}
+
+// specificity ranks rules, preferring asset specific rules over protocol specific ones
+func (r FeeRule) specificity() int {
+	s := 0
+	if r.Asset != "" {
+		s += 2
+	}
+	if r.Protocol != "" {
+		s++
+	}
+	return s
+}
+
+func (r FeeRule) matches(op FeeOperation, protocol, asset string) bool {
+	return r.Operation == op &&
+		(r.Protocol == "" || r.Protocol == protocol) &&
+		(r.Asset == "" || r.Asset == asset)
+}
+
+// feeMemo describes the entries of a fee in the ledger
+func feeMemo(op FeeOperation) string {
+	return fmt.Sprintf("Fee for %s", op)
+}
+
+// FeeItem is a fee charged to a participant, itemized in responses
+type FeeItem struct {
+	Operation   FeeOperation    `json:"operation"`
+	Participant string          `json:"participant"`
+	Asset       string          `json:"asset"`
+	Amount      decimal.Decimal `json:"amount"`
+}
+
+// FeeSchedule holds the configured fee rules. A nil schedule charges no fees.
+type FeeSchedule struct {
+	Rules []FeeRule `json:"fees"`
+}
+
+// LoadFeeSchedule reads a fee schedule from a JSON file
+func LoadFeeSchedule(path string) (*FeeSchedule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fee schedule: %w", err)
+	}
+
+	var schedule FeeSchedule
+	if err := json.Unmarshal(data, &schedule); err != nil {
+		return nil, fmt.Errorf("invalid fee schedule: %w", err)
+	}
+
+	for i, rule := range schedule.Rules {
+		switch rule.Operation {
+		case FeeOperationCloseAppSession, FeeOperationResizeChannel:
+		default:
+			return nil, fmt.Errorf("fee rule %d: unsupported operation %q", i, rule.Operation)
+		}
+		if rule.Flat.IsNegative() {
+			return nil, fmt.Errorf("fee rule %d: flat fee must not be negative", i)
+		}
+		if rule.BasisPoints > basisPointsDenominator {
+			return nil, fmt.Errorf("fee rule %d: basis points must not exceed %d", i, basisPointsDenominator)
+		}
+	}
+
+	return &schedule, nil
+}
+
+// Rule returns the most specific rule for an operation, if any
+func (s *FeeSchedule) Rule(op FeeOperation, protocol, asset string) (FeeRule, bool) {
+	if s == nil {
+		return FeeRule{}, false
+	}
+
+	var best FeeRule
+	found := false
+	for _, r := range s.Rules {
+		if r.matches(op, protocol, asset) && (!found || r.specificity() > best.specificity()) {
+			best = r
+			found = true
+		}
+	}
+	return best, found
+}
+
+// Quote returns the fee for an operation on the given amount.
+// The fee never exceeds the amount, and nothing is charged on zero amounts.
+func (s *FeeSchedule) Quote(op FeeOperation, protocol, asset string, amount decimal.Decimal) decimal.Decimal {
+	rule, ok := s.Rule(op, protocol, asset)
+	if !ok || !amount.IsPositive() {
+		return decimal.Zero
+	}
+
+	fee := rule.Flat.Add(amount.Mul(decimal.NewFromInt(int64(rule.BasisPoints))).Div(decimal.NewFromInt(basisPointsDenominator)))
+	fee = fee.Truncate(18)
+	if fee.GreaterThan(amount) {
+		return amount
+	}
+	return fee
+}
+
+// Charge quotes the fee of an operation and adds its transfer to the revenue account to the ledger transaction
+func (s *FeeSchedule) Charge(ledgerTx *LedgerTransaction, op FeeOperation, protocol string, account Account, asset string, amount decimal.Decimal) *FeeItem {
+	fee := s.Quote(op, protocol, asset, amount)
+	if fee.IsZero() {
+		return nil
+	}
+
+	ledgerTx.withMemo(feeMemo(op), func() {
+		ledgerTx.Transfer(account, RevenueAccount(), asset, fee)
+	})
+	return &FeeItem{
+		Operation:   op,
+		Participant: account.Participant,
+		Asset:       asset,
+		Amount:      fee,
+	}
+}
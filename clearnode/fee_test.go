@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// writeFeeSchedule writes a fee schedule file and loads it
+func writeFeeSchedule(t *testing.T, content string) (*FeeSchedule, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "fees.json")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return LoadFeeSchedule(path)
+}
+
+func TestFeeSchedule(t *testing.T) {
+	fees, err := writeFeeSchedule(t, `{"fees": [
+		{"operation": "close_app_session", "flat": "0.5"},
+		{"operation": "close_app_session", "protocol": "NitroRPC/0.2", "basis_points": 100},
+		{"operation": "close_app_session", "asset": "eth", "flat": "0.001", "basis_points": 10},
+		{"operation": "resize_channel", "asset": "usdc", "flat": "1"}
+	]}`)
+	require.NoError(t, err)
+
+	tcs := []struct {
+		name     string
+		op       FeeOperation
+		protocol string
+		asset    string
+		amount   int64
+		expected string
+	}{
+		{"Default", FeeOperationCloseAppSession, "custom", "usdc", 100, "0.5"},
+		{"ProtocolRule", FeeOperationCloseAppSession, "NitroRPC/0.2", "usdc", 100, "1"},
+		{"AssetRulePreferred", FeeOperationCloseAppSession, "NitroRPC/0.2", "eth", 100, "0.101"},
+		{"CappedAtAmount", FeeOperationResizeChannel, "", "usdc", 1, "1"},
+		{"ZeroAmount", FeeOperationCloseAppSession, "custom", "usdc", 0, "0"},
+		{"NoRule", FeeOperationResizeChannel, "", "eth", 100, "0"},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			fee := fees.Quote(tc.op, tc.protocol, tc.asset, decimal.NewFromInt(tc.amount))
+			assert.True(t, decimal.RequireFromString(tc.expected).Equal(fee), "expected %s, got %s", tc.expected, fee)
+		})
+	}
+
+	t.Run("NilSchedule", func(t *testing.T) {
+		var none *FeeSchedule
+		assert.True(t, none.Quote(FeeOperationCloseAppSession, "", "usdc", decimal.NewFromInt(100)).IsZero())
+	})
+
+	t.Run("InvalidRules", func(t *testing.T) {
+		_, err := writeFeeSchedule(t, `{"fees": [{"operation": "transfer", "flat": "1"}]}`)
+		assert.ErrorContains(t, err, "unsupported operation")
+		_, err = writeFeeSchedule(t, `{"fees": [{"operation": "resize_channel", "flat": "-1"}]}`)
+		assert.ErrorContains(t, err, "negative")
+		_, err = writeFeeSchedule(t, `{"fees": [{"operation": "resize_channel", "basis_points": 10001}]}`)
+		assert.ErrorContains(t, err, "basis points")
+	})
+}
+
+func TestHandleGetFeeSchedule(t *testing.T) {
+	fees, err := writeFeeSchedule(t, `{"fees": [
+		{"operation": "close_app_session", "basis_points": 50},
+		{"operation": "resize_channel", "flat": "1"}
+	]}`)
+	require.NoError(t, err)
+
+	resp, err := HandleGetFeeSchedule(&RPCMessage{Req: &RPCData{RequestID: 1, Method: "get_fee_schedule", Params: []any{
+		map[string]any{"operation": "close_app_session", "amount": "200"},
+	}}}, fees)
+	require.NoError(t, err)
+
+	schedule, ok := resp.Res.Params[0].(FeeScheduleResponse)
+	require.True(t, ok)
+	require.Len(t, schedule.Fees, 1)
+	assert.Equal(t, uint32(50), schedule.Fees[0].BasisPoints)
+	require.NotNil(t, schedule.Quote)
+	assert.True(t, decimal.NewFromInt(1).Equal(*schedule.Quote))
+
+	_, err = HandleGetFeeSchedule(&RPCMessage{Req: &RPCData{RequestID: 2, Method: "get_fee_schedule", Params: []any{
+		map[string]any{"amount": "200"},
+	}}}, fees)
+	assert.Error(t, err)
+
+	resp, err = HandleGetFeeSchedule(&RPCMessage{Req: &RPCData{RequestID: 3, Method: "get_fee_schedule"}}, nil)
+	require.NoError(t, err)
+	assert.Empty(t, resp.Res.Params[0].(FeeScheduleResponse).Fees)
+}
+
+func TestFeesCollectedIntoRevenue(t *testing.T) {
+	raw, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signer := LocalSigner{privateKey: raw}
+	participant := signer.GetAddress().Hex()
+
+	fees, err := writeFeeSchedule(t, `{"fees": [
+		{"operation": "close_app_session", "basis_points": 100},
+		{"operation": "resize_channel", "flat": "0.5"}
+	]}`)
+	require.NoError(t, err)
+
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	revenue := GetParticipantLedger(db, BrokerParticipant)
+
+	t.Run("CloseAppSession", func(t *testing.T) {
+		sessionID := "0xFeeSession"
+		require.NoError(t, db.Create(&AppSession{
+			SessionID:    sessionID,
+			Protocol:     "NitroRPC/0.2",
+			Participants: []string{participant},
+			Status:       ChannelStatusOpen,
+			Weights:      []int64{100},
+			Quorum:       100,
+		}).Error)
+		seedLedger(t, db, AppSessionAccount(sessionID, participant), "usdc", decimal.NewFromInt(200))
+
+		closeParams := CloseAppSessionParams{
+			AppSessionID: sessionID,
+			Allocations:  []AppAllocation{{Participant: participant, AssetSymbol: "usdc", Amount: decimal.NewFromInt(200)}},
+		}
+		req := &RPCMessage{Req: &RPCData{RequestID: 1, Method: "close_app_session", Params: []any{closeParams}, Timestamp: 1}}
+		signBytes, err := json.Marshal(CloseAppSignData{RequestID: 1, Method: "close_app_session", Params: []CloseAppSessionParams{closeParams}, Timestamp: 1})
+		require.NoError(t, err)
+		sig, err := signer.Sign(signBytes)
+		require.NoError(t, err)
+		req.Sig = []string{hexutil.Encode(sig)}
+
+		resp, err := HandleCloseApplication(req, db, fees)
+		require.NoError(t, err)
+
+		appResp, ok := resp.Res.Params[0].(*AppSessionResponse)
+		require.True(t, ok)
+		require.Len(t, appResp.Fees, 1)
+		assert.Equal(t, participant, appResp.Fees[0].Participant)
+		assert.True(t, decimal.NewFromInt(2).Equal(appResp.Fees[0].Amount))
+
+		balance, err := GetParticipantLedger(db, participant).Balance(participant, "usdc")
+		require.NoError(t, err)
+		assert.True(t, decimal.NewFromInt(198).Equal(balance), "got %s", balance)
+
+		collected, err := revenue.Balance(RevenueAccount().ID, "usdc")
+		require.NoError(t, err)
+		assert.True(t, decimal.NewFromInt(2).Equal(collected), "got %s", collected)
+
+		// The fee is posted in the same ledger transaction as the redistribution
+		var txIDs []string
+		require.NoError(t, db.Model(&Entry{}).Where("account_id IN ?", []string{sessionID, RevenueAccount().ID}).Distinct().Pluck("tx_id", &txIDs).Error)
+		assert.Len(t, txIDs, 2, "seed and close transactions")
+
+		var feeEntry Entry
+		require.NoError(t, db.Where("account_id = ?", RevenueAccount().ID).First(&feeEntry).Error)
+		assert.Equal(t, ReferenceTypeAppSession, feeEntry.ReferenceType)
+		assert.Equal(t, sessionID, feeEntry.Reference)
+		assert.Equal(t, "Fee for close_app_session", feeEntry.Memo)
+	})
+
+	t.Run("ResizeChannel", func(t *testing.T) {
+		brokerKey, err := crypto.GenerateKey()
+		require.NoError(t, err)
+		keys := NewKeyRing(&LocalSigner{privateKey: brokerKey})
+
+		tokenAddress := "0x1234567890123456789012345678901234567890"
+		require.NoError(t, db.Create(&Asset{Token: tokenAddress, ChainID: 137, Symbol: "usdc", Decimals: 6}).Error)
+		channel := Channel{
+			ChannelID:   "0xFeeChannel",
+			Participant: participant,
+			Status:      ChannelStatusOpen,
+			Token:       tokenAddress,
+			ChainID:     137,
+			Amount:      1000000,
+			Version:     1,
+		}
+		require.NoError(t, db.Create(&channel).Error)
+
+		resizeParams := ResizeChannelParams{ChannelID: channel.ChannelID, ResizeAmount: big.NewInt(10000000), FundsDestination: participant}
+		signBytes, err := json.Marshal(ResizeChannelSignData{RequestID: 2, Method: "resize_channel", Params: []ResizeChannelParams{resizeParams}, Timestamp: 2})
+		require.NoError(t, err)
+		sig, err := signer.Sign(signBytes)
+		require.NoError(t, err)
+
+		resp, err := HandleResizeChannel(&RPCMessage{
+			Req: &RPCData{RequestID: 2, Method: "resize_channel", Params: []any{resizeParams}, Timestamp: 2},
+			Sig: []string{hexutil.Encode(sig)},
+		}, db, keys, fees, nil)
+		require.NoError(t, err)
+
+		resizeResp, ok := resp.Res.Params[0].(ResizeChannelResponse)
+		require.True(t, ok)
+		require.Len(t, resizeResp.Fees, 1)
+		assert.True(t, decimal.RequireFromString("0.5").Equal(resizeResp.Fees[0].Amount))
+
+		// The fee is held together with the withdrawn amount and charged when the hold converts
+		balances, err := GetParticipantLedger(db, participant).GetBalances(participant)
+		require.NoError(t, err)
+		require.Len(t, balances, 1)
+		assert.True(t, decimal.RequireFromString("10.5").Equal(balances[0].Held), "got %s", balances[0].Held)
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			holds, err := settleResizedStates(tx, channel.ChannelID, resizeResp.Version, resizeResp.StateData)
+			if err != nil {
+				return err
+			}
+			ledgerTx := NewLedgerTransaction(tx)
+			chargeHoldFees(ledgerTx, holds)
+			return ledgerTx.Post()
+		})
+		require.NoError(t, err)
+
+		collected, err := revenue.Balance(RevenueAccount().ID, "usdc")
+		require.NoError(t, err)
+		assert.True(t, decimal.RequireFromString("2.5").Equal(collected), "got %s", collected)
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -11,7 +12,6 @@ import (
 	"github.com/erc7824/go-nitrolite"
 	"github.com/ethereum/go-ethereum/accounts/abi"
 	"github.com/ethereum/go-ethereum/common"
-	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/lib/pq"
 	"github.com/shopspring/decimal"
@@ -72,15 +72,45 @@ func (r CloseAppSignData) MarshalJSON() ([]byte, error) {
 
 // AppSessionResponse represents response data for application operations
 type AppSessionResponse struct {
-	AppSessionID string   `json:"app_session_id"`
-	Status       string   `json:"status"`
-	Participants []string `json:"participants,omitempty"`
-	Protocol     string   `json:"protocol,omitempty"`
-	Challenge    uint64   `json:"challenge,omitempty"`
-	Weights      []int64  `json:"weights,omitempty"`
-	Quorum       uint64   `json:"quorum,omitempty"`
-	Version      uint64   `json:"version,omitempty"`
-	Nonce        uint64   `json:"nonce,omitempty"`
+	AppSessionID string    `json:"app_session_id"`
+	Status       string    `json:"status"`
+	Participants []string  `json:"participants,omitempty"`
+	Protocol     string    `json:"protocol,omitempty"`
+	Challenge    uint64    `json:"challenge,omitempty"`
+	Weights      []int64   `json:"weights,omitempty"`
+	Quorum       uint64    `json:"quorum,omitempty"`
+	Version      uint64    `json:"version,omitempty"`
+	Nonce        uint64    `json:"nonce,omitempty"`
+	Fees         []FeeItem `json:"fees,omitempty"` // Fees charged on the allocations when closing
+}
+
+// GetLedgerEntriesParams represents parameters for listing ledger entries
+type GetLedgerEntriesParams struct {
+	ListOptions
+	AccountID string `json:"account_id"`
+	Asset     string `json:"asset,omitempty"`
+}
+
+// GetAppSessionsParams represents parameters for listing app sessions
+type GetAppSessionsParams struct {
+	ListOptions
+	Participant string `json:"participant"`
+	Status      string `json:"status,omitempty"`
+}
+
+// GetChannelsParams represents parameters for listing channels
+type GetChannelsParams struct {
+	ListOptions
+	Participant string `json:"participant"`
+	Status      string `json:"status,omitempty"`
+	Token       string `json:"token,omitempty"`
+	ChainID     uint32 `json:"chain_id,omitempty"`
+}
+
+// GetRPCHistoryParams represents parameters for listing the RPC history
+type GetRPCHistoryParams struct {
+	ListOptions
+	Method string `json:"method,omitempty"`
 }
 
 // ResizeChannelParams represents parameters needed for resizing a channel
@@ -100,6 +130,7 @@ type ResizeChannelResponse struct {
 	Allocations []Allocation `json:"allocations"`
 	StateHash   string       `json:"state_hash"`
 	Signature   Signature    `json:"server_signature"`
+	Fees        []FeeItem    `json:"fees,omitempty"` // Charged when the resize lands on-chain
 }
 
 // Allocation represents a token allocation for a specific participant
@@ -109,6 +140,19 @@ type Allocation struct {
 	Amount       *big.Int `json:"amount,string"`
 }
 
+// WithdrawParams represents parameters needed to withdraw from the unified balance on a chain
+type WithdrawParams struct {
+	Asset            string          `json:"asset"             validate:"required"`
+	ChainID          uint32          `json:"chain_id"          validate:"required"`
+	Amount           decimal.Decimal `json:"amount"`
+	FundsDestination string          `json:"funds_destination" validate:"required"`
+}
+
+// LiquidityResponse lists the broker liquidity per chain and token
+type LiquidityResponse struct {
+	Liquidity []ChainLiquidity `json:"liquidity"`
+}
+
 type ResizeChannelSignData struct {
 	RequestID uint64
 	Method    string
@@ -117,14 +161,18 @@ type ResizeChannelSignData struct {
 }
 
 type LedgerEntryResponse struct {
-	ID          uint            `json:"id"`
-	AccountID   string          `json:"account_id"`
-	AccountType AccountType     `json:"account_type"`
-	Asset       string          `json:"asset"`
-	Participant string          `json:"participant"`
-	Credit      decimal.Decimal `json:"credit"`
-	Debit       decimal.Decimal `json:"debit"`
-	CreatedAt   time.Time       `json:"created_at"`
+	ID            uint            `json:"id"`
+	TxID          string          `json:"tx_id"`
+	AccountID     string          `json:"account_id"`
+	AccountType   AccountType     `json:"account_type"`
+	Asset         string          `json:"asset"`
+	Participant   string          `json:"participant"`
+	Credit        decimal.Decimal `json:"credit"`
+	Debit         decimal.Decimal `json:"debit"`
+	ReferenceType ReferenceType   `json:"reference_type,omitempty"`
+	Reference     string          `json:"reference,omitempty"`
+	Memo          string          `json:"memo,omitempty"`
+	CreatedAt     time.Time       `json:"created_at"`
 }
 
 func (r ResizeChannelSignData) MarshalJSON() ([]byte, error) {
@@ -154,6 +202,7 @@ type ChannelResponse struct {
 	ChannelID   string        `json:"channel_id"`
 	Participant string        `json:"participant"`
 	Status      ChannelStatus `json:"status"`
+	Reason      string        `json:"reason,omitempty"` // Why the broker rejected the channel
 	Token       string        `json:"token"`
 	// Total amount in the channel (user + broker)
 	Amount      *big.Int `json:"amount"`
@@ -173,8 +222,10 @@ type Signature struct {
 }
 
 type Balance struct {
-	Asset  string          `json:"asset"`
-	Amount decimal.Decimal `json:"amount"`
+	Asset     string          `json:"asset"`
+	Amount    decimal.Decimal `json:"amount"`
+	Held      decimal.Decimal `json:"held"`      // Reserved for signed withdrawals pending on-chain
+	Spendable decimal.Decimal `json:"spendable"` // Amount minus held
 }
 
 // NetworkInfo represents information about a supported network
@@ -186,8 +237,9 @@ type NetworkInfo struct {
 
 // BrokerConfig represents the broker configuration information
 type BrokerConfig struct {
-	BrokerAddress string        `json:"broker_address"`
-	Networks      []NetworkInfo `json:"networks"`
+	BrokerAddress string          `json:"broker_address"`
+	BrokerKeys    []BrokerKeyInfo `json:"broker_keys"`
+	Networks      []NetworkInfo   `json:"networks"`
 }
 
 // RPCEntry represents an RPC record from history.
@@ -203,8 +255,23 @@ type RPCEntry struct {
 	ResSig    []string `json:"res_sig"`
 }
 
+// parseListParams decodes the optional first parameter of a list request and validates its list options
+func parseListParams(rpc *RPCMessage, params any, opts *ListOptions) error {
+	if len(rpc.Req.Params) > 0 && rpc.Req.Params[0] != nil {
+		paramsJSON, err := json.Marshal(rpc.Req.Params[0])
+		if err != nil {
+			return fmt.Errorf("failed to parse parameters: %w", err)
+		}
+		if err := json.Unmarshal(paramsJSON, params); err != nil {
+			return fmt.Errorf("invalid parameters format: %w", err)
+		}
+	}
+
+	return opts.normalize()
+}
+
 // HandleGetConfig returns the broker configuration
-func HandleGetConfig(rpc *RPCMessage, config *Config, signer *Signer) (*RPCMessage, error) {
+func HandleGetConfig(rpc *RPCMessage, config *Config, keys *KeyRing) (*RPCMessage, error) {
 	supportedNetworks := []NetworkInfo{}
 
 	// Populate the supported networks from the config
@@ -217,7 +284,8 @@ func HandleGetConfig(rpc *RPCMessage, config *Config, signer *Signer) (*RPCMessa
 	}
 
 	brokerConfig := BrokerConfig{
-		BrokerAddress: signer.GetAddress().Hex(),
+		BrokerAddress: keys.Active().GetAddress().Hex(),
+		BrokerKeys:    keys.Schedule(),
 		Networks:      supportedNetworks,
 	}
 
@@ -255,27 +323,18 @@ func HandleGetLedgerBalances(rpc *RPCMessage, address string, db *gorm.DB) (*RPC
 }
 
 func HandleGetLedgerEntries(rpc *RPCMessage, address string, db *gorm.DB) (*RPCMessage, error) {
-	var accountID string
-	var asset string
-
-	if len(rpc.Req.Params) > 0 {
-		paramsJSON, err := json.Marshal(rpc.Req.Params[0])
-		if err == nil {
-			var params map[string]string
-			if err := json.Unmarshal(paramsJSON, &params); err == nil {
-				accountID = params["account_id"]
-				asset = params["asset"]
-			}
-		}
+	var params GetLedgerEntriesParams
+	if err := parseListParams(rpc, &params, &params.ListOptions); err != nil {
+		return nil, err
 	}
 
-	if accountID == "" {
+	if params.AccountID == "" {
 		return nil, errors.New("missing account_id")
 	}
 
 	ledger := GetParticipantLedger(db, address)
 
-	entries, err := ledger.GetEntries(accountID, asset)
+	entries, page, err := ledger.GetEntries(params.AccountID, params.Asset, params.ListOptions)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find account: %w", err)
 	}
@@ -283,18 +342,22 @@ func HandleGetLedgerEntries(rpc *RPCMessage, address string, db *gorm.DB) (*RPCM
 	response := make([]LedgerEntryResponse, len(entries))
 	for i, entry := range entries {
 		response[i] = LedgerEntryResponse{
-			ID:          entry.ID,
-			AccountID:   entry.AccountID,
-			AccountType: entry.AccountType,
-			Asset:       entry.AssetSymbol,
-			Participant: entry.Participant,
-			Credit:      entry.Credit,
-			Debit:       entry.Debit,
-			CreatedAt:   entry.CreatedAt,
+			ID:            entry.ID,
+			TxID:          entry.TxID,
+			AccountID:     entry.AccountID,
+			AccountType:   entry.AccountType,
+			Asset:         entry.AssetSymbol,
+			Participant:   entry.Participant,
+			Credit:        entry.Credit,
+			Debit:         entry.Debit,
+			ReferenceType: entry.ReferenceType,
+			Reference:     entry.Reference,
+			Memo:          entry.Memo,
+			CreatedAt:     entry.CreatedAt,
 		}
 	}
 
-	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response, page}, time.Now())
 	return rpcResponse, nil
 }
 
@@ -363,6 +426,19 @@ func HandleCreateApplication(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error)
 
 	// Use a transaction to ensure atomicity for the entire operation
 	err = db.Transaction(func(tx *gorm.DB) error {
+		// Lock the participant balances before checking them, so they can't be spent concurrently
+		balanceRefs := make([]BalanceRef, 0, len(createApp.Allocations))
+		for _, allocation := range createApp.Allocations {
+			balanceRefs = append(balanceRefs, BalanceRef{Account: ParticipantAccount(allocation.Participant), AssetSymbol: allocation.AssetSymbol})
+		}
+		if err := LockBalances(tx, balanceRefs...); err != nil {
+			return err
+		}
+
+		ledgerTx := NewLedgerTransaction(tx)
+		ledgerTx.SetReference(ReferenceTypeAppSession, appSessionID.Hex(), "Funds locked in app session")
+		// Amounts locked per participant and asset, as entries are only written once all allocations are checked
+		locked := map[string]decimal.Decimal{}
 		for _, allocation := range createApp.Allocations {
 			if allocation.Amount.IsNegative() {
 				return errors.New("invalid allocation")
@@ -374,19 +450,25 @@ func HandleCreateApplication(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error)
 			}
 
 			participantLedger := GetParticipantLedger(tx, allocation.Participant)
-			balance, err := participantLedger.Balance(allocation.Participant, allocation.AssetSymbol)
+			balance, err := participantLedger.SpendableBalance(allocation.Participant, allocation.AssetSymbol)
 			if err != nil {
 				return fmt.Errorf("failed to check participant balance: %w", err)
 			}
-			if allocation.Amount.GreaterThan(balance) {
+			lockKey := allocation.Participant + ":" + allocation.AssetSymbol
+			locked[lockKey] = locked[lockKey].Add(allocation.Amount)
+			if locked[lockKey].GreaterThan(balance) {
 				return errors.New("insufficient funds")
 			}
-			if err := participantLedger.Record(allocation.Participant, allocation.AssetSymbol, allocation.Amount.Neg()); err != nil {
-				return fmt.Errorf("failed to transfer funds from participant: %w", err)
-			}
-			if err := participantLedger.Record(appSessionID.Hex(), allocation.AssetSymbol, allocation.Amount); err != nil {
-				return fmt.Errorf("failed to transfer funds to virtual app: %w", err)
-			}
+			ledgerTx.Transfer(
+				ParticipantAccount(allocation.Participant),
+				AppSessionAccount(appSessionID.Hex(), allocation.Participant),
+				allocation.AssetSymbol,
+				allocation.Amount,
+			)
+		}
+
+		if err := ledgerTx.Post(); err != nil {
+			return fmt.Errorf("failed to transfer funds to virtual app: %w", err)
 		}
 
 		weights := pq.Int64Array{}
@@ -428,7 +510,7 @@ func HandleCreateApplication(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error)
 }
 
 // HandleCloseApplication closes a virtual app session and redistributes funds to participants
-func HandleCloseApplication(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error) {
+func HandleCloseApplication(rpc *RPCMessage, db *gorm.DB, fees *FeeSchedule) (*RPCMessage, error) {
 	if len(rpc.Req.Params) == 0 {
 		return nil, errors.New("missing parameters")
 	}
@@ -467,6 +549,7 @@ func HandleCloseApplication(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error) {
 		return nil, errors.New("error serializing message")
 	}
 
+	var feeItems []FeeItem
 	err = db.Transaction(func(tx *gorm.DB) error {
 		var appSession AppSession
 		if err := tx.Where("session_id = ? AND status = ?", params.AppSessionID, ChannelStatusOpen).Order("nonce DESC").
@@ -504,6 +587,20 @@ func HandleCloseApplication(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error) {
 			return fmt.Errorf("quorum not met: %d / %d", totalWeight, appSession.Quorum)
 		}
 
+		// Lock the session balances before reading them, so they can't be redistributed twice
+		var balanceRefs []BalanceRef
+		for _, p := range appSession.Participants {
+			for asset := range assets {
+				balanceRefs = append(balanceRefs,
+					BalanceRef{Account: AppSessionAccount(appSession.SessionID, p), AssetSymbol: asset},
+					BalanceRef{Account: ParticipantAccount(p), AssetSymbol: asset},
+				)
+			}
+		}
+		if err := LockBalances(tx, balanceRefs...); err != nil {
+			return err
+		}
+
 		appSessionBalance := map[string]decimal.Decimal{}
 		for _, p := range appSession.Participants {
 			ledger := GetParticipantLedger(tx, p)
@@ -516,6 +613,8 @@ func HandleCloseApplication(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error) {
 			}
 		}
 
+		ledgerTx := NewLedgerTransaction(tx)
+		ledgerTx.SetReference(ReferenceTypeAppSession, appSession.SessionID, "App session closed, funds released")
 		allocationSum := map[string]decimal.Decimal{}
 		participantsSeen := map[string]bool{}
 
@@ -536,11 +635,10 @@ func HandleCloseApplication(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error) {
 			}
 
 			// Debit session, credit participant
-			if err := ledger.Record(appSession.SessionID, alloc.AssetSymbol, balance.Neg()); err != nil {
-				return fmt.Errorf("failed to debit session: %w", err)
-			}
-			if err := ledger.Record(alloc.Participant, alloc.AssetSymbol, alloc.Amount); err != nil {
-				return fmt.Errorf("failed to credit participant: %w", err)
+			ledgerTx.Debit(AppSessionAccount(appSession.SessionID, alloc.Participant), alloc.AssetSymbol, balance)
+			ledgerTx.Credit(ParticipantAccount(alloc.Participant), alloc.AssetSymbol, alloc.Amount)
+			if fee := fees.Charge(ledgerTx, FeeOperationCloseAppSession, appSession.Protocol, ParticipantAccount(alloc.Participant), alloc.AssetSymbol, alloc.Amount); fee != nil {
+				feeItems = append(feeItems, *fee)
 			}
 
 			allocationSum[alloc.AssetSymbol] = allocationSum[alloc.AssetSymbol].Add(alloc.Amount)
@@ -562,6 +660,10 @@ func HandleCloseApplication(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error) {
 			}
 		}
 
+		if err := ledgerTx.Post(); err != nil {
+			return fmt.Errorf("failed to redistribute session funds: %w", err)
+		}
+
 		return tx.Model(&appSession).Updates(map[string]any{
 			"status": ChannelStatusClosed,
 		}).Error
@@ -574,6 +676,7 @@ func HandleCloseApplication(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error) {
 	response := &AppSessionResponse{
 		AppSessionID: params.AppSessionID,
 		Status:       string(ChannelStatusClosed),
+		Fees:         feeItems,
 	}
 
 	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
@@ -621,25 +724,16 @@ func HandleGetAppDefinition(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error) {
 }
 
 func HandleGetAppSessions(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error) {
-	var participant string
-	var status string
-
-	if len(rpc.Req.Params) > 0 {
-		paramsJSON, err := json.Marshal(rpc.Req.Params[0])
-		if err == nil {
-			var params map[string]string
-			if err := json.Unmarshal(paramsJSON, &params); err == nil {
-				participant = params["participant"]
-				status = params["status"]
-			}
-		}
+	var params GetAppSessionsParams
+	if err := parseListParams(rpc, &params, &params.ListOptions); err != nil {
+		return nil, err
 	}
 
-	if participant == "" {
+	if params.Participant == "" {
 		return nil, errors.New("missing participant")
 	}
 
-	sessions, err := getAppSessionsForParticipant(db, participant, status)
+	sessions, page, err := getAppSessionsForParticipant(db, params.Participant, params.Status, params.ListOptions)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find application sessions: %w", err)
 	}
@@ -658,12 +752,12 @@ func HandleGetAppSessions(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error) {
 		}
 	}
 
-	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response, page}, time.Now())
 	return rpcResponse, nil
 }
 
 // HandleResizeChannel processes a request to resize a payment channel
-func HandleResizeChannel(rpc *RPCMessage, db *gorm.DB, signer *Signer) (*RPCMessage, error) {
+func HandleResizeChannel(rpc *RPCMessage, db *gorm.DB, keys *KeyRing, fees *FeeSchedule, liquidity *Liquidity) (*RPCMessage, error) {
 	if len(rpc.Req.Params) < 1 {
 		return nil, errors.New("missing parameters")
 	}
@@ -687,6 +781,12 @@ func HandleResizeChannel(rpc *RPCMessage, db *gorm.DB, signer *Signer) (*RPCMess
 		return nil, fmt.Errorf("failed to find channel: %w", err)
 	}
 
+	// States are signed with the broker key the channel was opened with
+	signer, err := keys.Get(channel.Broker)
+	if err != nil {
+		return nil, err
+	}
+
 	req := ResizeChannelSignData{
 		RequestID: rpc.Req.RequestID,
 		Method:    rpc.Req.Method,
@@ -694,6 +794,10 @@ func HandleResizeChannel(rpc *RPCMessage, db *gorm.DB, signer *Signer) (*RPCMess
 		Timestamp: rpc.Req.Timestamp,
 	}
 
+	if len(rpc.Sig) == 0 {
+		return nil, errors.New("missing signature")
+	}
+
 	reqBytes, err := json.Marshal(req)
 	if err != nil {
 		return nil, errors.New("error serializing message")
@@ -720,28 +824,17 @@ func HandleResizeChannel(rpc *RPCMessage, db *gorm.DB, signer *Signer) (*RPCMess
 		params.AllocateAmount = big.NewInt(0)
 	}
 
-	ledger := GetParticipantLedger(db, channel.Participant)
-	balance, err := ledger.Balance(channel.Participant, asset.Symbol)
-	if err != nil {
-		return nil, fmt.Errorf("failed to check participant A balance: %w", err)
-	}
-
-	rawBalance := balance.Shift(int32(asset.Decimals)).BigInt()
-
 	newChannelAmount := new(big.Int).Add(new(big.Int).SetUint64(channel.Amount), params.AllocateAmount)
-	if rawBalance.Cmp(newChannelAmount) < 0 {
-		return nil, errors.New("insufficient unified balance")
-	}
-
-	newChannelAmount.Add(newChannelAmount, params.ResizeAmount)
-	if newChannelAmount.Cmp(big.NewInt(0)) < 0 {
+	resizedAmount := new(big.Int).Add(newChannelAmount, params.ResizeAmount)
+	if resizedAmount.Sign() < 0 {
 		return nil, errors.New("new channel amount must be positive")
 	}
+
 	allocations := []nitrolite.Allocation{
 		{
 			Destination: common.HexToAddress(params.FundsDestination),
 			Token:       common.HexToAddress(channel.Token),
-			Amount:      newChannelAmount,
+			Amount:      resizedAmount,
 		},
 		{
 			Destination: signer.GetAddress(),
@@ -749,69 +842,110 @@ func HandleResizeChannel(rpc *RPCMessage, db *gorm.DB, signer *Signer) (*RPCMess
 			Amount:      big.NewInt(0),
 		},
 	}
-
 	resizeAmounts := []*big.Int{new(big.Int).Neg(params.ResizeAmount), params.AllocateAmount}
-
-	intentionType, err := abi.NewType("int256[]", "", nil)
+	state, err := newResizeState(channel, resizeAmounts, allocations)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create ABI type for intentions: %w", err)
+		return nil, err
 	}
 
-	intentionsArgs := abi.Arguments{
-		{Type: intentionType},
+	// The allocate amount is deposited into the channel by the broker, out of its liquidity on the chain
+	brokerAllocation := decimal.NewFromBigInt(params.AllocateAmount, -int32(asset.Decimals))
+	var brokerAvailable *big.Int
+	if brokerAllocation.IsPositive() {
+		if liquidity == nil {
+			return nil, errors.New("broker liquidity is not available")
+		}
+		if brokerAvailable, err = liquidity.Available(context.Background(), channel.ChainID, signer.GetAddress(), common.HexToAddress(channel.Token)); err != nil {
+			return nil, err
+		}
+	} else {
+		brokerAllocation = decimal.Zero
 	}
 
-	encodedIntentions, err := intentionsArgs.Pack(resizeAmounts)
-	if err != nil {
-		return nil, fmt.Errorf("failed to pack intentions: %w", err)
-	}
+	var response ResizeChannelResponse
+	err = db.Transaction(func(tx *gorm.DB) error {
+		account := ParticipantAccount(channel.Participant)
+		// Locking the custody balance serializes allocations on the chain, which share the broker liquidity
+		if err := LockBalances(tx,
+			BalanceRef{Account: account, AssetSymbol: asset.Symbol},
+			BalanceRef{Account: CustodyAccount(channel.ChainID), AssetSymbol: asset.Symbol},
+		); err != nil {
+			return err
+		}
+		// The same request again gets the pending state back, which keeps its hold
+		pending, err := findPendingState(tx, channel.ChannelID, state)
+		if err != nil {
+			return err
+		}
+		if pending != nil {
+			response, err = newResizeChannelResponse(tx, pending)
+			return err
+		}
+		// Only one state is signed per version, a different request waits until the pending state lands
+		if err := ReserveStateVersion(tx, channel.ChannelID, channel.Version+1); err != nil {
+			return err
+		}
 
-	// Encode the channel ID and state for signing
-	channelID := common.HexToHash(channel.ChannelID)
-	encodedState, err := nitrolite.EncodeState(channelID, nitrolite.IntentRESIZE, big.NewInt(int64(channel.Version)+1), encodedIntentions, allocations)
-	if err != nil {
-		return nil, fmt.Errorf("failed to encode state hash: %w", err)
-	}
+		ledger := GetParticipantLedger(tx, channel.Participant)
+		balance, err := ledger.SpendableBalance(channel.Participant, asset.Symbol)
+		if err != nil {
+			return fmt.Errorf("failed to check participant A balance: %w", err)
+		}
 
-	// Generate state hash and sign it
-	stateHash := crypto.Keccak256Hash(encodedState).Hex()
-	sig, err := signer.NitroSign(encodedState)
-	if err != nil {
-		return nil, fmt.Errorf("failed to sign state: %w", err)
-	}
+		// The unified balance backs the whole channel, including what the broker allocates to it
+		rawBalance := balance.Shift(int32(asset.Decimals)).BigInt()
+		if rawBalance.Cmp(newChannelAmount) < 0 {
+			return errors.New("insufficient unified balance")
+		}
 
-	response := ResizeChannelResponse{
-		ChannelID: channel.ChannelID,
-		Intent:    uint8(nitrolite.IntentRESIZE),
-		Version:   channel.Version + 1,
-		StateData: hexutil.Encode(encodedIntentions),
-		StateHash: stateHash,
-		Signature: Signature{
-			V: sig.V,
-			R: hexutil.Encode(sig.R[:]),
-			S: hexutil.Encode(sig.S[:]),
-		},
-	}
+		// The Resized event debits the unified balance by the resize amount and the fee, hold both until then
+		amount, fee := decimal.Zero, decimal.Zero
+		if params.ResizeAmount.Sign() > 0 {
+			amount = decimal.NewFromBigInt(params.ResizeAmount, -int32(asset.Decimals))
+			fee = fees.Quote(FeeOperationResizeChannel, "", asset.Symbol, amount)
+			if balance.LessThan(amount.Add(fee)) {
+				return errors.New("insufficient unified balance to cover the fee")
+			}
+		}
+		// The allocation is held as well, so that the balance backing it isn't spent before the Resized event
+		held := amount.Add(fee).Add(brokerAllocation)
+		if balance.LessThan(held) {
+			return errors.New("insufficient unified balance")
+		}
+		if brokerAllocation.IsPositive() {
+			if err := liquidity.CheckAllocation(tx, asset, signer.GetAddress(), brokerAvailable, brokerAllocation); err != nil {
+				return err
+			}
+		}
 
-	for _, alloc := range allocations {
-		response.Allocations = append(response.Allocations, Allocation{
-			Participant:  alloc.Destination.Hex(),
-			TokenAddress: alloc.Token.Hex(),
-			Amount:       alloc.Amount,
-		})
+		// Signed in the transaction which places the hold, the state is rolled back if holding fails
+		signed, err := signChannelState(tx, signer, channel.ChannelID, state)
+		if err != nil {
+			return err
+		}
+		if _, err := PlaceHold(tx, signed, account, asset.Symbol, held, fee, brokerAllocation); err != nil {
+			return err
+		}
+		response, err = newResizeChannelResponse(tx, signed)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
 	return rpcResponse, nil
 }
 
-// HandleCloseChannel processes a request to close a payment channel
-func HandleCloseChannel(rpc *RPCMessage, db *gorm.DB, signer *Signer) (*RPCMessage, error) {
+// HandleWithdraw signs a resize state which pays out part of the unified balance on the requested chain.
+// The unified balance aggregates deposits of all chains, so the broker allocates the withdrawn amount from
+// its side of the participant's channel on that chain, out of its own liquidity on the custody contract.
+func HandleWithdraw(rpc *RPCMessage, address string, db *gorm.DB, keys *KeyRing, fees *FeeSchedule, liquidity *Liquidity) (*RPCMessage, error) {
 	if len(rpc.Req.Params) < 1 {
 		return nil, errors.New("missing parameters")
 	}
 
-	var params CloseChannelParams
+	var params WithdrawParams
 	paramsJSON, err := json.Marshal(rpc.Req.Params[0])
 	if err != nil {
 		return nil, fmt.Errorf("failed to parse parameters: %w", err)
@@ -821,124 +955,387 @@ func HandleCloseChannel(rpc *RPCMessage, db *gorm.DB, signer *Signer) (*RPCMessa
 		return nil, fmt.Errorf("invalid parameters format: %w", err)
 	}
 
-	channel, err := GetChannelByID(db, params.ChannelID)
-	if err != nil {
-		return nil, fmt.Errorf("failed to find channel: %w", err)
+	if err := validate.Struct(&params); err != nil {
+		return nil, err
+	}
+	if !params.Amount.IsPositive() {
+		return nil, errors.New("amount must be positive")
 	}
 
-	reqBytes, err := json.Marshal(rpc.Req)
+	asset, err := GetAssetBySymbol(db, params.Asset, params.ChainID)
 	if err != nil {
-		return nil, errors.New("error serializing message")
+		return nil, fmt.Errorf("failed to find asset: %w", err)
+	}
+	if asset == nil {
+		return nil, fmt.Errorf("asset %s is not supported on chain %d", params.Asset, params.ChainID)
 	}
 
-	isValid, err := ValidateSignature(reqBytes, rpc.Sig[0], channel.Participant)
-	if err != nil || !isValid {
-		return nil, errors.New("invalid signature")
+	rawAmount := params.Amount.Shift(int32(asset.Decimals))
+	if !rawAmount.IsInteger() {
+		return nil, fmt.Errorf("amount exceeds the %d decimals of %s", asset.Decimals, asset.Symbol)
 	}
 
-	asset, err := GetAssetByToken(db, channel.Token, channel.ChainID)
+	channel, err := CheckExistingChannels(db, address, asset.Token, params.ChainID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to find asset: %w", err)
+		return nil, err
 	}
-	if asset == nil {
-		return nil, fmt.Errorf("asset not found: %s", channel.Token)
+	if channel == nil {
+		return nil, fmt.Errorf("no open %s channel on chain %d, open one first", asset.Symbol, params.ChainID)
 	}
 
-	ledger := GetParticipantLedger(db, channel.Participant)
-	balance, err := ledger.Balance(channel.Participant, asset.Symbol)
+	// States are signed with the broker key the channel was opened with
+	signer, err := keys.Get(channel.Broker)
 	if err != nil {
-		return nil, fmt.Errorf("failed to check participant A balance: %w", err)
+		return nil, err
 	}
 
-	if balance.IsNegative() {
-		return nil, errors.New("insufficient funds for participant: " + channel.Token)
+	if len(rpc.Sig) == 0 {
+		return nil, errors.New("missing signature")
 	}
 
-	rawBalance := balance.Shift(int32(asset.Decimals)).BigInt()
+	reqBytes, err := json.Marshal(rpc.Req)
+	if err != nil {
+		return nil, errors.New("error serializing message")
+	}
 
-	channelAmount := new(big.Int).SetUint64(channel.Amount)
-	if channelAmount.Cmp(rawBalance) < 0 {
-		return nil, errors.New("resize this channel first")
+	isValid, err := ValidateSignature(reqBytes, rpc.Sig[0], channel.Participant)
+	if err != nil || !isValid {
+		return nil, errors.New("invalid signature")
+	}
+
+	if liquidity == nil {
+		return nil, errors.New("broker liquidity is not available")
+	}
+	available, err := liquidity.Available(context.Background(), params.ChainID, signer.GetAddress(), common.HexToAddress(asset.Token))
+	if err != nil {
+		return nil, err
 	}
 
+	// The broker deposits the amount into the channel and the participant withdraws it, the allocations are unchanged
 	allocations := []nitrolite.Allocation{
 		{
 			Destination: common.HexToAddress(params.FundsDestination),
 			Token:       common.HexToAddress(channel.Token),
-			Amount:      rawBalance,
+			Amount:      new(big.Int).SetUint64(channel.Amount),
 		},
 		{
 			Destination: signer.GetAddress(),
 			Token:       common.HexToAddress(channel.Token),
-			Amount:      new(big.Int).Sub(channelAmount, rawBalance), // Broker receives the remaining amount
+			Amount:      big.NewInt(0),
 		},
 	}
+	resizeAmounts := []*big.Int{new(big.Int).Neg(rawAmount.BigInt()), rawAmount.BigInt()}
+	state, err := newResizeState(channel, resizeAmounts, allocations)
+	if err != nil {
+		return nil, err
+	}
 
-	stateDataStr := "0x"
-	stateData, err := hexutil.Decode(stateDataStr)
+	var response ResizeChannelResponse
+	err = db.Transaction(func(tx *gorm.DB) error {
+		account := ParticipantAccount(channel.Participant)
+		// Locking the custody balance serializes withdrawals on the chain, which share the broker liquidity
+		if err := LockBalances(tx,
+			BalanceRef{Account: account, AssetSymbol: asset.Symbol},
+			BalanceRef{Account: CustodyAccount(params.ChainID), AssetSymbol: asset.Symbol},
+		); err != nil {
+			return err
+		}
+		// The same withdrawal again gets the pending state back, which keeps its hold
+		pending, err := findPendingState(tx, channel.ChannelID, state)
+		if err != nil {
+			return err
+		}
+		if pending != nil {
+			response, err = newResizeChannelResponse(tx, pending)
+			return err
+		}
+		// Only one state is signed per version, a different request waits until the pending state lands
+		if err := ReserveStateVersion(tx, channel.ChannelID, channel.Version+1); err != nil {
+			return err
+		}
+
+		balance, err := GetParticipantLedger(tx, channel.Participant).SpendableBalance(channel.Participant, asset.Symbol)
+		if err != nil {
+			return fmt.Errorf("failed to check participant balance: %w", err)
+		}
+		fee := fees.Quote(FeeOperationResizeChannel, "", asset.Symbol, params.Amount)
+		if balance.LessThan(params.Amount.Add(fee)) {
+			return errors.New("insufficient unified balance")
+		}
+
+		if err := liquidity.CheckAllocation(tx, asset, signer.GetAddress(), available, params.Amount); err != nil {
+			return err
+		}
+
+		signed, err := signChannelState(tx, signer, channel.ChannelID, state)
+		if err != nil {
+			return err
+		}
+		if _, err := PlaceHold(tx, signed, account, asset.Symbol, params.Amount.Add(fee), fee, params.Amount); err != nil {
+			return err
+		}
+		response, err = newResizeChannelResponse(tx, signed)
+		return err
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode state data: %w", err)
+		return nil, err
+	}
+
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
+	return rpcResponse, nil
+}
+
+// HandleGetLiquidity returns the broker liquidity per chain and token, optionally for a single asset
+func HandleGetLiquidity(rpc *RPCMessage, liquidity *Liquidity) (*RPCMessage, error) {
+	var assetSymbol string
+	if len(rpc.Req.Params) > 0 {
+		paramsJSON, err := json.Marshal(rpc.Req.Params[0])
+		if err == nil {
+			var params map[string]string
+			if err := json.Unmarshal(paramsJSON, &params); err == nil {
+				assetSymbol = params["asset"]
+			}
+		}
 	}
 
-	channelID := common.HexToHash(channel.ChannelID)
-	encodedState, err := nitrolite.EncodeState(channelID, nitrolite.IntentFINALIZE, big.NewInt(int64(channel.Version)+1), stateData, allocations)
+	response := LiquidityResponse{Liquidity: []ChainLiquidity{}}
+	if liquidity != nil {
+		chains, err := liquidity.Chains(context.Background(), assetSymbol)
+		if err != nil {
+			return nil, err
+		}
+		response.Liquidity = chains
+	}
+
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
+	return rpcResponse, nil
+}
+
+// newResizeState returns the next resize state of a channel with the given resize amounts and allocations
+func newResizeState(channel *Channel, resizeAmounts []*big.Int, allocations []nitrolite.Allocation) (nitrolite.State, error) {
+	encodedIntentions, err := encodeResizeAmounts(resizeAmounts)
+	if err != nil {
+		return nitrolite.State{}, err
+	}
+	return nitrolite.State{
+		Intent:      uint8(nitrolite.IntentRESIZE),
+		Version:     new(big.Int).SetUint64(channel.Version + 1),
+		Data:        encodedIntentions,
+		Allocations: allocations,
+	}, nil
+}
+
+// encodeResizeAmounts packs the resize amounts of a channel as the data of a resize state
+func encodeResizeAmounts(resizeAmounts []*big.Int) ([]byte, error) {
+	intentionType, err := abi.NewType("int256[]", "", nil)
 	if err != nil {
-		return nil, fmt.Errorf("failed to encode state hash: %w", err)
+		return nil, fmt.Errorf("failed to create ABI type for intentions: %w", err)
+	}
+
+	intentionsArgs := abi.Arguments{
+		{Type: intentionType},
 	}
 
-	stateHash := crypto.Keccak256Hash(encodedState).Hex()
-	sig, err := signer.NitroSign(encodedState)
+	encodedIntentions, err := intentionsArgs.Pack(resizeAmounts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to sign state: %w", err)
-	}
-
-	response := CloseChannelResponse{
-		ChannelID: channel.ChannelID,
-		Intent:    uint8(nitrolite.IntentFINALIZE),
-		Version:   channel.Version + 1,
-		StateData: stateDataStr,
-		StateHash: stateHash,
-		Signature: Signature{
-			V: sig.V,
-			R: hexutil.Encode(sig.R[:]),
-			S: hexutil.Encode(sig.S[:]),
-		},
+		return nil, fmt.Errorf("failed to pack intentions: %w", err)
 	}
+	return encodedIntentions, nil
+}
 
-	for _, alloc := range allocations {
-		response.FinalAllocations = append(response.FinalAllocations, Allocation{
-			Participant:  alloc.Destination.Hex(),
-			TokenAddress: alloc.Token.Hex(),
-			Amount:       alloc.Amount,
-		})
+// newResizeChannelResponse returns a resize state signed by the broker, with the fees held until it lands on-chain
+func newResizeChannelResponse(tx *gorm.DB, state *ChannelState) (ResizeChannelResponse, error) {
+	holds, err := stateHolds(tx, state.ID)
+	if err != nil {
+		return ResizeChannelResponse{}, err
+	}
+
+	response := ResizeChannelResponse{
+		ChannelID:   state.ChannelID,
+		Intent:      state.Intent,
+		Version:     state.Version,
+		StateData:   state.StateData,
+		Allocations: state.Allocations,
+		StateHash:   state.StateHash,
+		Signature:   state.BrokerSignature,
+	}
+	for _, h := range holds {
+		if h.Fee.IsPositive() {
+			response.Fees = append(response.Fees, FeeItem{Operation: FeeOperationResizeChannel, Participant: h.Participant, Asset: h.AssetSymbol, Amount: h.Fee})
+		}
+	}
+	return response, nil
+}
+
+// HandleCloseChannel processes a request to close a payment channel
+func HandleCloseChannel(rpc *RPCMessage, db *gorm.DB, keys *KeyRing) (*RPCMessage, error) {
+	if len(rpc.Req.Params) < 1 {
+		return nil, errors.New("missing parameters")
+	}
+
+	var params CloseChannelParams
+	paramsJSON, err := json.Marshal(rpc.Req.Params[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse parameters: %w", err)
+	}
+
+	if err := json.Unmarshal(paramsJSON, &params); err != nil {
+		return nil, fmt.Errorf("invalid parameters format: %w", err)
+	}
+
+	channel, err := GetChannelByID(db, params.ChannelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find channel: %w", err)
+	}
+
+	// States are signed with the broker key the channel was opened with
+	signer, err := keys.Get(channel.Broker)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rpc.Sig) == 0 {
+		return nil, errors.New("missing signature")
+	}
+
+	reqBytes, err := json.Marshal(rpc.Req)
+	if err != nil {
+		return nil, errors.New("error serializing message")
+	}
+
+	isValid, err := ValidateSignature(reqBytes, rpc.Sig[0], channel.Participant)
+	if err != nil || !isValid {
+		return nil, errors.New("invalid signature")
+	}
+
+	response, err := signFinalState(db, channel, signer, common.HexToAddress(params.FundsDestination))
+	if err != nil {
+		return nil, err
 	}
 
 	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
 	return rpcResponse, nil
 }
 
-// HandleGetChannels returns a list of channels for a given account
-// TODO: add filters, pagination, etc.
-func HandleGetChannels(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error) {
-	var participant string
-	var status string
+// signFinalState signs the final state of a channel, which pays out the spendable balance of the participant
+// to the funds destination and the rest of the channel to the broker. The payout is held until the Closed event.
+func signFinalState(db *gorm.DB, channel *Channel, signer Signer, fundsDestination common.Address) (CloseChannelResponse, error) {
+	asset, err := GetAssetByToken(db, channel.Token, channel.ChainID)
+	if err != nil {
+		return CloseChannelResponse{}, fmt.Errorf("failed to find asset: %w", err)
+	}
+	if asset == nil {
+		return CloseChannelResponse{}, fmt.Errorf("asset not found: %s", channel.Token)
+	}
 
-	if len(rpc.Req.Params) > 0 {
-		paramsJSON, err := json.Marshal(rpc.Req.Params[0])
-		if err == nil {
-			var params map[string]string
-			if err := json.Unmarshal(paramsJSON, &params); err == nil {
-				participant = params["participant"]
-				status = params["status"]
+	channelAmount := new(big.Int).SetUint64(channel.Amount)
+	var state *ChannelState
+	err = db.Transaction(func(tx *gorm.DB) error {
+		account := ParticipantAccount(channel.Participant)
+		if err := LockBalances(tx, BalanceRef{Account: account, AssetSymbol: asset.Symbol}); err != nil {
+			return err
+		}
+		ledger := GetParticipantLedger(tx, channel.Participant)
+		balance, err := ledger.SpendableBalance(channel.Participant, asset.Symbol)
+		if err != nil {
+			return fmt.Errorf("failed to check participant A balance: %w", err)
+		}
+
+		// A pending final state holds the balance it pays out, which is counted back so that the same request
+		// signs the same state again
+		version := channel.Version + 1
+		pending, err := validState(tx, channel.ChannelID, version)
+		if err != nil {
+			return err
+		}
+		if pending != nil && pending.Status == ChannelStateStatusPending && pending.Intent == uint8(nitrolite.IntentFINALIZE) {
+			holds, err := stateHolds(tx, pending.ID)
+			if err != nil {
+				return err
+			}
+			for _, h := range holds {
+				balance = balance.Add(h.Amount)
 			}
 		}
+
+		if balance.IsNegative() {
+			return errors.New("insufficient funds for participant: " + channel.Token)
+		}
+
+		rawBalance := balance.Shift(int32(asset.Decimals)).BigInt()
+		if channelAmount.Cmp(rawBalance) < 0 {
+			return errors.New("resize this channel first")
+		}
+
+		allocations := []nitrolite.Allocation{
+			{
+				Destination: fundsDestination,
+				Token:       common.HexToAddress(channel.Token),
+				Amount:      rawBalance,
+			},
+			{
+				Destination: signer.GetAddress(),
+				Token:       common.HexToAddress(channel.Token),
+				Amount:      new(big.Int).Sub(channelAmount, rawBalance), // Broker receives the remaining amount
+			},
+		}
+
+		final := nitrolite.State{
+			Intent:      uint8(nitrolite.IntentFINALIZE),
+			Version:     new(big.Int).SetUint64(version),
+			Data:        []byte{},
+			Allocations: allocations,
+		}
+		// The same request again gets the pending state back, which keeps its hold
+		if state, err = findPendingState(tx, channel.ChannelID, final); err != nil || state != nil {
+			return err
+		}
+		if err := ReserveStateVersion(tx, channel.ChannelID, version); err != nil {
+			return err
+		}
+
+		// Signed in the transaction which places the hold, the state is rolled back if holding fails
+		state, err = signChannelState(tx, signer, channel.ChannelID, final)
+		if err != nil {
+			return err
+		}
+
+		// The whole spendable balance is paid out, hold it until the Closed event
+		_, err = PlaceHold(tx, state, account, asset.Symbol, balance, decimal.Zero, decimal.Zero)
+		return err
+	})
+	if err != nil {
+		return CloseChannelResponse{}, err
+	}
+
+	return CloseChannelResponse{
+		ChannelID:        state.ChannelID,
+		Intent:           state.Intent,
+		Version:          state.Version,
+		StateData:        state.StateData,
+		FinalAllocations: state.Allocations,
+		StateHash:        state.StateHash,
+		Signature:        state.BrokerSignature,
+	}, nil
+}
+
+// HandleGetChannels returns a page of channels for a given account
+func HandleGetChannels(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error) {
+	var params GetChannelsParams
+	if err := parseListParams(rpc, &params, &params.ListOptions); err != nil {
+		return nil, err
 	}
 
-	if participant == "" {
+	if params.Participant == "" {
 		return nil, errors.New("missing participant parameter")
 	}
 
-	channels, err := getChannelsByParticipant(db, participant, status)
+	channels, page, err := listChannels(db, ChannelFilter{
+		Participant: params.Participant,
+		Status:      params.Status,
+		Token:       params.Token,
+		ChainID:     params.ChainID,
+	}, params.ListOptions)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get channels: %w", err)
 	}
@@ -949,6 +1346,7 @@ func HandleGetChannels(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error) {
 			ChannelID:   channel.ChannelID,
 			Participant: channel.Participant,
 			Status:      channel.Status,
+			Reason:      channel.Reason,
 			Token:       channel.Token,
 			Amount:      big.NewInt(int64(channel.Amount)),
 			ChainID:     channel.ChainID,
@@ -961,7 +1359,65 @@ func HandleGetChannels(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error) {
 		})
 	}
 
-	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{channelResponses}, time.Now())
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{channelResponses, page}, time.Now())
+	return rpcResponse, nil
+}
+
+// GetChannelStatesParams represents parameters for listing the states signed for a channel
+type GetChannelStatesParams struct {
+	ChannelID string `json:"channel_id"`
+	ListOptions
+}
+
+// ChannelStateResponse represents a state signed by the broker for a channel
+type ChannelStateResponse struct {
+	ChannelID     string             `json:"channel_id"`
+	Intent        uint8              `json:"intent"`
+	Version       uint64             `json:"version"`
+	StateData     string             `json:"state_data"`
+	Allocations   []Allocation       `json:"allocations"`
+	StateHash     string             `json:"state_hash"`
+	Signature     Signature          `json:"server_signature"`
+	UserSignature *Signature         `json:"user_signature,omitempty"` // Set once the state is seen on-chain
+	Status        ChannelStateStatus `json:"status"`
+	TxHash        string             `json:"tx_hash,omitempty"`
+	CreatedAt     time.Time          `json:"created_at"`
+}
+
+// HandleGetChannelStates returns a page of the states the broker signed for a channel
+func HandleGetChannelStates(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error) {
+	var params GetChannelStatesParams
+	if err := parseListParams(rpc, &params, &params.ListOptions); err != nil {
+		return nil, err
+	}
+
+	if params.ChannelID == "" {
+		return nil, errors.New("missing channel_id parameter")
+	}
+
+	states, page, err := listChannelStates(db, params.ChannelID, params.ListOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get channel states: %w", err)
+	}
+
+	resp := []ChannelStateResponse{}
+	for _, state := range states {
+		resp = append(resp, ChannelStateResponse{
+			ChannelID:     state.ChannelID,
+			Intent:        state.Intent,
+			Version:       state.Version,
+			StateData:     state.StateData,
+			Allocations:   state.Allocations,
+			StateHash:     state.StateHash,
+			Signature:     state.BrokerSignature,
+			UserSignature: state.UserSignature,
+			Status:        state.Status,
+			TxHash:        state.TxHash,
+			CreatedAt:     state.CreatedAt,
+		})
+	}
+
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{resp, page}, time.Now())
 	return rpcResponse, nil
 }
 
@@ -970,8 +1426,13 @@ func HandleGetRPCHistory(participant string, rpc *RPCMessage, store *RPCStore) (
 		return nil, errors.New("missing participant parameter")
 	}
 
-	var rpcHistory []RPCRecord
-	if err := store.db.Where("sender = ?", participant).Order("timestamp DESC").Find(&rpcHistory).Error; err != nil {
+	var params GetRPCHistoryParams
+	if err := parseListParams(rpc, &params, &params.ListOptions); err != nil {
+		return nil, err
+	}
+
+	rpcHistory, page, err := store.GetHistory(participant, params.Method, params.ListOptions)
+	if err != nil {
 		return nil, fmt.Errorf("failed to retrieve RPC history: %w", err)
 	}
 
@@ -990,7 +1451,7 @@ func HandleGetRPCHistory(participant string, rpc *RPCMessage, store *RPCStore) (
 		})
 	}
 
-	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response, page}, time.Now())
 	return rpcResponse, nil
 }
 
@@ -1040,3 +1501,161 @@ func HandleGetAssets(rpc *RPCMessage, db *gorm.DB) (*RPCMessage, error) {
 	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
 	return rpcResponse, nil
 }
+
+// GetFeeScheduleParams represents optional parameters to filter the fee schedule and quote a fee
+type GetFeeScheduleParams struct {
+	Operation FeeOperation     `json:"operation,omitempty"`
+	Protocol  string           `json:"protocol,omitempty"`
+	Asset     string           `json:"asset,omitempty"`
+	Amount    *decimal.Decimal `json:"amount,omitempty"`
+}
+
+// FeeScheduleResponse represents the configured fee rules and an optional quote
+type FeeScheduleResponse struct {
+	Fees  []FeeRule        `json:"fees"`
+	Quote *decimal.Decimal `json:"quote,omitempty"` // Fee for the requested operation and amount
+}
+
+// HandleGetFeeSchedule returns the fee rules, optionally filtered by operation, and quotes the fee for an amount
+func HandleGetFeeSchedule(rpc *RPCMessage, fees *FeeSchedule) (*RPCMessage, error) {
+	var params GetFeeScheduleParams
+	if len(rpc.Req.Params) > 0 {
+		paramsJSON, err := json.Marshal(rpc.Req.Params[0])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse parameters: %w", err)
+		}
+		if err := json.Unmarshal(paramsJSON, &params); err != nil {
+			return nil, fmt.Errorf("invalid parameters format: %w", err)
+		}
+	}
+
+	response := FeeScheduleResponse{Fees: []FeeRule{}}
+	if fees != nil {
+		for _, rule := range fees.Rules {
+			if params.Operation == "" || rule.Operation == params.Operation {
+				response.Fees = append(response.Fees, rule)
+			}
+		}
+	}
+
+	if params.Amount != nil {
+		if params.Operation == "" {
+			return nil, errors.New("operation is required to quote a fee")
+		}
+		quote := fees.Quote(params.Operation, params.Protocol, params.Asset, *params.Amount)
+		response.Quote = &quote
+	}
+
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
+	return rpcResponse, nil
+}
+
+// GetLedgerStatementParams represents parameters for generating a ledger statement
+type GetLedgerStatementParams struct {
+	AccountID string `json:"account_id,omitempty"` // Defaults to the unified balance of the participant
+	Asset     string `json:"asset,omitempty"`
+	StartTime uint64 `json:"start_time"`         // Inclusive start of the period in Unix milliseconds
+	EndTime   uint64 `json:"end_time,omitempty"` // Exclusive end of the period in Unix milliseconds, defaults to now
+	Format    string `json:"format,omitempty"`   // json (default) or csv
+}
+
+// StatementExport carries a statement rendered in an export format
+type StatementExport struct {
+	Format  string `json:"format"`
+	Content string `json:"content"`
+}
+
+// HandleGetLedgerStatement returns the statement of a participant's account for a period
+func HandleGetLedgerStatement(rpc *RPCMessage, address string, db *gorm.DB) (*RPCMessage, error) {
+	if len(rpc.Req.Params) < 1 {
+		return nil, errors.New("missing parameters")
+	}
+
+	var params GetLedgerStatementParams
+	paramsJSON, err := json.Marshal(rpc.Req.Params[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse parameters: %w", err)
+	}
+	if err := json.Unmarshal(paramsJSON, &params); err != nil {
+		return nil, fmt.Errorf("invalid parameters format: %w", err)
+	}
+
+	if params.AccountID == "" {
+		params.AccountID = address
+	}
+	end := time.Now()
+	if params.EndTime != 0 {
+		end = time.UnixMilli(int64(params.EndTime))
+	}
+
+	statement, err := GenerateStatement(db, address, params.AccountID, params.Asset, time.UnixMilli(int64(params.StartTime)), end)
+	if err != nil {
+		return nil, err
+	}
+
+	var response any = statement
+	switch params.Format {
+	case StatementFormatJSON, "":
+	case StatementFormatCSV:
+		var buf strings.Builder
+		if err := statement.WriteCSV(&buf); err != nil {
+			return nil, fmt.Errorf("failed to export statement: %w", err)
+		}
+		response = StatementExport{Format: StatementFormatCSV, Content: buf.String()}
+	default:
+		return nil, fmt.Errorf("unsupported statement format: %s", params.Format)
+	}
+
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{response}, time.Now())
+	return rpcResponse, nil
+}
+
+// CountersignCloseParams represents the participant signature of the final state of a broker-initiated close
+type CountersignCloseParams struct {
+	RequestID uint      `json:"request_id" validate:"required"`
+	Signature Signature `json:"signature"`
+}
+
+// HandleCountersignClose submits the final state of a broker-initiated close, once countersigned by the participant
+func HandleCountersignClose(rpc *RPCMessage, address string, settlement *Settlement) (*RPCMessage, error) {
+	if len(rpc.Req.Params) < 1 {
+		return nil, errors.New("missing parameters")
+	}
+
+	var params CountersignCloseParams
+	paramsJSON, err := json.Marshal(rpc.Req.Params[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse parameters: %w", err)
+	}
+
+	if err := json.Unmarshal(paramsJSON, &params); err != nil {
+		return nil, fmt.Errorf("invalid parameters format: %w", err)
+	}
+
+	if err := validate.Struct(&params); err != nil {
+		return nil, err
+	}
+	if settlement == nil {
+		return nil, errors.New("channel settlement is not available")
+	}
+	if len(rpc.Sig) == 0 {
+		return nil, errors.New("missing signature")
+	}
+
+	reqBytes, err := json.Marshal(rpc.Req)
+	if err != nil {
+		return nil, errors.New("error serializing message")
+	}
+	isValid, err := ValidateSignature(reqBytes, rpc.Sig[0], address)
+	if err != nil || !isValid {
+		return nil, errors.New("invalid signature")
+	}
+
+	request, err := settlement.Countersign(context.Background(), params.RequestID, address, params.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	rpcResponse := CreateResponse(rpc.Req.RequestID, rpc.Req.Method, []any{newCloseRequestResponse(request)}, time.Now())
+	return rpcResponse, nil
+}
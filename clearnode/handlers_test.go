@@ -36,14 +36,14 @@ func setupTestSqlite(t testing.TB) *gorm.DB {
 	require.NoError(t, err)
 
 	// Auto migrate all required models
-	err = db.AutoMigrate(&Entry{}, &Channel{}, &AppSession{}, &RPCRecord{}, &Asset{})
+	err = db.AutoMigrate(&Entry{}, &Channel{}, &AppSession{}, &RPCRecord{}, &Asset{}, &AccountBalance{}, &LedgerCheckpoint{}, &LedgerCheckpointBalance{}, &LedgerHold{}, &ReconciliationRun{}, &ReconciliationBalance{}, &ReconciliationDiscrepancy{}, &ChannelCloseRequest{}, &ChannelState{}, &EventCursor{}, &ProcessedEvent{})
 	require.NoError(t, err)
 
 	return db
 }
 
-// setupTestPostgres creates a PostgreSQL database using testcontainers
-func setupTestPostgres(ctx context.Context, t testing.TB) (*gorm.DB, testcontainers.Container) {
+// setupTestPostgres creates a PostgreSQL database using testcontainers, and returns its connection string
+func setupTestPostgres(ctx context.Context, t testing.TB) (*gorm.DB, testcontainers.Container, string) {
 	t.Helper()
 
 	const dbName = "postgres"
@@ -77,10 +77,10 @@ func setupTestPostgres(ctx context.Context, t testing.TB) (*gorm.DB, testcontain
 	require.NoError(t, err)
 
 	// Auto migrate all required models
-	err = db.AutoMigrate(&Entry{}, &Channel{}, &AppSession{}, &RPCRecord{}, &Asset{})
+	err = db.AutoMigrate(&Entry{}, &Channel{}, &AppSession{}, &RPCRecord{}, &Asset{}, &AccountBalance{}, &LedgerCheckpoint{}, &LedgerCheckpointBalance{}, &LedgerHold{}, &ReconciliationRun{}, &ReconciliationBalance{}, &ReconciliationDiscrepancy{}, &ChannelCloseRequest{}, &ChannelState{}, &EventCursor{}, &ProcessedEvent{})
 	require.NoError(t, err)
 
-	return db, postgresContainer
+	return db, postgresContainer, url
 }
 
 // setupTestDB creates a test database based on the TEST_DB_DRIVER environment variable
@@ -97,7 +97,7 @@ func setupTestDB(t testing.TB) (*gorm.DB, func()) {
 	case "postgres":
 		log.Println("Using PostgreSQL for testing")
 		var container testcontainers.Container
-		db, container = setupTestPostgres(ctx, t)
+		db, container, _ = setupTestPostgres(ctx, t)
 		cleanup = func() {
 			if container != nil {
 				if err := container.Terminate(ctx); err != nil {
@@ -139,7 +139,7 @@ func TestHandleCloseVirtualApp(t *testing.T) {
 	raw, err := crypto.GenerateKey()
 	require.NoError(t, err)
 
-	signer := Signer{privateKey: raw}
+	signer := LocalSigner{privateKey: raw}
 	participantA := signer.GetAddress().Hex()
 	participantB := "0xParticipantB"
 
@@ -175,8 +175,8 @@ func TestHandleCloseVirtualApp(t *testing.T) {
 
 	assetSymbol := "usdc"
 
-	require.NoError(t, GetParticipantLedger(db, participantA).Record(vAppID, assetSymbol, decimal.NewFromInt(200)))
-	require.NoError(t, GetParticipantLedger(db, participantB).Record(vAppID, assetSymbol, decimal.NewFromInt(300)))
+	seedLedger(t, db, AppSessionAccount(vAppID, participantA), assetSymbol, decimal.NewFromInt(200))
+	seedLedger(t, db, AppSessionAccount(vAppID, participantB), assetSymbol, decimal.NewFromInt(300))
 
 	closeParams := CloseAppSessionParams{
 		AppSessionID: vAppID,
@@ -207,7 +207,7 @@ func TestHandleCloseVirtualApp(t *testing.T) {
 	sig, _ := signer.Sign(signBytes)
 	req.Sig = []string{hexutil.Encode(sig)}
 
-	resp, err := HandleCloseApplication(req, db)
+	resp, err := HandleCloseApplication(req, db, nil)
 	require.NoError(t, err)
 	assert.Equal(t, "close_app_session", resp.Res.Method)
 	var updated AppSession
@@ -232,8 +232,8 @@ func TestHandleCreateVirtualApp(t *testing.T) {
 	// Generate private keys for both participants
 	rawA, _ := crypto.GenerateKey()
 	rawB, _ := crypto.GenerateKey()
-	signerA := Signer{privateKey: rawA}
-	signerB := Signer{privateKey: rawB}
+	signerA := LocalSigner{privateKey: rawA}
+	signerB := LocalSigner{privateKey: rawB}
 	addrA := signerA.GetAddress().Hex()
 	addrB := signerB.GetAddress().Hex()
 
@@ -253,8 +253,8 @@ func TestHandleCreateVirtualApp(t *testing.T) {
 		require.NoError(t, db.Create(ch).Error)
 	}
 
-	require.NoError(t, GetParticipantLedger(db, addrA).Record(addrA, "usdc", decimal.NewFromInt(100)))
-	require.NoError(t, GetParticipantLedger(db, addrB).Record(addrB, "usdc", decimal.NewFromInt(200)))
+	seedLedger(t, db, ParticipantAccount(addrA), "usdc", decimal.NewFromInt(100))
+	seedLedger(t, db, ParticipantAccount(addrB), "usdc", decimal.NewFromInt(200))
 
 	ts := uint64(time.Now().Unix())
 	def := AppDefinition{
@@ -328,9 +328,7 @@ func TestHandleGetLedgerBalances(t *testing.T) {
 	db, cleanup := setupTestDB(t)
 	defer cleanup()
 
-	ledger := GetParticipantLedger(db, "0xParticipant1")
-	err := ledger.Record("0xParticipant1", "usdc", decimal.NewFromInt(1000))
-	require.NoError(t, err)
+	seedLedger(t, db, ParticipantAccount("0xParticipant1"), "usdc", decimal.NewFromInt(1000))
 
 	// Create RPC request with token address parameter
 	params := map[string]string{
@@ -391,19 +389,19 @@ func TestHandleGetConfig(t *testing.T) {
 			"polygon": {
 				Name:           "polygon",
 				ChainID:        137,
-				InfuraURL:      "https://polygon-mainnet.infura.io/v3/test",
+				RPCURLs:        []string{"https://polygon-mainnet.infura.io/v3/test"},
 				CustodyAddress: "0xCustodyAddress1",
 			},
 			"celo": {
 				Name:           "celo",
 				ChainID:        42220,
-				InfuraURL:      "https://celo-mainnet.infura.io/v3/test",
+				RPCURLs:        []string{"https://celo-mainnet.infura.io/v3/test"},
 				CustodyAddress: "0xCustodyAddress2",
 			},
 			"base": {
 				Name:           "base",
 				ChainID:        8453,
-				InfuraURL:      "https://base-mainnet.infura.io/v3/test",
+				RPCURLs:        []string{"https://base-mainnet.infura.io/v3/test"},
 				CustodyAddress: "0xCustodyAddress3",
 			},
 		},
@@ -422,9 +420,15 @@ func TestHandleGetConfig(t *testing.T) {
 	raw, err := crypto.GenerateKey()
 	require.NoError(t, err)
 
-	signer := Signer{privateKey: raw}
+	signer := LocalSigner{privateKey: raw}
+
+	rawLegacy, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	legacy := LocalSigner{privateKey: rawLegacy}
+	retiresAt := time.Now().Add(24 * time.Hour)
+	keys := NewKeyRing(&signer, BrokerKey{Signer: &legacy, RetiresAt: &retiresAt})
 
-	response, err := HandleGetConfig(rpcRequest, mockConfig, &signer)
+	response, err := HandleGetConfig(rpcRequest, mockConfig, keys)
 	require.NoError(t, err)
 	assert.NotNil(t, response)
 
@@ -440,6 +444,13 @@ func TestHandleGetConfig(t *testing.T) {
 	// Verify broker address
 	assert.Equal(t, signer.GetAddress().Hex(), configMap.BrokerAddress)
 
+	// Verify broker key rotation schedule
+	require.Len(t, configMap.BrokerKeys, 2)
+	assert.Equal(t, signer.GetAddress().Hex(), configMap.BrokerKeys[0].Address)
+	assert.Equal(t, BrokerKeyStatusActive, configMap.BrokerKeys[0].Status)
+	assert.Equal(t, legacy.GetAddress().Hex(), configMap.BrokerKeys[1].Address)
+	assert.Equal(t, BrokerKeyStatusLegacy, configMap.BrokerKeys[1].Status)
+
 	// Verify supported networks
 	require.Len(t, configMap.Networks, 3, "Should have 3 supported networks")
 
@@ -465,7 +476,7 @@ func TestHandleGetConfig(t *testing.T) {
 func TestHandleGetChannels(t *testing.T) {
 	rawKey, err := crypto.GenerateKey()
 	require.NoError(t, err)
-	signer := Signer{privateKey: rawKey}
+	signer := LocalSigner{privateKey: rawKey}
 	participantAddr := signer.GetAddress().Hex()
 
 	db, cleanup := setupTestDB(t)
@@ -567,7 +578,7 @@ func TestHandleGetChannels(t *testing.T) {
 	assert.Equal(t, "get_channels", response.Res.Method)
 	assert.Equal(t, uint64(123), response.Res.RequestID)
 
-	require.Len(t, response.Res.Params, 1, "Response should contain a slice of ChannelResponse")
+	require.Len(t, response.Res.Params, 2, "Response should contain a slice of ChannelResponse and the page info")
 	channelsSlice, ok := response.Res.Params[0].([]ChannelResponse)
 	require.True(t, ok, "Response parameter should be a slice of ChannelResponse")
 
@@ -921,7 +932,7 @@ func TestHandleGetAssets(t *testing.T) {
 func TestHandleGetAppSessions(t *testing.T) {
 	rawKey, err := crypto.GenerateKey()
 	require.NoError(t, err)
-	signer := Signer{privateKey: rawKey}
+	signer := LocalSigner{privateKey: rawKey}
 	participantAddr := signer.GetAddress().Hex()
 
 	db, cleanup := setupTestDB(t)
@@ -993,7 +1004,7 @@ func TestHandleGetAppSessions(t *testing.T) {
 	// Verify response format
 	assert.Equal(t, "get_app_sessions", resp1.Res.Method)
 	assert.Equal(t, uint64(1), resp1.Res.RequestID)
-	require.Len(t, resp1.Res.Params, 1, "Response should contain an array of AppSessionResponse objects")
+	require.Len(t, resp1.Res.Params, 2, "Response should contain an array of AppSessionResponse objects and the page info")
 
 	// Extract and verify app sessions
 	sessionResponses, ok := resp1.Res.Params[0].([]AppSessionResponse)
@@ -1072,7 +1083,7 @@ func TestHandleGetAppSessions(t *testing.T) {
 func TestHandleGetRPCHistory(t *testing.T) {
 	rawKey, err := crypto.GenerateKey()
 	require.NoError(t, err)
-	signer := Signer{privateKey: rawKey}
+	signer := LocalSigner{privateKey: rawKey}
 	participantAddr := signer.GetAddress().Hex()
 
 	db, cleanup := setupTestDB(t)
@@ -1152,7 +1163,7 @@ func TestHandleGetRPCHistory(t *testing.T) {
 	assert.Equal(t, "get_rpc_history", response.Res.Method)
 	assert.Equal(t, uint64(100), response.Res.RequestID)
 
-	require.Len(t, response.Res.Params, 1, "Response should contain RPCEntry entries")
+	require.Len(t, response.Res.Params, 2, "Response should contain RPCEntry entries and the page info")
 	rpcHistory, ok := response.Res.Params[0].([]RPCEntry)
 	require.True(t, ok, "Response parameter should be a slice of RPCEntry")
 
@@ -1184,7 +1195,6 @@ func TestHandleGetLedgerEntries(t *testing.T) {
 	defer cleanup()
 
 	participant := "0xParticipant1"
-	ledger := GetParticipantLedger(db, participant)
 
 	// Create test entries with different assets
 	testData := []struct {
@@ -1200,8 +1210,7 @@ func TestHandleGetLedgerEntries(t *testing.T) {
 
 	// Insert test entries
 	for _, data := range testData {
-		err := ledger.Record(participant, data.asset, data.amount)
-		require.NoError(t, err)
+		seedLedger(t, db, ParticipantAccount(participant), data.asset, data.amount)
 	}
 
 	// Test Case 1: Get all entries for the participant
@@ -1229,7 +1238,7 @@ func TestHandleGetLedgerEntries(t *testing.T) {
 	// Verify response format
 	assert.Equal(t, "get_ledger_entries", resp1.Res.Method)
 	assert.Equal(t, uint64(1), resp1.Res.RequestID)
-	require.Len(t, resp1.Res.Params, 1, "Response should contain an array of Entry objects")
+	require.Len(t, resp1.Res.Params, 2, "Response should contain an array of Entry objects and the page info")
 
 	// Extract and verify entries
 	entries1, ok := resp1.Res.Params[0].([]LedgerEntryResponse)
@@ -1302,3 +1311,200 @@ func TestHandleGetLedgerEntries(t *testing.T) {
 	assert.Error(t, err, "Should return error with empty participant")
 	assert.Nil(t, resp3)
 }
+
+func TestHandleCloseChannelLegacyBrokerKey(t *testing.T) {
+	rawKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signer := LocalSigner{privateKey: rawKey}
+	participantAddr := signer.GetAddress().Hex()
+
+	rawActive, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	active := LocalSigner{privateKey: rawActive}
+	rawLegacy, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	legacy := LocalSigner{privateKey: rawLegacy}
+
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	tokenAddress := "0x1234567890123456789012345678901234567890"
+	require.NoError(t, db.Create(&Asset{Token: tokenAddress, ChainID: 137, Symbol: "usdc", Decimals: 6}).Error)
+
+	// The channel was opened with the broker key that has since been rotated out
+	channel := Channel{
+		ChannelID:   "0xChannelLegacy",
+		Participant: participantAddr,
+		Broker:      legacy.GetAddress().Hex(),
+		Status:      ChannelStatusOpen,
+		Token:       tokenAddress,
+		ChainID:     137,
+		Amount:      1000000,
+		Version:     1,
+		Adjudicator: "0xAdjudicator",
+	}
+	require.NoError(t, db.Create(&channel).Error)
+	seedLedger(t, db, ParticipantAccount(participantAddr), "usdc", decimal.NewFromInt(1))
+
+	params := CloseChannelParams{
+		ChannelID:        channel.ChannelID,
+		FundsDestination: participantAddr,
+	}
+	rpcRequest := &RPCMessage{
+		Req: &RPCData{
+			RequestID: 1,
+			Method:    "close_channel",
+			Params:    []any{params},
+			Timestamp: uint64(time.Now().Unix()),
+		},
+	}
+	reqBytes, err := json.Marshal(rpcRequest.Req)
+	require.NoError(t, err)
+	signed, err := signer.Sign(reqBytes)
+	require.NoError(t, err)
+	rpcRequest.Sig = []string{hexutil.Encode(signed)}
+
+	t.Run("LegacyKeyHonored", func(t *testing.T) {
+		retiresAt := time.Now().Add(time.Hour)
+		keys := NewKeyRing(&active, BrokerKey{Signer: &legacy, RetiresAt: &retiresAt})
+
+		resp, err := HandleCloseChannel(rpcRequest, db, keys)
+		require.NoError(t, err)
+
+		closeResp, ok := resp.Res.Params[0].(CloseChannelResponse)
+		require.True(t, ok)
+		require.Len(t, closeResp.FinalAllocations, 2)
+		assert.Equal(t, legacy.GetAddress().Hex(), closeResp.FinalAllocations[1].Participant)
+
+		stateHash, err := hexutil.Decode(closeResp.StateHash)
+		require.NoError(t, err)
+		sig := append(append(hexutil.MustDecode(closeResp.Signature.R), hexutil.MustDecode(closeResp.Signature.S)...), closeResp.Signature.V-27)
+		pubKey, err := crypto.SigToPub(stateHash, sig)
+		require.NoError(t, err)
+		assert.Equal(t, legacy.GetAddress(), crypto.PubkeyToAddress(*pubKey), "State should be signed with the channel's broker key")
+	})
+
+	t.Run("RetiredKeyRejected", func(t *testing.T) {
+		retiredAt := time.Now().Add(-time.Hour)
+		keys := NewKeyRing(&active, BrokerKey{Signer: &legacy, RetiresAt: &retiredAt})
+
+		_, err := HandleCloseChannel(rpcRequest, db, keys)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "retired")
+	})
+}
+
+// TestListPagination tests cursor pagination, sorting and filters of the list handlers
+func TestListPagination(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	participant := "0xParticipant1"
+
+	// Channels created at the same time must still be paged without gaps or duplicates
+	createdAt := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, db.Create(&Channel{
+			ChannelID:   fmt.Sprintf("0xChannel%d", i),
+			Participant: participant,
+			Status:      ChannelStatusOpen,
+			Token:       "0xToken",
+			ChainID:     137,
+			Adjudicator: "0xAdj",
+			CreatedAt:   createdAt,
+		}).Error)
+	}
+	require.NoError(t, db.Create(&Channel{
+		ChannelID:   "0xChannel6",
+		Participant: participant,
+		Status:      ChannelStatusOpen,
+		Token:       "0xToken",
+		ChainID:     8453,
+		Adjudicator: "0xAdj",
+		CreatedAt:   createdAt.Add(time.Minute),
+	}).Error)
+
+	for i := 1; i <= 5; i++ {
+		seedLedger(t, db, ParticipantAccount(participant), "usdc", decimal.NewFromInt(int64(i)))
+	}
+
+	call := func(handler func(*RPCMessage) (*RPCMessage, error), params map[string]any) ([]any, PageInfo) {
+		paramsJSON, err := json.Marshal(params)
+		require.NoError(t, err)
+		resp, err := handler(&RPCMessage{Req: &RPCData{RequestID: 1, Params: []any{json.RawMessage(paramsJSON)}}})
+		require.NoError(t, err)
+		require.Len(t, resp.Res.Params, 2)
+		page, ok := resp.Res.Params[1].(PageInfo)
+		require.True(t, ok)
+
+		var items []any
+		switch v := resp.Res.Params[0].(type) {
+		case []ChannelResponse:
+			for _, c := range v {
+				items = append(items, c.ChannelID)
+			}
+		case []LedgerEntryResponse:
+			for _, e := range v {
+				items = append(items, e.Credit.IntPart())
+			}
+		}
+		return items, page
+	}
+
+	getChannels := func(rpc *RPCMessage) (*RPCMessage, error) { return HandleGetChannels(rpc, db) }
+	getEntries := func(rpc *RPCMessage) (*RPCMessage, error) { return HandleGetLedgerEntries(rpc, participant, db) }
+
+	t.Run("ChannelsAscending", func(t *testing.T) {
+		var all []any
+		params := map[string]any{"participant": participant, "limit": 2, "sort": "asc"}
+		for {
+			items, page := call(getChannels, params)
+			all = append(all, items...)
+			if page.NextCursor == "" {
+				break
+			}
+			params["cursor"] = page.NextCursor
+		}
+		assert.Equal(t, []any{"0xChannel1", "0xChannel2", "0xChannel3", "0xChannel4", "0xChannel5", "0xChannel6"}, all)
+	})
+
+	t.Run("ChannelsFilters", func(t *testing.T) {
+		items, page := call(getChannels, map[string]any{"participant": participant, "chain_id": 8453})
+		assert.Equal(t, []any{"0xChannel6"}, items)
+		assert.Empty(t, page.NextCursor)
+
+		items, _ = call(getChannels, map[string]any{"participant": participant, "start_time": createdAt.Add(30 * time.Second).UnixMilli()})
+		assert.Equal(t, []any{"0xChannel6"}, items)
+	})
+
+	t.Run("LedgerEntriesDescending", func(t *testing.T) {
+		items, page := call(getEntries, map[string]any{"account_id": participant, "limit": 3})
+		assert.Equal(t, []any{int64(5), int64(4), int64(3)}, items)
+		require.NotEmpty(t, page.NextCursor)
+
+		items, page = call(getEntries, map[string]any{"account_id": participant, "limit": 3, "cursor": page.NextCursor})
+		assert.Equal(t, []any{int64(2), int64(1)}, items)
+		assert.Empty(t, page.NextCursor)
+	})
+
+	t.Run("InvalidOptions", func(t *testing.T) {
+		for _, params := range []map[string]any{
+			{"account_id": participant, "limit": MaxPageLimit + 1},
+			{"account_id": participant, "sort": "random"},
+			{"account_id": participant, "cursor": "not-a-cursor"},
+			{"account_id": participant, "start_time": 2000, "end_time": 1000},
+		} {
+			paramsJSON, err := json.Marshal(params)
+			require.NoError(t, err)
+			_, err = HandleGetLedgerEntries(&RPCMessage{Req: &RPCData{Params: []any{json.RawMessage(paramsJSON)}}}, participant, db)
+			assert.Error(t, err, "params: %v", params)
+		}
+
+		// A cursor cannot be reused with a different sort order
+		_, page := call(getEntries, map[string]any{"account_id": participant, "limit": 1})
+		paramsJSON, err := json.Marshal(map[string]any{"account_id": participant, "sort": "asc", "cursor": page.NextCursor})
+		require.NoError(t, err)
+		_, err = HandleGetLedgerEntries(&RPCMessage{Req: &RPCData{Params: []any{json.RawMessage(paramsJSON)}}}, participant, db)
+		assert.Error(t, err)
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Health serves the liveness, readiness and status of the broker
+type Health struct {
+	db             *gorm.DB
+	driver         string
+	version        string
+	startedAt      time.Time
+	custodyClients map[string]*Custody
+	pools          map[string]*RPCPool
+	leaders        *LeaderGroup // Leaderships of the listeners and jobs, nil when the node runs them all
+	connections    func() int
+}
+
+// NewHealth creates the health endpoints of the broker. The networks must not change once they are served.
+func NewHealth(db *gorm.DB, driver, version string, custodyClients map[string]*Custody, pools map[string]*RPCPool, leaders *LeaderGroup, connections func() int) *Health {
+	return &Health{
+		db:             db,
+		driver:         driver,
+		version:        version,
+		startedAt:      time.Now(),
+		custodyClients: custodyClients,
+		pools:          pools,
+		leaders:        leaders,
+		connections:    connections,
+	}
+}
+
+// ReadinessResponse is the result of the readiness checks, failed checks carry their error
+type ReadinessResponse struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// NetworkListenerStatus is the progress of the custody events listener of a network
+type NetworkListenerStatus struct {
+	Network   string           `json:"network"`
+	ChainID   uint32           `json:"chain_id"`
+	Ingestion EventIngestion   `json:"ingestion"`
+	Health    NetworkStatus    `json:"rpc_status"`
+	Endpoints []EndpointHealth `json:"rpc_endpoints"`
+	Leader    bool             `json:"leader"`   // Whether this node runs the listener of the network
+	Listener  *ListenerStatus  `json:"listener"` // Nil when the network could not be initialized
+}
+
+// StatusResponse is the status of the broker
+type StatusResponse struct {
+	Version          string                  `json:"version"`
+	RPCStatus        string                  `json:"rpc_status"` // "ok", or "degraded" when a network has RPC endpoints down
+	StartedAt        time.Time               `json:"started_at"`
+	ConnectedClients int                     `json:"connected_clients"` // Clients connected to this node
+	Leaderships      map[string]bool         `json:"leaderships"`       // Listeners and jobs, by whether this node runs them
+	Networks         []NetworkListenerStatus `json:"networks"`
+}
+
+// HandleLive reports that the process is alive and serving requests
+func (h *Health) HandleLive(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// HandleReady reports whether the broker can serve clients: the database is reachable and migrated,
+// and at least one custody listener receives events on the leader node
+func (h *Health) HandleReady(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+
+	response := ReadinessResponse{Ready: true, Checks: make(map[string]string)}
+	check := func(name string, err error) {
+		if err != nil {
+			response.Ready = false
+			response.Checks[name] = err.Error()
+			return
+		}
+		response.Checks[name] = "ok"
+	}
+
+	check("database", h.pingDB(ctx))
+	check("migrations", CheckMigrations(h.db.WithContext(ctx), h.driver))
+	check("listeners", h.checkListeners())
+
+	w.Header().Set("Content-Type", "application/json")
+	if !response.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// HandleStatus reports the build version, the connected clients, the progress of every network and the health
+// of its RPC endpoints. A degraded network doesn't fail the request, the broker keeps serving the other networks.
+func (h *Health) HandleStatus(w http.ResponseWriter, r *http.Request) {
+	response := StatusResponse{
+		Version:          h.version,
+		RPCStatus:        "ok",
+		StartedAt:        h.startedAt,
+		ConnectedClients: h.connections(),
+		Leaderships:      map[string]bool{},
+		Networks:         []NetworkListenerStatus{},
+	}
+
+	if h.leaders != nil {
+		response.Leaderships = h.leaders.Leaders()
+	}
+
+	for name, pool := range h.pools {
+		health := pool.Health()
+		if health.Status != NetworkStatusHealthy {
+			response.RPCStatus = "degraded"
+		}
+		network := NetworkListenerStatus{
+			Network:   name,
+			Health:    health.Status,
+			Endpoints: health.Endpoints,
+			Leader:    h.isLeader(listenerLeadership(name)),
+		}
+		if client, ok := h.custodyClients[name]; ok {
+			status := client.Status()
+			// A subscription only sees the blocks with events, the endpoints know the latest head
+			for _, endpoint := range health.Endpoints {
+				status.HeadBlock = max(status.HeadBlock, endpoint.HeadBlock)
+			}
+			network.ChainID = client.chainID
+			network.Ingestion = client.ingestion.Mode
+			network.Listener = &status
+		}
+		response.Networks = append(response.Networks, network)
+	}
+	sort.Slice(response.Networks, func(i, j int) bool {
+		return response.Networks[i].Network < response.Networks[j].Network
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (h *Health) pingDB(ctx context.Context) error {
+	sqlDB, err := h.db.DB()
+	if err != nil {
+		return fmt.Errorf("failed to get database connection: %w", err)
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return fmt.Errorf("database is unreachable: %w", err)
+	}
+	return nil
+}
+
+func (h *Health) isLeader(name string) bool {
+	return h.leaders == nil || h.leaders.IsLeader(name)
+}
+
+// checkListeners only considers the networks led by this node, a node leading none serves clients while
+// the other nodes run the listeners
+func (h *Health) checkListeners() error {
+	leading := false
+	for name, client := range h.custodyClients {
+		if !h.isLeader(listenerLeadership(name)) {
+			continue
+		}
+		leading = true
+		switch client.Status().State {
+		case ListenerStateSubscribed, ListenerStatePolling:
+			return nil
+		}
+	}
+	if !leading {
+		return nil
+	}
+	return errors.New("no custody listener is receiving events")
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	polygonURL := "https://polygon.example.com"
+	baseURL := "https://base.example.com"
+	pools := map[string]*RPCPool{
+		"polygon": newTestPool(map[string]*fakeEndpoint{polygonURL: {chainID: 137, head: 500}}, polygonURL),
+		"base":    newTestPool(map[string]*fakeEndpoint{}, baseURL),
+	}
+	polygon := &Custody{chainID: 137, ingestion: IngestionConfig{Mode: EventIngestionSubscribe}, status: ListenerStatus{State: ListenerStateStarting}}
+	custodyClients := map[string]*Custody{"polygon": polygon}
+	health := NewHealth(db, "sqlite", "v1.2.3", custodyClients, pools, nil, func() int { return 3 })
+
+	serve := func(handler http.HandlerFunc, path string) *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler(recorder, httptest.NewRequest("GET", path, nil))
+		return recorder
+	}
+
+	t.Run("Live", func(t *testing.T) {
+		assert.Equal(t, http.StatusOK, serve(health.HandleLive, "/healthz").Code)
+	})
+
+	t.Run("Ready", func(t *testing.T) {
+		recorder := serve(health.HandleReady, "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, recorder.Code, "no listener receives events yet")
+		var response ReadinessResponse
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		assert.False(t, response.Ready)
+		assert.Equal(t, "ok", response.Checks["database"])
+		assert.Equal(t, "ok", response.Checks["migrations"])
+		assert.Equal(t, "no custody listener is receiving events", response.Checks["listeners"])
+
+		// Nodes serve clients while the others run the listeners
+		health.leaders = NewLeaderGroup(LocalElector{}, time.Second)
+		health.leaders.leaderships[listenerLeadership("polygon")] = NewLeadership(LocalElector{}, listenerLeadership("polygon"), time.Second)
+		assert.Equal(t, http.StatusOK, serve(health.HandleReady, "/readyz").Code)
+		health.leaders = nil
+
+		polygon.SetState(ListenerStateSubscribed)
+		assert.Equal(t, http.StatusOK, serve(health.HandleReady, "/readyz").Code)
+
+		sqlDB, err := db.DB()
+		require.NoError(t, err)
+		require.NoError(t, sqlDB.Close())
+		recorder = serve(health.HandleReady, "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "database is unreachable")
+	})
+
+	t.Run("Status", func(t *testing.T) {
+		polygon.SetState(ListenerStateSubscribed)
+		polygon.SetHeadBlock(420)
+		polygon.setLastBlock(410)
+		pools["polygon"].CheckHealth(t.Context())
+
+		recorder := serve(health.HandleStatus, "/status")
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		var response StatusResponse
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+		assert.Equal(t, "v1.2.3", response.Version)
+		assert.Equal(t, 3, response.ConnectedClients)
+		assert.Equal(t, "ok", response.RPCStatus)
+		require.Len(t, response.Networks, 2)
+
+		assert.Equal(t, "base", response.Networks[0].Network)
+		assert.Nil(t, response.Networks[0].Listener, "a network which failed to start has no listener")
+
+		assert.Equal(t, "polygon", response.Networks[1].Network)
+		assert.Equal(t, uint32(137), response.Networks[1].ChainID)
+		assert.Equal(t, EventIngestionSubscribe, response.Networks[1].Ingestion)
+		assert.True(t, response.Networks[1].Leader, "a single node runs every listener")
+		assert.Equal(t, &ListenerStatus{State: ListenerStateSubscribed, HeadBlock: 500, LastBlock: 410}, response.Networks[1].Listener)
+		require.Len(t, response.Networks[1].Endpoints, 1)
+		assert.True(t, response.Networks[1].Endpoints[0].Up)
+	})
+}
+
+func TestCheckMigrations(t *testing.T) {
+	latest, err := latestMigrationVersion("config/migrations/postgres")
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, latest, int64(20250801090000))
+	assert.NoError(t, CheckMigrations(nil, "sqlite"), "sqlite databases are migrated on connection")
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// HoldStatus represents the state of a hold on a unified balance
+type HoldStatus string
+
+var (
+	HoldStatusActive    HoldStatus = "active"    // Funds are reserved and can't be spent
+	HoldStatusConverted HoldStatus = "converted" // The matching on-chain event was processed and debited the balance
+	HoldStatusReleased  HoldStatus = "released"  // The hold was superseded or timed out and the funds are spendable again
+)
+
+// LedgerHold reserves part of a unified balance for a channel state signed by the broker,
+// until the matching Resized or Closed event debits the balance on-chain.
+type LedgerHold struct {
+	ID               uint            `gorm:"primaryKey"`
+	ChannelID        string          `gorm:"column:channel_id;not null;index"`
+	AccountID        string          `gorm:"column:account_id;not null;index:idx_ledger_holds_account"`
+	Participant      string          `gorm:"column:participant;not null;index:idx_ledger_holds_account"`
+	AssetSymbol      string          `gorm:"column:asset_symbol;not null;index:idx_ledger_holds_account"`
+	Amount           decimal.Decimal `gorm:"column:amount;type:decimal(38,18);not null"`
+	Fee              decimal.Decimal `gorm:"column:fee;type:decimal(38,18);not null;default:0"`               // Part of the amount charged as fee when the hold is converted
+	BrokerAllocation decimal.Decimal `gorm:"column:broker_allocation;type:decimal(38,18);not null;default:0"` // Allocated by the broker from its side of the channel, out of its on-chain liquidity
+	Status           HoldStatus      `gorm:"column:status;not null"`
+	Version          uint64          `gorm:"column:version;not null"`                          // Version of the signed state the hold was placed for
+	ChannelStateID   uint            `gorm:"column:channel_state_id;not null;default:0;index"` // Signed state the hold was placed for, 0 for holds placed before states were linked
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+}
+
+func (LedgerHold) TableName() string {
+	return "ledger_holds"
+}
+
+// PlaceHold reserves an amount of the account balance for a signed channel state, including the fee
+// charged once the state lands on-chain, and the broker liquidity the state allocates to the channel.
+// The hold lasts until the state lands or is superseded, callers lock the account balance with LockBalances
+// in the transaction which stores the state.
+func PlaceHold(tx *gorm.DB, state *ChannelState, account Account, assetSymbol string, amount, fee, brokerAllocation decimal.Decimal) (*LedgerHold, error) {
+	if !amount.IsPositive() && !brokerAllocation.IsPositive() {
+		return nil, nil
+	}
+
+	hold := &LedgerHold{
+		ChannelID:        state.ChannelID,
+		AccountID:        account.ID,
+		Participant:      account.Participant,
+		AssetSymbol:      assetSymbol,
+		Amount:           amount,
+		Fee:              fee,
+		Status:           HoldStatusActive,
+		BrokerAllocation: brokerAllocation,
+		Version:          state.Version,
+		ChannelStateID:   state.ID,
+	}
+	if err := tx.Create(hold).Error; err != nil {
+		return nil, fmt.Errorf("failed to place hold: %w", err)
+	}
+	return hold, nil
+}
+
+// ConvertHolds marks the active holds of channel states as converted, once their on-chain event debited the balance,
+// along with the holds of the channel placed before states were linked to them. The converted holds are returned,
+// so that their fees can be charged in the same ledger transaction.
+func ConvertHolds(tx *gorm.DB, channelID string, stateIDs ...uint) ([]LedgerHold, error) {
+	q := func() *gorm.DB {
+		return tx.Where("channel_id = ? AND channel_state_id IN ?", channelID, append([]uint{0}, stateIDs...))
+	}
+	var holds []LedgerHold
+	if err := q().Where("status = ?", HoldStatusActive).Order("id").Find(&holds).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch holds: %w", err)
+	}
+	if err := setHoldStatus(q(), HoldStatusConverted); err != nil {
+		return nil, err
+	}
+	return holds, nil
+}
+
+// stateHolds returns the active holds of a channel state
+func stateHolds(tx *gorm.DB, stateID uint) ([]LedgerHold, error) {
+	var holds []LedgerHold
+	if err := tx.Where("channel_state_id = ? AND status = ?", stateID, HoldStatusActive).Order("id").Find(&holds).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch holds: %w", err)
+	}
+	return holds, nil
+}
+
+// chargeHoldFees adds the fees of converted holds to the ledger transaction
+func chargeHoldFees(ledgerTx *LedgerTransaction, holds []LedgerHold) {
+	ledgerTx.withMemo(feeMemo(FeeOperationResizeChannel), func() {
+		for _, h := range holds {
+			ledgerTx.Transfer(ParticipantAccount(h.Participant), RevenueAccount(), h.AssetSymbol, h.Fee)
+		}
+	})
+}
+
+// ReleaseHolds makes the funds reserved by the active holds of channel states spendable again
+func ReleaseHolds(tx *gorm.DB, stateIDs ...uint) error {
+	if len(stateIDs) == 0 {
+		return nil
+	}
+	return setHoldStatus(tx.Where("channel_state_id IN ?", stateIDs), HoldStatusReleased)
+}
+
+// ReleaseExpiredHolds releases holds older than the timeout whose state can't be submitted on-chain anymore.
+// Holds of pending states are kept however old, the participant could still submit them. Holds placed before
+// states were linked are matched to the pending states of their version.
+func ReleaseExpiredHolds(db *gorm.DB, timeout time.Duration) (int64, error) {
+	pending := db.Model(&ChannelState{}).Select("1").
+		Where("channel_states.status = ?", ChannelStateStatusPending).
+		Where(`channel_states.id = ledger_holds.channel_state_id OR (ledger_holds.channel_state_id = 0
+			AND channel_states.channel_id = ledger_holds.channel_id AND channel_states.version = ledger_holds.version)`)
+	result := db.Model(&LedgerHold{}).
+		Where("status = ? AND created_at < ?", HoldStatusActive, time.Now().Add(-timeout)).
+		Where("NOT EXISTS (?)", pending).
+		Updates(map[string]any{"status": HoldStatusReleased, "updated_at": time.Now()})
+	if result.Error != nil {
+		return 0, fmt.Errorf("failed to release expired holds: %w", result.Error)
+	}
+	return result.RowsAffected, nil
+}
+
+// RunHoldSweeper periodically releases expired holds
+func RunHoldSweeper(ctx context.Context, db *gorm.DB, timeout time.Duration) {
+	interval := time.Minute
+	if timeout < interval {
+		interval = timeout
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		released, err := ReleaseExpiredHolds(db, timeout)
+		if err != nil {
+			log.Printf("%v", err)
+			continue
+		}
+		if released > 0 {
+			log.Printf("Released %d expired ledger holds", released)
+		}
+	}
+}
+
+func setHoldStatus(q *gorm.DB, status HoldStatus) error {
+	err := q.Model(&LedgerHold{}).
+		Where("status = ?", HoldStatusActive).
+		Updates(map[string]any{"status": status, "updated_at": time.Now()}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update holds: %w", err)
+	}
+	return nil
+}
+
+// heldAmounts returns the amounts reserved by active holds of an account per asset
+func heldAmounts(tx *gorm.DB, accountID, participant string) (map[string]decimal.Decimal, error) {
+	var holds []LedgerHold
+	if err := tx.Where("account_id = ? AND participant = ? AND status = ?", accountID, participant, HoldStatusActive).
+		Find(&holds).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch holds: %w", err)
+	}
+
+	held := map[string]decimal.Decimal{}
+	for _, h := range holds {
+		held[h.AssetSymbol] = held[h.AssetSymbol].Add(h.Amount)
+	}
+	return held, nil
+}
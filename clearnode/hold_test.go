@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLedgerHolds(t *testing.T) {
+	rawKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signer := LocalSigner{privateKey: rawKey}
+	participantAddr := signer.GetAddress().Hex()
+
+	rawBroker, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	keys := NewKeyRing(&LocalSigner{privateKey: rawBroker})
+
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	tokenAddress := "0x1234567890123456789012345678901234567890"
+	require.NoError(t, db.Create(&Asset{Token: tokenAddress, ChainID: 137, Symbol: "usdc", Decimals: 6}).Error)
+
+	channel := Channel{
+		ChannelID:   "0xChannelHold",
+		Participant: participantAddr,
+		Status:      ChannelStatusOpen,
+		Token:       tokenAddress,
+		ChainID:     137,
+		Amount:      5000000,
+		Version:     1,
+		Adjudicator: "0xAdjudicator",
+	}
+	require.NoError(t, db.Create(&channel).Error)
+	seedLedger(t, db, ParticipantAccount(participantAddr), "usdc", decimal.NewFromInt(5))
+
+	ledger := GetParticipantLedger(db, participantAddr)
+	assertBalance := func(t *testing.T, held, spendable int64) {
+		t.Helper()
+		balances, err := ledger.GetBalances(participantAddr)
+		require.NoError(t, err)
+		require.Len(t, balances, 1)
+		assert.True(t, decimal.NewFromInt(5).Equal(balances[0].Amount), "amount: %s", balances[0].Amount)
+		assert.True(t, decimal.NewFromInt(held).Equal(balances[0].Held), "held: %s", balances[0].Held)
+		assert.True(t, decimal.NewFromInt(spendable).Equal(balances[0].Spendable), "spendable: %s", balances[0].Spendable)
+	}
+	activeHolds := func() []LedgerHold {
+		var holds []LedgerHold
+		require.NoError(t, db.Where("channel_id = ? AND status = ?", channel.ChannelID, HoldStatusActive).Find(&holds).Error)
+		return holds
+	}
+
+	t.Run("RequiresSignature", func(t *testing.T) {
+		_, err := HandleResizeChannel(&RPCMessage{
+			Req: &RPCData{RequestID: 1, Method: "resize_channel", Params: []any{ResizeChannelParams{ChannelID: channel.ChannelID, ResizeAmount: big.NewInt(1), FundsDestination: participantAddr}}},
+		}, db, keys, nil, nil)
+		require.ErrorContains(t, err, "missing signature")
+
+		_, err = HandleCloseChannel(&RPCMessage{
+			Req: &RPCData{RequestID: 1, Method: "close_channel", Params: []any{CloseChannelParams{ChannelID: channel.ChannelID, FundsDestination: participantAddr}}},
+		}, db, keys)
+		require.ErrorContains(t, err, "missing signature")
+		assert.Empty(t, activeHolds())
+	})
+
+	var resized ResizeChannelResponse
+	t.Run("ResizePlacesHold", func(t *testing.T) {
+		resizeParams := ResizeChannelParams{
+			ChannelID:        channel.ChannelID,
+			ResizeAmount:     big.NewInt(2000000),
+			FundsDestination: participantAddr,
+		}
+		resize := func(requestID uint64) ResizeChannelResponse {
+			reqBytes, err := json.Marshal(ResizeChannelSignData{RequestID: requestID, Method: "resize_channel", Params: []ResizeChannelParams{resizeParams}, Timestamp: 1})
+			require.NoError(t, err)
+			sig, err := signer.Sign(reqBytes)
+			require.NoError(t, err)
+
+			resp, err := HandleResizeChannel(&RPCMessage{
+				Req: &RPCData{RequestID: requestID, Method: "resize_channel", Params: []any{resizeParams}, Timestamp: 1},
+				Sig: []string{hexutil.Encode(sig)},
+			}, db, keys, nil, nil)
+			require.NoError(t, err)
+			return resp.Res.Params[0].(ResizeChannelResponse)
+		}
+		resized = resize(1)
+
+		holds := activeHolds()
+		require.Len(t, holds, 1)
+		assert.Equal(t, uint64(2), holds[0].Version)
+		assertBalance(t, 2, 3)
+
+		// The response was lost, the same request gets the pending state back without holding twice
+		again := resize(2)
+		assert.Equal(t, resized.StateHash, again.StateHash)
+		assert.Equal(t, resized.Signature, again.Signature)
+		assert.Len(t, activeHolds(), 1)
+		assertBalance(t, 2, 3)
+	})
+
+	closeRequest := &RPCMessage{
+		Req: &RPCData{
+			RequestID: 3,
+			Method:    "close_channel",
+			Params:    []any{CloseChannelParams{ChannelID: channel.ChannelID, FundsDestination: participantAddr}},
+			Timestamp: 2,
+		},
+	}
+	reqBytes, err := json.Marshal(closeRequest.Req)
+	require.NoError(t, err)
+	closeSig, err := signer.Sign(reqBytes)
+	require.NoError(t, err)
+	closeRequest.Sig = []string{hexutil.Encode(closeSig)}
+
+	t.Run("CloseRefusedWhileResizePending", func(t *testing.T) {
+		// The resize state could still be submitted, a final state for the same version is refused
+		_, err := HandleCloseChannel(closeRequest, db, keys)
+		require.ErrorContains(t, err, "a state for version 2 of channel "+channel.ChannelID+" is already signed")
+		assert.Len(t, activeHolds(), 1)
+		assertBalance(t, 2, 3)
+	})
+
+	t.Run("ConvertOnChainEvent", func(t *testing.T) {
+		converted, err := settleResizedStates(db, channel.ChannelID, 2, resized.StateData)
+		require.NoError(t, err)
+		require.Len(t, converted, 1)
+		assert.True(t, decimal.NewFromInt(2).Equal(converted[0].Amount))
+		assert.Empty(t, activeHolds())
+		assertBalance(t, 0, 5)
+
+		// The resize landed, the next version can be signed
+		require.NoError(t, db.Model(&channel).Update("version", 2).Error)
+		resp, err := HandleCloseChannel(closeRequest, db, keys)
+		require.NoError(t, err)
+		final := resp.Res.Params[0].(CloseChannelResponse)
+		assert.Equal(t, uint64(3), final.Version)
+		assert.Equal(t, int64(5000000), final.FinalAllocations[0].Amount.Int64())
+		assert.Len(t, activeHolds(), 1)
+		assertBalance(t, 5, 0)
+
+		// Closing again to the same destination returns the pending final state
+		resp, err = HandleCloseChannel(closeRequest, db, keys)
+		require.NoError(t, err)
+		assert.Equal(t, final.StateHash, resp.Res.Params[0].(CloseChannelResponse).StateHash)
+		assert.Len(t, activeHolds(), 1)
+
+		var count int64
+		require.NoError(t, db.Model(&ChannelState{}).Where("channel_id = ?", channel.ChannelID).Count(&count).Error)
+		assert.Equal(t, int64(2), count)
+
+		converted, err = settleClosedStates(db, channel.ChannelID)
+		require.NoError(t, err)
+		require.Len(t, converted, 1)
+		assert.Empty(t, activeHolds())
+
+		require.NoError(t, db.Model(&LedgerHold{}).Where("status = ?", HoldStatusConverted).Count(&count).Error)
+		assert.Equal(t, int64(2), count)
+		assertBalance(t, 0, 5)
+	})
+
+	t.Run("ReleaseExpired", func(t *testing.T) {
+		account := ParticipantAccount(participantAddr)
+		stale, err := PlaceHold(db, &ChannelState{ChannelID: channel.ChannelID, Version: 3}, account, "usdc", decimal.NewFromInt(1), decimal.Zero, decimal.Zero)
+		require.NoError(t, err)
+		require.NoError(t, db.Model(stale).Update("created_at", time.Now().Add(-2*time.Hour)).Error)
+		_, err = PlaceHold(db, &ChannelState{ChannelID: "0xOtherChannel", Version: 1}, account, "usdc", decimal.NewFromInt(1), decimal.Zero, decimal.Zero)
+		require.NoError(t, err)
+		assertBalance(t, 2, 3)
+
+		// The participant can still submit pending states, their holds are kept however old
+		pending := &ChannelState{ChannelID: channel.ChannelID, Version: 3, Intent: 2, Status: ChannelStateStatusPending}
+		require.NoError(t, db.Create(pending).Error)
+		kept, err := PlaceHold(db, pending, account, "usdc", decimal.NewFromInt(1), decimal.Zero, decimal.Zero)
+		require.NoError(t, err)
+		unlinked, err := PlaceHold(db, &ChannelState{ChannelID: channel.ChannelID, Version: 3}, account, "usdc", decimal.NewFromInt(1), decimal.Zero, decimal.Zero)
+		require.NoError(t, err)
+		require.NoError(t, db.Model(&LedgerHold{}).Where("id IN ?", []uint{kept.ID, unlinked.ID}).Update("created_at", time.Now().Add(-2*time.Hour)).Error)
+		assertBalance(t, 4, 1)
+
+		released, err := ReleaseExpiredHolds(db, time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, int64(0), released)
+		assertBalance(t, 4, 1)
+
+		// Once superseded they are released like the holds of states which were never stored
+		require.NoError(t, db.Model(pending).Update("status", ChannelStateStatusSuperseded).Error)
+		released, err = ReleaseExpiredHolds(db, time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, int64(3), released)
+		assert.Empty(t, activeHolds())
+		assertBalance(t, 1, 4)
+	})
+}
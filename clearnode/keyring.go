@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// BrokerKeyStatus describes the role of a broker key in the rotation schedule
+type BrokerKeyStatus string
+
+var (
+	BrokerKeyStatusActive  BrokerKeyStatus = "active"
+	BrokerKeyStatusLegacy  BrokerKeyStatus = "legacy"
+	BrokerKeyStatusRetired BrokerKeyStatus = "retired"
+)
+
+// BrokerKey is a broker signing key together with its rotation schedule
+type BrokerKey struct {
+	Signer      Signer
+	ActivatedAt *time.Time // When the key became active, if known
+	RetiresAt   *time.Time // When a legacy key stops being honored, nil means never
+}
+
+// BrokerKeyInfo represents a broker key in the published rotation schedule
+type BrokerKeyInfo struct {
+	Address     string          `json:"address"`
+	Status      BrokerKeyStatus `json:"status"`
+	ActivatedAt *time.Time      `json:"activated_at,omitempty"`
+	RetiresAt   *time.Time      `json:"retires_at,omitempty"`
+}
+
+// KeyRing holds the active broker key, which is used for new channels and general
+// message signing, and legacy keys which are still honored for channels that reference them.
+type KeyRing struct {
+	active BrokerKey
+	legacy []BrokerKey
+}
+
+// NewKeyRing creates a key ring with the given active signer and legacy keys
+func NewKeyRing(active Signer, legacy ...BrokerKey) *KeyRing {
+	return &KeyRing{
+		active: BrokerKey{Signer: active},
+		legacy: legacy,
+	}
+}
+
+// NewKeyRingFromConfig initializes signers for the active and legacy broker keys
+func NewKeyRingFromConfig(cnf KeyRingConfig) (*KeyRing, error) {
+	active, err := NewSignerFromConfig(cnf.Active)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise active broker key: %w", err)
+	}
+
+	keys := NewKeyRing(active)
+	keys.active.ActivatedAt = cnf.ActivatedAt
+
+	for i, legacyConf := range cnf.Legacy {
+		signer, err := NewSignerFromConfig(legacyConf.SignerConfig)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialise legacy broker key %d: %w", i+1, err)
+		}
+		if signer.GetAddress() == active.GetAddress() {
+			return nil, fmt.Errorf("legacy broker key %d is the active key", i+1)
+		}
+		keys.legacy = append(keys.legacy, BrokerKey{Signer: signer, RetiresAt: legacyConf.RetiresAt})
+	}
+
+	return keys, nil
+}
+
+// Active returns the signer for the active broker key
+func (k *KeyRing) Active() Signer {
+	return k.active.Signer
+}
+
+// Original returns the signer for the oldest configured broker key.
+// Rotation moves the previous key to BROKER_LEGACY_1, so the oldest key is the last legacy key.
+func (k *KeyRing) Original() Signer {
+	if len(k.legacy) == 0 {
+		return k.active.Signer
+	}
+	return k.legacy[len(k.legacy)-1].Signer
+}
+
+// IsActive reports whether the address belongs to the active broker key
+func (k *KeyRing) IsActive(address string) bool {
+	return strings.EqualFold(address, k.active.Signer.GetAddress().Hex())
+}
+
+// Get returns the signer for a broker key that is still honored.
+// An empty address refers to the active key.
+func (k *KeyRing) Get(address string) (Signer, error) {
+	if address == "" || k.IsActive(address) {
+		return k.active.Signer, nil
+	}
+
+	for _, key := range k.legacy {
+		if !strings.EqualFold(address, key.Signer.GetAddress().Hex()) {
+			continue
+		}
+		if key.RetiresAt != nil && time.Now().After(*key.RetiresAt) {
+			return nil, fmt.Errorf("broker key %s was retired at %s", address, key.RetiresAt.Format(time.RFC3339))
+		}
+		return key.Signer, nil
+	}
+
+	return nil, fmt.Errorf("unknown broker key %s", address)
+}
+
+// Signers returns all broker keys which are still honored, starting with the active one
+func (k *KeyRing) Signers() []Signer {
+	signers := []Signer{k.active.Signer}
+	for _, key := range k.legacy {
+		if key.RetiresAt == nil || time.Now().Before(*key.RetiresAt) {
+			signers = append(signers, key.Signer)
+		}
+	}
+	return signers
+}
+
+// Schedule returns the rotation schedule of all configured broker keys
+func (k *KeyRing) Schedule() []BrokerKeyInfo {
+	schedule := []BrokerKeyInfo{{
+		Address:     k.active.Signer.GetAddress().Hex(),
+		Status:      BrokerKeyStatusActive,
+		ActivatedAt: k.active.ActivatedAt,
+	}}
+
+	for _, key := range k.legacy {
+		status := BrokerKeyStatusLegacy
+		if key.RetiresAt != nil && time.Now().After(*key.RetiresAt) {
+			status = BrokerKeyStatusRetired
+		}
+		schedule = append(schedule, BrokerKeyInfo{
+			Address:   key.Signer.GetAddress().Hex(),
+			Status:    status,
+			RetiresAt: key.RetiresAt,
+		})
+	}
+
+	return schedule
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRing(t *testing.T) {
+	newSigner := func() *LocalSigner {
+		key, err := crypto.GenerateKey()
+		require.NoError(t, err)
+		return &LocalSigner{privateKey: key}
+	}
+	active, legacy, retired := newSigner(), newSigner(), newSigner()
+
+	retiresAt := time.Now().Add(time.Hour)
+	retiredAt := time.Now().Add(-time.Hour)
+	keys := NewKeyRing(active,
+		BrokerKey{Signer: legacy, RetiresAt: &retiresAt},
+		BrokerKey{Signer: retired, RetiresAt: &retiredAt},
+	)
+
+	assert.Equal(t, active.GetAddress(), keys.Active().GetAddress())
+	assert.True(t, keys.IsActive(active.GetAddress().Hex()))
+	assert.False(t, keys.IsActive(legacy.GetAddress().Hex()))
+
+	signer, err := keys.Get("")
+	require.NoError(t, err)
+	assert.Equal(t, active.GetAddress(), signer.GetAddress())
+
+	signer, err = keys.Get(legacy.GetAddress().Hex())
+	require.NoError(t, err)
+	assert.Equal(t, legacy.GetAddress(), signer.GetAddress())
+
+	_, err = keys.Get(retired.GetAddress().Hex())
+	assert.Error(t, err)
+	_, err = keys.Get(newSigner().GetAddress().Hex())
+	assert.Error(t, err)
+
+	signers := keys.Signers()
+	require.Len(t, signers, 2)
+	assert.Equal(t, active.GetAddress(), signers[0].GetAddress())
+	assert.Equal(t, legacy.GetAddress(), signers[1].GetAddress())
+
+	schedule := keys.Schedule()
+	require.Len(t, schedule, 3)
+	assert.Equal(t, BrokerKeyStatusActive, schedule[0].Status)
+	assert.Equal(t, BrokerKeyStatusLegacy, schedule[1].Status)
+	assert.Equal(t, BrokerKeyStatusRetired, schedule[2].Status)
+}
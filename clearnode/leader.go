@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Elector elects a single node of a cluster to hold a named leadership
+type Elector interface {
+	// TryAcquire takes a leadership unless another node holds it, and reports whether this node holds it
+	TryAcquire(ctx context.Context, name string) (bool, error)
+	// Check fails once this node may have lost a leadership, e.g. with the database session holding it
+	Check(ctx context.Context, name string) error
+	// Release hands a leadership over to the other nodes
+	Release(ctx context.Context, name string) error
+}
+
+// LocalElector elects the process, for a single node
+type LocalElector struct{}
+
+func (LocalElector) TryAcquire(ctx context.Context, name string) (bool, error) { return true, nil }
+func (LocalElector) Check(ctx context.Context, name string) error              { return nil }
+func (LocalElector) Release(ctx context.Context, name string) error            { return nil }
+
+// NewElector creates the elector matching the database, nodes sharing a Postgres database elect a leader
+func NewElector(db *gorm.DB, driver string) (Elector, error) {
+	if driver != "postgres" {
+		return LocalElector{}, nil
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database connection: %w", err)
+	}
+	return NewPostgresElector(sqlDB), nil
+}
+
+// PostgresElector holds leaderships as session advisory locks on a dedicated connection. They are released
+// when the connection is closed, so a node which dies hands its leaderships over to the others.
+type PostgresElector struct {
+	db     *sql.DB
+	conn   *sql.Conn
+	connMu sync.Mutex
+}
+
+// NewPostgresElector creates an elector on a Postgres database
+func NewPostgresElector(db *sql.DB) *PostgresElector {
+	return &PostgresElector{db: db}
+}
+
+// TryAcquire takes the advisory lock of a leadership
+func (e *PostgresElector) TryAcquire(ctx context.Context, name string) (bool, error) {
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+
+	if e.conn == nil {
+		conn, err := e.db.Conn(ctx)
+		if err != nil {
+			return false, fmt.Errorf("failed to open leader election connection: %w", err)
+		}
+		e.conn = conn
+	}
+
+	var acquired bool
+	if err := e.conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", leadershipLockKey(name)).Scan(&acquired); err != nil {
+		e.dropConn()
+		return false, fmt.Errorf("failed to acquire leadership %s: %w", name, err)
+	}
+	return acquired, nil
+}
+
+// Check confirms that the advisory lock of a leadership is held by the current session. A lock is lost
+// with the session which took it, even once another leadership opened a new connection.
+func (e *PostgresElector) Check(ctx context.Context, name string) error {
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+
+	if e.conn == nil {
+		return errors.New("leader election connection is closed")
+	}
+	var held bool
+	if err := e.conn.QueryRowContext(ctx, heldLockQuery, leadershipLockKey(name)).Scan(&held); err != nil {
+		e.dropConn()
+		return fmt.Errorf("leader election connection is lost: %w", err)
+	}
+	if !held {
+		return fmt.Errorf("leadership %s is not held by the current session", name)
+	}
+	return nil
+}
+
+// heldLockQuery tells whether the session holds an advisory lock, pg_locks splits its key into the high
+// bits in classid and the low bits in objid
+const heldLockQuery = `SELECT EXISTS (
+	SELECT 1 FROM pg_locks
+	WHERE locktype = 'advisory' AND objsubid = 1 AND granted AND pid = pg_backend_pid()
+		AND ((classid::bigint << 32) | objid::bigint) = $1
+)`
+
+// Release unlocks the advisory lock of a leadership
+func (e *PostgresElector) Release(ctx context.Context, name string) error {
+	e.connMu.Lock()
+	defer e.connMu.Unlock()
+
+	if e.conn == nil {
+		return nil
+	}
+	if _, err := e.conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", leadershipLockKey(name)); err != nil {
+		e.dropConn()
+		return fmt.Errorf("failed to release leadership %s: %w", name, err)
+	}
+	return nil
+}
+
+// dropConn closes the connection holding the locks, which releases them all
+func (e *PostgresElector) dropConn() {
+	e.conn.Close()
+	e.conn = nil
+}
+
+// leadershipLockKey derives the advisory lock key of a leadership
+func leadershipLockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte("clearnode:" + name))
+	return int64(h.Sum64())
+}
+
+// Leadership runs a task on the elected node only. Followers try to take over every interval, and the
+// task of a node losing the leadership is cancelled.
+type Leadership struct {
+	elector  Elector
+	name     string
+	interval time.Duration
+	leader   atomic.Bool
+}
+
+// NewLeadership creates a named leadership
+func NewLeadership(elector Elector, name string, interval time.Duration) *Leadership {
+	return &Leadership{elector: elector, name: name, interval: interval}
+}
+
+// IsLeader tells whether this node runs the task
+func (l *Leadership) IsLeader() bool {
+	return l.leader.Load()
+}
+
+// Run runs the task whenever this node is the leader, until the context is cancelled. The task must
+// return once its context is cancelled.
+func (l *Leadership) Run(ctx context.Context, task func(ctx context.Context)) {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+
+	for {
+		acquired, err := l.elector.TryAcquire(ctx, l.name)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Failed to elect the leader of %s: %v", l.name, err)
+		}
+		if acquired {
+			l.lead(ctx, task, ticker)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// lead runs the task until the context is cancelled or the leadership is lost
+func (l *Leadership) lead(ctx context.Context, task func(ctx context.Context), ticker *time.Ticker) {
+	log.Printf("Elected leader of %s", l.name)
+	l.leader.Store(true)
+	defer l.leader.Store(false)
+
+	taskCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		task(taskCtx)
+	}()
+
+	for {
+		select {
+		case <-done:
+			cancel()
+			l.release()
+			return
+		case <-ctx.Done():
+			cancel()
+			<-done
+			l.release()
+			return
+		case <-ticker.C:
+			if err := l.elector.Check(ctx, l.name); err != nil {
+				log.Printf("Lost the leadership of %s: %v", l.name, err)
+				cancel()
+				<-done
+				return
+			}
+		}
+	}
+}
+
+func (l *Leadership) release() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := l.elector.Release(ctx, l.name); err != nil {
+		log.Printf("Failed to release the leadership of %s: %v", l.name, err)
+	}
+}
+
+// LeaderGroup runs tasks under named leaderships until it is stopped. Each leadership is elected on its
+// own, so the tasks of a cluster may run on different nodes.
+type LeaderGroup struct {
+	elector     Elector
+	interval    time.Duration
+	ctx         context.Context
+	cancel      context.CancelFunc
+	wg          sync.WaitGroup
+	leaderships map[string]*Leadership
+	mu          sync.RWMutex
+}
+
+// NewLeaderGroup creates a group of leaderships elected every interval
+func NewLeaderGroup(elector Elector, interval time.Duration) *LeaderGroup {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &LeaderGroup{
+		elector:     elector,
+		interval:    interval,
+		ctx:         ctx,
+		cancel:      cancel,
+		leaderships: make(map[string]*Leadership),
+	}
+}
+
+// Go runs a task whenever this node holds the named leadership
+func (g *LeaderGroup) Go(name string, task func(ctx context.Context)) {
+	leadership := NewLeadership(g.elector, name, g.interval)
+	g.mu.Lock()
+	g.leaderships[name] = leadership
+	g.mu.Unlock()
+
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		leadership.Run(g.ctx, task)
+	}()
+}
+
+// IsLeader tells whether this node holds the named leadership, a name outside the group is always held
+func (g *LeaderGroup) IsLeader(name string) bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	leadership, ok := g.leaderships[name]
+	return !ok || leadership.IsLeader()
+}
+
+// Leaders reports by name whether this node holds each leadership
+func (g *LeaderGroup) Leaders() map[string]bool {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+	leaders := make(map[string]bool, len(g.leaderships))
+	for name, leadership := range g.leaderships {
+		leaders[name] = leadership.IsLeader()
+	}
+	return leaders
+}
+
+// Stop cancels the tasks, waits for them to return and releases the leaderships, until the context is done
+func (g *LeaderGroup) Stop(ctx context.Context) error {
+	g.cancel()
+	return waitWithContext(ctx, &g.wg)
+}
+
+// listenerLeadership is the name of the leadership of the custody listener of a network
+func listenerLeadership(network string) string {
+	return "custody-listener:" + network
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lockTable holds the leaderships of the nodes of a test cluster
+type lockTable struct {
+	mu      sync.Mutex
+	holders map[string]fakeSession
+}
+
+// fakeSession is a database session of a node, locks are held by a session
+type fakeSession struct {
+	elector *fakeElector
+	id      int
+}
+
+// fakeElector is a node of a test cluster, which loses its leaderships with its session
+type fakeElector struct {
+	locks        *lockTable
+	session      int
+	disconnected atomic.Bool
+}
+
+func (e *fakeElector) TryAcquire(ctx context.Context, name string) (bool, error) {
+	if e.disconnected.Load() {
+		return false, errors.New("connection refused")
+	}
+	e.locks.mu.Lock()
+	defer e.locks.mu.Unlock()
+	session := fakeSession{elector: e, id: e.session}
+	if holder, ok := e.locks.holders[name]; ok && holder != session {
+		return false, nil
+	}
+	e.locks.holders[name] = session
+	return true, nil
+}
+
+func (e *fakeElector) Check(ctx context.Context, name string) error {
+	if e.disconnected.Load() {
+		return errors.New("connection refused")
+	}
+	e.locks.mu.Lock()
+	defer e.locks.mu.Unlock()
+	if e.locks.holders[name] != (fakeSession{elector: e, id: e.session}) {
+		return errors.New("lock is not held by the session")
+	}
+	return nil
+}
+
+func (e *fakeElector) Release(ctx context.Context, name string) error {
+	e.locks.mu.Lock()
+	defer e.locks.mu.Unlock()
+	if e.locks.holders[name] == (fakeSession{elector: e, id: e.session}) {
+		delete(e.locks.holders, name)
+	}
+	return nil
+}
+
+// disconnect drops the leaderships of the node, as a database does with the session of a dead node
+func (e *fakeElector) disconnect() {
+	e.disconnected.Store(true)
+	e.reconnect()
+}
+
+// reconnect replaces the session of the node, the locks of the previous session are dropped
+func (e *fakeElector) reconnect() {
+	e.locks.mu.Lock()
+	defer e.locks.mu.Unlock()
+	for name, holder := range e.locks.holders {
+		if holder.elector == e {
+			delete(e.locks.holders, name)
+		}
+	}
+	e.session++
+}
+
+func TestLeadership(t *testing.T) {
+	locks := &lockTable{holders: make(map[string]fakeSession)}
+	electors := []*fakeElector{{locks: locks}, {locks: locks}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var running atomic.Int32
+	var wg sync.WaitGroup
+	var leaderships []*Leadership
+	for _, elector := range electors {
+		leadership := NewLeadership(elector, "custody-listeners", 10*time.Millisecond)
+		leaderships = append(leaderships, leadership)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			leadership.Run(ctx, func(ctx context.Context) {
+				running.Add(1)
+				defer running.Add(-1)
+				<-ctx.Done()
+			})
+		}()
+	}
+
+	// A single node runs the task
+	require.Eventually(t, func() bool { return running.Load() == 1 }, 5*time.Second, time.Millisecond)
+	leader, follower := 0, 1
+	if leaderships[1].IsLeader() {
+		leader, follower = 1, 0
+	}
+	assert.True(t, leaderships[leader].IsLeader())
+	assert.False(t, leaderships[follower].IsLeader())
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), running.Load())
+
+	// The follower takes over from a leader whose session is replaced, e.g. by a reconnection for another
+	// leadership, although the leader is still connected
+	electors[leader].reconnect()
+	require.Eventually(t, func() bool {
+		return leaderships[follower].IsLeader() && !leaderships[leader].IsLeader() && running.Load() == 1
+	}, 5*time.Second, time.Millisecond)
+	leader, follower = follower, leader
+
+	// The follower takes over from a leader which lost its database session
+	electors[leader].disconnect()
+	require.Eventually(t, func() bool {
+		return leaderships[follower].IsLeader() && !leaderships[leader].IsLeader() && running.Load() == 1
+	}, 5*time.Second, time.Millisecond)
+
+	// The task is stopped and the leadership released on shutdown
+	cancel()
+	wg.Wait()
+	assert.Zero(t, running.Load())
+	assert.Empty(t, locks.holders)
+}
+
+func TestLeaderGroup(t *testing.T) {
+	locks := &lockTable{holders: make(map[string]fakeSession)}
+	electors := []*fakeElector{{locks: locks}, {locks: locks}}
+	names := []string{listenerLeadership("polygon"), listenerLeadership("base"), "metrics"}
+
+	var running sync.Map // Leadership name to the number of nodes running its task
+	var groups []*LeaderGroup
+	for _, elector := range electors {
+		group := NewLeaderGroup(elector, 10*time.Millisecond)
+		for _, name := range names {
+			group.Go(name, func(ctx context.Context) {
+				count, _ := running.LoadOrStore(name, &atomic.Int32{})
+				count.(*atomic.Int32).Add(1)
+				defer count.(*atomic.Int32).Add(-1)
+				<-ctx.Done()
+			})
+		}
+		groups = append(groups, group)
+	}
+
+	// Every task runs on a single node, and the leaderships are held independently
+	runningOnce := func() bool {
+		for _, name := range names {
+			count, ok := running.Load(name)
+			if !ok || count.(*atomic.Int32).Load() != 1 {
+				return false
+			}
+		}
+		return true
+	}
+	require.Eventually(t, runningOnce, 5*time.Second, time.Millisecond)
+	for _, name := range names {
+		assert.NotEqual(t, groups[0].IsLeader(name), groups[1].IsLeader(name), name)
+	}
+	assert.True(t, groups[0].IsLeader("unknown"), "a leadership outside the group is held")
+	assert.Len(t, groups[0].Leaders(), len(names))
+
+	// The remaining node takes over every task of a dead node
+	electors[0].disconnect()
+	require.Eventually(t, func() bool {
+		for _, name := range names {
+			if !groups[1].IsLeader(name) {
+				return false
+			}
+		}
+		return runningOnce()
+	}, 5*time.Second, time.Millisecond)
+
+	for _, group := range groups {
+		require.NoError(t, group.Stop(context.Background()))
+	}
+	assert.False(t, groups[1].IsLeader("metrics"))
+	assert.Empty(t, locks.holders)
+}
+
+func TestPostgresElector(t *testing.T) {
+	if os.Getenv("TEST_DB_DRIVER") != "postgres" {
+		t.Skip("set TEST_DB_DRIVER=postgres to test leader election on Postgres")
+	}
+
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+	sqlDB, err := db.DB()
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	leader, follower := NewPostgresElector(sqlDB), NewPostgresElector(sqlDB)
+
+	acquired, err := leader.TryAcquire(ctx, "custody-listeners")
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	acquired, err = follower.TryAcquire(ctx, "custody-listeners")
+	require.NoError(t, err)
+	assert.False(t, acquired, "the leadership is held by another session")
+	acquired, err = follower.TryAcquire(ctx, "other")
+	require.NoError(t, err)
+	assert.True(t, acquired, "leaderships are independent")
+
+	require.NoError(t, leader.Check(ctx, "custody-listeners"))
+	assert.Error(t, follower.Check(ctx, "custody-listeners"))
+	require.NoError(t, follower.Check(ctx, "other"))
+
+	// The leadership is lost with the session, even once the elector reconnects for another leadership
+	leader.connMu.Lock()
+	leader.dropConn()
+	leader.connMu.Unlock()
+	assert.Error(t, leader.Check(ctx, "custody-listeners"))
+	acquired, err = leader.TryAcquire(ctx, "jobs")
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	assert.Error(t, leader.Check(ctx, "custody-listeners"), "the new session does not hold the lock")
+	require.NoError(t, leader.Check(ctx, "jobs"))
+
+	// The leadership is taken over once the session of the leader is gone
+	acquired, err = follower.TryAcquire(ctx, "custody-listeners")
+	require.NoError(t, err)
+	assert.True(t, acquired)
+}
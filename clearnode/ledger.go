@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/shopspring/decimal"
 	"gorm.io/gorm"
 )
@@ -11,99 +12,258 @@ import (
 // Entry represents a ledger entry in the database
 type Entry struct {
 	ID          uint            `gorm:"primaryKey"`
+	TxID        string          `gorm:"column:tx_id;not null;default:'';index"`
 	AccountID   string          `gorm:"column:account_id;not null;index:idx_account_asset_symbol;index:idx_account_participant"`
 	AccountType AccountType     `gorm:"column:account_type;not null"`
 	AssetSymbol string          `gorm:"column:asset_symbol;not null;index:idx_account_asset_symbol"`
 	Participant string          `gorm:"column:participant;not null;index:idx_account_participant"`
 	Credit      decimal.Decimal `gorm:"column:credit;type:decimal(38,18);not null"`
 	Debit       decimal.Decimal `gorm:"column:debit;type:decimal(38,18);not null"`
-	CreatedAt   time.Time
+	// ReferenceType and Reference identify what the entry was posted for, e.g. an app session ID or an on-chain tx hash
+	ReferenceType ReferenceType `gorm:"column:reference_type;not null;default:''"`
+	Reference     string        `gorm:"column:reference;not null;default:'';index"`
+	Memo          string        `gorm:"column:memo;not null;default:''"` // Human-readable description
+	CreatedAt     time.Time
 }
 
 func (Entry) TableName() string {
 	return "ledger"
 }
 
-type ParticipantLedger struct {
-	participant string
-	db          *gorm.DB
+// ReferenceType describes what the reference of a ledger entry points to
+type ReferenceType string
+
+var (
+	ReferenceTypeAppSession ReferenceType = "app_session" // App session ID
+	ReferenceTypeChannel    ReferenceType = "channel"     // Channel ID
+	ReferenceTypeTxHash     ReferenceType = "tx_hash"     // Hash of the on-chain transaction that emitted the custody event
+	ReferenceTypeTransfer   ReferenceType = "transfer"    // Ledger transaction ID of an off-chain transfer
+)
+
+// BrokerParticipant is the participant that owns the broker's own ledger accounts
+const BrokerParticipant = "broker"
+
+// Account identifies a ledger account of a participant
+type Account struct {
+	ID          string
+	Type        AccountType
+	Participant string
 }
 
-func GetParticipantLedger(db *gorm.DB, participant string) *ParticipantLedger {
-	return &ParticipantLedger{participant: participant, db: db}
+// ParticipantAccount is the unified balance account of a participant
+func ParticipantAccount(participant string) Account {
+	return Account{ID: participant, Type: LiabilityDefault, Participant: participant}
 }
 
-func (l *ParticipantLedger) Record(accountID string, assetSymbol string, amount decimal.Decimal) error {
-	entry := &Entry{
-		AccountID:   accountID,
-		Participant: l.participant,
-		AssetSymbol: assetSymbol,
-		Credit:      decimal.Zero,
-		Debit:       decimal.Zero,
-		CreatedAt:   time.Now(),
+// AppSessionAccount holds the funds a participant has locked in an app session
+func AppSessionAccount(sessionID, participant string) Account {
+	return Account{ID: sessionID, Type: LiabilityDefault, Participant: participant}
+}
+
+// CustodyAccount holds the funds deposited into the custody contract on a chain.
+// Every participant deposit is mirrored by a debit to this account.
+func CustodyAccount(chainID uint32) Account {
+	return Account{ID: fmt.Sprintf("custody:%d", chainID), Type: AssetDefault, Participant: BrokerParticipant}
+}
+
+// BrokerEquityAccount records the funds the broker contributes to channels out of its own liquidity
+func BrokerEquityAccount() Account {
+	return Account{ID: "equity:broker", Type: EquityDefault, Participant: BrokerParticipant}
+}
+
+// LedgerTransaction groups the entries of a single operation.
+// The entries are only written by Post, and only if debits equal credits for every asset.
+type LedgerTransaction struct {
+	db      *gorm.DB
+	id      string
+	entries []Entry
+	err     error
+
+	referenceType ReferenceType
+	reference     string
+	memo          string
+}
+
+// NewLedgerTransaction starts a new ledger transaction
+func NewLedgerTransaction(db *gorm.DB) *LedgerTransaction {
+	return &LedgerTransaction{db: db, id: uuid.NewString()}
+}
+
+// ID returns the identifier shared by all entries of the transaction
+func (t *LedgerTransaction) ID() string {
+	return t.id
+}
+
+// SetReference sets the reference and memo of the entries added afterwards
+func (t *LedgerTransaction) SetReference(referenceType ReferenceType, reference, memo string) {
+	t.referenceType = referenceType
+	t.reference = reference
+	t.memo = memo
+}
+
+// withMemo adds entries with a different memo, e.g. to describe fees charged within an operation
+func (t *LedgerTransaction) withMemo(memo string, add func()) {
+	prev := t.memo
+	t.memo = memo
+	add()
+	t.memo = prev
+}
+
+// Debit adds a debit entry. Debits increase asset and expense accounts and decrease all others.
+func (t *LedgerTransaction) Debit(account Account, assetSymbol string, amount decimal.Decimal) {
+	t.add(account, assetSymbol, decimal.Zero, amount)
+}
+
+// Credit adds a credit entry. Credits increase liability, equity and revenue accounts and decrease all others.
+func (t *LedgerTransaction) Credit(account Account, assetSymbol string, amount decimal.Decimal) {
+	t.add(account, assetSymbol, amount, decimal.Zero)
+}
+
+// Transfer moves funds between two liability accounts
+func (t *LedgerTransaction) Transfer(from, to Account, assetSymbol string, amount decimal.Decimal) {
+	t.Debit(from, assetSymbol, amount)
+	t.Credit(to, assetSymbol, amount)
+}
+
+func (t *LedgerTransaction) add(account Account, assetSymbol string, credit, debit decimal.Decimal) {
+	if credit.IsNegative() || debit.IsNegative() {
+		if t.err == nil {
+			t.err = fmt.Errorf("negative amount for account %s", account.ID)
+		}
+		return
+	}
+	if credit.IsZero() && debit.IsZero() {
+		return
 	}
 
-	if amount.IsPositive() {
-		entry.Credit = amount
-	} else if amount.IsNegative() {
-		entry.Debit = amount.Abs()
-	} else {
+	t.entries = append(t.entries, Entry{
+		TxID:        t.id,
+		AccountID:   account.ID,
+		AccountType: account.Type,
+		AssetSymbol: assetSymbol,
+		Participant: account.Participant,
+		Credit:      credit,
+		Debit:       debit,
+
+		ReferenceType: t.referenceType,
+		Reference:     t.reference,
+		Memo:          t.memo,
+	})
+}
+
+// Post validates that the transaction is balanced and writes its entries
+func (t *LedgerTransaction) Post() error {
+	if t.err != nil {
+		return t.err
+	}
+	if len(t.entries) == 0 {
 		return nil
 	}
 
-	fmt.Println("recording entry for: ", l.participant, " in account ", accountID, " ", assetSymbol, " ", amount)
-	return l.db.Create(entry).Error
+	totals := map[string]decimal.Decimal{}
+	for _, entry := range t.entries {
+		totals[entry.AssetSymbol] = totals[entry.AssetSymbol].Add(entry.Debit).Sub(entry.Credit)
+	}
+	for asset, total := range totals {
+		if !total.IsZero() {
+			return fmt.Errorf("unbalanced ledger transaction %s: debits and credits of %s differ by %s", t.id, asset, total)
+		}
+	}
+
+	now := time.Now()
+	for i := range t.entries {
+		t.entries[i].CreatedAt = now
+	}
+
+	if err := t.db.Create(&t.entries).Error; err != nil {
+		return fmt.Errorf("failed to post ledger transaction: %w", err)
+	}
+	if err := applyBalanceDeltas(t.db, t.entries); err != nil {
+		return fmt.Errorf("failed to update balances: %w", err)
+	}
+	return nil
+}
+
+type ParticipantLedger struct {
+	participant string
+	db          *gorm.DB
 }
 
+func GetParticipantLedger(db *gorm.DB, participant string) *ParticipantLedger {
+	return &ParticipantLedger{participant: participant, db: db}
+}
+
+// Balance returns the balance of an account from the maintained balances table
 func (l *ParticipantLedger) Balance(accountID string, assetSymbol string) (decimal.Decimal, error) {
-	type result struct {
-		Balance decimal.Decimal `gorm:"column:balance"`
-	}
-	var res result
-	if err := l.db.Model(&Entry{}).
-		Where("account_id = ? AND asset_symbol = ? AND participant = ?", accountID, assetSymbol, l.participant).
-		Select("COALESCE(SUM(credit),0) - COALESCE(SUM(debit),0) AS balance").
-		Scan(&res).Error; err != nil {
+	var balance AccountBalance
+	err := l.db.Where("account_id = ? AND participant = ? AND asset_symbol = ?", accountID, l.participant, assetSymbol).
+		Limit(1).Find(&balance).Error
+	if err != nil {
 		return decimal.Zero, err
 	}
-	return res.Balance, nil
+	return balance.Amount, nil
 }
 
-func (l *ParticipantLedger) GetBalances(accountID string) ([]Balance, error) {
-	type row struct {
-		Asset   string          `gorm:"column:asset_symbol"`
-		Balance decimal.Decimal `gorm:"column:balance"`
+// SpendableBalance returns the balance of an account minus the amount reserved by active holds
+func (l *ParticipantLedger) SpendableBalance(accountID string, assetSymbol string) (decimal.Decimal, error) {
+	balance, err := l.Balance(accountID, assetSymbol)
+	if err != nil {
+		return decimal.Zero, err
+	}
+	held, err := heldAmounts(l.db, accountID, l.participant)
+	if err != nil {
+		return decimal.Zero, err
 	}
+	return balance.Sub(held[assetSymbol]), nil
+}
 
-	var rows []row
+// GetBalances returns the balances of an account for every asset it has held
+func (l *ParticipantLedger) GetBalances(accountID string) ([]Balance, error) {
+	var rows []AccountBalance
 	if err := l.db.
-		Model(&Entry{}).
 		Where("account_id = ? AND participant = ?", accountID, l.participant).
-		Select("asset_symbol", "COALESCE(SUM(credit),0) - COALESCE(SUM(debit),0) AS balance").
-		Group("asset_symbol").
-		Scan(&rows).Error; err != nil {
+		Order("asset_symbol").
+		Find(&rows).Error; err != nil {
+		return nil, err
+	}
+
+	held, err := heldAmounts(l.db, accountID, l.participant)
+	if err != nil {
 		return nil, err
 	}
 
 	balances := make([]Balance, len(rows))
 	for i, r := range rows {
 		balances[i] = Balance{
-			Asset:  r.Asset,
-			Amount: r.Balance,
+			Asset:     r.AssetSymbol,
+			Amount:    r.Amount,
+			Held:      held[r.AssetSymbol],
+			Spendable: r.Amount.Sub(held[r.AssetSymbol]),
 		}
 	}
 	return balances, nil
 }
 
-func (l *ParticipantLedger) GetEntries(accountID, assetSymbol string) ([]Entry, error) {
+// GetEntries returns a page of entries of an account, optionally filtered by asset
+func (l *ParticipantLedger) GetEntries(accountID, assetSymbol string, opts ListOptions) ([]Entry, PageInfo, error) {
 	var entries []Entry
 	q := l.db.Where("account_id = ? AND participant = ?", accountID, l.participant)
 	if assetSymbol != "" {
 		q = q.Where("asset_symbol = ?", assetSymbol)
 	}
+	q = opts.applyTimeRange(q, "created_at")
+
+	q, err := paginateByID(q, opts)
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
 
 	if err := q.Find(&entries).Error; err != nil {
-		return nil, err
+		return nil, PageInfo{}, err
 	}
-	return entries, nil
+
+	entries, page := newPage(entries, opts, func(e Entry) pageCursor {
+		return pageCursor{ID: e.ID}
+	})
+	return entries, page, nil
 }
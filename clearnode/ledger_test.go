@@ -0,0 +1,214 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// seedLedger deposits (or withdraws, for negative amounts) funds of an account against the custody account
+func seedLedger(t testing.TB, db *gorm.DB, account Account, assetSymbol string, amount decimal.Decimal) {
+	t.Helper()
+
+	ledgerTx := NewLedgerTransaction(db)
+	if amount.IsNegative() {
+		ledgerTx.Debit(account, assetSymbol, amount.Abs())
+		ledgerTx.Credit(CustodyAccount(137), assetSymbol, amount.Abs())
+	} else {
+		ledgerTx.Debit(CustodyAccount(137), assetSymbol, amount)
+		ledgerTx.Credit(account, assetSymbol, amount)
+	}
+	require.NoError(t, ledgerTx.Post())
+}
+
+func TestLedgerTransaction(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	alice := ParticipantAccount("0xAlice")
+	bob := ParticipantAccount("0xBob")
+
+	t.Run("Balanced", func(t *testing.T) {
+		ledgerTx := NewLedgerTransaction(db)
+		ledgerTx.Debit(CustodyAccount(137), "usdc", decimal.NewFromInt(100))
+		ledgerTx.Credit(alice, "usdc", decimal.NewFromInt(100))
+		ledgerTx.Transfer(alice, bob, "usdc", decimal.NewFromInt(40))
+		require.NoError(t, ledgerTx.Post())
+
+		var entries []Entry
+		require.NoError(t, db.Where("tx_id = ?", ledgerTx.ID()).Find(&entries).Error)
+		require.Len(t, entries, 4)
+		for _, entry := range entries {
+			if entry.AccountID == "custody:137" {
+				assert.Equal(t, AssetDefault, entry.AccountType)
+				assert.Equal(t, BrokerParticipant, entry.Participant)
+			} else {
+				assert.Equal(t, LiabilityDefault, entry.AccountType)
+			}
+		}
+
+		balance, err := GetParticipantLedger(db, "0xAlice").Balance("0xAlice", "usdc")
+		require.NoError(t, err)
+		assert.True(t, decimal.NewFromInt(60).Equal(balance))
+		balance, err = GetParticipantLedger(db, "0xBob").Balance("0xBob", "usdc")
+		require.NoError(t, err)
+		assert.True(t, decimal.NewFromInt(40).Equal(balance))
+	})
+
+	t.Run("Unbalanced", func(t *testing.T) {
+		ledgerTx := NewLedgerTransaction(db)
+		ledgerTx.Debit(CustodyAccount(137), "usdc", decimal.NewFromInt(100))
+		ledgerTx.Credit(alice, "usdc", decimal.NewFromInt(100))
+		// Balanced in total, but not per asset
+		ledgerTx.Debit(alice, "usdc", decimal.NewFromInt(5))
+		ledgerTx.Credit(bob, "eth", decimal.NewFromInt(5))
+		require.Error(t, ledgerTx.Post())
+
+		var count int64
+		require.NoError(t, db.Model(&Entry{}).Where("tx_id = ?", ledgerTx.ID()).Count(&count).Error)
+		assert.Zero(t, count, "Nothing should be written for an unbalanced transaction")
+	})
+
+	t.Run("NegativeAmount", func(t *testing.T) {
+		ledgerTx := NewLedgerTransaction(db)
+		ledgerTx.Debit(alice, "usdc", decimal.NewFromInt(-10))
+		ledgerTx.Credit(bob, "usdc", decimal.NewFromInt(-10))
+		require.Error(t, ledgerTx.Post())
+	})
+}
+
+func TestBalanceConsistency(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	metrics := &Metrics{LedgerBalanceMismatches: prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_ledger_balance_mismatches"})}
+	alice := ParticipantAccount("0xAlice")
+
+	seedLedger(t, db, alice, "usdc", decimal.NewFromInt(100))
+	seedLedger(t, db, alice, "usdc", decimal.NewFromInt(-30))
+
+	var balance AccountBalance
+	require.NoError(t, db.Where("account_id = ? AND asset_symbol = ?", "0xAlice", "usdc").First(&balance).Error)
+	assert.True(t, decimal.NewFromInt(70).Equal(balance.Amount))
+	assert.Equal(t, LiabilityDefault, balance.AccountType)
+
+	mismatches, err := VerifyBalances(db)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+
+	// Recent entries are kept out of checkpoints
+	checkpoint, err := CreateCheckpoint(db)
+	require.NoError(t, err)
+	assert.Nil(t, checkpoint)
+
+	require.NoError(t, db.Model(&Entry{}).Where("1 = 1").Update("created_at", time.Now().Add(-2*checkpointLag)).Error)
+	CheckLedger(db, metrics)
+	checkpoint, err = latestCheckpoint(db)
+	require.NoError(t, err)
+	require.NotNil(t, checkpoint)
+	assert.Equal(t, 0.0, testutil.ToFloat64(metrics.LedgerBalanceMismatches))
+
+	// Verification starts from the checkpoint, so later entries are added on top of it
+	seedLedger(t, db, alice, "usdc", decimal.NewFromInt(5))
+	mismatches, err = VerifyBalances(db)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+
+	// A maintained balance which doesn't match the entries is reported
+	require.NoError(t, db.Model(&AccountBalance{}).
+		Where("account_id = ? AND asset_symbol = ?", "0xAlice", "usdc").
+		Update("amount", decimal.NewFromInt(1000)).Error)
+	CheckLedger(db, metrics)
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.LedgerBalanceMismatches))
+
+	mismatches, err = VerifyBalances(db)
+	require.NoError(t, err)
+	require.Len(t, mismatches, 1)
+	assert.Equal(t, "0xAlice", mismatches[0].AccountID)
+	assert.True(t, decimal.NewFromInt(75).Equal(mismatches[0].Computed))
+}
+
+// TestConcurrentAppSessionsCannotOverdraw creates app sessions from the same unified balance concurrently.
+// Requests may fail on lock contention, but the balance must never be spent twice.
+func TestConcurrentAppSessionsCannotOverdraw(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	rawA, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	rawB, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	signerA := LocalSigner{privateKey: rawA}
+	addrA := signerA.GetAddress().Hex()
+	addrB := (&LocalSigner{privateKey: rawB}).GetAddress().Hex()
+
+	initial := decimal.NewFromInt(100)
+	amount := decimal.NewFromInt(30)
+	seedLedger(t, db, ParticipantAccount(addrA), "usdc", initial)
+
+	const requests = 20
+	var wg sync.WaitGroup
+	var succeeded atomic.Int64
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(nonce uint64) {
+			defer wg.Done()
+
+			createParams := CreateAppSessionParams{
+				Definition: AppDefinition{
+					Protocol:     "test-proto",
+					Participants: []string{addrA, addrB},
+					Weights:      []uint64{1, 1},
+					Quorum:       1,
+					Challenge:    60,
+					Nonce:        nonce,
+				},
+				Allocations: []AppAllocation{
+					{Participant: addrA, AssetSymbol: "usdc", Amount: amount},
+					{Participant: addrB, AssetSymbol: "usdc", Amount: decimal.Zero},
+				},
+			}
+			rpcReq := &RPCMessage{Req: &RPCData{
+				RequestID: nonce,
+				Method:    "create_app_session",
+				Params:    []any{createParams},
+				Timestamp: nonce,
+			}}
+			signBytes, _ := CreateAppSignData{
+				RequestID: rpcReq.Req.RequestID,
+				Method:    rpcReq.Req.Method,
+				Params:    []CreateAppSessionParams{createParams},
+				Timestamp: rpcReq.Req.Timestamp,
+			}.MarshalJSON()
+			sig, _ := signerA.Sign(signBytes)
+			rpcReq.Sig = []string{hexutil.Encode(sig)}
+
+			if _, err := HandleCreateApplication(rpcReq, db); err == nil {
+				succeeded.Add(1)
+			}
+		}(uint64(i + 1))
+	}
+	wg.Wait()
+	assert.Positive(t, succeeded.Load(), "Some requests should succeed")
+
+	balance, err := GetParticipantLedger(db, addrA).Balance(addrA, "usdc")
+	require.NoError(t, err)
+	assert.False(t, balance.IsNegative(), "Unified balance must never go negative, got %s", balance)
+	assert.LessOrEqual(t, succeeded.Load(), int64(3), "At most 3 sessions of 30 can be funded from 100")
+	assert.True(t, initial.Sub(amount.Mul(decimal.NewFromInt(succeeded.Load()))).Equal(balance),
+		"Balance should only be reduced by the successful requests")
+
+	mismatches, err := VerifyBalances(db)
+	require.NoError(t, err)
+	assert.Empty(t, mismatches)
+}
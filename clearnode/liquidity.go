@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// LiquidityThreshold configures the broker liquidity kept for an asset on a chain
+type LiquidityThreshold struct {
+	Reserve decimal.Decimal // Never allocated to channel states
+	Target  decimal.Decimal // Alerts are raised when the free liquidity drops below it
+}
+
+// ChainLiquidity is the broker's liquidity in a token on a chain
+type ChainLiquidity struct {
+	ChainID     uint32          `json:"chain_id"`
+	Token       string          `json:"token"`
+	Asset       string          `json:"asset"`
+	Available   decimal.Decimal `json:"available"` // Available balance of the broker keys on the custody contract
+	Committed   decimal.Decimal `json:"committed"` // Allocated to signed states which haven't landed on-chain yet
+	Reserve     decimal.Decimal `json:"reserve"`   // Kept back from allocations to channel states
+	Target      decimal.Decimal `json:"target"`
+	Free        decimal.Decimal `json:"free"` // Available for new allocations
+	BelowTarget bool            `json:"below_target"`
+}
+
+// custodyFunds moves the funds of the active broker key in and out of a custody contract
+type custodyFunds interface {
+	DepositFunds(ctx context.Context, token common.Address, amount *big.Int) (common.Hash, error)
+	WithdrawFunds(ctx context.Context, token common.Address, amount *big.Int) (common.Hash, error)
+}
+
+// liquidityChain is a custody contract the broker holds liquidity on
+type liquidityChain struct {
+	reader     custodyReader
+	funds      custodyFunds
+	thresholds map[string]LiquidityThreshold // By lowercase asset symbol
+}
+
+// Liquidity tracks the funds the broker can allocate to channels on the custody contract of each chain
+type Liquidity struct {
+	db       *gorm.DB
+	keys     *KeyRing
+	chains   map[uint32]liquidityChain
+	chainsMu sync.RWMutex
+}
+
+// NewLiquidity creates a liquidity view without chains, which are added as their custody clients connect
+func NewLiquidity(db *gorm.DB, keys *KeyRing) *Liquidity {
+	return &Liquidity{
+		db:     db,
+		keys:   keys,
+		chains: make(map[uint32]liquidityChain),
+	}
+}
+
+// AddChain registers the custody contract of a chain with the liquidity thresholds of its assets
+func (l *Liquidity) AddChain(chainID uint32, reader custodyReader, funds custodyFunds, thresholds map[string]LiquidityThreshold) {
+	l.chainsMu.Lock()
+	defer l.chainsMu.Unlock()
+	l.chains[chainID] = liquidityChain{reader: reader, funds: funds, thresholds: thresholds}
+}
+
+func (l *Liquidity) chain(chainID uint32) (liquidityChain, error) {
+	l.chainsMu.RLock()
+	defer l.chainsMu.RUnlock()
+	chain, ok := l.chains[chainID]
+	if !ok {
+		return liquidityChain{}, fmt.Errorf("chain %d is not connected", chainID)
+	}
+	return chain, nil
+}
+
+// Threshold returns the liquidity threshold of an asset on a chain, zero when not configured
+func (l *Liquidity) Threshold(chainID uint32, assetSymbol string) LiquidityThreshold {
+	chain, err := l.chain(chainID)
+	if err != nil {
+		return LiquidityThreshold{}
+	}
+	return chain.thresholds[strings.ToLower(assetSymbol)]
+}
+
+// Available returns the raw amount of a token a broker key holds on the custody contract of a chain
+func (l *Liquidity) Available(ctx context.Context, chainID uint32, broker, token common.Address) (*big.Int, error) {
+	chain, err := l.chain(chainID)
+	if err != nil {
+		return nil, err
+	}
+	info, err := chain.reader.GetAccountInfo(&bind.CallOpts{Context: ctx}, broker, token)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get account info on chain %d: %w", chainID, err)
+	}
+	return info.Available, nil
+}
+
+// CheckAllocation verifies that a broker key can allocate an amount of an asset to a channel state
+// without dipping into the reserve, given its available balance read from the custody contract.
+// It runs in the transaction placing the hold of the state, with the custody balance of the asset locked.
+func (l *Liquidity) CheckAllocation(tx *gorm.DB, asset *Asset, broker common.Address, available *big.Int, amount decimal.Decimal) error {
+	committed, err := committedAllocations(tx, asset.ChainID, asset.Token, broker.Hex())
+	if err != nil {
+		return err
+	}
+
+	threshold := l.Threshold(asset.ChainID, asset.Symbol)
+	free := decimal.NewFromBigInt(available, -int32(asset.Decimals)).Sub(committed).Sub(threshold.Reserve)
+	if free.LessThan(amount) {
+		return fmt.Errorf("insufficient broker liquidity on chain %d: %s %s available", asset.ChainID, decimal.Max(free, decimal.Zero), asset.Symbol)
+	}
+	return nil
+}
+
+// Chains returns the liquidity of the broker keys in every asset of the connected chains, optionally for a single asset
+func (l *Liquidity) Chains(ctx context.Context, assetSymbol string) ([]ChainLiquidity, error) {
+	l.chainsMu.RLock()
+	chainIDs := make([]uint32, 0, len(l.chains))
+	for chainID := range l.chains {
+		chainIDs = append(chainIDs, chainID)
+	}
+	l.chainsMu.RUnlock()
+	sort.Slice(chainIDs, func(i, j int) bool { return chainIDs[i] < chainIDs[j] })
+
+	result := []ChainLiquidity{}
+	for _, chainID := range chainIDs {
+		q := l.db.Where("chain_id = ?", chainID)
+		if assetSymbol != "" {
+			q = q.Where("symbol = ?", assetSymbol)
+		}
+		var assets []Asset
+		if err := q.Order("symbol").Find(&assets).Error; err != nil {
+			return nil, fmt.Errorf("failed to fetch assets: %w", err)
+		}
+
+		for _, asset := range assets {
+			threshold := l.Threshold(chainID, asset.Symbol)
+			liquidity := ChainLiquidity{
+				ChainID: chainID,
+				Token:   asset.Token,
+				Asset:   asset.Symbol,
+				Reserve: threshold.Reserve,
+				Target:  threshold.Target,
+			}
+			for _, signer := range l.keys.Signers() {
+				broker := signer.GetAddress()
+				available, err := l.Available(ctx, chainID, broker, common.HexToAddress(asset.Token))
+				if err != nil {
+					return nil, err
+				}
+				committed, err := committedAllocations(l.db, chainID, asset.Token, broker.Hex())
+				if err != nil {
+					return nil, err
+				}
+				liquidity.Available = liquidity.Available.Add(decimal.NewFromBigInt(available, -int32(asset.Decimals)))
+				liquidity.Committed = liquidity.Committed.Add(committed)
+			}
+			liquidity.Free = decimal.Max(liquidity.Available.Sub(liquidity.Committed).Sub(liquidity.Reserve), decimal.Zero)
+			liquidity.BelowTarget = liquidity.Free.LessThan(liquidity.Target)
+			result = append(result, liquidity)
+		}
+	}
+	return result, nil
+}
+
+// Deposit moves funds of the active broker key into the custody contract of a chain
+func (l *Liquidity) Deposit(ctx context.Context, asset *Asset, amount decimal.Decimal) (common.Hash, error) {
+	chain, err := l.chain(asset.ChainID)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	return chain.funds.DepositFunds(ctx, common.HexToAddress(asset.Token), amount.Shift(int32(asset.Decimals)).BigInt())
+}
+
+// Withdraw moves funds of the active broker key out of the custody contract of a chain.
+// Funds committed to signed states stay on the contract.
+func (l *Liquidity) Withdraw(ctx context.Context, asset *Asset, amount decimal.Decimal) (common.Hash, error) {
+	chain, err := l.chain(asset.ChainID)
+	if err != nil {
+		return common.Hash{}, err
+	}
+
+	broker := l.keys.Active().GetAddress()
+	available, err := l.Available(ctx, asset.ChainID, broker, common.HexToAddress(asset.Token))
+	if err != nil {
+		return common.Hash{}, err
+	}
+	committed, err := committedAllocations(l.db, asset.ChainID, asset.Token, broker.Hex())
+	if err != nil {
+		return common.Hash{}, err
+	}
+	free := decimal.NewFromBigInt(available, -int32(asset.Decimals)).Sub(committed)
+	if free.LessThan(amount) {
+		return common.Hash{}, fmt.Errorf("only %s %s on chain %d are not committed to channel states", decimal.Max(free, decimal.Zero), asset.Symbol, asset.ChainID)
+	}
+
+	return chain.funds.WithdrawFunds(ctx, common.HexToAddress(asset.Token), amount.Shift(int32(asset.Decimals)).BigInt())
+}
+
+// RunLiquidityMonitor periodically checks the broker liquidity against the configured targets
+func RunLiquidityMonitor(ctx context.Context, l *Liquidity, metrics *Metrics, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Check(ctx, metrics); err != nil {
+				log.Printf("Liquidity check failed: %v", err)
+			}
+		}
+	}
+}
+
+// Check reports the broker liquidity in the metrics, and raises alerts for liquidity below target
+func (l *Liquidity) Check(ctx context.Context, metrics *Metrics) error {
+	chains, err := l.Chains(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	for _, c := range chains {
+		if c.BelowTarget {
+			log.Printf("ALERT: broker liquidity of %s on chain %d is %s, below the target of %s, rebalance with admin_deposit",
+				c.Asset, c.ChainID, c.Free, c.Target)
+		}
+		if metrics == nil {
+			continue
+		}
+
+		labels := prometheus.Labels{"network": strconv.FormatUint(uint64(c.ChainID), 10), "asset": c.Asset}
+		metrics.BrokerLiquidityFree.With(labels).Set(c.Free.InexactFloat64())
+		metrics.BrokerLiquidityCommitted.With(labels).Set(c.Committed.InexactFloat64())
+		belowTarget := 0.0
+		if c.BelowTarget {
+			belowTarget = 1
+		}
+		metrics.BrokerLiquidityBelowTarget.With(labels).Set(belowTarget)
+	}
+	return nil
+}
+
+// committedAllocations returns the amount a broker key allocated to signed channel states on a chain,
+// which is still reserved by active holds
+func committedAllocations(tx *gorm.DB, chainID uint32, token, broker string) (decimal.Decimal, error) {
+	var committed decimal.NullDecimal
+	err := tx.Model(&LedgerHold{}).
+		Joins("JOIN channels ON channels.channel_id = ledger_holds.channel_id").
+		Where("ledger_holds.status = ? AND channels.chain_id = ? AND channels.token = ? AND channels.broker = ?", HoldStatusActive, chainID, token, broker).
+		Select("SUM(ledger_holds.broker_allocation)").
+		Scan(&committed).Error
+	if err != nil {
+		return decimal.Zero, fmt.Errorf("failed to compute committed allocations: %w", err)
+	}
+	if !committed.Valid {
+		return decimal.Zero, nil
+	}
+	return committed.Decimal, nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandleWithdraw(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	rawBroker, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	keys := NewKeyRing(&LocalSigner{privateKey: rawBroker})
+	broker := keys.Active().GetAddress()
+
+	// USDC deposited on chain 137 is withdrawn on chain 8453
+	baseToken := "0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913"
+	require.NoError(t, db.Create(&Asset{Token: baseToken, ChainID: 8453, Symbol: "usdc", Decimals: 6}).Error)
+
+	liquidity := NewLiquidity(db, keys)
+	custody := &fakeCustody{available: map[common.Address]*big.Int{common.HexToAddress(baseToken): big.NewInt(6000000)}}
+	liquidity.AddChain(8453, custody, custody, nil)
+
+	newParticipant := func(t *testing.T, channelID string, deposit int64) Signer {
+		t.Helper()
+		raw, err := crypto.GenerateKey()
+		require.NoError(t, err)
+		signer := &LocalSigner{privateKey: raw}
+		require.NoError(t, db.Create(&Channel{
+			ChannelID:   channelID,
+			Participant: signer.GetAddress().Hex(),
+			Broker:      broker.Hex(),
+			Status:      ChannelStatusOpen,
+			Token:       baseToken,
+			ChainID:     8453,
+			Version:     1,
+		}).Error)
+		seedLedger(t, db, ParticipantAccount(signer.GetAddress().Hex()), "usdc", decimal.NewFromInt(deposit))
+		return signer
+	}
+	withdraw := func(t *testing.T, signer Signer, params WithdrawParams) (*RPCMessage, error) {
+		t.Helper()
+		rpc := &RPCMessage{Req: &RPCData{RequestID: 1, Method: "withdraw", Params: []any{params}, Timestamp: 1}}
+		reqBytes, err := json.Marshal(rpc.Req)
+		require.NoError(t, err)
+		sig, err := signer.Sign(reqBytes)
+		require.NoError(t, err)
+		rpc.Sig = []string{hexutil.Encode(sig)}
+		return HandleWithdraw(rpc, signer.GetAddress().Hex(), db, keys, nil, liquidity)
+	}
+
+	alice := newParticipant(t, "0xAliceBase", 10)
+	aliceAddr := alice.GetAddress().Hex()
+
+	t.Run("AllocatesFromBrokerSide", func(t *testing.T) {
+		resp, err := withdraw(t, alice, WithdrawParams{Asset: "usdc", ChainID: 8453, Amount: decimal.NewFromInt(4), FundsDestination: aliceAddr})
+		require.NoError(t, err)
+
+		state, ok := resp.Res.Params[0].(ResizeChannelResponse)
+		require.True(t, ok)
+		assert.Equal(t, uint64(2), state.Version)
+		require.Len(t, state.Allocations, 2)
+		assert.Equal(t, int64(0), state.Allocations[0].Amount.Int64())
+		assert.Equal(t, broker.Hex(), state.Allocations[1].Participant)
+
+		var hold LedgerHold
+		require.NoError(t, db.Where("channel_id = ? AND status = ?", "0xAliceBase", HoldStatusActive).First(&hold).Error)
+		assert.True(t, decimal.NewFromInt(4).Equal(hold.Amount))
+		assert.True(t, decimal.NewFromInt(4).Equal(hold.BrokerAllocation))
+
+		spendable, err := GetParticipantLedger(db, aliceAddr).SpendableBalance(aliceAddr, "usdc")
+		require.NoError(t, err)
+		assert.True(t, decimal.NewFromInt(6).Equal(spendable), "got %s", spendable)
+	})
+
+	t.Run("InsufficientLiquidity", func(t *testing.T) {
+		bob := newParticipant(t, "0xBobBase", 10)
+		_, err := withdraw(t, bob, WithdrawParams{Asset: "usdc", ChainID: 8453, Amount: decimal.NewFromInt(3), FundsDestination: bob.GetAddress().Hex()})
+		assert.ErrorContains(t, err, "insufficient broker liquidity on chain 8453: 2 usdc available")
+
+		_, err = withdraw(t, bob, WithdrawParams{Asset: "usdc", ChainID: 8453, Amount: decimal.NewFromInt(2), FundsDestination: bob.GetAddress().Hex()})
+		assert.NoError(t, err)
+	})
+
+	t.Run("SupersededWithdrawalFreesLiquidity", func(t *testing.T) {
+		// The same withdrawal again returns the pending state, which keeps its hold
+		_, err := withdraw(t, alice, WithdrawParams{Asset: "usdc", ChainID: 8453, Amount: decimal.NewFromInt(4), FundsDestination: aliceAddr})
+		require.NoError(t, err)
+		var count int64
+		require.NoError(t, db.Model(&LedgerHold{}).Where("channel_id = ? AND status = ?", "0xAliceBase", HoldStatusActive).Count(&count).Error)
+		assert.Equal(t, int64(1), count)
+
+		// A different withdrawal waits until the pending state lands
+		_, err = withdraw(t, alice, WithdrawParams{Asset: "usdc", ChainID: 8453, Amount: decimal.NewFromInt(1), FundsDestination: aliceAddr})
+		assert.ErrorContains(t, err, "a state for version 2 of channel 0xAliceBase is already signed")
+
+		// Once another state landed the pending one is superseded, and its hold is released
+		_, err = settleResizedStates(db, "0xAliceBase", 2, "0x")
+		require.NoError(t, err)
+		_, err = withdraw(t, alice, WithdrawParams{Asset: "usdc", ChainID: 8453, Amount: decimal.NewFromInt(11), FundsDestination: aliceAddr})
+		assert.ErrorContains(t, err, "insufficient unified balance")
+
+		_, err = withdraw(t, alice, WithdrawParams{Asset: "usdc", ChainID: 8453, Amount: decimal.NewFromInt(4), FundsDestination: aliceAddr})
+		assert.NoError(t, err)
+	})
+
+	t.Run("InvalidRequests", func(t *testing.T) {
+		unsigned := &RPCMessage{Req: &RPCData{RequestID: 1, Method: "withdraw", Params: []any{WithdrawParams{Asset: "usdc", ChainID: 8453, Amount: decimal.NewFromInt(1), FundsDestination: aliceAddr}}, Timestamp: 1}}
+		_, err := HandleWithdraw(unsigned, aliceAddr, db, keys, nil, liquidity)
+		assert.ErrorContains(t, err, "missing signature")
+
+		_, err = withdraw(t, alice, WithdrawParams{Asset: "usdc", ChainID: 8453, Amount: decimal.RequireFromString("0.0000001"), FundsDestination: aliceAddr})
+		assert.ErrorContains(t, err, "decimals")
+
+		_, err = withdraw(t, alice, WithdrawParams{Asset: "usdc", ChainID: 137, Amount: decimal.NewFromInt(1), FundsDestination: aliceAddr})
+		assert.ErrorContains(t, err, "not supported on chain 137")
+
+		require.NoError(t, db.Create(&Asset{Token: "0x1234567890123456789012345678901234567890", ChainID: 137, Symbol: "usdc", Decimals: 6}).Error)
+		_, err = withdraw(t, alice, WithdrawParams{Asset: "usdc", ChainID: 137, Amount: decimal.NewFromInt(1), FundsDestination: aliceAddr})
+		assert.ErrorContains(t, err, "no open usdc channel on chain 137")
+	})
+
+	t.Run("GetLiquidity", func(t *testing.T) {
+		resp, err := HandleGetLiquidity(&RPCMessage{Req: &RPCData{RequestID: 2, Method: "get_liquidity", Params: []any{map[string]string{"asset": "usdc"}}}}, liquidity)
+		require.NoError(t, err)
+
+		chains := resp.Res.Params[0].(LiquidityResponse).Liquidity
+		require.Len(t, chains, 1)
+		assert.Equal(t, uint32(8453), chains[0].ChainID)
+		assert.True(t, decimal.NewFromInt(6).Equal(chains[0].Available), "got %s", chains[0].Available)
+		assert.True(t, decimal.NewFromInt(6).Equal(chains[0].Committed), "got %s", chains[0].Committed)
+		assert.True(t, chains[0].Free.IsZero())
+	})
+
+	t.Run("AllocateCommitsLiquidity", func(t *testing.T) {
+		carol := newParticipant(t, "0xCarolBase", 10)
+		carolAddr := carol.GetAddress().Hex()
+		resize := func() (*RPCMessage, error) {
+			params := ResizeChannelParams{ChannelID: "0xCarolBase", AllocateAmount: big.NewInt(2000000), FundsDestination: carolAddr}
+			reqBytes, err := json.Marshal(ResizeChannelSignData{RequestID: 1, Method: "resize_channel", Params: []ResizeChannelParams{params}, Timestamp: 1})
+			require.NoError(t, err)
+			sig, err := carol.Sign(reqBytes)
+			require.NoError(t, err)
+			return HandleResizeChannel(&RPCMessage{
+				Req: &RPCData{RequestID: 1, Method: "resize_channel", Params: []any{params}, Timestamp: 1},
+				Sig: []string{hexutil.Encode(sig)},
+			}, db, keys, nil, liquidity)
+		}
+
+		// The broker deposits the allocate amount, out of the liquidity committed to the withdrawals
+		_, err := resize()
+		assert.ErrorContains(t, err, "insufficient broker liquidity on chain 8453: 0 usdc available")
+
+		custody.available[common.HexToAddress(baseToken)] = big.NewInt(8000000)
+		_, err = resize()
+		require.NoError(t, err)
+
+		var hold LedgerHold
+		require.NoError(t, db.Where("channel_id = ? AND status = ?", "0xCarolBase", HoldStatusActive).First(&hold).Error)
+		assert.True(t, decimal.NewFromInt(2).Equal(hold.Amount), "the balance backing the allocation is held")
+		assert.True(t, decimal.NewFromInt(2).Equal(hold.BrokerAllocation))
+
+		committed, err := committedAllocations(db, 8453, baseToken, broker.Hex())
+		require.NoError(t, err)
+		assert.True(t, decimal.NewFromInt(8).Equal(committed), "got %s", committed)
+	})
+}
+
+func TestLiquidityManagement(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	rawBroker, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	keys := NewKeyRing(&LocalSigner{privateKey: rawBroker})
+
+	rawAdmin, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	admin := &LocalSigner{privateKey: rawAdmin}
+	admins := ParseAdminSet(" " + admin.GetAddress().Hex() + ",not-an-address")
+
+	token := "0x833589fCD6eDb6E08f4c7C32D4f71b54bdA02913"
+	asset := Asset{Token: token, ChainID: 8453, Symbol: "usdc", Decimals: 6}
+	require.NoError(t, db.Create(&asset).Error)
+
+	thresholds, err := loadLiquidityThresholds("BASE", []string{
+		"BASE_LIQUIDITY_RESERVE_USDC=3",
+		"BASE_LIQUIDITY_TARGET_USDC=5",
+		"BASE_LIQUIDITY_RESERVE_WETH=1",
+		"POLYGON_LIQUIDITY_RESERVE_USDC=100",
+	})
+	require.NoError(t, err)
+	require.Len(t, thresholds, 2)
+	assert.True(t, decimal.NewFromInt(1).Equal(thresholds["weth"].Target), "the target defaults to the reserve")
+
+	custody := &fakeCustody{available: map[common.Address]*big.Int{common.HexToAddress(token): big.NewInt(10000000)}}
+	liquidity := NewLiquidity(db, keys)
+	liquidity.AddChain(8453, custody, custody, thresholds)
+
+	metrics := &Metrics{
+		BrokerLiquidityFree:        prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_broker_liquidity_free"}, []string{"network", "asset"}),
+		BrokerLiquidityCommitted:   prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_broker_liquidity_committed"}, []string{"network", "asset"}),
+		BrokerLiquidityBelowTarget: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_broker_liquidity_below_target"}, []string{"network", "asset"}),
+	}
+
+	t.Run("ReserveIsNotAllocated", func(t *testing.T) {
+		broker := keys.Active().GetAddress()
+		require.NoError(t, db.Create(&Channel{ChannelID: "0xReserveChannel", Participant: "0xAlice", Broker: broker.Hex(), Status: ChannelStatusOpen, Token: token, ChainID: 8453}).Error)
+
+		err := liquidity.CheckAllocation(db, &asset, broker, custody.available[common.HexToAddress(token)], decimal.NewFromInt(8))
+		assert.ErrorContains(t, err, "insufficient broker liquidity on chain 8453: 7 usdc available")
+
+		_, err = PlaceHold(db, &ChannelState{ChannelID: "0xReserveChannel", Version: 1}, ParticipantAccount("0xAlice"), "usdc", decimal.NewFromInt(7), decimal.Zero, decimal.NewFromInt(7))
+		require.NoError(t, err)
+	})
+
+	t.Run("AlertsBelowTarget", func(t *testing.T) {
+		require.NoError(t, liquidity.Check(context.Background(), metrics))
+		assert.Equal(t, 0.0, testutil.ToFloat64(metrics.BrokerLiquidityFree.WithLabelValues("8453", "usdc")))
+		assert.Equal(t, 7.0, testutil.ToFloat64(metrics.BrokerLiquidityCommitted.WithLabelValues("8453", "usdc")))
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.BrokerLiquidityBelowTarget.WithLabelValues("8453", "usdc")))
+	})
+
+	adminRequest := func(t *testing.T, signer Signer, method string, params AdminFundsParams) *RPCMessage {
+		t.Helper()
+		rpc := &RPCMessage{Req: &RPCData{RequestID: 1, Method: method, Params: []any{params}, Timestamp: 1}}
+		reqBytes, err := json.Marshal(rpc.Req)
+		require.NoError(t, err)
+		sig, err := signer.Sign(reqBytes)
+		require.NoError(t, err)
+		rpc.Sig = []string{hexutil.Encode(sig)}
+		return rpc
+	}
+
+	t.Run("AdminDeposit", func(t *testing.T) {
+		params := AdminFundsParams{ChainID: 8453, Asset: "usdc", Amount: decimal.NewFromInt(5)}
+
+		rawOther, err := crypto.GenerateKey()
+		require.NoError(t, err)
+		other := &LocalSigner{privateKey: rawOther}
+		_, err = HandleAdminDeposit(adminRequest(t, other, "admin_deposit", params), other.GetAddress().Hex(), db, admins, liquidity)
+		assert.ErrorContains(t, err, "restricted to admin addresses")
+
+		resp, err := HandleAdminDeposit(adminRequest(t, admin, "admin_deposit", params), admin.GetAddress().Hex(), db, admins, liquidity)
+		require.NoError(t, err)
+		deposit := resp.Res.Params[0].(AdminFundsResponse)
+		assert.Equal(t, token, deposit.Token)
+		assert.Equal(t, int64(15000000), custody.available[common.HexToAddress(token)].Int64())
+
+		require.NoError(t, liquidity.Check(context.Background(), metrics))
+		assert.Equal(t, 5.0, testutil.ToFloat64(metrics.BrokerLiquidityFree.WithLabelValues("8453", "usdc")))
+		assert.Equal(t, 0.0, testutil.ToFloat64(metrics.BrokerLiquidityBelowTarget.WithLabelValues("8453", "usdc")))
+	})
+
+	t.Run("AdminWithdrawKeepsCommittedFunds", func(t *testing.T) {
+		_, err := HandleAdminWithdraw(adminRequest(t, admin, "admin_withdraw", AdminFundsParams{ChainID: 8453, Asset: "usdc", Amount: decimal.NewFromInt(9)}), admin.GetAddress().Hex(), db, admins, liquidity)
+		assert.ErrorContains(t, err, "only 8 usdc on chain 8453 are not committed")
+
+		_, err = HandleAdminWithdraw(adminRequest(t, admin, "admin_withdraw", AdminFundsParams{ChainID: 8453, Asset: "usdc", Amount: decimal.NewFromInt(8)}), admin.GetAddress().Hex(), db, admins, liquidity)
+		require.NoError(t, err)
+		assert.Equal(t, int64(7000000), custody.available[common.HexToAddress(token)].Int64())
+	})
+}
@@ -3,12 +3,12 @@ package main
 import (
 	"context"
 	"embed"
+	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
-	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -16,21 +16,33 @@ import (
 //go:embed config/migrations/*/*.sql
 var embedMigrations embed.FS
 
+// version is the build version reported on /status, set with -ldflags "-X main.version=..."
+var version = "dev"
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "statement" {
+		if err := runStatementCommand(os.Args[2:]); err != nil {
+			log.Fatalf("failed to export statement: %v", err)
+		}
+		return
+	}
+
 	config, err := LoadConfig()
 	if err != nil {
 		log.Fatalf("failed to load configuration: %v", err)
 	}
 
-	db, err := ConnectToDB(config.dbConf)
+	keys, err := NewKeyRingFromConfig(config.keysConf)
 	if err != nil {
-		log.Fatalf("Failed to setup database: %v", err)
+		log.Fatalf("failed to initialise broker keys: %v", err)
 	}
 
-	signer, err := NewSigner(config.privateKeyHex)
+	config.dbConf.ChannelBroker = keys.Original().GetAddress().Hex()
+	db, err := ConnectToDB(config.dbConf)
 	if err != nil {
-		log.Fatalf("failed to initialise signer: %v", err)
+		log.Fatalf("Failed to setup database: %v", err)
 	}
+
 	rpcStore := NewRPCStore(db)
 
 	// Initialize Prometheus metrics
@@ -38,41 +50,89 @@ func main() {
 	// Map to store custody clients for later reference
 	custodyClients := make(map[string]*Custody)
 
-	go metrics.RecordMetricsPeriodically(db, custodyClients)
+	liquidity := NewLiquidity(db, keys)
+	settlement := NewSettlement(db, keys)
+	bus, err := NewMessageBus(config.messageBus, db, config.dbConf)
+	if err != nil {
+		log.Fatalf("failed to create message bus: %v", err)
+	}
+	defer bus.Close()
+	elector, err := NewElector(db, config.dbConf.Driver)
+	if err != nil {
+		log.Fatalf("failed to create leader elector: %v", err)
+	}
 
-	unifiedWSHandler := NewUnifiedWSHandler(signer, db, metrics, rpcStore, config)
+	unifiedWSHandler := NewUnifiedWSHandler(keys, db, metrics, rpcStore, config, liquidity, settlement, bus)
 	http.HandleFunc("/ws", unifiedWSHandler.HandleConnection)
 
+	// Networks are isolated from each other, one whose endpoints are all down is reported on /status
+	rpcPools := make(map[string]*RPCPool)
+
 	for name, network := range config.networks {
-		client, err := NewCustody(signer, db, unifiedWSHandler.sendBalanceUpdate, unifiedWSHandler.sendChannelUpdate, network.InfuraURL, network.CustodyAddress, network.ChainID)
+		if err := RegisterNativeAsset(db, network.ChainID); err != nil {
+			log.Fatalf("failed to register native asset: %v", err)
+		}
+
+		pool := NewRPCPool(name, network.RPCURLs)
+		rpcPools[name] = pool
+		client, err := NewCustody(pool, keys, db, network.Policy, network.Ingestion, unifiedWSHandler.sendBalanceUpdate, unifiedWSHandler.sendChannelUpdate, network.CustodyAddress, network.ChainID)
 		if err != nil {
 			log.Printf("Warning: Failed to initialize %s blockchain client: %v", name, err)
 			continue
 		}
 		custodyClients[name] = client
-		go client.ListenEvents(context.Background())
+		liquidity.AddChain(client.chainID, client.custody, client, network.Liquidity)
+		settlement.AddChain(client.chainID, client)
 	}
 
+	// Nodes sharing the database elect a single one to run each custody listener, so that events are
+	// credited once, and each background job. Tasks stop on shutdown, or when their leadership is lost.
+	leaders := NewLeaderGroup(elector, config.leaderElectionInterval)
+	for name, client := range custodyClients {
+		leaders.Go(listenerLeadership(name), func(ctx context.Context) {
+			client.ListenEvents(ctx)
+			client.SetState(ListenerStateStandby)
+		})
+	}
+	reconciler := NewReconciler(db, metrics, keys, custodyClients)
+	leaders.Go("metrics", func(ctx context.Context) { metrics.RecordMetricsPeriodically(ctx, db, custodyClients) })
+	leaders.Go("ledger-checks", func(ctx context.Context) { RunLedgerChecks(ctx, db, metrics, config.ledgerCheckInterval) })
+	leaders.Go("hold-sweeper", func(ctx context.Context) { RunHoldSweeper(ctx, db, config.holdTimeout) })
+	leaders.Go("reconciliation", func(ctx context.Context) { RunReconciliation(ctx, reconciler, config.reconcileInterval) })
+	leaders.Go("liquidity", func(ctx context.Context) { RunLiquidityMonitor(ctx, liquidity, metrics, config.liquidityInterval) })
+	leaders.Go("settlement", func(ctx context.Context) { RunSettlementMonitor(ctx, settlement, config.settlementInterval) })
+
+	// Every node checks its own RPC endpoints
+	rpcHealthCtx, stopRPCHealthChecks := context.WithCancel(context.Background())
+	defer stopRPCHealthChecks()
+	go RunRPCHealthChecks(rpcHealthCtx, rpcPools, metrics, config.rpcHealthInterval)
+
+	health := NewHealth(db, config.dbConf.Driver, version, custodyClients, rpcPools, leaders, unifiedWSHandler.ConnectionCount)
+	http.HandleFunc("/healthz", health.HandleLive)
+	http.HandleFunc("/readyz", health.HandleReady)
+	http.HandleFunc("/status", health.HandleStatus)
+
 	// Set up a separate mux for metrics
 	metricsMux := http.NewServeMux()
 	metricsMux.Handle("/metrics", promhttp.Handler())
 
 	// Start metrics server on a separate port
 	metricsServer := &http.Server{
-		Addr:    ":4242",
+		Addr:    fmt.Sprintf(":%d", config.metricsPort),
 		Handler: metricsMux,
 	}
 	go func() {
-		log.Printf("Prometheus metrics available at http://localhost:4242/metrics")
+		log.Printf("Prometheus metrics available at http://localhost:%d/metrics", config.metricsPort)
 		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Printf("Error starting metrics server: %v", err)
 		}
 	}()
 
 	// Start the main HTTP server.
+	server := &http.Server{Addr: fmt.Sprintf(":%d", config.httpPort)}
 	go func() {
-		log.Printf("Starting server, visit http://localhost:8000")
-		if err := http.ListenAndServe(":8000", nil); err != nil {
+		log.Printf("Starting server, visit http://localhost:%d", config.httpPort)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatal(err)
 		}
 	}()
@@ -82,15 +142,28 @@ func main() {
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 	<-stop
 
-	log.Println("Shutting down...")
+	log.Printf("Shutting down, waiting up to %s for connections and listeners to drain", config.shutdownTimeout)
 
-	// Shutdown metrics server
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), config.shutdownTimeout)
 	defer cancel()
+
+	// Stop accepting connections, then answer the requests being handled and ask clients to reconnect.
+	// RPC history is written by the request handlers, so it is complete once they are drained.
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+	if err := unifiedWSHandler.Shutdown(ctx); err != nil {
+		log.Printf("Error draining WebSocket connections: %v", err)
+	}
+
+	// Handled events save their cursor, the events of a listener stopped mid-way are read again on restart.
+	// The leaderships are released for the other nodes to take over.
+	if err := leaders.Stop(ctx); err != nil {
+		log.Printf("Error stopping custody listeners and background jobs: %v", err)
+	}
+
 	if err := metricsServer.Shutdown(ctx); err != nil {
 		log.Printf("Error shutting down metrics server: %v", err)
 	}
-
-	unifiedWSHandler.CloseAllConnections()
 	log.Println("Server stopped")
 }
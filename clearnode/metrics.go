@@ -37,6 +37,27 @@ type Metrics struct {
 	// Smart contract metrics
 	BrokerBalanceAvailable *prometheus.GaugeVec
 	BrokerChannelCount     *prometheus.GaugeVec
+
+	// Liquidity metrics
+	BrokerLiquidityFree        *prometheus.GaugeVec
+	BrokerLiquidityCommitted   *prometheus.GaugeVec
+	BrokerLiquidityBelowTarget *prometheus.GaugeVec
+
+	// Ledger metrics
+	LedgerBalanceMismatches prometheus.Gauge
+
+	// Reconciliation metrics
+	ReconciliationDiscrepancies *prometheus.GaugeVec
+	ReconciliationDifference    *prometheus.GaugeVec
+	ReconciliationLiabilities   *prometheus.GaugeVec
+	ReconciliationBacking       *prometheus.GaugeVec
+	ReconciliationFailures      prometheus.Counter
+	ReconciliationLastRun       prometheus.Gauge
+
+	// RPC endpoint metrics
+	RPCEndpointUp      *prometheus.GaugeVec
+	RPCEndpointLatency *prometheus.GaugeVec
+	NetworkDegraded    *prometheus.GaugeVec
 }
 
 // NewMetrics initializes and registers Prometheus metrics
@@ -98,21 +119,103 @@ func NewMetrics() *Metrics {
 				Name: "clearnet_broker_balance_available",
 				Help: "Available balance of the broker on the custody contract",
 			},
-			[]string{"network", "token"},
+			[]string{"network", "token", "broker"},
 		),
 		BrokerChannelCount: promauto.NewGaugeVec(
 			prometheus.GaugeOpts{
 				Name: "clearnet_broker_channel_count",
 				Help: "Number of channels for the broker on the custody contract",
 			},
+			[]string{"network", "token", "broker"},
+		),
+		BrokerLiquidityFree: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clearnet_broker_liquidity_free",
+				Help: "Broker liquidity available for new channel allocations, net of commitments and reserve",
+			},
+			[]string{"network", "asset"},
+		),
+		BrokerLiquidityCommitted: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clearnet_broker_liquidity_committed",
+				Help: "Broker liquidity allocated to signed channel states which haven't landed on-chain yet",
+			},
+			[]string{"network", "asset"},
+		),
+		BrokerLiquidityBelowTarget: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clearnet_broker_liquidity_below_target",
+				Help: "1 when the free broker liquidity is below the configured target",
+			},
+			[]string{"network", "asset"},
+		),
+		LedgerBalanceMismatches: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "clearnet_ledger_balance_mismatches",
+			Help: "The number of maintained balances which differ from the ledger entries in the last consistency check",
+		}),
+		ReconciliationDiscrepancies: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clearnet_reconciliation_discrepancies",
+				Help: "The number of discrepancies found by the last reconciliation run",
+			},
+			[]string{"network", "token", "kind"},
+		),
+		ReconciliationDifference: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clearnet_reconciliation_difference",
+				Help: "Custody amount recorded by the ledger minus the open channel amounts in the last reconciliation run",
+			},
 			[]string{"network", "token"},
 		),
+		ReconciliationLiabilities: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clearnet_reconciliation_liabilities",
+				Help: "Total user liabilities of the ledger per asset in the last reconciliation run",
+			},
+			[]string{"asset"},
+		),
+		ReconciliationBacking: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clearnet_reconciliation_backing",
+				Help: "Open channel amounts and broker custody balances per asset in the last reconciliation run",
+			},
+			[]string{"asset"},
+		),
+		ReconciliationFailures: promauto.NewCounter(prometheus.CounterOpts{
+			Name: "clearnet_reconciliation_failures_total",
+			Help: "The total number of reconciliation runs which could not read every custody contract",
+		}),
+		ReconciliationLastRun: promauto.NewGauge(prometheus.GaugeOpts{
+			Name: "clearnet_reconciliation_last_run_timestamp_seconds",
+			Help: "Time of the last reconciliation run",
+		}),
+		RPCEndpointUp: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clearnet_rpc_endpoint_up",
+				Help: "1 when the RPC endpoint answered its last call or health check",
+			},
+			[]string{"network", "endpoint"},
+		),
+		RPCEndpointLatency: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clearnet_rpc_endpoint_latency_seconds",
+				Help: "Moving average of the RPC endpoint health check round trips",
+			},
+			[]string{"network", "endpoint"},
+		),
+		NetworkDegraded: promauto.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "clearnet_network_degraded",
+				Help: "1 when some or all RPC endpoints of the network are down",
+			},
+			[]string{"network"},
+		),
 	}
 
 	return metrics
 }
 
-func (m *Metrics) RecordMetricsPeriodically(db *gorm.DB, custodyClients map[string]*Custody) {
+func (m *Metrics) RecordMetricsPeriodically(ctx context.Context, db *gorm.DB, custodyClients map[string]*Custody) {
 	dbTicker := time.NewTicker(15 * time.Second)
 	defer dbTicker.Stop()
 
@@ -120,6 +223,8 @@ func (m *Metrics) RecordMetricsPeriodically(db *gorm.DB, custodyClients map[stri
 	defer balanceTicker.Stop()
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case <-dbTicker.C:
 			m.UpdateChannelMetrics(db)
 			m.UpdateAppSessionMetrics(db)
@@ -129,7 +234,7 @@ func (m *Metrics) RecordMetricsPeriodically(db *gorm.DB, custodyClients map[stri
 
 			// Update metrics for each custody client
 			for _, client := range custodyClients {
-				client.UpdateBalanceMetrics(context.Background(), monitoredTokens, m)
+				client.UpdateBalanceMetrics(ctx, monitoredTokens, m)
 			}
 		}
 	}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	// DefaultPageLimit is the number of items returned when no limit is requested
+	DefaultPageLimit = 100
+	// MaxPageLimit is the maximum number of items that can be requested at once
+	MaxPageLimit = 1000
+)
+
+// SortType represents the sort order of a list query
+type SortType string
+
+var (
+	SortTypeAscending  SortType = "asc"
+	SortTypeDescending SortType = "desc"
+)
+
+// ListOptions represents the pagination, sorting and time range parameters shared by list queries
+type ListOptions struct {
+	Limit     uint64   `json:"limit,omitempty"`
+	Cursor    string   `json:"cursor,omitempty"`     // Opaque cursor returned as next_cursor by the previous page
+	Sort      SortType `json:"sort,omitempty"`       // asc or desc, newest first by default
+	StartTime uint64   `json:"start_time,omitempty"` // Inclusive lower bound in Unix milliseconds
+	EndTime   uint64   `json:"end_time,omitempty"`   // Exclusive upper bound in Unix milliseconds
+}
+
+// PageInfo is returned alongside list responses
+type PageInfo struct {
+	NextCursor string `json:"next_cursor,omitempty"` // Empty when there are no more items
+}
+
+// pageCursor marks the position of the last returned item.
+// ID based listings use ID, others use CreatedAt with Key as tie-breaker.
+type pageCursor struct {
+	Sort      SortType   `json:"s"`
+	ID        uint       `json:"id,omitempty"`
+	CreatedAt *time.Time `json:"t,omitempty"`
+	Key       string     `json:"k,omitempty"`
+}
+
+// normalize applies defaults and validates the options
+func (o *ListOptions) normalize() error {
+	if o.Limit == 0 {
+		o.Limit = DefaultPageLimit
+	}
+	if o.Limit > MaxPageLimit {
+		return fmt.Errorf("limit must not exceed %d", MaxPageLimit)
+	}
+
+	switch o.Sort {
+	case "":
+		o.Sort = SortTypeDescending
+	case SortTypeAscending, SortTypeDescending:
+	default:
+		return fmt.Errorf("invalid sort: %s", o.Sort)
+	}
+
+	if o.StartTime != 0 && o.EndTime != 0 && o.EndTime <= o.StartTime {
+		return errors.New("end_time must be after start_time")
+	}
+
+	return nil
+}
+
+// cursor decodes the cursor of the options, returning nil for the first page
+func (o ListOptions) cursor() (*pageCursor, error) {
+	if o.Cursor == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(o.Cursor)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+
+	var c pageCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+	if c.Sort != o.Sort {
+		return nil, errors.New("cursor does not match sort order")
+	}
+
+	return &c, nil
+}
+
+// applyTimeRange limits a time column to the requested range
+func (o ListOptions) applyTimeRange(q *gorm.DB, column string) *gorm.DB {
+	if o.StartTime != 0 {
+		q = q.Where(column+" >= ?", time.UnixMilli(int64(o.StartTime)))
+	}
+	if o.EndTime != 0 {
+		q = q.Where(column+" < ?", time.UnixMilli(int64(o.EndTime)))
+	}
+	return q
+}
+
+// paginateByID orders the query by the id column and continues after the cursor.
+// One extra row is fetched to find out whether there is a next page.
+func paginateByID(q *gorm.DB, opts ListOptions) (*gorm.DB, error) {
+	c, err := opts.cursor()
+	if err != nil {
+		return nil, err
+	}
+
+	op := "<"
+	if opts.Sort == SortTypeAscending {
+		op = ">"
+	}
+	if c != nil {
+		q = q.Where("id "+op+" ?", c.ID)
+	}
+
+	return q.Order("id " + string(opts.Sort)).Limit(int(opts.Limit) + 1), nil
+}
+
+// paginateByCreatedAt orders the query by created_at with keyColumn as tie-breaker and continues after the cursor.
+// One extra row is fetched to find out whether there is a next page.
+func paginateByCreatedAt(q *gorm.DB, keyColumn string, opts ListOptions) (*gorm.DB, error) {
+	c, err := opts.cursor()
+	if err != nil {
+		return nil, err
+	}
+
+	op := "<"
+	if opts.Sort == SortTypeAscending {
+		op = ">"
+	}
+	if c != nil {
+		if c.CreatedAt == nil {
+			return nil, errors.New("invalid cursor")
+		}
+		q = q.Where("created_at "+op+" ? OR (created_at = ? AND "+keyColumn+" "+op+" ?)", *c.CreatedAt, *c.CreatedAt, c.Key)
+	}
+
+	return q.Order("created_at " + string(opts.Sort)).Order(keyColumn + " " + string(opts.Sort)).Limit(int(opts.Limit) + 1), nil
+}
+
+// newPage trims the extra row fetched by the paginate helpers and builds the cursor for the next page
+func newPage[T any](items []T, opts ListOptions, cursorOf func(T) pageCursor) ([]T, PageInfo) {
+	if uint64(len(items)) <= opts.Limit {
+		return items, PageInfo{}
+	}
+
+	items = items[:opts.Limit]
+	c := cursorOf(items[len(items)-1])
+	c.Sort = opts.Sort
+
+	data, _ := json.Marshal(c)
+	return items, PageInfo{NextCursor: base64.RawURLEncoding.EncodeToString(data)}
+}
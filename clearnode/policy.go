@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// defaultMinChallenge is the shortest challenge period accepted when a network doesn't configure one,
+// a shorter period leaves the broker no time to answer a challenge with a newer state
+const defaultMinChallenge = 3600
+
+// ChannelPolicy restricts the channels the broker joins on a network
+type ChannelPolicy struct {
+	Adjudicators map[string]bool          // Lowercase addresses, any adjudicator is allowed when empty
+	MinChallenge uint64                   // Seconds
+	MaxChallenge uint64                   // Seconds, unlimited when 0
+	Deposits     map[string]DepositLimits // By lowercase asset symbol
+}
+
+// DepositLimits bounds the initial deposit of a channel in an asset
+type DepositLimits struct {
+	Min decimal.Decimal
+	Max decimal.Decimal // Unlimited when zero
+}
+
+// NewChannelPolicy returns the policy used when a network doesn't configure one
+func NewChannelPolicy() *ChannelPolicy {
+	return &ChannelPolicy{
+		Adjudicators: map[string]bool{},
+		MinChallenge: defaultMinChallenge,
+		Deposits:     map[string]DepositLimits{},
+	}
+}
+
+// Check returns why the broker must not join a channel created on the network, or an empty string.
+// Only tokens registered as assets of the network are accepted, the zero address being the native token.
+func (p *ChannelPolicy) Check(tx *gorm.DB, chainID uint32, adjudicator string, challenge uint64, allocations []nitrolite.Allocation) (string, error) {
+	if reason := checkInitialAllocations(allocations); reason != "" {
+		return reason, nil
+	}
+	token := allocations[0].Token.Hex()
+	amount := allocations[0].Amount
+
+	if len(p.Adjudicators) > 0 && !p.Adjudicators[strings.ToLower(adjudicator)] {
+		return fmt.Sprintf("adjudicator %s is not allowed", adjudicator), nil
+	}
+	if challenge < p.MinChallenge {
+		return fmt.Sprintf("challenge period of %ds is below the minimum of %ds", challenge, p.MinChallenge), nil
+	}
+	if p.MaxChallenge > 0 && challenge > p.MaxChallenge {
+		return fmt.Sprintf("challenge period of %ds is above the maximum of %ds", challenge, p.MaxChallenge), nil
+	}
+
+	asset, err := GetAssetByToken(tx, token, chainID)
+	if err != nil {
+		return "", fmt.Errorf("failed to find asset: %w", err)
+	}
+	if asset == nil {
+		return fmt.Sprintf("token %s is not supported on chain %d", token, chainID), nil
+	}
+
+	deposit := decimal.NewFromBigInt(amount, -int32(asset.Decimals))
+	limits := p.Deposits[strings.ToLower(asset.Symbol)]
+	if deposit.LessThan(limits.Min) {
+		return fmt.Sprintf("deposit of %s %s is below the minimum of %s", deposit, asset.Symbol, limits.Min), nil
+	}
+	if limits.Max.IsPositive() && deposit.GreaterThan(limits.Max) {
+		return fmt.Sprintf("deposit of %s %s is above the maximum of %s", deposit, asset.Symbol, limits.Max), nil
+	}
+	return "", nil
+}
+
+// checkInitialAllocations returns why the initial allocations of a channel don't match what the broker expects:
+// the participant deposit first, and an empty broker allocation in the same token, as joining locks it from the
+// broker funds on the custody contract
+func checkInitialAllocations(allocations []nitrolite.Allocation) string {
+	if len(allocations) != 2 {
+		return fmt.Sprintf("expected 2 initial allocations, got %d", len(allocations))
+	}
+	deposit, broker := allocations[0], allocations[1]
+	if broker.Token != deposit.Token {
+		return fmt.Sprintf("allocations are in different tokens %s and %s", deposit.Token.Hex(), broker.Token.Hex())
+	}
+	if broker.Amount.Sign() != 0 {
+		return fmt.Sprintf("broker allocation of %s must be empty, the broker doesn't fund channels on creation", broker.Amount)
+	}
+	// Channel amounts are stored as uint64, which is below 19 units of an 18 decimals token
+	if !deposit.Amount.IsUint64() {
+		return fmt.Sprintf("deposit of %s exceeds the largest supported channel amount", deposit.Amount)
+	}
+	return ""
+}
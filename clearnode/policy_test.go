@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelPolicy(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	token := "0x1234567890123456789012345678901234567890"
+	adjudicator := "0xAdA000000000000000000000000000000000000a"
+	require.NoError(t, db.Create(&Asset{Token: token, ChainID: 137, Symbol: "usdc", Decimals: 6}).Error)
+
+	allocate := func(token string, deposit, broker int64) []nitrolite.Allocation {
+		return []nitrolite.Allocation{
+			{Destination: common.HexToAddress("0xdead"), Token: common.HexToAddress(token), Amount: big.NewInt(deposit)},
+			{Destination: common.HexToAddress("0xb0b"), Token: common.HexToAddress(token), Amount: big.NewInt(broker)},
+		}
+	}
+
+	t.Run("LoadFromEnv", func(t *testing.T) {
+		policy, err := loadChannelPolicy("POLYGON", []string{
+			"POLYGON_ALLOWED_ADJUDICATORS=" + adjudicator + ", 0x00000000000000000000000000000000000000bb",
+			"POLYGON_MIN_CHALLENGE_PERIOD=600",
+			"POLYGON_MAX_CHALLENGE_PERIOD=86400",
+			"POLYGON_MIN_DEPOSIT_USDC=1",
+			"POLYGON_MAX_DEPOSIT_USDC=1000",
+			"BASE_MIN_DEPOSIT_USDC=5",
+		})
+		require.NoError(t, err)
+		assert.Len(t, policy.Adjudicators, 2)
+		assert.True(t, policy.Adjudicators["0xada000000000000000000000000000000000000a"])
+		assert.Equal(t, uint64(600), policy.MinChallenge)
+		assert.Equal(t, uint64(86400), policy.MaxChallenge)
+		require.Len(t, policy.Deposits, 1)
+		assert.True(t, decimal.NewFromInt(1).Equal(policy.Deposits["usdc"].Min))
+		assert.True(t, decimal.NewFromInt(1000).Equal(policy.Deposits["usdc"].Max))
+
+		defaults, err := loadChannelPolicy("CELO", nil)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(defaultMinChallenge), defaults.MinChallenge)
+		assert.Empty(t, defaults.Adjudicators)
+
+		_, err = loadChannelPolicy("POLYGON", []string{"POLYGON_ALLOWED_ADJUDICATORS=not-an-address"})
+		assert.ErrorContains(t, err, "POLYGON_ALLOWED_ADJUDICATORS")
+		_, err = loadChannelPolicy("POLYGON", []string{"POLYGON_MAX_CHALLENGE_PERIOD=60"})
+		assert.ErrorContains(t, err, "below the minimum")
+		_, err = loadChannelPolicy("POLYGON", []string{"POLYGON_MIN_DEPOSIT_USDC=10", "POLYGON_MAX_DEPOSIT_USDC=5"})
+		assert.ErrorContains(t, err, "POLYGON_MAX_DEPOSIT_USDC")
+	})
+
+	t.Run("Check", func(t *testing.T) {
+		policy := &ChannelPolicy{
+			Adjudicators: map[string]bool{"0xada000000000000000000000000000000000000a": true},
+			MinChallenge: 3600,
+			MaxChallenge: 86400,
+			Deposits:     map[string]DepositLimits{"usdc": {Min: decimal.NewFromInt(1), Max: decimal.NewFromInt(1000)}},
+		}
+
+		tests := []struct {
+			name        string
+			adjudicator string
+			challenge   uint64
+			token       string
+			amount      int64
+			reason      string
+		}{
+			{"Allowed", adjudicator, 3600, token, 5000000, ""},
+			{"UnknownAdjudicator", "0x00000000000000000000000000000000000000cc", 3600, token, 5000000, "adjudicator 0x00000000000000000000000000000000000000cc is not allowed"},
+			{"ZeroChallenge", adjudicator, 0, token, 5000000, "challenge period of 0s is below the minimum of 3600s"},
+			{"LongChallenge", adjudicator, 86401, token, 5000000, "challenge period of 86401s is above the maximum of 86400s"},
+			{"UnregisteredToken", adjudicator, 3600, "0x00000000000000000000000000000000000000dd", 5000000, "token 0x00000000000000000000000000000000000000dd is not supported on chain 137"},
+			{"SmallDeposit", adjudicator, 3600, token, 500000, "deposit of 0.5 usdc is below the minimum of 1"},
+			{"LargeDeposit", adjudicator, 3600, token, 1000000001, "deposit of 1000.000001 usdc is above the maximum of 1000"},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				reason, err := policy.Check(db, 137, tt.adjudicator, tt.challenge, allocate(tt.token, tt.amount, 0))
+				require.NoError(t, err)
+				assert.Equal(t, tt.reason, reason)
+			})
+		}
+
+		// Any adjudicator is joined when none is configured
+		reason, err := NewChannelPolicy().Check(db, 137, "0x00000000000000000000000000000000000000cc", 3600, allocate(token, 1, 0))
+		require.NoError(t, err)
+		assert.Empty(t, reason)
+	})
+
+	t.Run("InitialAllocations", func(t *testing.T) {
+		policy := NewChannelPolicy()
+		check := func(allocations []nitrolite.Allocation) string {
+			reason, err := policy.Check(db, 137, adjudicator, 3600, allocations)
+			require.NoError(t, err)
+			return reason
+		}
+
+		assert.Equal(t, "expected 2 initial allocations, got 1", check(allocate(token, 5, 0)[:1]))
+		assert.Equal(t, "broker allocation of 5 must be empty, the broker doesn't fund channels on creation", check(allocate(token, 5, 5)))
+
+		mixed := allocate(token, 5, 0)
+		mixed[1].Token = NativeTokenAddress
+		assert.Contains(t, check(mixed), "allocations are in different tokens")
+
+		huge := allocate(token, 5, 0)
+		huge[0].Amount = new(big.Int).Lsh(big.NewInt(1), 64)
+		assert.Equal(t, "deposit of 18446744073709551616 exceeds the largest supported channel amount", check(huge))
+	})
+
+	t.Run("NativeAsset", func(t *testing.T) {
+		require.NoError(t, RegisterNativeAsset(db, 137))
+		require.NoError(t, RegisterNativeAsset(db, 137))
+		require.NoError(t, RegisterNativeAsset(db, 999))
+
+		asset, err := GetAssetByToken(db, "0x0000000000000000000000000000000000000000", 137)
+		require.NoError(t, err)
+		require.NotNil(t, asset)
+		assert.Equal(t, "pol", asset.Symbol)
+		assert.Equal(t, uint8(18), asset.Decimals)
+
+		// One POL is a valid deposit into a native channel
+		oneNative, _ := new(big.Int).SetString("1000000000000000000", 10)
+		allocations := allocate(NativeTokenAddress.Hex(), 0, 0)
+		allocations[0].Amount = oneNative
+		reason, err := NewChannelPolicy().Check(db, 137, adjudicator, 3600, allocations)
+		require.NoError(t, err)
+		assert.Empty(t, reason)
+
+		reason, err = NewChannelPolicy().Check(db, 999, adjudicator, 3600, allocations)
+		require.NoError(t, err)
+		assert.Equal(t, "token 0x0000000000000000000000000000000000000000 is not supported on chain 999", reason)
+	})
+}
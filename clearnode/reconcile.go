@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// reconciliationTimeout bounds the contract reads of a single reconciliation run
+const reconciliationTimeout = time.Minute
+
+// ReconciliationStatus is the outcome of a reconciliation run
+type ReconciliationStatus string
+
+const (
+	ReconciliationStatusOK            ReconciliationStatus = "ok"
+	ReconciliationStatusDiscrepancies ReconciliationStatus = "discrepancies"
+	ReconciliationStatusFailed        ReconciliationStatus = "failed"
+)
+
+// DiscrepancyKind classifies a difference found by reconciliation
+type DiscrepancyKind string
+
+var (
+	DiscrepancyChannelMissingOnChain DiscrepancyKind = "channel_missing_on_chain" // Open in the database, unknown to the custody contract
+	DiscrepancyChannelNotOpen        DiscrepancyKind = "channel_not_open"         // Held by the custody contract, missing or closed in the database
+	DiscrepancyCustodyBalance        DiscrepancyKind = "custody_balance"          // Custody account of the ledger differs from the open channel amounts
+	DiscrepancyUndercollateralized   DiscrepancyKind = "undercollateralized"      // User liabilities exceed the channel funds and broker balances
+)
+
+// ReconciliationRun records a comparison of the custody contracts with the ledger and the channels table
+type ReconciliationRun struct {
+	ID            uint                        `gorm:"primaryKey"`
+	Status        ReconciliationStatus        `gorm:"column:status;not null"`
+	Discrepancies int                         `gorm:"column:discrepancies;not null;default:0"`
+	Error         string                      `gorm:"column:error;not null;default:''"`
+	CreatedAt     time.Time                   `gorm:"index"`
+	Balances      []ReconciliationBalance     `gorm:"foreignKey:RunID"`
+	Items         []ReconciliationDiscrepancy `gorm:"foreignKey:RunID"`
+}
+
+func (ReconciliationRun) TableName() string {
+	return "reconciliation_runs"
+}
+
+// ReconciliationBalance holds the on-chain and off-chain totals of a token on a chain in a run
+type ReconciliationBalance struct {
+	ID              uint            `gorm:"primaryKey"`
+	RunID           uint            `gorm:"column:run_id;not null;index"`
+	ChainID         uint32          `gorm:"column:chain_id;not null"`
+	Token           string          `gorm:"column:token;not null"`
+	AssetSymbol     string          `gorm:"column:asset_symbol;not null"`
+	BrokerAvailable decimal.Decimal `gorm:"column:broker_available;type:decimal(38,18);not null"` // Available balance of the broker keys on the custody contract
+	ChannelCount    int64           `gorm:"column:channel_count;not null"`                        // Channel count of the broker keys on the custody contract
+	OpenChannels    int64           `gorm:"column:open_channels;not null"`                        // Open channels in the database
+	ChannelAmount   decimal.Decimal `gorm:"column:channel_amount;type:decimal(38,18);not null"`   // Sum of the open channel amounts in the database
+	CustodyAmount   decimal.Decimal `gorm:"column:custody_amount;type:decimal(38,18);not null"`   // Amount the ledger records as deposited in custody
+}
+
+func (ReconciliationBalance) TableName() string {
+	return "reconciliation_balances"
+}
+
+// ReconciliationDiscrepancy is a difference found by a reconciliation run.
+// Channel discrepancies carry a channel ID, asset level ones have no chain.
+type ReconciliationDiscrepancy struct {
+	ID          uint            `gorm:"primaryKey"`
+	RunID       uint            `gorm:"column:run_id;not null;index"`
+	Kind        DiscrepancyKind `gorm:"column:kind;not null"`
+	ChainID     uint32          `gorm:"column:chain_id;not null;default:0"`
+	Token       string          `gorm:"column:token;not null;default:''"`
+	AssetSymbol string          `gorm:"column:asset_symbol;not null;default:''"`
+	ChannelID   string          `gorm:"column:channel_id;not null;default:''"`
+	Expected    string          `gorm:"column:expected;not null;default:''"`
+	Actual      string          `gorm:"column:actual;not null;default:''"`
+}
+
+func (ReconciliationDiscrepancy) TableName() string {
+	return "reconciliation_discrepancies"
+}
+
+// custodyReader is the part of the custody contract bindings read by reconciliation
+type custodyReader interface {
+	GetAccountInfo(opts *bind.CallOpts, user common.Address, token common.Address) (struct {
+		Available    *big.Int
+		ChannelCount *big.Int
+	}, error)
+	GetAccountChannels(opts *bind.CallOpts, account common.Address) ([][32]byte, error)
+}
+
+// Reconciler compares the custody contracts of every chain with the ledger and the open channels
+type Reconciler struct {
+	db      *gorm.DB
+	metrics *Metrics
+	brokers []common.Address
+	chains  map[uint32]custodyReader
+}
+
+// NewReconciler creates a reconciler for the custody clients and the honored broker keys
+func NewReconciler(db *gorm.DB, metrics *Metrics, keys *KeyRing, custodyClients map[string]*Custody) *Reconciler {
+	r := &Reconciler{
+		db:      db,
+		metrics: metrics,
+		chains:  make(map[uint32]custodyReader, len(custodyClients)),
+	}
+	for _, signer := range keys.Signers() {
+		r.brokers = append(r.brokers, signer.GetAddress())
+	}
+	for _, client := range custodyClients {
+		r.chains[client.chainID] = client.custody
+	}
+	return r
+}
+
+// RunReconciliation periodically reconciles the custody contracts with the ledger
+func RunReconciliation(ctx context.Context, r *Reconciler, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := r.Reconcile(ctx); err != nil {
+				log.Printf("Reconciliation failed: %v", err)
+			}
+		}
+	}
+}
+
+// Reconcile compares the custody contracts with the ledger and the open channels once.
+// The run is stored with its totals and discrepancies, which are also reported in the logs and metrics.
+func (r *Reconciler) Reconcile(ctx context.Context) (*ReconciliationRun, error) {
+	ctx, cancel := context.WithTimeout(ctx, reconciliationTimeout)
+	defer cancel()
+
+	run := &ReconciliationRun{Status: ReconciliationStatusOK}
+	var failures []string
+
+	chainIDs := make([]uint32, 0, len(r.chains))
+	for chainID := range r.chains {
+		chainIDs = append(chainIDs, chainID)
+	}
+	sort.Slice(chainIDs, func(i, j int) bool { return chainIDs[i] < chainIDs[j] })
+
+	for _, chainID := range chainIDs {
+		balances, discrepancies, err := r.reconcileChain(ctx, chainID, r.chains[chainID])
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("chain %d: %v", chainID, err))
+			continue
+		}
+		run.Balances = append(run.Balances, balances...)
+		run.Items = append(run.Items, discrepancies...)
+	}
+
+	// Liabilities span all chains, so they can only be compared when every chain was read
+	if len(failures) == 0 {
+		discrepancies, err := r.reconcileLiabilities(run.Balances)
+		if err != nil {
+			failures = append(failures, err.Error())
+		}
+		run.Items = append(run.Items, discrepancies...)
+	}
+
+	run.Discrepancies = len(run.Items)
+	if len(run.Items) > 0 {
+		run.Status = ReconciliationStatusDiscrepancies
+	}
+	if len(failures) > 0 {
+		run.Status = ReconciliationStatusFailed
+		run.Error = strings.Join(failures, "; ")
+	}
+
+	if err := r.db.Create(run).Error; err != nil {
+		return nil, fmt.Errorf("failed to store reconciliation run: %w", err)
+	}
+
+	r.report(run)
+	return run, nil
+}
+
+// reconcileChain compares the channels of the broker keys on a custody contract with the open channels,
+// and the amounts of the open channels with the custody account of the ledger
+func (r *Reconciler) reconcileChain(ctx context.Context, chainID uint32, custody custodyReader) ([]ReconciliationBalance, []ReconciliationDiscrepancy, error) {
+	callOpts := &bind.CallOpts{Context: ctx}
+
+	onChain := map[string]bool{}
+	for _, broker := range r.brokers {
+		ids, err := custody.GetAccountChannels(callOpts, broker)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get channels of broker %s: %w", broker.Hex(), err)
+		}
+		for _, id := range ids {
+			onChain[common.Hash(id).Hex()] = true
+		}
+	}
+
+	// Rejected channels stay on-chain until the participant closes them
+	var channels []Channel
+	statuses := []ChannelStatus{ChannelStatusOpen, ChannelStatusJoining, ChannelStatusRejected}
+	if err := r.db.Where("chain_id = ? AND status IN ?", chainID, statuses).
+		Find(&channels).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch channels: %w", err)
+	}
+	known := make(map[string]Channel, len(channels))
+	for _, ch := range channels {
+		known[strings.ToLower(ch.ChannelID)] = ch
+	}
+
+	var discrepancies []ReconciliationDiscrepancy
+	for _, ch := range channels {
+		if ch.Status == ChannelStatusOpen && !onChain[strings.ToLower(ch.ChannelID)] {
+			discrepancies = append(discrepancies, ReconciliationDiscrepancy{
+				Kind:      DiscrepancyChannelMissingOnChain,
+				ChainID:   chainID,
+				Token:     ch.Token,
+				ChannelID: ch.ChannelID,
+				Expected:  string(ChannelStatusOpen),
+				Actual:    "missing",
+			})
+		}
+	}
+
+	missing := make([]string, 0)
+	for id := range onChain {
+		if _, ok := known[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+	sort.Strings(missing)
+	for _, id := range missing {
+		discrepancy := ReconciliationDiscrepancy{
+			Kind:      DiscrepancyChannelNotOpen,
+			ChainID:   chainID,
+			ChannelID: id,
+			Expected:  string(ChannelStatusOpen),
+			Actual:    "missing",
+		}
+		var ch Channel
+		err := r.db.Where("LOWER(channel_id) = ?", id).Limit(1).Find(&ch).Error
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch channel %s: %w", id, err)
+		}
+		if ch.ChannelID != "" {
+			discrepancy.Token = ch.Token
+			discrepancy.Actual = string(ch.Status)
+		}
+		discrepancies = append(discrepancies, discrepancy)
+	}
+
+	var assets []Asset
+	if err := r.db.Where("chain_id = ?", chainID).Order("token").Find(&assets).Error; err != nil {
+		return nil, nil, fmt.Errorf("failed to fetch assets: %w", err)
+	}
+
+	custodyAccount := CustodyAccount(chainID)
+	balances := make([]ReconciliationBalance, 0, len(assets))
+	for _, asset := range assets {
+		balance := ReconciliationBalance{
+			ChainID:     chainID,
+			Token:       asset.Token,
+			AssetSymbol: asset.Symbol,
+		}
+
+		for _, broker := range r.brokers {
+			info, err := custody.GetAccountInfo(callOpts, broker, common.HexToAddress(asset.Token))
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to get account info of broker %s for token %s: %w", broker.Hex(), asset.Token, err)
+			}
+			balance.BrokerAvailable = balance.BrokerAvailable.Add(decimal.NewFromBigInt(info.Available, -int32(asset.Decimals)))
+			balance.ChannelCount += info.ChannelCount.Int64()
+		}
+
+		for _, ch := range channels {
+			if ch.Status != ChannelStatusOpen || !strings.EqualFold(ch.Token, asset.Token) {
+				continue
+			}
+			balance.OpenChannels++
+			balance.ChannelAmount = balance.ChannelAmount.Add(decimal.NewFromBigInt(new(big.Int).SetUint64(ch.Amount), -int32(asset.Decimals)))
+		}
+
+		// The custody account is an asset account, debited with deposits
+		custodyBalance, err := GetParticipantLedger(r.db, custodyAccount.Participant).Balance(custodyAccount.ID, asset.Symbol)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to fetch custody balance of %s: %w", asset.Symbol, err)
+		}
+		balance.CustodyAmount = custodyBalance.Neg()
+
+		if !balance.CustodyAmount.Equal(balance.ChannelAmount) {
+			discrepancies = append(discrepancies, ReconciliationDiscrepancy{
+				Kind:        DiscrepancyCustodyBalance,
+				ChainID:     chainID,
+				Token:       asset.Token,
+				AssetSymbol: asset.Symbol,
+				Expected:    balance.ChannelAmount.String(),
+				Actual:      balance.CustodyAmount.String(),
+			})
+		}
+		balances = append(balances, balance)
+	}
+
+	return balances, discrepancies, nil
+}
+
+// reconcileLiabilities checks that the funds owed to users are covered by the open channels and the broker balances
+func (r *Reconciler) reconcileLiabilities(balances []ReconciliationBalance) ([]ReconciliationDiscrepancy, error) {
+	type row struct {
+		AssetSymbol string          `gorm:"column:asset_symbol"`
+		Amount      decimal.Decimal `gorm:"column:amount"`
+	}
+	var rows []row
+	if err := r.db.Model(&AccountBalance{}).
+		Where("account_type >= ? AND account_type < ?", LiabilityDefault, EquityDefault).
+		Select("asset_symbol", "COALESCE(SUM(amount),0) AS amount").
+		Group("asset_symbol").
+		Order("asset_symbol").
+		Scan(&rows).Error; err != nil {
+		return nil, fmt.Errorf("failed to compute liabilities: %w", err)
+	}
+
+	backing := map[string]decimal.Decimal{}
+	for _, b := range balances {
+		backing[b.AssetSymbol] = backing[b.AssetSymbol].Add(b.ChannelAmount).Add(b.BrokerAvailable)
+	}
+
+	if r.metrics != nil {
+		r.metrics.ReconciliationLiabilities.Reset()
+		r.metrics.ReconciliationBacking.Reset()
+		for asset, amount := range backing {
+			r.metrics.ReconciliationBacking.WithLabelValues(asset).Set(amount.InexactFloat64())
+		}
+	}
+
+	var discrepancies []ReconciliationDiscrepancy
+	for _, l := range rows {
+		if r.metrics != nil {
+			r.metrics.ReconciliationLiabilities.WithLabelValues(l.AssetSymbol).Set(l.Amount.InexactFloat64())
+		}
+		if l.Amount.GreaterThan(backing[l.AssetSymbol]) {
+			discrepancies = append(discrepancies, ReconciliationDiscrepancy{
+				Kind:        DiscrepancyUndercollateralized,
+				AssetSymbol: l.AssetSymbol,
+				Expected:    l.Amount.String(),
+				Actual:      backing[l.AssetSymbol].String(),
+			})
+		}
+	}
+	return discrepancies, nil
+}
+
+// report logs the discrepancies of a run and updates the reconciliation metrics
+func (r *Reconciler) report(run *ReconciliationRun) {
+	if run.Error != "" {
+		log.Printf("ALERT: reconciliation run %d failed: %s", run.ID, run.Error)
+	}
+	for _, d := range run.Items {
+		log.Printf("ALERT: reconciliation run %d found %s on chain %d (token %s, asset %s, channel %s): expected %s, actual %s",
+			run.ID, d.Kind, d.ChainID, d.Token, d.AssetSymbol, d.ChannelID, d.Expected, d.Actual)
+	}
+
+	if r.metrics == nil {
+		return
+	}
+	if run.Status == ReconciliationStatusFailed {
+		r.metrics.ReconciliationFailures.Inc()
+	}
+
+	r.metrics.ReconciliationDiscrepancies.Reset()
+	for _, d := range run.Items {
+		token := d.Token
+		if token == "" {
+			token = d.AssetSymbol
+		}
+		r.metrics.ReconciliationDiscrepancies.With(prometheus.Labels{
+			"network": strconv.FormatUint(uint64(d.ChainID), 10),
+			"token":   token,
+			"kind":    string(d.Kind),
+		}).Inc()
+	}
+
+	r.metrics.ReconciliationDifference.Reset()
+	for _, b := range run.Balances {
+		r.metrics.ReconciliationDifference.With(prometheus.Labels{
+			"network": strconv.FormatUint(uint64(b.ChainID), 10),
+			"token":   b.Token,
+		}).Set(b.CustodyAmount.Sub(b.ChannelAmount).InexactFloat64())
+	}
+	r.metrics.ReconciliationLastRun.SetToCurrentTime()
+}
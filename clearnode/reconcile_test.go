@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeCustody serves custody contract reads from memory, and moves broker funds in and out of its available balances
+type fakeCustody struct {
+	channels  map[common.Address][][32]byte
+	available map[common.Address]*big.Int
+	err       error
+}
+
+func (f *fakeCustody) GetAccountInfo(opts *bind.CallOpts, user common.Address, token common.Address) (struct {
+	Available    *big.Int
+	ChannelCount *big.Int
+}, error) {
+	info := struct {
+		Available    *big.Int
+		ChannelCount *big.Int
+	}{Available: big.NewInt(0), ChannelCount: big.NewInt(int64(len(f.channels[user])))}
+	if f.err != nil {
+		return info, f.err
+	}
+	if available, ok := f.available[token]; ok {
+		info.Available = available
+	}
+	return info, nil
+}
+
+func (f *fakeCustody) GetAccountChannels(opts *bind.CallOpts, account common.Address) ([][32]byte, error) {
+	return f.channels[account], f.err
+}
+
+func (f *fakeCustody) DepositFunds(ctx context.Context, token common.Address, amount *big.Int) (common.Hash, error) {
+	if f.available[token] == nil {
+		f.available[token] = big.NewInt(0)
+	}
+	f.available[token] = new(big.Int).Add(f.available[token], amount)
+	return common.HexToHash("0xd1"), f.err
+}
+
+func (f *fakeCustody) WithdrawFunds(ctx context.Context, token common.Address, amount *big.Int) (common.Hash, error) {
+	f.available[token] = new(big.Int).Sub(f.available[token], amount)
+	return common.HexToHash("0xe1"), f.err
+}
+
+func newTestReconciliationMetrics() *Metrics {
+	return &Metrics{
+		ReconciliationDiscrepancies: prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_reconciliation_discrepancies"}, []string{"network", "token", "kind"}),
+		ReconciliationDifference:    prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_reconciliation_difference"}, []string{"network", "token"}),
+		ReconciliationLiabilities:   prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_reconciliation_liabilities"}, []string{"asset"}),
+		ReconciliationBacking:       prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_reconciliation_backing"}, []string{"asset"}),
+		ReconciliationFailures:      prometheus.NewCounter(prometheus.CounterOpts{Name: "test_reconciliation_failures_total"}),
+		ReconciliationLastRun:       prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_reconciliation_last_run"}),
+	}
+}
+
+func TestReconciliation(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	broker := common.HexToAddress("0xB0B0000000000000000000000000000000000001")
+	token := "0x1234567890123456789012345678901234567890"
+	require.NoError(t, db.Create(&Asset{Token: token, ChainID: 137, Symbol: "usdc", Decimals: 6}).Error)
+
+	tracked := common.HexToHash("0x01")
+	untracked := common.HexToHash("0x02")
+	stale := common.HexToHash("0x03")
+	for _, ch := range []Channel{
+		{ChannelID: tracked.Hex(), Participant: "0xAlice", Amount: 5000000},
+		{ChannelID: stale.Hex(), Participant: "0xBob", Amount: 1000000},
+	} {
+		ch.ChainID = 137
+		ch.Token = token
+		ch.Broker = broker.Hex()
+		ch.Status = ChannelStatusOpen
+		require.NoError(t, db.Create(&ch).Error)
+	}
+	seedLedger(t, db, ParticipantAccount("0xAlice"), "usdc", decimal.NewFromInt(5))
+	seedLedger(t, db, ParticipantAccount("0xBob"), "usdc", decimal.NewFromInt(1))
+
+	custody := &fakeCustody{
+		channels:  map[common.Address][][32]byte{broker: {tracked, untracked}},
+		available: map[common.Address]*big.Int{common.HexToAddress(token): big.NewInt(2000000)},
+	}
+	metrics := newTestReconciliationMetrics()
+	reconciler := &Reconciler{db: db, metrics: metrics, brokers: []common.Address{broker}, chains: map[uint32]custodyReader{137: custody}}
+
+	t.Run("ChannelDiscrepancies", func(t *testing.T) {
+		run, err := reconciler.Reconcile(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, ReconciliationStatusDiscrepancies, run.Status)
+
+		require.Len(t, run.Balances, 1)
+		balance := run.Balances[0]
+		assert.Equal(t, "usdc", balance.AssetSymbol)
+		assert.Equal(t, int64(2), balance.OpenChannels)
+		assert.Equal(t, int64(2), balance.ChannelCount)
+		assert.True(t, decimal.NewFromInt(6).Equal(balance.ChannelAmount), "got %s", balance.ChannelAmount)
+		assert.True(t, decimal.NewFromInt(6).Equal(balance.CustodyAmount), "got %s", balance.CustodyAmount)
+		assert.True(t, decimal.NewFromInt(2).Equal(balance.BrokerAvailable), "got %s", balance.BrokerAvailable)
+
+		require.Len(t, run.Items, 2)
+		assert.Equal(t, DiscrepancyChannelMissingOnChain, run.Items[0].Kind)
+		assert.Equal(t, stale.Hex(), run.Items[0].ChannelID)
+		assert.Equal(t, DiscrepancyChannelNotOpen, run.Items[1].Kind)
+		assert.Equal(t, untracked.Hex(), run.Items[1].ChannelID)
+		assert.Equal(t, "missing", run.Items[1].Actual)
+
+		var stored ReconciliationRun
+		require.NoError(t, db.Preload("Balances").Preload("Items").First(&stored, run.ID).Error)
+		assert.Equal(t, 2, stored.Discrepancies)
+		assert.Len(t, stored.Balances, 1)
+		assert.Len(t, stored.Items, 2)
+
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.ReconciliationDiscrepancies.WithLabelValues("137", token, string(DiscrepancyChannelMissingOnChain))))
+		assert.Equal(t, 0.0, testutil.ToFloat64(metrics.ReconciliationDifference.WithLabelValues("137", token)))
+		assert.Equal(t, 6.0, testutil.ToFloat64(metrics.ReconciliationLiabilities.WithLabelValues("usdc")))
+		assert.Equal(t, 8.0, testutil.ToFloat64(metrics.ReconciliationBacking.WithLabelValues("usdc")))
+	})
+
+	t.Run("BalanceDiscrepancies", func(t *testing.T) {
+		require.NoError(t, db.Model(&Channel{}).Where("channel_id = ?", stale.Hex()).Update("status", ChannelStatusClosed).Error)
+		custody.channels[broker] = [][32]byte{tracked}
+		// Credited without a matching deposit into an open channel
+		seedLedger(t, db, ParticipantAccount("0xAlice"), "usdc", decimal.NewFromInt(10))
+
+		run, err := reconciler.Reconcile(context.Background())
+		require.NoError(t, err)
+		require.Len(t, run.Items, 2)
+
+		custodyItem, collateralItem := run.Items[0], run.Items[1]
+		assert.Equal(t, DiscrepancyCustodyBalance, custodyItem.Kind)
+		assert.Equal(t, "5", custodyItem.Expected)
+		assert.Equal(t, "16", custodyItem.Actual)
+		assert.Equal(t, DiscrepancyUndercollateralized, collateralItem.Kind)
+		assert.Equal(t, "16", collateralItem.Expected)
+		assert.Equal(t, "7", collateralItem.Actual)
+
+		assert.Equal(t, 11.0, testutil.ToFloat64(metrics.ReconciliationDifference.WithLabelValues("137", token)))
+		assert.Equal(t, 0.0, testutil.ToFloat64(metrics.ReconciliationDiscrepancies.WithLabelValues("137", token, string(DiscrepancyChannelMissingOnChain))))
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.ReconciliationDiscrepancies.WithLabelValues("0", "usdc", string(DiscrepancyUndercollateralized))))
+	})
+
+	t.Run("UnreadableChain", func(t *testing.T) {
+		custody.err = errors.New("rpc unavailable")
+		defer func() { custody.err = nil }()
+
+		run, err := reconciler.Reconcile(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, ReconciliationStatusFailed, run.Status)
+		assert.Contains(t, run.Error, "rpc unavailable")
+		assert.Empty(t, run.Items)
+		assert.Equal(t, 1.0, testutil.ToFloat64(metrics.ReconciliationFailures))
+	})
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// rpcHealthCheckTimeout bounds the round trip of an endpoint health check
+const rpcHealthCheckTimeout = 5 * time.Second
+
+// NetworkStatus is the health of a network's RPC endpoints
+type NetworkStatus string
+
+const (
+	NetworkStatusHealthy  NetworkStatus = "healthy"
+	NetworkStatusDegraded NetworkStatus = "degraded" // Some endpoints are down, calls fail over to the others
+	NetworkStatusDown     NetworkStatus = "down"     // Every endpoint is down, the network is isolated until one recovers
+)
+
+// RPCPool is a chain backend over several RPC endpoints of a network. Calls and subscriptions go to the
+// endpoint with the lowest latency among those up, and fail over to the next one when an endpoint can't be reached.
+// Endpoints marked down are retried by the health checks, and as a last resort when no endpoint is up.
+type RPCPool struct {
+	network   string
+	endpoints []*rpcEndpoint
+	dial      func(url string) (ChainBackend, error)
+	mu        sync.Mutex
+}
+
+// rpcEndpoint is an RPC endpoint of a pool and its health
+type rpcEndpoint struct {
+	url       string
+	name      string       // Scheme and host only, the path and query of provider URLs often hold an API key
+	client    ChainBackend // Dialed on first use, and again after a failure
+	up        bool
+	failures  int           // Consecutive failures
+	latency   time.Duration // Moving average of the health check round trips
+	head      uint64        // Head block at the last health check
+	lastError string
+	checkedAt time.Time
+}
+
+// EndpointHealth is the health of an RPC endpoint
+type EndpointHealth struct {
+	Endpoint  string    `json:"endpoint"`
+	Up        bool      `json:"up"`
+	LatencyMs int64     `json:"latency_ms"`
+	HeadBlock uint64    `json:"head_block"`
+	Failures  int       `json:"failures"`
+	LastError string    `json:"last_error,omitempty"`
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+}
+
+// NetworkHealth is the health of the RPC endpoints of a network
+type NetworkHealth struct {
+	Network   string           `json:"network"`
+	Status    NetworkStatus    `json:"status"`
+	Endpoints []EndpointHealth `json:"endpoints"`
+}
+
+// NewRPCPool returns a pool over the RPC endpoints of a network, in order of preference until their latency is known
+func NewRPCPool(network string, urls []string) *RPCPool {
+	p := &RPCPool{network: network, dial: DialChainBackend}
+	for _, u := range urls {
+		p.endpoints = append(p.endpoints, &rpcEndpoint{url: u, name: endpointName(u), up: true})
+	}
+	return p
+}
+
+// endpointName returns the scheme and host of an endpoint URL
+func endpointName(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil || parsed.Host == "" {
+		return "invalid endpoint"
+	}
+	return parsed.Scheme + "://" + parsed.Host
+}
+
+// Health returns the health of the network's endpoints
+func (p *RPCPool) Health() NetworkHealth {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	health := NetworkHealth{Network: p.network, Status: NetworkStatusHealthy}
+	up := 0
+	for _, e := range p.endpoints {
+		if e.up {
+			up++
+		}
+		health.Endpoints = append(health.Endpoints, EndpointHealth{
+			Endpoint:  e.name,
+			Up:        e.up,
+			LatencyMs: e.latency.Milliseconds(),
+			HeadBlock: e.head,
+			Failures:  e.failures,
+			LastError: e.lastError,
+			CheckedAt: e.checkedAt,
+		})
+	}
+	switch {
+	case up == 0:
+		health.Status = NetworkStatusDown
+	case up < len(p.endpoints):
+		health.Status = NetworkStatusDegraded
+	}
+	return health
+}
+
+// CheckHealth measures the round trip of every endpoint, and marks the ones which answer as up
+func (p *RPCPool) CheckHealth(ctx context.Context) {
+	p.mu.Lock()
+	endpoints := append([]*rpcEndpoint(nil), p.endpoints...)
+	p.mu.Unlock()
+
+	for _, e := range endpoints {
+		client, err := p.client(e)
+		if err != nil {
+			p.markFailure(e, err)
+			continue
+		}
+
+		checkCtx, cancel := context.WithTimeout(ctx, rpcHealthCheckTimeout)
+		start := time.Now()
+		header, err := client.HeaderByNumber(checkCtx, nil)
+		cancel()
+		if err != nil {
+			p.markFailure(e, err)
+			continue
+		}
+		p.markHealthy(e, time.Since(start), header.Number.Uint64())
+	}
+}
+
+// candidates returns the endpoints to try in turn: the ones up by latency, then the ones down by failures
+func (p *RPCPool) candidates() []*rpcEndpoint {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	candidates := append([]*rpcEndpoint(nil), p.endpoints...)
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.up != b.up {
+			return a.up
+		}
+		if a.up {
+			return a.latency < b.latency
+		}
+		return a.failures < b.failures
+	})
+	return candidates
+}
+
+// client returns the client of an endpoint, dialing it when needed
+func (p *RPCPool) client(e *rpcEndpoint) (ChainBackend, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e.client == nil {
+		client, err := p.dial(e.url)
+		if err != nil {
+			return nil, err
+		}
+		e.client = client
+	}
+	return e.client, nil
+}
+
+func (p *RPCPool) markHealthy(e *rpcEndpoint, latency time.Duration, head uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !e.up {
+		log.Printf("RPC endpoint %s of %s is back up", e.name, p.network)
+	}
+	if e.latency == 0 {
+		e.latency = latency
+	} else {
+		e.latency = (3*e.latency + latency) / 4
+	}
+	e.up = true
+	e.failures = 0
+	e.head = head
+	e.lastError = ""
+	e.checkedAt = time.Now()
+}
+
+// markFailure marks an endpoint down and drops its client, so that a lost connection is dialed again
+func (p *RPCPool) markFailure(e *rpcEndpoint, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e.up {
+		log.Printf("RPC endpoint %s of %s is down: %v", e.name, p.network, err)
+	}
+	e.up = false
+	e.failures++
+	e.lastError = err.Error()
+	e.checkedAt = time.Now()
+	if closer, ok := e.client.(interface{ Close() }); ok {
+		closer.Close()
+	}
+	e.client = nil
+}
+
+// isEndpointFailure tells whether an error is worth failing over, as opposed to an answer of the node
+// such as a reverted call, or the cancellation of the call
+func isEndpointFailure(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, ethereum.NotFound) {
+		return false
+	}
+	var rpcErr rpc.Error
+	return !errors.As(err, &rpcErr)
+}
+
+// do calls the endpoints in turn until one of them answers
+func (p *RPCPool) do(ctx context.Context, call func(ChainBackend) error) error {
+	var lastErr error
+	for _, e := range p.candidates() {
+		client, err := p.client(e)
+		if err == nil {
+			err = call(client)
+			if err == nil || !isEndpointFailure(ctx, err) {
+				return err
+			}
+		}
+		p.markFailure(e, err)
+		lastErr = err
+	}
+	if lastErr == nil {
+		return fmt.Errorf("no RPC endpoints configured for %s", p.network)
+	}
+	return fmt.Errorf("all RPC endpoints of %s failed: %w", p.network, lastErr)
+}
+
+// SubscribeFilterLogs subscribes on the first endpoint which supports subscriptions.
+// An endpoint whose subscription fails is marked down, the subscriber resubscribes through the pool.
+func (p *RPCPool) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	var lastErr error
+	for _, e := range p.candidates() {
+		client, err := p.client(e)
+		if err != nil {
+			p.markFailure(e, err)
+			lastErr = err
+			continue
+		}
+		sub, err := client.SubscribeFilterLogs(ctx, q, ch)
+		if err != nil {
+			// HTTP endpoints answer without supporting subscriptions, they stay up for calls
+			if isEndpointFailure(ctx, err) {
+				p.markFailure(e, err)
+			}
+			lastErr = err
+			continue
+		}
+		return p.watchSubscription(e, sub), nil
+	}
+	if lastErr == nil {
+		return nil, fmt.Errorf("no RPC endpoints configured for %s", p.network)
+	}
+	return nil, fmt.Errorf("no RPC endpoint of %s could subscribe to logs: %w", p.network, lastErr)
+}
+
+// poolSubscription forwards the error of an endpoint subscription after marking the endpoint down
+type poolSubscription struct {
+	ethereum.Subscription
+	err chan error
+}
+
+func (s *poolSubscription) Err() <-chan error {
+	return s.err
+}
+
+func (p *RPCPool) watchSubscription(e *rpcEndpoint, sub ethereum.Subscription) ethereum.Subscription {
+	wrapped := &poolSubscription{Subscription: sub, err: make(chan error, 1)}
+	go func() {
+		err, ok := <-sub.Err()
+		if ok && err != nil {
+			p.markFailure(e, err)
+			wrapped.err <- err
+		}
+		close(wrapped.err)
+	}()
+	return wrapped
+}
+
+func (p *RPCPool) ChainID(ctx context.Context) (chainID *big.Int, err error) {
+	err = p.do(ctx, func(c ChainBackend) error { chainID, err = c.ChainID(ctx); return err })
+	return chainID, err
+}
+
+func (p *RPCPool) CodeAt(ctx context.Context, contract common.Address, blockNumber *big.Int) (code []byte, err error) {
+	err = p.do(ctx, func(c ChainBackend) error { code, err = c.CodeAt(ctx, contract, blockNumber); return err })
+	return code, err
+}
+
+func (p *RPCPool) CallContract(ctx context.Context, call ethereum.CallMsg, blockNumber *big.Int) (result []byte, err error) {
+	err = p.do(ctx, func(c ChainBackend) error { result, err = c.CallContract(ctx, call, blockNumber); return err })
+	return result, err
+}
+
+func (p *RPCPool) HeaderByNumber(ctx context.Context, number *big.Int) (header *types.Header, err error) {
+	err = p.do(ctx, func(c ChainBackend) error { header, err = c.HeaderByNumber(ctx, number); return err })
+	return header, err
+}
+
+func (p *RPCPool) PendingCodeAt(ctx context.Context, account common.Address) (code []byte, err error) {
+	err = p.do(ctx, func(c ChainBackend) error { code, err = c.PendingCodeAt(ctx, account); return err })
+	return code, err
+}
+
+func (p *RPCPool) PendingNonceAt(ctx context.Context, account common.Address) (nonce uint64, err error) {
+	err = p.do(ctx, func(c ChainBackend) error { nonce, err = c.PendingNonceAt(ctx, account); return err })
+	return nonce, err
+}
+
+func (p *RPCPool) SuggestGasPrice(ctx context.Context) (price *big.Int, err error) {
+	err = p.do(ctx, func(c ChainBackend) error { price, err = c.SuggestGasPrice(ctx); return err })
+	return price, err
+}
+
+func (p *RPCPool) SuggestGasTipCap(ctx context.Context) (tip *big.Int, err error) {
+	err = p.do(ctx, func(c ChainBackend) error { tip, err = c.SuggestGasTipCap(ctx); return err })
+	return tip, err
+}
+
+func (p *RPCPool) EstimateGas(ctx context.Context, call ethereum.CallMsg) (gas uint64, err error) {
+	err = p.do(ctx, func(c ChainBackend) error { gas, err = c.EstimateGas(ctx, call); return err })
+	return gas, err
+}
+
+// SendTransaction submits a signed transaction, resending it to another endpoint is harmless
+func (p *RPCPool) SendTransaction(ctx context.Context, tx *types.Transaction) error {
+	return p.do(ctx, func(c ChainBackend) error { return c.SendTransaction(ctx, tx) })
+}
+
+func (p *RPCPool) FilterLogs(ctx context.Context, q ethereum.FilterQuery) (logs []types.Log, err error) {
+	err = p.do(ctx, func(c ChainBackend) error { logs, err = c.FilterLogs(ctx, q); return err })
+	return logs, err
+}
+
+func (p *RPCPool) TransactionReceipt(ctx context.Context, txHash common.Hash) (receipt *types.Receipt, err error) {
+	err = p.do(ctx, func(c ChainBackend) error { receipt, err = c.TransactionReceipt(ctx, txHash); return err })
+	return receipt, err
+}
+
+func (p *RPCPool) TransactionByHash(ctx context.Context, hash common.Hash) (tx *types.Transaction, isPending bool, err error) {
+	err = p.do(ctx, func(c ChainBackend) error { tx, isPending, err = c.TransactionByHash(ctx, hash); return err })
+	return tx, isPending, err
+}
+
+// RunRPCHealthChecks checks the endpoints of every network, and reports their health in the metrics
+func RunRPCHealthChecks(ctx context.Context, pools map[string]*RPCPool, metrics *Metrics, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, pool := range pools {
+			pool.CheckHealth(ctx)
+			health := pool.Health()
+			if health.Status == NetworkStatusDown {
+				log.Printf("ALERT: every RPC endpoint of %s is down", health.Network)
+			}
+			reportNetworkHealth(metrics, health)
+		}
+	}
+}
+
+func reportNetworkHealth(metrics *Metrics, health NetworkHealth) {
+	if metrics == nil {
+		return
+	}
+	degraded := 0.0
+	if health.Status != NetworkStatusHealthy {
+		degraded = 1
+	}
+	metrics.NetworkDegraded.With(prometheus.Labels{"network": health.Network}).Set(degraded)
+
+	for _, e := range health.Endpoints {
+		labels := prometheus.Labels{"network": health.Network, "endpoint": e.Endpoint}
+		up := 0.0
+		if e.Up {
+			up = 1
+		}
+		metrics.RPCEndpointUp.With(labels).Set(up)
+		metrics.RPCEndpointLatency.With(labels).Set(float64(e.LatencyMs) / 1000)
+	}
+}
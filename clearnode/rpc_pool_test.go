@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeEndpoint answers chain ID and header calls, or fails them with err
+type fakeEndpoint struct {
+	ChainBackend
+	chainID int64
+	head    int64
+	delay   time.Duration
+	err     error
+	calls   int
+}
+
+func (f *fakeEndpoint) ChainID(ctx context.Context) (*big.Int, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return big.NewInt(f.chainID), nil
+}
+
+func (f *fakeEndpoint) HeaderByNumber(ctx context.Context, number *big.Int) (*types.Header, error) {
+	time.Sleep(f.delay)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &types.Header{Number: big.NewInt(f.head)}, nil
+}
+
+func (f *fakeEndpoint) SubscribeFilterLogs(ctx context.Context, q ethereum.FilterQuery, ch chan<- types.Log) (ethereum.Subscription, error) {
+	return nil, f.err
+}
+
+// revertError is a JSON-RPC error answered by a node
+type revertError struct{}
+
+func (revertError) Error() string  { return "execution reverted" }
+func (revertError) ErrorCode() int { return 3 }
+
+func newTestPool(endpoints map[string]*fakeEndpoint, urls ...string) *RPCPool {
+	pool := NewRPCPool("polygon", urls)
+	pool.dial = func(url string) (ChainBackend, error) {
+		if e, ok := endpoints[url]; ok {
+			return e, nil
+		}
+		return nil, errors.New("dial failed")
+	}
+	return pool
+}
+
+func TestRPCPool(t *testing.T) {
+	primaryURL := "https://polygon-mainnet.infura.io/v3/secret-key"
+	fallbackURL := "wss://polygon.example.com/ws"
+
+	t.Run("FailsOver", func(t *testing.T) {
+		primary := &fakeEndpoint{chainID: 137, err: errors.New("connection refused")}
+		fallback := &fakeEndpoint{chainID: 137}
+		pool := newTestPool(map[string]*fakeEndpoint{primaryURL: primary, fallbackURL: fallback}, primaryURL, fallbackURL)
+
+		chainID, err := pool.ChainID(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, int64(137), chainID.Int64())
+
+		health := pool.Health()
+		assert.Equal(t, NetworkStatusDegraded, health.Status)
+		assert.False(t, health.Endpoints[0].Up)
+		assert.Equal(t, "https://polygon-mainnet.infura.io", health.Endpoints[0].Endpoint, "API keys must not be reported")
+		assert.Equal(t, "connection refused", health.Endpoints[0].LastError)
+		assert.True(t, health.Endpoints[1].Up)
+
+		// The endpoint down is only tried again once no endpoint is up
+		_, err = pool.ChainID(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 1, primary.calls)
+		assert.Equal(t, 2, fallback.calls)
+
+		// The health check brings the endpoint back
+		primary.err = nil
+		pool.CheckHealth(context.Background())
+		health = pool.Health()
+		assert.Equal(t, NetworkStatusHealthy, health.Status)
+		assert.Zero(t, health.Endpoints[0].Failures)
+	})
+
+	t.Run("NodeErrorsAreReturned", func(t *testing.T) {
+		primary := &fakeEndpoint{err: revertError{}}
+		fallback := &fakeEndpoint{chainID: 137}
+		pool := newTestPool(map[string]*fakeEndpoint{primaryURL: primary, fallbackURL: fallback}, primaryURL, fallbackURL)
+
+		_, err := pool.ChainID(context.Background())
+		assert.EqualError(t, err, "execution reverted")
+		assert.Zero(t, fallback.calls)
+		assert.Equal(t, NetworkStatusHealthy, pool.Health().Status)
+	})
+
+	t.Run("AllDown", func(t *testing.T) {
+		primary := &fakeEndpoint{err: errors.New("connection refused")}
+		pool := newTestPool(map[string]*fakeEndpoint{primaryURL: primary}, primaryURL, fallbackURL)
+
+		_, err := pool.ChainID(context.Background())
+		assert.ErrorContains(t, err, "all RPC endpoints of polygon failed")
+		_, err = pool.SubscribeFilterLogs(context.Background(), ethereum.FilterQuery{}, make(chan types.Log))
+		assert.ErrorContains(t, err, "no RPC endpoint of polygon could subscribe to logs")
+		assert.Equal(t, NetworkStatusDown, pool.Health().Status)
+
+		recorder := httptest.NewRecorder()
+		health := NewHealth(nil, "sqlite", "", nil, map[string]*RPCPool{"polygon": pool}, nil, func() int { return 0 })
+		health.HandleStatus(recorder, httptest.NewRequest("GET", "/status", nil))
+		assert.Equal(t, 200, recorder.Code, "a degraded network must not fail the status")
+		assert.Contains(t, recorder.Body.String(), `"rpc_status":"degraded"`)
+		assert.Contains(t, recorder.Body.String(), `"rpc_status":"down"`)
+	})
+
+	t.Run("PrefersLowLatency", func(t *testing.T) {
+		primary := &fakeEndpoint{chainID: 137, head: 100, delay: 30 * time.Millisecond}
+		fallback := &fakeEndpoint{chainID: 137, head: 101}
+		pool := newTestPool(map[string]*fakeEndpoint{primaryURL: primary, fallbackURL: fallback}, primaryURL, fallbackURL)
+
+		pool.CheckHealth(context.Background())
+		_, err := pool.ChainID(context.Background())
+		require.NoError(t, err)
+		assert.Zero(t, primary.calls)
+		assert.Equal(t, 1, fallback.calls)
+		assert.Equal(t, uint64(101), pool.Health().Endpoints[1].HeadBlock)
+	})
+
+	t.Run("LoadFromEnv", func(t *testing.T) {
+		urls := loadRPCURLs("POLYGON", []string{
+			"POLYGON_RPC_URLS=" + fallbackURL + ", https://polygon-rpc.com,," + primaryURL,
+			"POLYGON_INFURA_URL=" + primaryURL,
+			"BASE_RPC_URLS=https://base.example.com",
+		})
+		assert.Equal(t, []string{primaryURL, fallbackURL, "https://polygon-rpc.com"}, urls)
+		assert.Empty(t, loadRPCURLs("CELO", nil))
+	})
+}
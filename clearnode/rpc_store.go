@@ -68,6 +68,36 @@ func (s *RPCStore) GetMessages(limit int, offset int) (messages []RPCRecord, tot
 	return messages, total, err
 }
 
+// GetHistory returns a page of RPC messages sent by the participant, optionally filtered by method.
+// The time range is applied to the request timestamps.
+func (s *RPCStore) GetHistory(sender, method string, opts ListOptions) ([]RPCRecord, PageInfo, error) {
+	q := s.db.Where("sender = ?", sender)
+	if method != "" {
+		q = q.Where("method = ?", method)
+	}
+	if opts.StartTime != 0 {
+		q = q.Where("timestamp >= ?", opts.StartTime)
+	}
+	if opts.EndTime != 0 {
+		q = q.Where("timestamp < ?", opts.EndTime)
+	}
+
+	q, err := paginateByID(q, opts)
+	if err != nil {
+		return nil, PageInfo{}, err
+	}
+
+	var records []RPCRecord
+	if err := q.Find(&records).Error; err != nil {
+		return nil, PageInfo{}, err
+	}
+
+	records, page := newPage(records, opts, func(r RPCRecord) pageCursor {
+		return pageCursor{ID: r.ID}
+	})
+	return records, page, nil
+}
+
 // GetMessageByID retrieves a specific RPC message by its request ID
 func (s *RPCStore) GetMessageByID(reqID uint64) (*RPCRecord, error) {
 	var message RPCRecord
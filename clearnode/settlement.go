@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"gorm.io/gorm"
+)
+
+// CloseMode selects how a broker-initiated channel close is settled
+type CloseMode string
+
+var (
+	CloseModeCooperative CloseMode = "cooperative" // The participant countersigns the final state
+	CloseModeChallenge   CloseMode = "challenge"   // The latest mutually signed state is enforced on-chain
+)
+
+// CloseRequestStatus represents the progress of a broker-initiated channel close
+type CloseRequestStatus string
+
+var (
+	CloseRequestStatusAwaitingSignature CloseRequestStatus = "awaiting_signature" // Final state pushed to the participant
+	CloseRequestStatusSubmitting        CloseRequestStatus = "submitting"         // Countersigned, close transaction being sent
+	CloseRequestStatusSubmitted         CloseRequestStatus = "submitted"          // Close or challenge transaction sent
+	CloseRequestStatusChallenged        CloseRequestStatus = "challenged"         // Challenge period running on-chain
+	CloseRequestStatusClosed            CloseRequestStatus = "closed"
+	CloseRequestStatusCancelled         CloseRequestStatus = "cancelled" // Superseded by a later request
+)
+
+// activeCloseRequestStatuses are the statuses of close requests which haven't settled yet
+var activeCloseRequestStatuses = []CloseRequestStatus{
+	CloseRequestStatusAwaitingSignature,
+	CloseRequestStatusSubmitting,
+	CloseRequestStatusSubmitted,
+	CloseRequestStatusChallenged,
+}
+
+// SignedState is a channel state with the signatures collected for it
+type SignedState struct {
+	Intent      uint8        `json:"intent"`
+	Version     uint64       `json:"version"`
+	StateData   string       `json:"state_data"`
+	Allocations []Allocation `json:"allocations"`
+	Sigs        []Signature  `json:"sigs"`
+}
+
+// ChannelCloseRequest tracks a channel close initiated by the broker until the channel is closed on-chain
+type ChannelCloseRequest struct {
+	ID                 uint               `gorm:"primaryKey"`
+	ChannelID          string             `gorm:"column:channel_id;not null;index"`
+	ChainID            uint32             `gorm:"column:chain_id;not null"`
+	Participant        string             `gorm:"column:participant;not null"`
+	Mode               CloseMode          `gorm:"column:mode;not null"`
+	Status             CloseRequestStatus `gorm:"column:status;not null;index"`
+	RequestedBy        string             `gorm:"column:requested_by;not null"`
+	State              SignedState        `gorm:"column:state;type:text;serializer:json;not null"` // Final state to countersign, or the challenged state
+	TxHash             string             `gorm:"column:tx_hash;not null;default:''"`              // Latest transaction settling the channel
+	ChallengeExpiresAt *time.Time         `gorm:"column:challenge_expires_at"`
+	CreatedAt          time.Time
+	UpdatedAt          time.Time
+}
+
+// TableName specifies the table name for the ChannelCloseRequest model
+func (ChannelCloseRequest) TableName() string {
+	return "channel_close_requests"
+}
+
+// channelSettler submits channel states to the custody contract of a chain
+type channelSettler interface {
+	CloseChannel(ctx context.Context, channelID common.Hash, broker string, state nitrolite.State) (common.Hash, error)
+	ChallengeChannel(ctx context.Context, channelID common.Hash, broker string, state nitrolite.State) (common.Hash, error)
+	LatestSignedState(ctx context.Context, channelID common.Hash, broker string) (nitrolite.State, error)
+}
+
+// Settlement closes channels on behalf of the broker, cooperatively or by challenging them on-chain
+type Settlement struct {
+	db       *gorm.DB
+	keys     *KeyRing
+	chains   map[uint32]channelSettler
+	chainsMu sync.RWMutex
+}
+
+// NewSettlement creates a settlement service without chains, which are added as their custody clients connect
+func NewSettlement(db *gorm.DB, keys *KeyRing) *Settlement {
+	return &Settlement{
+		db:     db,
+		keys:   keys,
+		chains: make(map[uint32]channelSettler),
+	}
+}
+
+// AddChain registers the custody contract of a chain
+func (s *Settlement) AddChain(chainID uint32, settler channelSettler) {
+	s.chainsMu.Lock()
+	defer s.chainsMu.Unlock()
+	s.chains[chainID] = settler
+}
+
+func (s *Settlement) chain(chainID uint32) (channelSettler, error) {
+	s.chainsMu.RLock()
+	defer s.chainsMu.RUnlock()
+	settler, ok := s.chains[chainID]
+	if !ok {
+		return nil, fmt.Errorf("chain %d is not connected", chainID)
+	}
+	return settler, nil
+}
+
+// RequestClose starts closing an open channel. In cooperative mode the final state is signed and
+// awaits the countersignature of the participant, in challenge mode the latest mutually signed state
+// is submitted to the custody contract to start the challenge period.
+func (s *Settlement) RequestClose(ctx context.Context, channel *Channel, mode CloseMode, fundsDestination common.Address, requestedBy string) (*ChannelCloseRequest, error) {
+	if channel.Status != ChannelStatusOpen {
+		return nil, fmt.Errorf("channel %s is not open", channel.ChannelID)
+	}
+
+	var settling int64
+	err := s.db.Model(&ChannelCloseRequest{}).
+		Where("channel_id = ? AND status IN ?", channel.ChannelID, []CloseRequestStatus{CloseRequestStatusSubmitting, CloseRequestStatusSubmitted, CloseRequestStatusChallenged}).
+		Count(&settling).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to check close requests: %w", err)
+	}
+	if settling > 0 {
+		return nil, fmt.Errorf("channel %s is already being settled on-chain", channel.ChannelID)
+	}
+
+	settler, err := s.chain(channel.ChainID)
+	if err != nil {
+		return nil, err
+	}
+
+	request := ChannelCloseRequest{
+		ChannelID:   channel.ChannelID,
+		ChainID:     channel.ChainID,
+		Participant: channel.Participant,
+		Mode:        mode,
+		RequestedBy: requestedBy,
+	}
+
+	channelID := common.HexToHash(channel.ChannelID)
+	switch mode {
+	case CloseModeCooperative:
+		signer, err := s.keys.Get(channel.Broker)
+		if err != nil {
+			return nil, err
+		}
+		final, err := signFinalState(s.db, channel, signer, fundsDestination)
+		if err != nil {
+			return nil, err
+		}
+		request.Status = CloseRequestStatusAwaitingSignature
+		request.State = SignedState{
+			Intent:      final.Intent,
+			Version:     final.Version,
+			StateData:   final.StateData,
+			Allocations: final.FinalAllocations,
+			Sigs:        []Signature{final.Signature},
+		}
+	case CloseModeChallenge:
+		state, err := s.latestSignedState(ctx, settler, channel)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find the latest signed state: %w", err)
+		}
+		txHash, err := settler.ChallengeChannel(ctx, channelID, channel.Broker, state)
+		if err != nil {
+			return nil, err
+		}
+		request.Status = CloseRequestStatusSubmitted
+		request.State = newSignedState(state)
+		request.TxHash = txHash.Hex()
+	default:
+		return nil, fmt.Errorf("unsupported close mode: %s", mode)
+	}
+
+	// A cancelled request leaves its final state pending, only the same cooperative close can be requested again
+	err = s.db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&ChannelCloseRequest{}).
+			Where("channel_id = ? AND status = ?", channel.ChannelID, CloseRequestStatusAwaitingSignature).
+			Update("status", CloseRequestStatusCancelled).Error
+		if err != nil {
+			return fmt.Errorf("failed to cancel close requests: %w", err)
+		}
+		if err := tx.Create(&request).Error; err != nil {
+			return fmt.Errorf("failed to store close request: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Requested %s close of channel %s on chain %d by %s", mode, channel.ChannelID, channel.ChainID, requestedBy)
+	return &request, nil
+}
+
+// latestSignedState returns the latest state of a channel signed by both parties, read back from the
+// custody contract for channels whose states weren't stored yet
+func (s *Settlement) latestSignedState(ctx context.Context, settler channelSettler, channel *Channel) (nitrolite.State, error) {
+	stored, err := GetLatestSignedState(s.db, channel.ChannelID)
+	if err != nil {
+		return nitrolite.State{}, err
+	}
+	if stored == nil {
+		return settler.LatestSignedState(ctx, common.HexToHash(channel.ChannelID), channel.Broker)
+	}
+	return stored.signedState().toNitrolite()
+}
+
+// Countersign submits the final state of a cooperative close request to the custody contract,
+// once the participant signed it
+func (s *Settlement) Countersign(ctx context.Context, requestID uint, participant string, sig Signature) (*ChannelCloseRequest, error) {
+	var request ChannelCloseRequest
+	if err := s.db.First(&request, requestID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, fmt.Errorf("close request %d not found", requestID)
+		}
+		return nil, fmt.Errorf("failed to find close request: %w", err)
+	}
+	if !strings.EqualFold(request.Participant, participant) {
+		return nil, fmt.Errorf("close request %d belongs to another participant", requestID)
+	}
+	if request.Status != CloseRequestStatusAwaitingSignature {
+		return nil, fmt.Errorf("close request %d is %s", requestID, request.Status)
+	}
+
+	channelID := common.HexToHash(request.ChannelID)
+	state, err := request.State.toNitrolite()
+	if err != nil {
+		return nil, err
+	}
+	encodedState, err := nitrolite.EncodeState(channelID, nitrolite.Intent(state.Intent), state.Version, state.Data, state.Allocations)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode state: %w", err)
+	}
+
+	userSig, err := sig.toNitrolite()
+	if err != nil {
+		return nil, err
+	}
+	isValid, err := nitrolite.Verify(encodedState, userSig, common.HexToAddress(participant))
+	if err != nil || !isValid {
+		return nil, errors.New("invalid state signature")
+	}
+
+	settler, err := s.chain(request.ChainID)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := GetChannelByID(s.db, request.ChannelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find channel: %w", err)
+	}
+	if channel == nil {
+		return nil, fmt.Errorf("channel %s not found", request.ChannelID)
+	}
+
+	// The request is claimed before sending, so that concurrent countersignatures and a new close request
+	// can't submit or cancel it while the transaction is sent
+	claim := s.db.Model(&ChannelCloseRequest{}).
+		Where("id = ? AND status = ?", request.ID, CloseRequestStatusAwaitingSignature).
+		Update("status", CloseRequestStatusSubmitting)
+	if claim.Error != nil {
+		return nil, fmt.Errorf("failed to claim close request: %w", claim.Error)
+	}
+	if claim.RowsAffected == 0 {
+		return nil, fmt.Errorf("close request %d is no longer awaiting a signature", requestID)
+	}
+
+	// Signatures are ordered like the channel participants
+	state.Sigs = append([]nitrolite.Signature{userSig}, state.Sigs...)
+	txHash, err := settler.CloseChannel(ctx, channelID, channel.Broker, state)
+	if err != nil {
+		release := s.db.Model(&ChannelCloseRequest{}).
+			Where("id = ? AND status = ?", request.ID, CloseRequestStatusSubmitting).
+			Update("status", CloseRequestStatusAwaitingSignature)
+		if release.Error != nil {
+			log.Printf("Failed to release close request %d: %v", request.ID, release.Error)
+		}
+		return nil, err
+	}
+
+	request.State.Sigs = append([]Signature{sig}, request.State.Sigs...)
+	request.Status = CloseRequestStatusSubmitted
+	request.TxHash = txHash.Hex()
+	err = s.db.Model(&ChannelCloseRequest{}).
+		Where("id = ? AND status = ?", request.ID, CloseRequestStatusSubmitting).
+		Updates(&ChannelCloseRequest{State: request.State, Status: request.Status, TxHash: request.TxHash}).Error
+	if err != nil {
+		return nil, fmt.Errorf("failed to update close request: %w", err)
+	}
+	return &request, nil
+}
+
+// RunSettlementMonitor periodically closes channels whose challenge period expired
+func RunSettlementMonitor(ctx context.Context, s *Settlement, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.FinalizeChallenges(ctx); err != nil {
+				log.Printf("Settlement check failed: %v", err)
+			}
+		}
+	}
+}
+
+// FinalizeChallenges closes the challenged channels of close requests whose challenge period expired
+func (s *Settlement) FinalizeChallenges(ctx context.Context) error {
+	var requests []ChannelCloseRequest
+	err := s.db.Where("status = ? AND challenge_expires_at <= ?", CloseRequestStatusChallenged, time.Now()).
+		Order("id").Find(&requests).Error
+	if err != nil {
+		return fmt.Errorf("failed to fetch challenged close requests: %w", err)
+	}
+
+	for _, request := range requests {
+		if err := s.finalize(ctx, &request); err != nil {
+			log.Printf("Failed to finalize challenge of channel %s: %v", request.ChannelID, err)
+		}
+	}
+	return nil
+}
+
+func (s *Settlement) finalize(ctx context.Context, request *ChannelCloseRequest) error {
+	settler, err := s.chain(request.ChainID)
+	if err != nil {
+		return err
+	}
+	channel, err := GetChannelByID(s.db, request.ChannelID)
+	if err != nil {
+		return fmt.Errorf("failed to find channel: %w", err)
+	}
+	if channel == nil {
+		return fmt.Errorf("channel %s not found", request.ChannelID)
+	}
+	state, err := request.State.toNitrolite()
+	if err != nil {
+		return err
+	}
+
+	txHash, err := settler.CloseChannel(ctx, common.HexToHash(request.ChannelID), channel.Broker, state)
+	if err != nil {
+		return err
+	}
+
+	request.Status = CloseRequestStatusSubmitted
+	request.TxHash = txHash.Hex()
+	if err := s.db.Save(request).Error; err != nil {
+		return fmt.Errorf("failed to update close request: %w", err)
+	}
+	log.Printf("Finalized challenge of channel %s on chain %d, TxHash: %s", request.ChannelID, request.ChainID, request.TxHash)
+	return nil
+}
+
+// markCloseRequestsChallenged records the expiration of a challenge started by a close request
+func markCloseRequestsChallenged(tx *gorm.DB, channelID string, expiresAt time.Time) error {
+	err := tx.Model(&ChannelCloseRequest{}).
+		Where("channel_id = ? AND mode = ? AND status = ?", channelID, CloseModeChallenge, CloseRequestStatusSubmitted).
+		Updates(map[string]any{"status": CloseRequestStatusChallenged, "challenge_expires_at": expiresAt}).Error
+	if err != nil {
+		return fmt.Errorf("failed to update close requests: %w", err)
+	}
+	return nil
+}
+
+// completeCloseRequests marks the unsettled close requests of a channel closed on-chain
+func completeCloseRequests(tx *gorm.DB, channelID, txHash string) error {
+	err := tx.Model(&ChannelCloseRequest{}).
+		Where("channel_id = ? AND status IN ?", channelID, activeCloseRequestStatuses).
+		Updates(map[string]any{"status": CloseRequestStatusClosed, "tx_hash": txHash}).Error
+	if err != nil {
+		return fmt.Errorf("failed to complete close requests: %w", err)
+	}
+	return nil
+}
+
+// newSignedState converts a custody contract state
+func newSignedState(state nitrolite.State) SignedState {
+	signed := SignedState{
+		Intent:    state.Intent,
+		Version:   state.Version.Uint64(),
+		StateData: hexutil.Encode(state.Data),
+	}
+	for _, alloc := range state.Allocations {
+		signed.Allocations = append(signed.Allocations, Allocation{
+			Participant:  alloc.Destination.Hex(),
+			TokenAddress: alloc.Token.Hex(),
+			Amount:       alloc.Amount,
+		})
+	}
+	for _, sig := range state.Sigs {
+		signed.Sigs = append(signed.Sigs, newSignature(sig))
+	}
+	return signed
+}
+
+// newSignature converts a custody contract signature
+func newSignature(sig nitrolite.Signature) Signature {
+	return Signature{
+		V: sig.V,
+		R: hexutil.Encode(sig.R[:]),
+		S: hexutil.Encode(sig.S[:]),
+	}
+}
+
+// toNitrolite converts the state for submission to the custody contract
+func (s SignedState) toNitrolite() (nitrolite.State, error) {
+	data, err := hexutil.Decode(s.StateData)
+	if err != nil {
+		return nitrolite.State{}, fmt.Errorf("failed to decode state data: %w", err)
+	}
+
+	state := nitrolite.State{
+		Intent:  s.Intent,
+		Version: new(big.Int).SetUint64(s.Version),
+		Data:    data,
+	}
+	for _, alloc := range s.Allocations {
+		state.Allocations = append(state.Allocations, nitrolite.Allocation{
+			Destination: common.HexToAddress(alloc.Participant),
+			Token:       common.HexToAddress(alloc.TokenAddress),
+			Amount:      alloc.Amount,
+		})
+	}
+	for _, sig := range s.Sigs {
+		nitroSig, err := sig.toNitrolite()
+		if err != nil {
+			return nitrolite.State{}, err
+		}
+		state.Sigs = append(state.Sigs, nitroSig)
+	}
+	return state, nil
+}
+
+// toNitrolite converts the signature for submission to the custody contract
+func (s Signature) toNitrolite() (nitrolite.Signature, error) {
+	r, err := hexutil.Decode(s.R)
+	if err != nil || len(r) != 32 {
+		return nitrolite.Signature{}, errors.New("invalid signature r")
+	}
+	sVal, err := hexutil.Decode(s.S)
+	if err != nil || len(sVal) != 32 {
+		return nitrolite.Signature{}, errors.New("invalid signature s")
+	}
+
+	sig := nitrolite.Signature{V: s.V}
+	copy(sig.R[:], r)
+	copy(sig.S[:], sVal)
+	return sig, nil
+}
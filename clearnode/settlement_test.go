@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSettler records the states submitted to a custody contract
+type fakeSettler struct {
+	latest     nitrolite.State
+	closed     []nitrolite.State
+	challenged []nitrolite.State
+	sending    func() error // Called while a close is sent, fails it when it returns an error
+}
+
+func (f *fakeSettler) CloseChannel(ctx context.Context, channelID common.Hash, broker string, state nitrolite.State) (common.Hash, error) {
+	if f.sending != nil {
+		if err := f.sending(); err != nil {
+			return common.Hash{}, err
+		}
+	}
+	f.closed = append(f.closed, state)
+	return common.HexToHash("0xc1"), nil
+}
+
+func (f *fakeSettler) ChallengeChannel(ctx context.Context, channelID common.Hash, broker string, state nitrolite.State) (common.Hash, error) {
+	f.challenged = append(f.challenged, state)
+	return common.HexToHash("0xc2"), nil
+}
+
+func (f *fakeSettler) LatestSignedState(ctx context.Context, channelID common.Hash, broker string) (nitrolite.State, error) {
+	return f.latest, nil
+}
+
+func TestBrokerInitiatedClose(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	rawBroker, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	keys := NewKeyRing(&LocalSigner{privateKey: rawBroker})
+	broker := keys.Active().GetAddress()
+
+	rawAdmin, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	admin := &LocalSigner{privateKey: rawAdmin}
+	admins := AdminSet{admin.GetAddress().Hex(): true}
+
+	rawParticipant, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	participant := &LocalSigner{privateKey: rawParticipant}
+	participantAddr := participant.GetAddress().Hex()
+
+	token := "0x1234567890123456789012345678901234567890"
+	require.NoError(t, db.Create(&Asset{Token: token, ChainID: 137, Symbol: "usdc", Decimals: 6}).Error)
+	channelID := common.HexToHash("0xc105e").Hex()
+	require.NoError(t, db.Create(&Channel{
+		ChannelID:   channelID,
+		Participant: participantAddr,
+		Broker:      broker.Hex(),
+		Status:      ChannelStatusOpen,
+		Token:       token,
+		ChainID:     137,
+		Amount:      5000000,
+		Version:     2,
+	}).Error)
+	seedLedger(t, db, ParticipantAccount(participantAddr), "usdc", decimal.NewFromInt(3))
+
+	settler := &fakeSettler{}
+	settlement := NewSettlement(db, keys)
+	settlement.AddChain(137, settler)
+
+	sign := func(t *testing.T, signer Signer, method string, params any) *RPCMessage {
+		t.Helper()
+		rpc := &RPCMessage{Req: &RPCData{RequestID: 1, Method: method, Params: []any{params}, Timestamp: 1}}
+		reqBytes, err := json.Marshal(rpc.Req)
+		require.NoError(t, err)
+		sig, err := signer.Sign(reqBytes)
+		require.NoError(t, err)
+		rpc.Sig = []string{hexutil.Encode(sig)}
+		return rpc
+	}
+
+	t.Run("RestrictedToAdmins", func(t *testing.T) {
+		rpc := sign(t, participant, "admin_close_channel", AdminCloseChannelParams{ChannelID: channelID, Mode: CloseModeCooperative})
+		_, err := HandleAdminCloseChannel(rpc, participantAddr, db, admins, settlement)
+		require.Error(t, err)
+	})
+
+	var request CloseRequestResponse
+	t.Run("Cooperative", func(t *testing.T) {
+		rpc := sign(t, admin, "admin_close_channel", AdminCloseChannelParams{ChannelID: channelID, Mode: CloseModeCooperative})
+		resp, err := HandleAdminCloseChannel(rpc, admin.GetAddress().Hex(), db, admins, settlement)
+		require.NoError(t, err)
+
+		var ok bool
+		request, ok = resp.Res.Params[0].(CloseRequestResponse)
+		require.True(t, ok)
+		assert.Equal(t, CloseRequestStatusAwaitingSignature, request.Status)
+		assert.Equal(t, uint8(nitrolite.IntentFINALIZE), request.State.Intent)
+		assert.Equal(t, uint64(3), request.State.Version)
+		require.Len(t, request.State.Allocations, 2)
+		assert.Equal(t, participantAddr, request.State.Allocations[0].Participant)
+		assert.Equal(t, int64(3000000), request.State.Allocations[0].Amount.Int64())
+		assert.Equal(t, int64(2000000), request.State.Allocations[1].Amount.Int64())
+		require.Len(t, request.State.Sigs, 1)
+
+		// The payout is held like for a participant-initiated close
+		var hold LedgerHold
+		require.NoError(t, db.Where("channel_id = ? AND status = ?", channelID, HoldStatusActive).First(&hold).Error)
+		assert.True(t, decimal.NewFromInt(3).Equal(hold.Amount))
+
+		// Requesting the close again cancels the first request and re-issues its pending final state
+		resp, err = HandleAdminCloseChannel(rpc, admin.GetAddress().Hex(), db, admins, settlement)
+		require.NoError(t, err)
+		again := resp.Res.Params[0].(CloseRequestResponse)
+		assert.Equal(t, request.State, again.State)
+
+		var cancelled ChannelCloseRequest
+		require.NoError(t, db.First(&cancelled, request.RequestID).Error)
+		assert.Equal(t, CloseRequestStatusCancelled, cancelled.Status)
+		var holds int64
+		require.NoError(t, db.Model(&LedgerHold{}).Where("channel_id = ? AND status = ?", channelID, HoldStatusActive).Count(&holds).Error)
+		assert.Equal(t, int64(1), holds)
+		request = again
+	})
+
+	t.Run("RejectsForeignSignature", func(t *testing.T) {
+		state, err := request.State.toNitrolite()
+		require.NoError(t, err)
+		encoded, err := nitrolite.EncodeState(common.HexToHash(channelID), nitrolite.IntentFINALIZE, state.Version, state.Data, state.Allocations)
+		require.NoError(t, err)
+		sig, err := admin.NitroSign(encoded)
+		require.NoError(t, err)
+
+		params := CountersignCloseParams{RequestID: request.RequestID, Signature: newSignature(sig)}
+		_, err = HandleCountersignClose(sign(t, participant, "countersign_close", params), participantAddr, settlement)
+		require.ErrorContains(t, err, "invalid state signature")
+		assert.Empty(t, settler.closed)
+	})
+
+	t.Run("Countersign", func(t *testing.T) {
+		state, err := request.State.toNitrolite()
+		require.NoError(t, err)
+		encoded, err := nitrolite.EncodeState(common.HexToHash(channelID), nitrolite.IntentFINALIZE, state.Version, state.Data, state.Allocations)
+		require.NoError(t, err)
+		sig, err := participant.NitroSign(encoded)
+		require.NoError(t, err)
+
+		params := CountersignCloseParams{RequestID: request.RequestID, Signature: newSignature(sig)}
+
+		// The request is claimed while the close is sent, and awaits the signature again when sending fails
+		settler.sending = func() error {
+			_, err := settlement.Countersign(context.Background(), request.RequestID, participantAddr, newSignature(sig))
+			assert.ErrorContains(t, err, "is submitting")
+			return errors.New("nonce too low")
+		}
+		_, err = HandleCountersignClose(sign(t, participant, "countersign_close", params), participantAddr, settlement)
+		require.ErrorContains(t, err, "nonce too low")
+		assert.Empty(t, settler.closed)
+		var pending ChannelCloseRequest
+		require.NoError(t, db.First(&pending, request.RequestID).Error)
+		assert.Equal(t, CloseRequestStatusAwaitingSignature, pending.Status)
+		settler.sending = nil
+
+		resp, err := HandleCountersignClose(sign(t, participant, "countersign_close", params), participantAddr, settlement)
+		require.NoError(t, err)
+
+		submitted := resp.Res.Params[0].(CloseRequestResponse)
+		assert.Equal(t, CloseRequestStatusSubmitted, submitted.Status)
+		require.Len(t, settler.closed, 1)
+		require.Len(t, settler.closed[0].Sigs, 2)
+		assert.Equal(t, sig, settler.closed[0].Sigs[0])
+		valid, err := nitrolite.Verify(encoded, settler.closed[0].Sigs[1], broker)
+		require.NoError(t, err)
+		assert.True(t, valid)
+
+		// Submitted closes are not started again
+		_, err = settlement.RequestClose(context.Background(), &Channel{ChannelID: channelID, Status: ChannelStatusOpen, ChainID: 137}, CloseModeChallenge, common.Address{}, "admin")
+		require.ErrorContains(t, err, "already being settled")
+
+		require.NoError(t, completeCloseRequests(db, channelID, "0xc1"))
+		var stored ChannelCloseRequest
+		require.NoError(t, db.First(&stored, request.RequestID).Error)
+		assert.Equal(t, CloseRequestStatusClosed, stored.Status)
+		assert.Len(t, stored.State.Sigs, 2)
+	})
+
+	t.Run("Challenge", func(t *testing.T) {
+		settler.closed = nil
+		settler.latest = nitrolite.State{
+			Intent:  uint8(nitrolite.IntentRESIZE),
+			Version: big.NewInt(2),
+			Data:    []byte{},
+			Allocations: []nitrolite.Allocation{
+				{Destination: participant.GetAddress(), Token: common.HexToAddress(token), Amount: big.NewInt(5000000)},
+				{Destination: broker, Token: common.HexToAddress(token), Amount: big.NewInt(0)},
+			},
+			Sigs: []nitrolite.Signature{{V: 27}, {V: 28}},
+		}
+
+		channel, err := GetChannelByID(db, channelID)
+		require.NoError(t, err)
+		req, err := settlement.RequestClose(context.Background(), channel, CloseModeChallenge, common.Address{}, admin.GetAddress().Hex())
+		require.NoError(t, err)
+		assert.Equal(t, CloseRequestStatusSubmitted, req.Status)
+		assert.Equal(t, uint64(2), req.State.Version)
+		require.Len(t, settler.challenged, 1)
+
+		// Nothing to finalize until the challenge period expires
+		require.NoError(t, markCloseRequestsChallenged(db, channelID, time.Now().Add(time.Hour)))
+		require.NoError(t, settlement.FinalizeChallenges(context.Background()))
+		assert.Empty(t, settler.closed)
+
+		require.NoError(t, db.Model(&ChannelCloseRequest{}).Where("id = ?", req.ID).Update("challenge_expires_at", time.Now().Add(-time.Minute)).Error)
+		require.NoError(t, settlement.FinalizeChallenges(context.Background()))
+		require.Len(t, settler.closed, 1)
+		assert.Equal(t, settler.latest.Allocations, settler.closed[0].Allocations)
+
+		var stored ChannelCloseRequest
+		require.NoError(t, db.First(&stored, req.ID).Error)
+		assert.Equal(t, CloseRequestStatusSubmitted, stored.Status)
+		assert.Equal(t, common.HexToHash("0xc1").Hex(), stored.TxHash)
+	})
+}
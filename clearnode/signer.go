@@ -1,24 +1,85 @@
 package main
 
 import (
+	"bytes"
 	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math/big"
+	"net/http"
+	"os"
 	"strings"
+	"time"
 
 	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/crypto"
 )
 
-// Signer handles signing operations using a private key
-type Signer struct {
+// Signer signs broker messages, channel states and on-chain transactions.
+// Implementations may keep the key in memory or delegate signing to an external service.
+type Signer interface {
+	// Sign creates a 65-byte [R || S || V] signature over the Keccak256 hash of data, with V in {0, 1}
+	Sign(data []byte) ([]byte, error)
+	// NitroSign creates a signature for the provided state in nitrolite.Signature format
+	NitroSign(encodedState []byte) (nitrolite.Signature, error)
+	// GetAddress returns the address of the signing key
+	GetAddress() common.Address
+	// NewTransactor returns transaction options which sign transactions for the given chain
+	NewTransactor(chainID *big.Int) (*bind.TransactOpts, error)
+}
+
+// Supported signer backends
+const (
+	SignerTypeLocal    = "local"
+	SignerTypeKeystore = "keystore"
+	SignerTypeRemote   = "remote"
+)
+
+// SignerConfig describes which backend holds the broker key and how to reach it
+type SignerConfig struct {
+	Type               string
+	PrivateKeyHex      string
+	KeystorePath       string
+	KeystorePassphrase string
+	RemoteURL          string
+	RemoteAddress      string
+	RemoteToken        string
+}
+
+// NewSignerFromConfig creates a signer for the backend selected in the configuration
+func NewSignerFromConfig(cnf SignerConfig) (Signer, error) {
+	var signer Signer
+	var err error
+	switch cnf.Type {
+	case SignerTypeLocal, "":
+		signer, err = NewLocalSigner(cnf.PrivateKeyHex)
+	case SignerTypeKeystore:
+		signer, err = NewKeystoreSigner(cnf.KeystorePath, cnf.KeystorePassphrase)
+	case SignerTypeRemote:
+		signer, err = NewRemoteSigner(cnf.RemoteURL, cnf.RemoteAddress, cnf.RemoteToken)
+	default:
+		return nil, fmt.Errorf("unsupported signer type: %s", cnf.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// LocalSigner handles signing operations using a private key held in memory
+type LocalSigner struct {
 	privateKey *ecdsa.PrivateKey
 }
 
-// NewSigner creates a new signer from a hex-encoded private key
-func NewSigner(privateKeyHex string) (*Signer, error) {
+// NewLocalSigner creates a new signer from a hex-encoded private key
+func NewLocalSigner(privateKeyHex string) (*LocalSigner, error) {
 	if len(privateKeyHex) >= 2 && privateKeyHex[:2] == "0x" {
 		privateKeyHex = privateKeyHex[2:]
 	}
@@ -28,56 +89,216 @@ func NewSigner(privateKeyHex string) (*Signer, error) {
 		return nil, err
 	}
 
-	publicKey := privateKey.Public().(*ecdsa.PublicKey)
+	signer := &LocalSigner{privateKey: privateKey}
+	log.Printf("Broker signer initialized with address: %s", signer.GetAddress().Hex())
+
+	return signer, nil
+}
+
+// NewKeystoreSigner creates a signer from an encrypted geth keystore JSON file
+func NewKeystoreSigner(path, passphrase string) (*LocalSigner, error) {
+	keyJSON, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keystore file: %w", err)
+	}
 
-	log.Printf("Broker signer initialized with address: %s", crypto.PubkeyToAddress(*publicKey).Hex())
+	key, err := keystore.DecryptKey(keyJSON, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt keystore: %w", err)
+	}
+
+	signer := &LocalSigner{privateKey: key.PrivateKey}
+	log.Printf("Broker keystore signer initialized with address: %s", signer.GetAddress().Hex())
+
+	return signer, nil
+}
 
-	return &Signer{privateKey: privateKey}, nil
+// SignHash signs a 32-byte digest
+func (s *LocalSigner) SignHash(hash []byte) ([]byte, error) {
+	return crypto.Sign(hash, s.privateKey)
 }
 
 // Sign creates an ECDSA signature for the provided data
-func (s *Signer) Sign(data []byte) ([]byte, error) {
-	sig, err := nitrolite.Sign(data, s.privateKey)
+func (s *LocalSigner) Sign(data []byte) ([]byte, error) {
+	return signData(s, data)
+}
+
+// NitroSign creates a signature for the provided state in nitrolite.Signature format
+func (s *LocalSigner) NitroSign(encodedState []byte) (nitrolite.Signature, error) {
+	return nitroSign(s, encodedState)
+}
+
+// GetAddress returns the address derived from the signer's public key
+func (s *LocalSigner) GetAddress() common.Address {
+	return crypto.PubkeyToAddress(s.privateKey.PublicKey)
+}
+
+// NewTransactor returns transaction options signed by the local key
+func (s *LocalSigner) NewTransactor(chainID *big.Int) (*bind.TransactOpts, error) {
+	return bind.NewKeyedTransactorWithChainID(s.privateKey, chainID)
+}
+
+// RemoteSigner delegates signing to an external HTTP signing service (e.g. a Vault transit
+// or web3signer style gateway), so the broker key never leaves the service.
+//
+// The service must accept `POST {url}/sign` with a JSON body `{"address": "0x..", "digest": "0x.."}`
+// and respond with `{"signature": "0x.."}` containing a 65-byte [R || S || V] signature of the digest.
+type RemoteSigner struct {
+	url     string
+	address common.Address
+	token   string
+	client  *http.Client
+}
+
+type remoteSignRequest struct {
+	Address string `json:"address"`
+	Digest  string `json:"digest"`
+}
+
+type remoteSignResponse struct {
+	Signature string `json:"signature"`
+}
+
+// NewRemoteSigner creates a signer backed by a remote signing service
+func NewRemoteSigner(url, address, token string) (*RemoteSigner, error) {
+	if url == "" {
+		return nil, errors.New("remote signer url is required")
+	}
+	if !common.IsHexAddress(address) {
+		return nil, fmt.Errorf("invalid remote signer address: %q", address)
+	}
+
+	signer := &RemoteSigner{
+		url:     strings.TrimSuffix(url, "/"),
+		address: common.HexToAddress(address),
+		token:   token,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	log.Printf("Broker remote signer initialized with address: %s", signer.address.Hex())
+
+	return signer, nil
+}
+
+// SignHash asks the remote service to sign a 32-byte digest and verifies the returned signature
+func (s *RemoteSigner) SignHash(hash []byte) ([]byte, error) {
+	body, err := json.Marshal(remoteSignRequest{
+		Address: s.address.Hex(),
+		Digest:  hexutil.Encode(hash),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.url+"/sign", bytes.NewReader(body))
 	if err != nil {
 		return nil, err
 	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("remote signer request failed: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote signer returned status %d", res.StatusCode)
+	}
 
-	signature := make([]byte, 65)
-	copy(signature[0:32], sig.R[:])
-	copy(signature[32:64], sig.S[:])
+	var signRes remoteSignResponse
+	if err := json.NewDecoder(res.Body).Decode(&signRes); err != nil {
+		return nil, fmt.Errorf("invalid remote signer response: %w", err)
+	}
 
-	if sig.V >= 27 {
-		signature[64] = sig.V - 27
+	sig, err := hexutil.Decode(signRes.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote signature hex: %w", err)
+	}
+	if len(sig) != 65 {
+		return nil, fmt.Errorf("invalid remote signature length: got %d, want 65", len(sig))
+	}
+	if sig[64] >= 27 {
+		sig[64] -= 27
+	}
+
+	// Never hand out a signature the broker address can't be recovered from
+	pubkey, err := crypto.SigToPub(hash, sig)
+	if err != nil {
+		return nil, fmt.Errorf("remote signature recovery failed: %w", err)
 	}
-	return signature, nil
+	if crypto.PubkeyToAddress(*pubkey) != s.address {
+		return nil, errors.New("remote signature does not match signer address")
+	}
+
+	return sig, nil
+}
+
+// Sign creates an ECDSA signature for the provided data
+func (s *RemoteSigner) Sign(data []byte) ([]byte, error) {
+	return signData(s, data)
 }
 
 // NitroSign creates a signature for the provided state in nitrolite.Signature format
-func (s *Signer) NitroSign(encodedState []byte) (nitrolite.Signature, error) {
-	sig, err := nitrolite.Sign(encodedState, s.privateKey)
+func (s *RemoteSigner) NitroSign(encodedState []byte) (nitrolite.Signature, error) {
+	return nitroSign(s, encodedState)
+}
+
+// GetAddress returns the address of the remote key
+func (s *RemoteSigner) GetAddress() common.Address {
+	return s.address
+}
+
+// NewTransactor returns transaction options which sign transactions through the remote service
+func (s *RemoteSigner) NewTransactor(chainID *big.Int) (*bind.TransactOpts, error) {
+	return newHashTransactor(s, chainID)
+}
+
+// hashSigner signs raw 32-byte digests, returning [R || S || V] signatures with V in {0, 1}
+type hashSigner interface {
+	SignHash(hash []byte) ([]byte, error)
+	GetAddress() common.Address
+}
+
+func signData(s hashSigner, data []byte) ([]byte, error) {
+	return s.SignHash(crypto.Keccak256(data))
+}
+
+func nitroSign(s hashSigner, encodedState []byte) (nitrolite.Signature, error) {
+	sig, err := s.SignHash(crypto.Keccak256(encodedState))
 	if err != nil {
 		return nitrolite.Signature{}, fmt.Errorf("failed to sign encoded state: %w", err)
 	}
-	return nitrolite.Signature{
-		V: sig.V,
-		R: sig.R,
-		S: sig.S,
-	}, nil
-}
 
-// GetPublicKey returns the public key associated with the signer
-func (s *Signer) GetPublicKey() *ecdsa.PublicKey {
-	return s.privateKey.Public().(*ecdsa.PublicKey)
+	var nitroSig nitrolite.Signature
+	copy(nitroSig.R[:], sig[0:32])
+	copy(nitroSig.S[:], sig[32:64])
+	nitroSig.V = sig[64] + 27
+	return nitroSig, nil
 }
 
-// GetPrivateKey returns the private key used by the signer
-func (s *Signer) GetPrivateKey() *ecdsa.PrivateKey {
-	return s.privateKey
-}
+func newHashTransactor(s hashSigner, chainID *big.Int) (*bind.TransactOpts, error) {
+	if chainID == nil {
+		return nil, bind.ErrNoChainID
+	}
 
-// GetAddress returns the address derived from the signer's public key
-func (s *Signer) GetAddress() common.Address {
-	return crypto.PubkeyToAddress(*s.GetPublicKey())
+	txSigner := types.LatestSignerForChainID(chainID)
+	from := s.GetAddress()
+	return &bind.TransactOpts{
+		From: from,
+		Signer: func(address common.Address, tx *types.Transaction) (*types.Transaction, error) {
+			if address != from {
+				return nil, bind.ErrNotAuthorized
+			}
+			sig, err := s.SignHash(txSigner.Hash(tx).Bytes())
+			if err != nil {
+				return nil, err
+			}
+			return tx.WithSignature(txSigner, sig)
+		},
+	}, nil
 }
 
 // ValidateSignature validates the signature of a message against the provided address
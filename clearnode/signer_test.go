@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/erc7824/go-nitrolite"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMockRemoteSigner starts a remote signing service that signs digests with the given key
+func newMockRemoteSigner(t *testing.T, signer *LocalSigner, token string) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/sign" {
+			http.NotFound(w, r)
+			return
+		}
+		if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		var req remoteSignRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		digest, err := hexutil.Decode(req.Digest)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		sig, err := signer.SignHash(digest)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		// Return Ethereum-style V to make sure it gets normalized
+		sig[64] += 27
+
+		json.NewEncoder(w).Encode(remoteSignResponse{Signature: hexutil.Encode(sig)})
+	}))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// assertSignerBehaviour checks that the signer produces signatures recoverable to its address
+func assertSignerBehaviour(t *testing.T, signer Signer) {
+	t.Helper()
+
+	msg := []byte(`[1,"get_config",[],1619123456789]`)
+	sig, err := signer.Sign(msg)
+	require.NoError(t, err)
+	require.Len(t, sig, 65)
+	assert.Less(t, sig[64], byte(27), "V should be normalized to {0, 1}")
+
+	valid, err := ValidateSignature(msg, hexutil.Encode(sig), signer.GetAddress().Hex())
+	require.NoError(t, err)
+	assert.True(t, valid)
+
+	state := []byte("encoded-state")
+	nitroSig, err := signer.NitroSign(state)
+	require.NoError(t, err)
+	valid, err = nitrolite.Verify(state, nitroSig, signer.GetAddress())
+	require.NoError(t, err)
+	assert.True(t, valid)
+
+	chainID := big.NewInt(137)
+	opts, err := signer.NewTransactor(chainID)
+	require.NoError(t, err)
+	assert.Equal(t, signer.GetAddress(), opts.From)
+
+	tx := types.NewTx(&types.LegacyTx{Nonce: 1, GasPrice: big.NewInt(1), Gas: 21000, To: &common.Address{}, Value: big.NewInt(1)})
+	signedTx, err := opts.Signer(opts.From, tx)
+	require.NoError(t, err)
+	sender, err := types.Sender(types.LatestSignerForChainID(chainID), signedTx)
+	require.NoError(t, err)
+	assert.Equal(t, signer.GetAddress(), sender)
+}
+
+func TestLocalSigner(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	signer, err := NewLocalSigner(hexutil.Encode(crypto.FromECDSA(key)))
+	require.NoError(t, err)
+	assert.Equal(t, crypto.PubkeyToAddress(key.PublicKey), signer.GetAddress())
+
+	assertSignerBehaviour(t, signer)
+}
+
+func TestKeystoreSigner(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+
+	keyJSON, err := keystore.EncryptKey(&keystore.Key{
+		Id:         uuid.New(),
+		Address:    crypto.PubkeyToAddress(key.PublicKey),
+		PrivateKey: key,
+	}, "passphrase", keystore.LightScryptN, keystore.LightScryptP)
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "broker.json")
+	require.NoError(t, os.WriteFile(path, keyJSON, 0600))
+
+	_, err = NewKeystoreSigner(path, "wrong-passphrase")
+	require.Error(t, err)
+
+	signer, err := NewSignerFromConfig(SignerConfig{
+		Type:               SignerTypeKeystore,
+		KeystorePath:       path,
+		KeystorePassphrase: "passphrase",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, crypto.PubkeyToAddress(key.PublicKey), signer.GetAddress())
+
+	assertSignerBehaviour(t, signer)
+}
+
+func TestRemoteSigner(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	backend := &LocalSigner{privateKey: key}
+	server := newMockRemoteSigner(t, backend, "secret-token")
+
+	signer, err := NewSignerFromConfig(SignerConfig{
+		Type:          SignerTypeRemote,
+		RemoteURL:     server.URL,
+		RemoteAddress: backend.GetAddress().Hex(),
+		RemoteToken:   "secret-token",
+	})
+	require.NoError(t, err)
+	assertSignerBehaviour(t, signer)
+
+	t.Run("Unauthorized", func(t *testing.T) {
+		unauthorized, err := NewRemoteSigner(server.URL, backend.GetAddress().Hex(), "")
+		require.NoError(t, err)
+		_, err = unauthorized.Sign([]byte("data"))
+		require.Error(t, err)
+	})
+
+	t.Run("AddressMismatch", func(t *testing.T) {
+		otherKey, err := crypto.GenerateKey()
+		require.NoError(t, err)
+		other := &LocalSigner{privateKey: otherKey}
+		// The service signs with a key different from the configured address
+		mismatch := newMockRemoteSigner(t, other, "")
+		wrong, err := NewRemoteSigner(mismatch.URL, backend.GetAddress().Hex(), "")
+		require.NoError(t, err)
+
+		_, err = wrong.Sign([]byte("data"))
+		require.Error(t, err)
+	})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"gorm.io/gorm"
+)
+
+// MaxStatementEntries is the maximum number of entries in a single statement
+const MaxStatementEntries = 10000
+
+// Supported statement export formats
+const (
+	StatementFormatJSON = "json"
+	StatementFormatCSV  = "csv"
+)
+
+// StatementBalance summarizes the activity of an asset over the statement period
+type StatementBalance struct {
+	Asset   string          `json:"asset"`
+	Opening decimal.Decimal `json:"opening"`
+	Credits decimal.Decimal `json:"credits"`
+	Debits  decimal.Decimal `json:"debits"`
+	Closing decimal.Decimal `json:"closing"`
+}
+
+// StatementEntry is a ledger entry with the running balance of its asset
+type StatementEntry struct {
+	LedgerEntryResponse
+	Balance decimal.Decimal `json:"balance"`
+}
+
+// Statement lists the entries of an account in a period with opening and closing balances
+type Statement struct {
+	Participant string             `json:"participant"`
+	AccountID   string             `json:"account_id"`
+	StartTime   time.Time          `json:"start_time"`
+	EndTime     time.Time          `json:"end_time"`
+	Balances    []StatementBalance `json:"balances"`
+	Entries     []StatementEntry   `json:"entries"`
+}
+
+// GenerateStatement builds the statement of an account for entries created in [start, end), optionally for a single asset
+func GenerateStatement(db *gorm.DB, participant, accountID, asset string, start, end time.Time) (*Statement, error) {
+	if !end.After(start) {
+		return nil, errors.New("end time must be after start time")
+	}
+
+	filter := func() *gorm.DB {
+		q := db.Model(&Entry{}).Where("account_id = ? AND participant = ?", accountID, participant)
+		if asset != "" {
+			q = q.Where("asset_symbol = ?", asset)
+		}
+		return q
+	}
+
+	type row struct {
+		AssetSymbol string          `gorm:"column:asset_symbol"`
+		Balance     decimal.Decimal `gorm:"column:balance"`
+	}
+	var openingRows []row
+	if err := filter().
+		Where("created_at < ?", start).
+		Select("asset_symbol", "COALESCE(SUM(credit),0) - COALESCE(SUM(debit),0) AS balance").
+		Group("asset_symbol").
+		Scan(&openingRows).Error; err != nil {
+		return nil, fmt.Errorf("failed to compute opening balances: %w", err)
+	}
+
+	var entries []Entry
+	if err := filter().
+		Where("created_at >= ? AND created_at < ?", start, end).
+		Order("id").
+		Limit(MaxStatementEntries + 1).
+		Find(&entries).Error; err != nil {
+		return nil, fmt.Errorf("failed to fetch entries: %w", err)
+	}
+	if len(entries) > MaxStatementEntries {
+		return nil, fmt.Errorf("statement exceeds %d entries, use a shorter period", MaxStatementEntries)
+	}
+
+	balances := map[string]*StatementBalance{}
+	balanceOf := func(asset string) *StatementBalance {
+		b, ok := balances[asset]
+		if !ok {
+			b = &StatementBalance{Asset: asset}
+			balances[asset] = b
+		}
+		return b
+	}
+	for _, r := range openingRows {
+		balanceOf(r.AssetSymbol).Opening = r.Balance
+	}
+
+	running := map[string]decimal.Decimal{}
+	for asset, b := range balances {
+		running[asset] = b.Opening
+	}
+
+	statement := &Statement{
+		Participant: participant,
+		AccountID:   accountID,
+		StartTime:   start,
+		EndTime:     end,
+		Balances:    []StatementBalance{},
+		Entries:     make([]StatementEntry, 0, len(entries)),
+	}
+	for _, e := range entries {
+		b := balanceOf(e.AssetSymbol)
+		b.Credits = b.Credits.Add(e.Credit)
+		b.Debits = b.Debits.Add(e.Debit)
+		running[e.AssetSymbol] = running[e.AssetSymbol].Add(e.Credit).Sub(e.Debit)
+
+		statement.Entries = append(statement.Entries, StatementEntry{
+			LedgerEntryResponse: LedgerEntryResponse{
+				ID:            e.ID,
+				TxID:          e.TxID,
+				AccountID:     e.AccountID,
+				AccountType:   e.AccountType,
+				Asset:         e.AssetSymbol,
+				Participant:   e.Participant,
+				Credit:        e.Credit,
+				Debit:         e.Debit,
+				ReferenceType: e.ReferenceType,
+				Reference:     e.Reference,
+				Memo:          e.Memo,
+				CreatedAt:     e.CreatedAt,
+			},
+			Balance: running[e.AssetSymbol],
+		})
+	}
+
+	for _, b := range balances {
+		b.Closing = b.Opening.Add(b.Credits).Sub(b.Debits)
+		statement.Balances = append(statement.Balances, *b)
+	}
+	sort.Slice(statement.Balances, func(i, j int) bool {
+		return statement.Balances[i].Asset < statement.Balances[j].Asset
+	})
+
+	return statement, nil
+}
+
+// WriteJSON writes the statement as indented JSON
+func (s *Statement) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// WriteCSV writes the statement as CSV, with an opening balance row per asset,
+// the entries with their running balance, and a closing balance row per asset
+func (s *Statement) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	header := []string{"date", "tx_id", "entry_id", "asset", "reference_type", "reference", "memo", "debit", "credit", "balance"}
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for _, b := range s.Balances {
+		if err := cw.Write([]string{s.StartTime.UTC().Format(time.RFC3339), "", "", b.Asset, "", "", "Opening balance", "", "", b.Opening.String()}); err != nil {
+			return err
+		}
+	}
+	for _, e := range s.Entries {
+		if err := cw.Write([]string{
+			e.CreatedAt.UTC().Format(time.RFC3339),
+			e.TxID,
+			strconv.FormatUint(uint64(e.ID), 10),
+			e.Asset,
+			string(e.ReferenceType),
+			e.Reference,
+			e.Memo,
+			e.Debit.String(),
+			e.Credit.String(),
+			e.Balance.String(),
+		}); err != nil {
+			return err
+		}
+	}
+	for _, b := range s.Balances {
+		if err := cw.Write([]string{s.EndTime.UTC().Format(time.RFC3339), "", "", b.Asset, "", "", "Closing balance", b.Debits.String(), b.Credits.String(), b.Closing.String()}); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// Write writes the statement in the given format
+func (s *Statement) Write(w io.Writer, format string) error {
+	switch format {
+	case StatementFormatJSON, "":
+		return s.WriteJSON(w)
+	case StatementFormatCSV:
+		return s.WriteCSV(w)
+	default:
+		return fmt.Errorf("unsupported statement format: %s", format)
+	}
+}
+
+// parseStatementTime accepts RFC3339 timestamps and plain dates
+func parseStatementTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.DateOnly, value)
+}
+
+// runStatementCommand implements `clearnode statement`, which exports the statement of a participant
+func runStatementCommand(args []string) error {
+	fs := flag.NewFlagSet("statement", flag.ContinueOnError)
+	participant := fs.String("participant", "", "participant address (required)")
+	account := fs.String("account", "", "ledger account ID, defaults to the participant's unified balance")
+	asset := fs.String("asset", "", "only include this asset")
+	from := fs.String("from", "", "start of the period, RFC3339 or YYYY-MM-DD (required)")
+	to := fs.String("to", "", "end of the period (exclusive), RFC3339 or YYYY-MM-DD, defaults to now")
+	format := fs.String("format", StatementFormatCSV, "output format, csv or json")
+	out := fs.String("out", "", "output file, defaults to stdout")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if *participant == "" || *from == "" {
+		fs.Usage()
+		return errors.New("participant and from are required")
+	}
+	if *account == "" {
+		*account = *participant
+	}
+	if *format != StatementFormatCSV && *format != StatementFormatJSON {
+		return fmt.Errorf("unsupported statement format: %s", *format)
+	}
+
+	start, err := parseStatementTime(*from)
+	if err != nil {
+		return fmt.Errorf("invalid from: %w", err)
+	}
+	end := time.Now()
+	if *to != "" {
+		if end, err = parseStatementTime(*to); err != nil {
+			return fmt.Errorf("invalid to: %w", err)
+		}
+	}
+
+	dbConf, err := LoadDatabaseConfig()
+	if err != nil {
+		return err
+	}
+	db, err := ConnectToDB(dbConf)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	statement, err := GenerateStatement(db, *participant, *account, *asset, start, end)
+	if err != nil {
+		return err
+	}
+
+	w := io.Writer(os.Stdout)
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("failed to create output file: %w", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	return statement.Write(w, *format)
+}
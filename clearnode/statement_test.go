@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/shopspring/decimal"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// postAt posts a deposit or withdrawal of a participant with a reference, dated at the given time
+func postAt(t *testing.T, db *gorm.DB, participant, asset string, amount decimal.Decimal, reference, memo string, at time.Time) {
+	t.Helper()
+
+	ledgerTx := NewLedgerTransaction(db)
+	ledgerTx.SetReference(ReferenceTypeTxHash, reference, memo)
+	if amount.IsNegative() {
+		ledgerTx.Transfer(ParticipantAccount(participant), CustodyAccount(137), asset, amount.Abs())
+	} else {
+		ledgerTx.Debit(CustodyAccount(137), asset, amount)
+		ledgerTx.Credit(ParticipantAccount(participant), asset, amount)
+	}
+	require.NoError(t, ledgerTx.Post())
+	require.NoError(t, db.Model(&Entry{}).Where("tx_id = ?", ledgerTx.ID()).Update("created_at", at).Error)
+}
+
+func TestLedgerStatement(t *testing.T) {
+	db, cleanup := setupTestDB(t)
+	defer cleanup()
+
+	participant := "0xParticipant1"
+	start := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+
+	postAt(t, db, participant, "usdc", decimal.NewFromInt(100), "0xtx1", "Deposit into channel 0xc1", start.Add(-time.Hour))
+	postAt(t, db, participant, "usdc", decimal.NewFromInt(50), "0xtx2", "Deposit into channel 0xc1", start.Add(time.Hour))
+	postAt(t, db, participant, "usdc", decimal.NewFromInt(-30), "0xtx3", "Withdrawal on close of channel 0xc1", start.Add(2*time.Hour))
+	postAt(t, db, participant, "eth", decimal.NewFromInt(2), "0xtx4", "Deposit into channel 0xc2", start.Add(3*time.Hour))
+	postAt(t, db, participant, "usdc", decimal.NewFromInt(1000), "0xtx5", "After the period", end)
+	postAt(t, db, "0xOther", "usdc", decimal.NewFromInt(7), "0xtx6", "Other participant", start.Add(time.Hour))
+
+	statement, err := GenerateStatement(db, participant, participant, "", start, end)
+	require.NoError(t, err)
+
+	require.Len(t, statement.Balances, 2)
+	eth, usdc := statement.Balances[0], statement.Balances[1]
+	assert.Equal(t, "eth", eth.Asset)
+	assert.True(t, eth.Opening.IsZero())
+	assert.True(t, decimal.NewFromInt(2).Equal(eth.Closing))
+	assert.Equal(t, "usdc", usdc.Asset)
+	assert.True(t, decimal.NewFromInt(100).Equal(usdc.Opening))
+	assert.True(t, decimal.NewFromInt(50).Equal(usdc.Credits))
+	assert.True(t, decimal.NewFromInt(30).Equal(usdc.Debits))
+	assert.True(t, decimal.NewFromInt(120).Equal(usdc.Closing))
+
+	require.Len(t, statement.Entries, 3)
+	assert.Equal(t, "0xtx2", statement.Entries[0].Reference)
+	assert.Equal(t, ReferenceTypeTxHash, statement.Entries[0].ReferenceType)
+	assert.Equal(t, "Deposit into channel 0xc1", statement.Entries[0].Memo)
+	assert.True(t, decimal.NewFromInt(150).Equal(statement.Entries[0].Balance))
+	assert.True(t, decimal.NewFromInt(120).Equal(statement.Entries[1].Balance))
+	assert.True(t, decimal.NewFromInt(2).Equal(statement.Entries[2].Balance))
+
+	t.Run("AssetFilter", func(t *testing.T) {
+		statement, err := GenerateStatement(db, participant, participant, "eth", start, end)
+		require.NoError(t, err)
+		require.Len(t, statement.Balances, 1)
+		require.Len(t, statement.Entries, 1)
+	})
+
+	t.Run("InvalidPeriod", func(t *testing.T) {
+		_, err := GenerateStatement(db, participant, participant, "", end, start)
+		assert.Error(t, err)
+	})
+
+	t.Run("CSV", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, statement.Write(&buf, StatementFormatCSV))
+
+		records, err := csv.NewReader(&buf).ReadAll()
+		require.NoError(t, err)
+		// Header, two opening rows, three entries and two closing rows
+		require.Len(t, records, 8)
+		assert.Equal(t, "memo", records[0][6])
+		assert.Equal(t, []string{"2025-06-01T00:00:00Z", "", "", "usdc", "", "", "Opening balance", "", "", "100"}, records[2])
+		assert.Equal(t, "Withdrawal on close of channel 0xc1", records[4][6])
+		assert.Equal(t, "30", records[4][7])
+		assert.Equal(t, "120", records[4][9])
+		assert.Equal(t, []string{"2025-07-01T00:00:00Z", "", "", "usdc", "", "", "Closing balance", "30", "50", "120"}, records[7])
+	})
+
+	t.Run("RPC", func(t *testing.T) {
+		params := GetLedgerStatementParams{StartTime: uint64(start.UnixMilli()), EndTime: uint64(end.UnixMilli())}
+		resp, err := HandleGetLedgerStatement(&RPCMessage{Req: &RPCData{RequestID: 1, Method: "get_ledger_statement", Params: []any{params}}}, participant, db)
+		require.NoError(t, err)
+		jsonStatement, ok := resp.Res.Params[0].(*Statement)
+		require.True(t, ok)
+		assert.Len(t, jsonStatement.Entries, 3)
+
+		data, err := json.Marshal(jsonStatement.Entries[0])
+		require.NoError(t, err)
+		assert.Contains(t, string(data), `"reference":"0xtx2"`)
+		assert.Contains(t, string(data), `"balance":"150"`)
+
+		params.Format = StatementFormatCSV
+		resp, err = HandleGetLedgerStatement(&RPCMessage{Req: &RPCData{RequestID: 2, Method: "get_ledger_statement", Params: []any{params}}}, participant, db)
+		require.NoError(t, err)
+		export, ok := resp.Res.Params[0].(StatementExport)
+		require.True(t, ok)
+		assert.Equal(t, StatementFormatCSV, export.Format)
+		assert.Contains(t, export.Content, "Closing balance")
+
+		// Statements are always generated for the authenticated participant
+		resp, err = HandleGetLedgerStatement(&RPCMessage{Req: &RPCData{RequestID: 3, Method: "get_ledger_statement", Params: []any{
+			GetLedgerStatementParams{AccountID: participant, StartTime: uint64(start.UnixMilli()), EndTime: uint64(end.UnixMilli())},
+		}}}, "0xOther", db)
+		require.NoError(t, err)
+		assert.Empty(t, resp.Res.Params[0].(*Statement).Entries)
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -20,29 +21,41 @@ import (
 
 var validate = validator.New()
 
+// shutdownCloseReason is sent with the Service Restart close code, telling clients to reconnect
+const shutdownCloseReason = "server is shutting down, reconnect"
+
 // UnifiedWSHandler manages WebSocket connections with authentication
 type UnifiedWSHandler struct {
-	signer        *Signer
+	keys          *KeyRing
 	db            *gorm.DB
 	upgrader      websocket.Upgrader
 	connections   map[string]*websocket.Conn
 	connectionsMu sync.RWMutex
+	open          map[*websocket.Conn]struct{} // Every upgraded connection, authenticated or not
+	openWg        sync.WaitGroup               // Connection handlers, which return once their in-flight request is answered
+	draining      bool                         // Set on shutdown, no new connection is served
 	authManager   *AuthManager
 	metrics       *Metrics
 	rpcStore      *RPCStore
 	config        *Config
+	liquidity     *Liquidity
+	settlement    *Settlement
+	bus           MessageBus
 }
 
 func NewUnifiedWSHandler(
-	signer *Signer,
+	keys *KeyRing,
 	db *gorm.DB,
 	metrics *Metrics,
 	rpcStore *RPCStore,
 	config *Config,
+	liquidity *Liquidity,
+	settlement *Settlement,
+	bus MessageBus,
 ) *UnifiedWSHandler {
-	return &UnifiedWSHandler{
-		signer: signer,
-		db:     db,
+	h := &UnifiedWSHandler{
+		keys: keys,
+		db:   db,
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  1024,
 			WriteBufferSize: 1024,
@@ -51,11 +64,17 @@ func NewUnifiedWSHandler(
 			},
 		},
 		connections: make(map[string]*websocket.Conn),
+		open:        make(map[*websocket.Conn]struct{}),
 		authManager: NewAuthManager(),
 		metrics:     metrics,
 		rpcStore:    rpcStore,
 		config:      config,
+		liquidity:   liquidity,
+		settlement:  settlement,
+		bus:         bus,
 	}
+	bus.Subscribe(h.deliverBusMessage)
+	return h
 }
 
 // HandleConnection handles the WebSocket connection lifecycle.
@@ -65,7 +84,11 @@ func (h *UnifiedWSHandler) HandleConnection(w http.ResponseWriter, r *http.Reque
 		log.Printf("Failed to upgrade to WebSocket: %v", err)
 		return
 	}
-	defer conn.Close()
+	if !h.trackConnection(conn) {
+		closeForShutdown(conn)
+		return
+	}
+	defer h.untrackConnection(conn)
 
 	// Increment connection metrics
 	h.metrics.ConnectionsTotal.Inc()
@@ -106,7 +129,7 @@ func (h *UnifiedWSHandler) HandleConnection(w http.ResponseWriter, r *http.Reque
 			h.metrics.AuthRequests.Inc()
 
 			// Client is initiating authentication
-			err := HandleAuthRequest(h.signer, conn, &rpcMsg, h.authManager)
+			err := HandleAuthRequest(h.keys.Active(), conn, &rpcMsg, h.authManager)
 			if err != nil {
 				log.Printf("Auth initialization failed: %v", err)
 				h.sendErrorResponse(address, nil, conn, err.Error())
@@ -116,7 +139,7 @@ func (h *UnifiedWSHandler) HandleConnection(w http.ResponseWriter, r *http.Reque
 
 		case "auth_verify":
 			// Client is responding to a challenge
-			authAddr, err := HandleAuthVerify(conn, &rpcMsg, h.authManager, h.signer)
+			authAddr, err := HandleAuthVerify(conn, &rpcMsg, h.authManager, h.keys.Active())
 			if err != nil {
 				log.Printf("Authentication verification failed: %v", err)
 				h.sendErrorResponse(address, nil, conn, err.Error())
@@ -234,13 +257,21 @@ func (h *UnifiedWSHandler) HandleConnection(w http.ResponseWriter, r *http.Reque
 			}
 
 		case "get_config":
-			rpcResponse, handlerErr = HandleGetConfig(&msg, h.config, h.signer)
+			rpcResponse, handlerErr = HandleGetConfig(&msg, h.config, h.keys)
 			if handlerErr != nil {
 				log.Printf("Error handling get_config: %v", handlerErr)
 				h.sendErrorResponse(address, &msg, conn, "Failed to get config: "+handlerErr.Error())
 				continue
 			}
 
+		case "get_fee_schedule":
+			rpcResponse, handlerErr = HandleGetFeeSchedule(&msg, h.config.fees)
+			if handlerErr != nil {
+				log.Printf("Error handling get_fee_schedule: %v", handlerErr)
+				h.sendErrorResponse(address, &msg, conn, "Failed to get fee schedule: "+handlerErr.Error())
+				continue
+			}
+
 		case "get_assets":
 			rpcResponse, handlerErr = HandleGetAssets(&msg, h.db)
 			if handlerErr != nil {
@@ -283,7 +314,7 @@ func (h *UnifiedWSHandler) HandleConnection(w http.ResponseWriter, r *http.Reque
 			h.sendBalanceUpdate(address)
 			recordHistory = true
 		case "close_app_session":
-			rpcResponse, handlerErr = HandleCloseApplication(&msg, h.db)
+			rpcResponse, handlerErr = HandleCloseApplication(&msg, h.db, h.config.fees)
 			if handlerErr != nil {
 				log.Printf("Error handling close_app_session: %v", handlerErr)
 				h.sendErrorResponse(address, &msg, conn, "Failed to close application: "+handlerErr.Error())
@@ -291,6 +322,14 @@ func (h *UnifiedWSHandler) HandleConnection(w http.ResponseWriter, r *http.Reque
 			}
 			h.sendBalanceUpdate(address)
 			recordHistory = true
+		case "get_ledger_statement":
+			rpcResponse, handlerErr = HandleGetLedgerStatement(&msg, address, h.db)
+			if handlerErr != nil {
+				log.Printf("Error handling get_ledger_statement: %v", handlerErr)
+				h.sendErrorResponse(address, &msg, conn, "Failed to get ledger statement: "+handlerErr.Error())
+				continue
+			}
+
 		case "get_app_sessions":
 			rpcResponse, handlerErr = HandleGetAppSessions(&msg, h.db)
 			if handlerErr != nil {
@@ -300,20 +339,87 @@ func (h *UnifiedWSHandler) HandleConnection(w http.ResponseWriter, r *http.Reque
 			}
 
 		case "resize_channel":
-			rpcResponse, handlerErr = HandleResizeChannel(&msg, h.db, h.signer)
+			rpcResponse, handlerErr = HandleResizeChannel(&msg, h.db, h.keys, h.config.fees, h.liquidity)
 			if handlerErr != nil {
 				log.Printf("Error handling resize_channel: %v", handlerErr)
 				h.sendErrorResponse(address, &msg, conn, "Failed to resize channel: "+handlerErr.Error())
 				continue
 			}
+			h.sendBalanceUpdate(address)
 			recordHistory = true
 		case "close_channel":
-			rpcResponse, handlerErr = HandleCloseChannel(&msg, h.db, h.signer)
+			rpcResponse, handlerErr = HandleCloseChannel(&msg, h.db, h.keys)
 			if handlerErr != nil {
 				log.Printf("Error handling close_channel: %v", handlerErr)
 				h.sendErrorResponse(address, &msg, conn, "Failed to close channel: "+handlerErr.Error())
 				continue
 			}
+			h.sendBalanceUpdate(address)
+			recordHistory = true
+		case "withdraw":
+			rpcResponse, handlerErr = HandleWithdraw(&msg, address, h.db, h.keys, h.config.fees, h.liquidity)
+			if handlerErr != nil {
+				log.Printf("Error handling withdraw: %v", handlerErr)
+				h.sendErrorResponse(address, &msg, conn, "Failed to withdraw: "+handlerErr.Error())
+				continue
+			}
+			h.sendBalanceUpdate(address)
+			recordHistory = true
+		case "get_liquidity":
+			rpcResponse, handlerErr = HandleGetLiquidity(&msg, h.liquidity)
+			if handlerErr != nil {
+				log.Printf("Error handling get_liquidity: %v", handlerErr)
+				h.sendErrorResponse(address, &msg, conn, "Failed to get liquidity: "+handlerErr.Error())
+				continue
+			}
+
+		case "admin_deposit":
+			rpcResponse, handlerErr = HandleAdminDeposit(&msg, address, h.db, h.config.admins, h.liquidity)
+			if handlerErr != nil {
+				log.Printf("Error handling admin_deposit: %v", handlerErr)
+				h.sendErrorResponse(address, &msg, conn, "Failed to deposit broker funds: "+handlerErr.Error())
+				continue
+			}
+			recordHistory = true
+		case "admin_withdraw":
+			rpcResponse, handlerErr = HandleAdminWithdraw(&msg, address, h.db, h.config.admins, h.liquidity)
+			if handlerErr != nil {
+				log.Printf("Error handling admin_withdraw: %v", handlerErr)
+				h.sendErrorResponse(address, &msg, conn, "Failed to withdraw broker funds: "+handlerErr.Error())
+				continue
+			}
+			recordHistory = true
+		case "admin_revoke_session":
+			rpcResponse, handlerErr = HandleAdminRevokeSession(&msg, address, h.config.admins)
+			if handlerErr != nil {
+				log.Printf("Error handling admin_revoke_session: %v", handlerErr)
+				h.sendErrorResponse(address, &msg, conn, "Failed to revoke session: "+handlerErr.Error())
+				continue
+			}
+			if revoked, ok := rpcResponse.Res.Params[0].(AdminRevokeSessionResponse); ok {
+				h.RevokeSession(revoked.Address)
+			}
+			recordHistory = true
+		case "admin_close_channel":
+			rpcResponse, handlerErr = HandleAdminCloseChannel(&msg, address, h.db, h.config.admins, h.settlement)
+			if handlerErr != nil {
+				log.Printf("Error handling admin_close_channel: %v", handlerErr)
+				h.sendErrorResponse(address, &msg, conn, "Failed to close channel: "+handlerErr.Error())
+				continue
+			}
+			// The participant is asked to countersign the final state
+			if request, ok := rpcResponse.Res.Params[0].(CloseRequestResponse); ok && request.Status == CloseRequestStatusAwaitingSignature {
+				h.sendResponse(request.Participant, "close_request", rpcResponse.Res.Params, "close request")
+				h.sendBalanceUpdate(request.Participant)
+			}
+			recordHistory = true
+		case "countersign_close":
+			rpcResponse, handlerErr = HandleCountersignClose(&msg, address, h.settlement)
+			if handlerErr != nil {
+				log.Printf("Error handling countersign_close: %v", handlerErr)
+				h.sendErrorResponse(address, &msg, conn, "Failed to countersign close: "+handlerErr.Error())
+				continue
+			}
 			recordHistory = true
 		case "get_channels":
 			rpcResponse, handlerErr = HandleGetChannels(&msg, h.db)
@@ -323,6 +429,14 @@ func (h *UnifiedWSHandler) HandleConnection(w http.ResponseWriter, r *http.Reque
 				continue
 			}
 
+		case "get_channel_states":
+			rpcResponse, handlerErr = HandleGetChannelStates(&msg, h.db)
+			if handlerErr != nil {
+				log.Printf("Error handling get_channel_states: %v", handlerErr)
+				h.sendErrorResponse(address, &msg, conn, "Failed to get channel states: "+handlerErr.Error())
+				continue
+			}
+
 		case "get_rpc_history":
 			rpcResponse, handlerErr = HandleGetRPCHistory(address, &msg, h.rpcStore)
 			if handlerErr != nil {
@@ -338,7 +452,7 @@ func (h *UnifiedWSHandler) HandleConnection(w http.ResponseWriter, r *http.Reque
 
 		// For broker methods, send back a signed RPC response.
 		byteData, _ := json.Marshal(rpcResponse.Res)
-		signature, _ := h.signer.Sign(byteData)
+		signature, _ := h.responseSigner(rpcResponse.Res.Params, msg.Req.Params).Sign(byteData)
 		rpcResponse.Sig = []string{hexutil.Encode(signature)}
 		wsResponseData, _ := json.Marshal(rpcResponse)
 
@@ -404,41 +518,13 @@ func forwardMessage(rpc *RPCMessage, msg []byte, fromAddress string, h *UnifiedW
 		return errors.New("failed to find virtual app session: " + err.Error())
 	}
 
-	// Iterate over all recipients in a virtual app and send the message
+	// Iterate over all recipients in a virtual app, which may be connected to other nodes
 	for _, recipient := range vApp.Participants {
 		if recipient == fromAddress {
 			continue
 		}
-
-		h.connectionsMu.RLock()
-		recipientConn, exists := h.connections[recipient]
-		h.connectionsMu.RUnlock()
-		if exists {
-			// Use NextWriter for safer message delivery
-			w, err := recipientConn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				log.Printf("Error getting writer for forwarded message to %s: %v", recipient, err)
-				continue
-			}
-
-			if _, err := w.Write(msg); err != nil {
-				log.Printf("Error writing forwarded message to %s: %v", recipient, err)
-				w.Close()
-				continue
-			}
-
-			if err := w.Close(); err != nil {
-				log.Printf("Error closing writer for forwarded message to %s: %v", recipient, err)
-				continue
-			}
-
-			// Increment sent message counter for each forwarded message
-			h.metrics.MessageSent.Inc()
-
-			log.Printf("Successfully forwarded message to %s", recipient)
-		} else {
-			log.Printf("Recipient %s not connected", recipient)
-			continue
+		if err := h.bus.Publish(context.Background(), BusMessage{Topic: BusTopicForward, Recipient: recipient, Payload: msg}); err != nil {
+			log.Printf("Error forwarding message to %s: %v", recipient, err)
 		}
 	}
 
@@ -455,8 +541,12 @@ func (h *UnifiedWSHandler) sendErrorResponse(sender string, rpc *RPCMessage, con
 		"error": errMsg,
 	}}, time.Now())
 
+	var requestParams []any
+	if rpc != nil && rpc.Req != nil {
+		requestParams = rpc.Req.Params
+	}
 	byteData, _ := json.Marshal(response.Req)
-	signature, _ := h.signer.Sign(byteData)
+	signature, _ := h.responseSigner(requestParams).Sign(byteData)
 	response.Sig = []string{hexutil.Encode(signature)}
 
 	responseData, err := json.Marshal(response)
@@ -504,7 +594,7 @@ func (h *UnifiedWSHandler) sendResponse(recipient string, method string, payload
 	response := CreateResponse(uint64(time.Now().UnixMilli()), method, payload, time.Now())
 
 	byteData, _ := json.Marshal(response.Req)
-	signature, _ := h.signer.Sign(byteData)
+	signature, _ := h.responseSigner(payload).Sign(byteData)
 	response.Sig = []string{hexutil.Encode(signature)}
 
 	responseData, err := json.Marshal(response)
@@ -513,36 +603,114 @@ func (h *UnifiedWSHandler) sendResponse(recipient string, method string, payload
 		return
 	}
 
-	h.connectionsMu.RLock()
-	recipientConn, exists := h.connections[recipient]
-	h.connectionsMu.RUnlock()
-	if exists {
-		// Use NextWriter for safer message delivery
-		w, err := recipientConn.NextWriter(websocket.TextMessage)
-		if err != nil {
-			log.Printf("Error getting writer for %s update to %s: %v", updateType, recipient, err)
-			return
-		}
+	// The recipient may be connected to another node
+	h.publish(BusMessage{Topic: BusTopicNotification, Recipient: recipient, Payload: responseData})
+}
 
-		if _, err := w.Write(responseData); err != nil {
-			log.Printf("Error writing %s update to %s: %v", updateType, recipient, err)
-			w.Close()
-			return
+// responseSigner returns the key signing a response. Responses about a channel, found from the channel_id of the
+// first response or request parameter, are signed with the key the channel was opened with, like its states.
+// Other responses, and responses about channels whose key was retired, are signed with the active key.
+func (h *UnifiedWSHandler) responseSigner(params ...[]any) Signer {
+	for _, p := range params {
+		channelID := channelIDOf(p)
+		if channelID == "" {
+			continue
+		}
+		channel, err := GetChannelByID(h.db, channelID)
+		if err != nil || channel == nil {
+			break
 		}
+		if signer, err := h.keys.Get(channel.Broker); err == nil {
+			return signer
+		}
+		break
+	}
+	return h.keys.Active()
+}
 
-		if err := w.Close(); err != nil {
-			log.Printf("Error closing writer for %s update to %s: %v", updateType, recipient, err)
-			return
+// channelIDOf returns the channel_id of the first parameter of a request or response, if it has one
+func channelIDOf(params []any) string {
+	if len(params) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(params[0])
+	if err != nil {
+		return ""
+	}
+	var ref struct {
+		ChannelID string `json:"channel_id"`
+	}
+	if err := json.Unmarshal(data, &ref); err != nil {
+		return ""
+	}
+	return ref.ChannelID
+}
+
+// publish hands a message to the bus, which delivers it on every node
+func (h *UnifiedWSHandler) publish(msg BusMessage) {
+	if err := h.bus.Publish(context.Background(), msg); err != nil {
+		log.Printf("Error publishing %s message to %s: %v", msg.Topic, msg.Recipient, err)
+	}
+}
+
+// deliverBusMessage delivers a message of the bus to the connection of its recipient on this node
+func (h *UnifiedWSHandler) deliverBusMessage(msg BusMessage) {
+	switch msg.Topic {
+	case BusTopicForward, BusTopicNotification:
+		h.writeToParticipant(msg.Recipient, msg.Payload, msg.Topic)
+	case BusTopicRevoke:
+		h.authManager.RevokeSession(msg.Recipient)
+
+		h.connectionsMu.RLock()
+		defer h.connectionsMu.RUnlock()
+		for address, conn := range h.connections {
+			if !strings.EqualFold(address, msg.Recipient) {
+				continue
+			}
+			log.Printf("Closing connection of %s, its session is revoked", address)
+			message := websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "session revoked")
+			conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+			conn.Close()
 		}
+	default:
+		log.Printf("Unknown bus message topic: %s", msg.Topic)
+	}
+}
 
-		// Increment sent message counter
-		h.metrics.MessageSent.Inc()
+// writeToParticipant writes a message to the connection of a participant, if it is connected to this node
+func (h *UnifiedWSHandler) writeToParticipant(recipient string, data []byte, topic BusTopic) {
+	h.connectionsMu.RLock()
+	recipientConn, exists := h.connections[recipient]
+	h.connectionsMu.RUnlock()
+	if !exists {
+		return
+	}
 
-		log.Printf("Successfully sent %s update to %s", updateType, recipient)
-	} else {
-		log.Printf("Recipient %s not connected", recipient)
+	// Use NextWriter for safer message delivery
+	w, err := recipientConn.NextWriter(websocket.TextMessage)
+	if err != nil {
+		log.Printf("Error getting writer for %s message to %s: %v", topic, recipient, err)
+		return
+	}
+
+	if _, err := w.Write(data); err != nil {
+		log.Printf("Error writing %s message to %s: %v", topic, recipient, err)
+		w.Close()
+		return
+	}
+
+	if err := w.Close(); err != nil {
+		log.Printf("Error closing writer for %s message to %s: %v", topic, recipient, err)
 		return
 	}
+
+	// Increment sent message counter
+	h.metrics.MessageSent.Inc()
+}
+
+// RevokeSession ends the auth session of a participant on every node, and closes its connections
+func (h *UnifiedWSHandler) RevokeSession(address string) {
+	h.publish(BusMessage{Topic: BusTopicRevoke, Recipient: address})
 }
 
 // sendBalanceUpdate sends balance updates to the client
@@ -563,6 +731,7 @@ func (h *UnifiedWSHandler) sendChannelsUpdate(address string, channels []Channel
 			ChannelID:   ch.ChannelID,
 			Participant: ch.Participant,
 			Status:      ch.Status,
+			Reason:      ch.Reason,
 			Token:       ch.Token,
 			Amount:      big.NewInt(int64(ch.Amount)),
 			ChainID:     ch.ChainID,
@@ -583,6 +752,7 @@ func (h *UnifiedWSHandler) sendChannelUpdate(channel Channel) {
 		ChannelID:   channel.ChannelID,
 		Participant: channel.Participant,
 		Status:      channel.Status,
+		Reason:      channel.Reason,
 		Token:       channel.Token,
 		Amount:      big.NewInt(int64(channel.Amount)),
 		ChainID:     channel.ChainID,
@@ -596,15 +766,94 @@ func (h *UnifiedWSHandler) sendChannelUpdate(channel Channel) {
 	h.sendResponse(channel.Participant, "cu", []any{channelResponse}, "channel")
 }
 
+// ConnectionCount returns the number of authenticated WebSocket connections
+func (h *UnifiedWSHandler) ConnectionCount() int {
+	h.connectionsMu.RLock()
+	defer h.connectionsMu.RUnlock()
+	return len(h.connections)
+}
+
+// Shutdown stops serving new connections and drains the open ones: a request being handled is answered,
+// then the connection is closed with a close frame asking the client to reconnect. Connections still open
+// when the context is done are closed abruptly.
+func (h *UnifiedWSHandler) Shutdown(ctx context.Context) error {
+	h.connectionsMu.Lock()
+	h.draining = true
+	// Wake up idle connections, a handler reads no more requests once the request it handles is answered
+	for conn := range h.open {
+		conn.SetReadDeadline(time.Now())
+	}
+	h.connectionsMu.Unlock()
+
+	if err := waitWithContext(ctx, &h.openWg); err != nil {
+		h.CloseAllConnections()
+		return fmt.Errorf("failed to drain WebSocket connections: %w", err)
+	}
+	return nil
+}
+
 // CloseAllConnections closes all open WebSocket connections during shutdown
 func (h *UnifiedWSHandler) CloseAllConnections() {
 	h.connectionsMu.RLock()
 	defer h.connectionsMu.RUnlock()
 
-	for userID, conn := range h.connections {
-		log.Printf("Closing connection for participant: %s", userID)
+	for conn := range h.open {
+		log.Printf("Closing connection of %s", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// trackConnection registers an upgraded connection, unless the handler is shutting down
+func (h *UnifiedWSHandler) trackConnection(conn *websocket.Conn) bool {
+	h.connectionsMu.Lock()
+	defer h.connectionsMu.Unlock()
+
+	if h.draining {
+		return false
+	}
+	h.open[conn] = struct{}{}
+	h.openWg.Add(1)
+	return true
+}
+
+// untrackConnection closes a connection once its handler returns
+func (h *UnifiedWSHandler) untrackConnection(conn *websocket.Conn) {
+	h.connectionsMu.Lock()
+	delete(h.open, conn)
+	draining := h.draining
+	h.connectionsMu.Unlock()
+
+	if draining {
+		closeForShutdown(conn)
+	} else {
 		conn.Close()
 	}
+	h.openWg.Done()
+}
+
+// closeForShutdown sends a Service Restart close frame, the hint for clients to reconnect, and closes the connection
+func closeForShutdown(conn *websocket.Conn) {
+	message := websocket.FormatCloseMessage(websocket.CloseServiceRestart, shutdownCloseReason)
+	if err := conn.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second)); err != nil {
+		log.Printf("Failed to send close frame to %s: %v", conn.RemoteAddr(), err)
+	}
+	conn.Close()
+}
+
+// waitWithContext waits for a wait group until the context is done
+func waitWithContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // AuthResponse represents the server's challenge response
@@ -619,7 +868,7 @@ type AuthVerifyParams struct {
 }
 
 // HandleAuthRequest initializes the authentication process by generating a challenge
-func HandleAuthRequest(signer *Signer, conn *websocket.Conn, rpc *RPCMessage, authManager *AuthManager) error {
+func HandleAuthRequest(signer Signer, conn *websocket.Conn, rpc *RPCMessage, authManager *AuthManager) error {
 	// Parse the parameters
 	if len(rpc.Req.Params) < 1 {
 		return errors.New("missing parameters")
@@ -655,7 +904,7 @@ func HandleAuthRequest(signer *Signer, conn *websocket.Conn, rpc *RPCMessage, au
 }
 
 // HandleAuthVerify verifies an authentication response to a challenge
-func HandleAuthVerify(conn *websocket.Conn, rpc *RPCMessage, authManager *AuthManager, signer *Signer) (string, error) {
+func HandleAuthVerify(conn *websocket.Conn, rpc *RPCMessage, authManager *AuthManager, signer Signer) (string, error) {
 	if len(rpc.Req.Params) < 1 {
 		return "", errors.New("missing parameters")
 	}
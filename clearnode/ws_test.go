@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestWSHandler(t *testing.T) *UnifiedWSHandler {
+	db, cleanup := setupTestDB(t)
+	t.Cleanup(cleanup)
+
+	brokerKey, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	metrics := &Metrics{
+		ConnectedClients: prometheus.NewGauge(prometheus.GaugeOpts{Name: "test_connected_clients"}),
+		ConnectionsTotal: prometheus.NewCounter(prometheus.CounterOpts{Name: "test_connections_total"}),
+		MessageReceived:  prometheus.NewCounter(prometheus.CounterOpts{Name: "test_message_received"}),
+		MessageSent:      prometheus.NewCounter(prometheus.CounterOpts{Name: "test_message_sent"}),
+	}
+	return NewUnifiedWSHandler(NewKeyRing(&LocalSigner{privateKey: brokerKey}), db, metrics, NewRPCStore(db), &Config{msgExpiryTime: 60}, nil, nil, NewLocalBus())
+}
+
+func TestWSHandlerShutdown(t *testing.T) {
+	handler := newTestWSHandler(t)
+	server := httptest.NewServer(http.HandlerFunc(handler.HandleConnection))
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	dial := func() *websocket.Conn {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	expectReconnectHint := func(conn *websocket.Conn) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		require.ErrorAs(t, err, &closeErr)
+		assert.Equal(t, websocket.CloseServiceRestart, closeErr.Code)
+		assert.Equal(t, shutdownCloseReason, closeErr.Text)
+	}
+
+	// A connection which sent requests and an idle one
+	busy, idle := dial(), dial()
+	request, err := json.Marshal(RPCMessage{Req: &RPCData{RequestID: 1, Method: "ping", Params: []any{}, Timestamp: uint64(time.Now().UnixMilli())}})
+	require.NoError(t, err)
+	require.NoError(t, busy.WriteMessage(websocket.TextMessage, request))
+	_, response, err := busy.ReadMessage()
+	require.NoError(t, err)
+	assert.Contains(t, string(response), "Authentication required")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, handler.Shutdown(ctx))
+	expectReconnectHint(busy)
+	expectReconnectHint(idle)
+
+	// Connections made while shutting down are turned away with the same hint
+	expectReconnectHint(dial())
+	assert.Zero(t, handler.ConnectionCount())
+}
+
+func TestResponseSigner(t *testing.T) {
+	handler := newTestWSHandler(t)
+	rawActive, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	active := &LocalSigner{privateKey: rawActive}
+	rawLegacy, err := crypto.GenerateKey()
+	require.NoError(t, err)
+	legacy := &LocalSigner{privateKey: rawLegacy}
+	handler.keys = NewKeyRing(active, BrokerKey{Signer: legacy})
+
+	require.NoError(t, handler.db.Create(&Channel{ChannelID: "0xChannelLegacy", Participant: "0xParticipant", Broker: legacy.GetAddress().Hex(), Status: ChannelStatusOpen}).Error)
+
+	// Responses about a channel are signed with its key, whether the channel is found from the response or the request
+	assert.Equal(t, legacy.GetAddress(), handler.responseSigner([]any{CloseChannelResponse{ChannelID: "0xChannelLegacy"}}).GetAddress())
+	assert.Equal(t, legacy.GetAddress(), handler.responseSigner([]any{map[string]any{"error": "failed"}}, []any{map[string]any{"channel_id": "0xChannelLegacy"}}).GetAddress())
+
+	assert.Equal(t, active.GetAddress(), handler.responseSigner([]any{[]ChannelResponse{{ChannelID: "0xChannelLegacy"}}}).GetAddress())
+	assert.Equal(t, active.GetAddress(), handler.responseSigner([]any{CloseChannelResponse{ChannelID: "0xUnknown"}}).GetAddress())
+	assert.Equal(t, active.GetAddress(), handler.responseSigner(nil).GetAddress())
+}